@@ -0,0 +1,5 @@
+// Package benchmark holds the Go benchmarks of the data plane, the results of
+// the end-to-end tests with iperf3 and ab are in README.md.
+//
+//	go test ./benchmark -bench . -benchmem
+package benchmark
@@ -0,0 +1,206 @@
+package benchmark
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
+)
+
+type relayFunc func(from, to net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool)
+
+var logger = utils.NewLogger("info")
+
+// plainConn hides the concrete type of a connection, so a relay can't splice it.
+type plainConn struct {
+	net.Conn
+}
+
+// startRelay listens for users and relays each of them to a sink that reads
+// everything, the byte count of every sink connection is sent on the channel.
+func startRelay(b *testing.B, relay relayFunc, wrap func(net.Conn) net.Conn, sniffer bool) (string, chan int64) {
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		sink.Close()
+		front.Close()
+	})
+
+	received := make(chan int64, 1024)
+	go func() {
+		for {
+			conn, err := sink.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				n, _ := io.Copy(io.Discard, conn)
+				conn.Close()
+				received <- n
+			}()
+		}
+	}()
+
+	status := ""
+	usage := web.NewDataStore("", context.Background(), "", sniffer, &status, logger)
+	go func() {
+		for {
+			user, err := front.Accept()
+			if err != nil {
+				return
+			}
+			target, err := net.Dial("tcp", sink.Addr().String())
+			if err != nil {
+				user.Close()
+				continue
+			}
+			go relay(wrap(user), wrap(target), logger, usage, 443, sniffer)
+		}
+	}()
+	return front.Addr().String(), received
+}
+
+// benchmarkThroughput sends b.N chunks of 64K through one relayed connection.
+func benchmarkThroughput(b *testing.B, relay relayFunc, wrap func(net.Conn) net.Conn, sniffer bool) {
+	addr, received := startRelay(b, relay, wrap, sniffer)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	chunk := make([]byte, 64*1024)
+
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	if n := <-received; n != int64(b.N*len(chunk)) {
+		b.Fatalf("sink received %d of %d bytes", n, b.N*len(chunk))
+	}
+	b.StopTimer()
+	conn.Close()
+}
+
+// benchmarkShortConnections relays b.N connections carrying 1K each.
+func benchmarkShortConnections(b *testing.B, relay relayFunc, wrap func(net.Conn) net.Conn) {
+	addr, received := startRelay(b, relay, wrap, false)
+	payload := make([]byte, 1024)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn.Write(payload)
+		conn.(*net.TCPConn).CloseWrite()
+		if n := <-received; n != int64(len(payload)) {
+			b.Fatalf("sink received %d of %d bytes", n, len(payload))
+		}
+		conn.Close()
+	}
+}
+
+func tcp(conn net.Conn) net.Conn   { return conn }
+func plain(conn net.Conn) net.Conn { return plainConn{conn} }
+
+// smallBuffer sets the 32K send buffer the client dials its targets with.
+func smallBuffer(conn net.Conn) net.Conn {
+	conn.(*net.TCPConn).SetWriteBuffer(32 * 1024)
+	return conn
+}
+
+func BenchmarkRelayTCP(b *testing.B) { benchmarkThroughput(b, utils.TCPConnectionHandler, tcp, false) }
+func BenchmarkRelayTCPLegacy(b *testing.B) {
+	benchmarkThroughput(b, legacyTCPConnectionHandler, tcp, false)
+}
+
+func BenchmarkRelayTCPSniffer(b *testing.B) {
+	benchmarkThroughput(b, utils.TCPConnectionHandler, tcp, true)
+}
+func BenchmarkRelayTCPSnifferLegacy(b *testing.B) {
+	benchmarkThroughput(b, legacyTCPConnectionHandler, tcp, true)
+}
+
+func BenchmarkRelayBuffered(b *testing.B) {
+	benchmarkThroughput(b, utils.TCPConnectionHandler, plain, false)
+}
+func BenchmarkRelayBufferedLegacy(b *testing.B) {
+	benchmarkThroughput(b, legacyTCPConnectionHandler, plain, false)
+}
+
+func BenchmarkRelaySmallBuffer(b *testing.B) {
+	benchmarkThroughput(b, utils.TCPConnectionHandler, smallBuffer, false)
+}
+func BenchmarkRelaySmallBufferLegacy(b *testing.B) {
+	benchmarkThroughput(b, legacyTCPConnectionHandler, smallBuffer, false)
+}
+
+func BenchmarkShortConnections(b *testing.B) {
+	benchmarkShortConnections(b, utils.TCPConnectionHandler, plain)
+}
+func BenchmarkShortConnectionsLegacy(b *testing.B) {
+	benchmarkShortConnections(b, legacyTCPConnectionHandler, plain)
+}
+
+// legacyTCPConnectionHandler is the relay before splice and pooled buffers, a
+// fresh 16K buffer per direction and the sniffer updated on every write.
+func legacyTCPConnectionHandler(from, to net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		legacyTransferData(from, to, logger, usage, remotePort, sniffer)
+	}()
+
+	legacyTransferData(to, from, logger, usage, remotePort, sniffer)
+
+	<-done
+}
+
+func legacyTransferData(from, to net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+	buf := make([]byte, 16*1024)
+	for {
+		r, err := from.Read(buf)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logger.Trace("unable to read from the connection: ", err)
+			}
+			from.Close()
+			to.Close()
+			return
+		}
+
+		totalWritten := 0
+		for totalWritten < r {
+			w, err := to.Write(buf[totalWritten:r])
+			if err != nil {
+				from.Close()
+				to.Close()
+				return
+			}
+			totalWritten += w
+		}
+
+		logger.Tracef("read data: %d bytes, written data: %d bytes", r, totalWritten)
+		if sniffer {
+			usage.AddOrUpdatePort(remotePort, uint64(totalWritten))
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package benchmark
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/musix/backhaul/internal/web"
+)
+
+type portAccounting interface {
+	AddOrUpdatePort(port int, usage uint64)
+}
+
+// benchmarkUsage adds 16K chunks to the usage of a few ports from many
+// goroutines at once, each goroutine stands for a connection.
+func benchmarkUsage(b *testing.B, newUsage func() portAccounting) {
+	for _, connections := range []int{1, 16, 256} {
+		b.Run(fmt.Sprintf("conns=%dxCPU", connections), func(b *testing.B) {
+			usage := newUsage()
+			var next atomic.Int64
+			b.SetParallelism(connections)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				port := 443 + int(next.Add(1)%4)
+				for pb.Next() {
+					usage.AddOrUpdatePort(port, 16*1024)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkUsage(b *testing.B) {
+	benchmarkUsage(b, func() portAccounting {
+		status := ""
+		return web.NewDataStore("", context.Background(), "", true, &status, logger)
+	})
+}
+
+func BenchmarkUsageLegacy(b *testing.B) {
+	benchmarkUsage(b, func() portAccounting { return &legacyUsage{} })
+}
+
+// legacyUsage is the port accounting before atomic counters, a global lock
+// and a load and store of the sync.Map on every call.
+type legacyUsage struct {
+	mu        sync.Mutex
+	dataStore sync.Map
+}
+
+func (m *legacyUsage) AddOrUpdatePort(port int, usage uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	value, ok := m.dataStore.Load(port)
+	if ok {
+		portUsage := value.(web.PortUsage)
+		portUsage.Usage += usage
+		m.dataStore.Store(port, portUsage)
+	} else {
+		m.dataStore.Store(port, web.PortUsage{Port: port, Usage: usage})
+	}
+}
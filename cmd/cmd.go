@@ -2,60 +2,346 @@ package cmd
 
 import (
 	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/musix/backhaul/internal/client"
 	"github.com/musix/backhaul/internal/config"
 	"github.com/musix/backhaul/internal/server"
+	"github.com/musix/backhaul/internal/tuning"
 	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
 
 	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
 )
 
 var (
 	logger = utils.NewLogger("info")
+
+	// The running tunnels by name, [server]/[client] run as the unnamed tunnel.
+	// Reload restarts only the tunnels whose configuration changed.
+	tunnelsMu    sync.Mutex
+	tunnels      = make(map[string]*tunnel)
+	parentCtx    context.Context
+	tuneInterval time.Duration
+
+	// token_file paths of the running tunnels, watched along with the config
+	tokenFiles []string
 )
 
-// Run is the main entry point for the application.
-func Run(configPath string, ctx context.Context) *config.Config {
-	// Load and parse the configuration file
-	cfg, err := loadConfig(configPath)
+// tunnelConfig is the configuration of one tunnel, either Server or Client is
+// set up, or both of a relay.
+type tunnelConfig struct {
+	name  string
+	cfg   *config.Config
+	relay bool
+}
+
+// tunnel is a running server, client or relay.
+type tunnel struct {
+	name   string
+	relay  bool
+	server *server.Server // nil for a client, token changes are applied to it
+	web    *web.Tunnel    // its bans carry over to the restarted tunnel
+	cancel context.CancelFunc
+	failed atomic.Bool // the transport failed and the tunnel stopped
+
+	// configuration as loaded, before the tuner changes it
+	loadedServer config.ServerConfig
+	loadedClient config.ClientConfig
+}
+
+// Run is the main entry point for the application. It starts every tunnel of the
+// configuration file in the background, auto-tuned every interval unless it is zero.
+func Run(configPath string, ctx context.Context, interval time.Duration) {
+	// Load and parse the configuration file, defaults are applied per tunnel
+	cfgs, err := loadTunnels(configPath)
 	if err != nil {
 		logger.Fatalf("failed to load configuration: %v", err)
 	}
 
-	// Apply default values to the configuration
-	applyDefaults(cfg)
+	// Refuse to start with an invalid configuration, report every problem at once
+	if errs := validateTunnels(cfgs); len(errs) > 0 {
+		for _, err := range errs {
+			logger.Error(err)
+		}
+		logger.Fatalf("invalid configuration %s, %d error(s)", configPath, len(errs))
+	}
 
-	// Determine whether to run as a server or client
-	switch {
-	case cfg.Server != nil && cfg.Server.BindAddr != "":
-		srv := server.NewServer(cfg.Server, ctx)
+	tunnelsMu.Lock()
+	defer tunnelsMu.Unlock()
+
+	parentCtx, tuneInterval = ctx, interval
+	tokenFiles = tunnelTokenFiles(cfgs)
+
+	// A tunnel that fails to start is reported, the others keep running
+	for _, tc := range cfgs {
+		t, err := startTunnel(tc, web.NewTunnel())
+		if err != nil {
+			logger.Errorf("tunnel %s failed to start: %v", displayName(tc.name), err)
+			continue
+		}
+		tunnels[tc.name] = t
+	}
+	if len(tunnels) == 0 {
+		logger.Fatalf("no tunnel of %s started", configPath)
+	}
+}
+
+// startTunnel runs the server or client of tc in the background until it is
+// cancelled, tunnelsMu must be held. It returns once the server listens, or
+// with the error the tunnel failed to start with.
+func startTunnel(tc tunnelConfig, webTunnel *web.Tunnel) (*tunnel, error) {
+	ctx, cancel := context.WithCancel(web.WithTunnel(parentCtx, webTunnel))
+	t := &tunnel{
+		name:         tc.name,
+		relay:        tc.relay,
+		web:          webTunnel,
+		cancel:       cancel,
+		loadedServer: *tc.cfg.Server,
+		loadedClient: *tc.cfg.Client,
+	}
+
+	// Determine whether to run as a relay, server or client
+	logLevel := tc.cfg.Client.LogLevel
+	log := utils.NewNamedLogger("info", tc.name)
+	if tc.relay {
+		// The downstream server carries the connections the upstream client
+		// receives, the client has a web state of its own
+		srv := server.NewServer(tc.cfg.Server, ctx)
+		clnt, err := client.NewClient(tc.cfg.Client, web.WithTunnel(ctx, web.NewTunnel()))
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		clnt.SetRelay(srv.Dial)
+		t.server = srv
+		if err := srv.Start(); err != nil {
+			cancel()
+			return nil, err
+		}
+		if err := clnt.Start(); err != nil {
+			cancel()
+			return nil, err
+		}
+		go t.watch(ctx, srv, log)
 		go func() {
-			srv.Start()
 			<-ctx.Done()
+			clnt.Stop()
 			srv.Stop()
-			logger.Println("shutting down server...")
+			log.Println("shutting down relay...")
 		}()
-		logger.Println("server started in background")
-
-	case cfg.Client != nil && cfg.Client.RemoteAddr != "":
-		clnt := client.NewClient(cfg.Client, ctx)
+		log.Println("relay started in background")
+	} else if tc.cfg.Server.BindAddr != "" {
+		logLevel = tc.cfg.Server.LogLevel
+		srv := server.NewServer(tc.cfg.Server, ctx)
+		t.server = srv
+		if err := srv.Start(); err != nil {
+			cancel()
+			return nil, err
+		}
+		go t.watch(ctx, srv, log)
+		go func() {
+			<-ctx.Done()
+			srv.Stop()
+			log.Println("shutting down server...")
+		}()
+		log.Println("server started in background")
+	} else {
+		clnt, err := client.NewClient(tc.cfg.Client, ctx)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		if err := clnt.Start(); err != nil {
+			cancel()
+			return nil, err
+		}
 		go func() {
-			clnt.Start()
 			<-ctx.Done()
 			clnt.Stop()
-			logger.Println("shutting down client...")
+			log.Println("shutting down client...")
 		}()
-		logger.Println("client started in background")
+		log.Println("client started in background")
+	}
+
+	// The tuner adjusts the configuration of this tunnel only
+	if tuneInterval > 0 {
+		tuner := tuning.NewTuner(tc.cfg, utils.NewNamedLogger(logLevel, tc.name))
+		tuner.Start(tuneInterval)
+		go func() {
+			<-ctx.Done()
+			tuner.Stop()
+		}()
+	}
+	return t, nil
+}
+
+// watch stops the tunnel and marks it down once its server failed, the other
+// tunnels keep running. Reload starts it again.
+func (t *tunnel) watch(ctx context.Context, srv *server.Server, log *logrus.Logger) {
+	select {
+	case err := <-srv.Failed():
+		log.Errorf("tunnel stopped: %v", err)
+		t.failed.Store(true)
+		t.cancel()
+	case <-ctx.Done():
+	}
+}
+
+// previous returns the configuration t was started with, Reload restores it
+// when the new configuration fails to start.
+func (t *tunnel) previous() tunnelConfig {
+	server, client := t.loadedServer, t.loadedClient
+	return tunnelConfig{name: t.name, cfg: &config.Config{Server: &server, Client: &client}, relay: t.relay}
+}
+
+// Reload applies the configuration file to the running tunnels. Unchanged
+// tunnels keep running and token changes are applied to the running server,
+// changed tunnels restart, removed ones stop and new ones start. An invalid
+// configuration is not applied, its errors are returned. A changed tunnel that
+// fails to start is restarted with its previous configuration and its error is
+// returned.
+func Reload(configPath string) []error {
+	cfgs, err := loadTunnels(configPath)
+	if err != nil {
+		return []error{fmt.Errorf("failed to load configuration: %v", err)}
+	}
+	if errs := validateTunnels(cfgs); len(errs) > 0 {
+		return errs
+	}
+
+	tunnelsMu.Lock()
+	defer tunnelsMu.Unlock()
+
+	tokenFiles = tunnelTokenFiles(cfgs)
+	var stop []*tunnel
+	var start []tunnelConfig
+	names := make(map[string]bool)
+	for _, tc := range cfgs {
+		names[tc.name] = true
+		t, ok := tunnels[tc.name]
+		switch {
+		case !ok:
+			start = append(start, tc)
+		case t.relay != tc.relay, t.failed.Load():
+			// A failed tunnel is started again even if it did not change
+			stop = append(stop, t)
+			start = append(start, tc)
+		case reflect.DeepEqual(t.loadedServer, *tc.cfg.Server) && reflect.DeepEqual(t.loadedClient, *tc.cfg.Client):
+			// unchanged, keep it running
+		case t.server != nil && onlyTokensDiffer(t.loadedServer, *tc.cfg.Server) && reflect.DeepEqual(t.loadedClient, *tc.cfg.Client):
+			// Token rotation is applied to the running server, the tunnel stays up
+			t.server.UpdateTokens(tc.cfg.Server)
+			t.loadedServer = *tc.cfg.Server
+		default:
+			stop = append(stop, t)
+			start = append(start, tc)
+		}
+	}
+	for name, t := range tunnels {
+		if !names[name] {
+			stop = append(stop, t)
+		}
+	}
+	if len(stop) == 0 && len(start) == 0 {
+		return nil
+	}
+
+	if err := utils.SdReloading(); err != nil {
+		logger.Debugf("failed to notify systemd: %v", err)
+	}
+
+	// Stop changed and removed tunnels, a restarted tunnel keeps its bans
+	stopped := make(map[string]*tunnel)
+	for _, t := range stop {
+		logger.Infof("stopping tunnel %s", displayName(t.name))
+		t.cancel()
+		stopped[t.name] = t
+		delete(tunnels, t.name)
+	}
+	if len(stop) > 0 {
+		// Wait a bit for graceful shutdown
+		time.Sleep(3 * time.Second)
+	}
+
+	var errs []error
+	started := 0
+	for _, tc := range start {
+		webTunnel := web.NewTunnel()
+		old, ok := stopped[tc.name]
+		if ok {
+			webTunnel = old.web.Successor()
+		}
+		logger.Infof("starting tunnel %s", displayName(tc.name))
+		t, err := startTunnel(tc, webTunnel)
+		if err == nil {
+			tunnels[tc.name] = t
+			started++
+			continue
+		}
+		if !ok || old.failed.Load() {
+			errs = append(errs, fmt.Errorf("tunnel %s failed to start: %v", displayName(tc.name), err))
+			continue
+		}
+
+		// Bring the tunnel back up as it ran before the reload
+		logger.Infof("restoring the previous configuration of tunnel %s", displayName(tc.name))
+		t, restoreErr := startTunnel(old.previous(), old.web.Successor())
+		if restoreErr != nil {
+			errs = append(errs, fmt.Errorf("tunnel %s failed to start: %v, with its previous configuration: %v", displayName(tc.name), err, restoreErr))
+			continue
+		}
+		tunnels[tc.name] = t
+		started++
+		errs = append(errs, fmt.Errorf("tunnel %s failed to start, its previous configuration was restored: %v", displayName(tc.name), err))
+	}
+	if started == 0 {
+		// No tunnel comes up to report READY=1 after RELOADING=1
+		utils.SdNotify("READY=1")
+	}
+	return errs
+}
+
+// TokenFiles returns the token_file paths of the running tunnels, a change of
+// them is applied with Reload like a change of the configuration file.
+func TokenFiles() []string {
+	tunnelsMu.Lock()
+	defer tunnelsMu.Unlock()
+	return append([]string(nil), tokenFiles...)
+}
 
-	default:
-		logger.Fatalf("neither server nor client configuration is properly set.")
+func tunnelTokenFiles(cfgs []tunnelConfig) []string {
+	var files []string
+	for _, tc := range cfgs {
+		for _, file := range []string{tc.cfg.Server.TokenFile, tc.cfg.Client.TokenFile} {
+			if file != "" {
+				files = append(files, file)
+			}
+		}
 	}
+	return files
+}
 
-	return cfg // Return the config object immediately
+func displayName(name string) string {
+	if name == "" {
+		return "[server]/[client]/[relay]"
+	}
+	return name
 }
 
-// loadConfig loads and parses the TOML configuration file.
+func onlyTokensDiffer(a, b config.ServerConfig) bool {
+	a.Token, a.TokenFile, a.Tokens = "", "", nil
+	b.Token, b.TokenFile, b.Tokens = "", "", nil
+	return reflect.DeepEqual(a, b)
+}
+
+// loadConfig loads and parses the TOML configuration file and resolves ${NAME}
+// references to environment variables.
 func loadConfig(configPath string) (*config.Config, error) {
 	var cfg config.Config
 	if _, err := toml.DecodeFile(configPath, &cfg); err != nil {
@@ -68,5 +354,110 @@ func loadConfig(configPath string) (*config.Config, error) {
 	if cfg.Client == nil {
 		cfg.Client = &config.ClientConfig{}
 	}
+	if err := expandEnv(reflect.ValueOf(&cfg)); err != nil {
+		return &cfg, err
+	}
 	return &cfg, nil
 }
+
+// loadTunnels loads the configuration file and returns its tunnels with secrets
+// loaded and defaults applied. Without [[tunnel]] entries the [server]/[client]
+// or [relay] tables are the only, unnamed tunnel.
+func loadTunnels(configPath string) ([]tunnelConfig, error) {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	legacy := cfg.Server.BindAddr != "" || cfg.Client.RemoteAddr != ""
+	var cfgs []tunnelConfig
+	switch {
+	case len(cfg.Tunnels) > 0 && (legacy || cfg.Relay != nil):
+		return nil, fmt.Errorf("[server]/[client] or [relay] and [[tunnel]] can not be combined, move them into a [[tunnel]]")
+	case cfg.Relay != nil && legacy:
+		return nil, fmt.Errorf("[relay] can not be combined with [server]/[client]")
+	case cfg.Relay != nil:
+		tc, err := relayTunnel("", cfg.Relay)
+		if err != nil {
+			return nil, err
+		}
+		cfgs = append(cfgs, tc)
+	case len(cfg.Tunnels) == 0:
+		cfgs = append(cfgs, tunnelConfig{cfg: cfg})
+	}
+
+	seen := make(map[string]bool)
+	for i, entry := range cfg.Tunnels {
+		switch {
+		case entry.Name == "":
+			return nil, fmt.Errorf("[[tunnel]] %d has no name", i+1)
+		case seen[entry.Name]:
+			return nil, fmt.Errorf("tunnel name %q is used more than once", entry.Name)
+		case countSet(entry.Server != nil, entry.Client != nil, entry.Relay != nil) != 1:
+			return nil, fmt.Errorf("tunnel %s needs one of a [tunnel.server], [tunnel.client] or [tunnel.relay] table", entry.Name)
+		}
+		seen[entry.Name] = true
+
+		if entry.Relay != nil {
+			tc, err := relayTunnel(entry.Name, entry.Relay)
+			if err != nil {
+				return nil, err
+			}
+			cfgs = append(cfgs, tc)
+			continue
+		}
+
+		tc := tunnelConfig{name: entry.Name, cfg: &config.Config{Server: entry.Server, Client: entry.Client}}
+		if tc.cfg.Server == nil {
+			tc.cfg.Server = &config.ServerConfig{}
+		}
+		if tc.cfg.Client == nil {
+			tc.cfg.Client = &config.ClientConfig{}
+		}
+		tc.cfg.Server.Name, tc.cfg.Client.Name = entry.Name, entry.Name
+		cfgs = append(cfgs, tc)
+	}
+
+	for _, tc := range cfgs {
+		if err := loadSecrets(tc.cfg); err != nil {
+			if tc.name != "" {
+				return nil, fmt.Errorf("tunnel %s: %v", tc.name, err)
+			}
+			return nil, err
+		}
+		// Apply default values to the configuration
+		applyDefaults(tc.cfg)
+	}
+	return cfgs, nil
+}
+
+// relayTunnel returns the tunnel of a relay, its logs are prefixed with
+// downstream and upstream.
+func relayTunnel(name string, relay *config.RelayConfig) (tunnelConfig, error) {
+	section := "[relay]"
+	if name != "" {
+		section = "tunnel " + name
+	}
+	if relay.Server == nil || relay.Client == nil {
+		return tunnelConfig{}, fmt.Errorf("%s needs both a server (downstream) and a client (upstream) table", section)
+	}
+
+	tc := tunnelConfig{name: name, cfg: &config.Config{Server: relay.Server, Client: relay.Client}, relay: true}
+	tc.cfg.Server.Name, tc.cfg.Client.Name = "downstream", "upstream"
+	// The address of the user received from upstream is passed on downstream
+	tc.cfg.Server.SourceMetadata = true
+	if name != "" {
+		tc.cfg.Server.Name, tc.cfg.Client.Name = name+"/downstream", name+"/upstream"
+	}
+	return tc, nil
+}
+
+func countSet(values ...bool) int {
+	n := 0
+	for _, v := range values {
+		if v {
+			n++
+		}
+	}
+	return n
+}
@@ -27,11 +27,18 @@ const ( // Default values
 	defaultMuxCon           = 8
 	defaultNodelay          = true
 	defaultAggressivePool   = true
+	defaultTLSExpiryWarn    = 14 // days
+	// access log rotation
+	defaultAccessLogMaxSize    = 100 // MB
+	defaultAccessLogMaxBackups = 5
+	defaultWebhookRetries      = 3
+	defaultBanWindow           = 60  // seconds
+	defaultBanDuration         = 600 // seconds
 )
 
 func applyDefaults(cfg *config.Config) {
 	// Token
-	if cfg.Server.Token == "" {
+	if cfg.Server.Token == "" && len(cfg.Server.Tokens) == 0 {
 		cfg.Server.Token = defaultToken
 	}
 	if cfg.Client.Token == "" {
@@ -160,7 +167,57 @@ func applyDefaults(cfg *config.Config) {
 		}
 	}
 
+	// ACME cache default
+	if len(cfg.Server.TLSACMEDomains) > 0 && cfg.Server.TLSACMECache == "" {
+		basedir, err := os.Getwd()
+		if err != nil {
+			basedir = "."
+		}
+		cfg.Server.TLSACMECache = basedir + "/ssl/acme"
+	}
+
+	// Certificate expiry warning
+	if cfg.Server.TLSExpiryWarn <= 0 {
+		cfg.Server.TLSExpiryWarn = defaultTLSExpiryWarn
+	}
+
 	if !cfg.Client.AggressivePool {
 		cfg.Client.AggressivePool = defaultAggressivePool
 	}
+
+	// Access log rotation
+	if cfg.Server.AccessLogMaxSize <= 0 {
+		cfg.Server.AccessLogMaxSize = defaultAccessLogMaxSize
+	}
+	if cfg.Client.AccessLogMaxSize <= 0 {
+		cfg.Client.AccessLogMaxSize = defaultAccessLogMaxSize
+	}
+	if cfg.Server.AccessLogMaxBackups <= 0 {
+		cfg.Server.AccessLogMaxBackups = defaultAccessLogMaxBackups
+	}
+	if cfg.Client.AccessLogMaxBackups <= 0 {
+		cfg.Client.AccessLogMaxBackups = defaultAccessLogMaxBackups
+	}
+
+	// Readiness, three missed heartbeats make the tunnel not ready
+	if cfg.Server.ReadyHeartbeatTimeout <= 0 {
+		cfg.Server.ReadyHeartbeatTimeout = 3 * cfg.Server.Heartbeat
+	}
+	if cfg.Client.ReadyHeartbeatTimeout <= 0 {
+		cfg.Client.ReadyHeartbeatTimeout = 3 * deafultHeartbeat // the client does not know the server heartbeat
+	}
+
+	if cfg.Server.WebhookRetries <= 0 {
+		cfg.Server.WebhookRetries = defaultWebhookRetries
+	}
+	if cfg.Client.WebhookRetries <= 0 {
+		cfg.Client.WebhookRetries = defaultWebhookRetries
+	}
+
+	if cfg.Server.BanWindow <= 0 {
+		cfg.Server.BanWindow = defaultBanWindow
+	}
+	if cfg.Server.BanDuration <= 0 {
+		cfg.Server.BanDuration = defaultBanDuration
+	}
 }
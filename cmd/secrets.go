@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/musix/backhaul/internal/config"
+	"github.com/musix/backhaul/internal/utils"
+)
+
+// envRef matches ${NAME} references in string settings.
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${NAME} in every string setting of v with the environment
+// variable NAME. A reference to an unset variable is an error.
+func expandEnv(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			return expandEnv(v.Elem())
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				if err := expandEnv(v.Field(i)); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := expandEnv(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			return nil
+		}
+		for _, key := range v.MapKeys() {
+			value, err := expandString(v.MapIndex(key).String())
+			if err != nil {
+				return err
+			}
+			v.SetMapIndex(key, reflect.ValueOf(value).Convert(v.Type().Elem()))
+		}
+	case reflect.String:
+		value, err := expandString(v.String())
+		if err != nil {
+			return err
+		}
+		v.SetString(value)
+	}
+	return nil
+}
+
+func expandString(s string) (string, error) {
+	var missing string
+	expanded := envRef.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envRef.FindStringSubmatch(ref)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok && missing == "" {
+			missing = name
+		}
+		return value
+	})
+	if missing != "" {
+		return "", fmt.Errorf("environment variable %s is not set", missing)
+	}
+	return expanded, nil
+}
+
+// readTokenFile returns the token stored in path, token_file and token exclude
+// each other.
+func readTokenFile(token, path string) (string, error) {
+	if path == "" {
+		return token, nil
+	}
+	if token != "" {
+		return "", fmt.Errorf("token and token_file are both set")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token_file: %v", err)
+	}
+	token = strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("token_file %s is empty", path)
+	}
+	return token, nil
+}
+
+// loadSecrets reads the token files of cfg and registers the secrets for log
+// redaction. Environment references are resolved by loadConfig.
+func loadSecrets(cfg *config.Config) error {
+	var err error
+	if cfg.Server.Token, err = readTokenFile(cfg.Server.Token, cfg.Server.TokenFile); err != nil {
+		return fmt.Errorf("server: %v", err)
+	}
+	if cfg.Client.Token, err = readTokenFile(cfg.Client.Token, cfg.Client.TokenFile); err != nil {
+		return fmt.Errorf("client: %v", err)
+	}
+
+	for _, token := range cfg.Server.Tokens {
+		utils.RegisterSecrets(token.Token)
+	}
+	for _, secrets := range [][]string{
+		{cfg.Server.Token, cfg.Server.WebPassword, cfg.Server.WebReadOnlyPassword, cfg.Server.WebhookSecret},
+		cfg.Server.WebTokens,
+		cfg.Server.WebReadOnlyTokens,
+		{cfg.Client.Token, cfg.Client.WebPassword, cfg.Client.WebReadOnlyPassword, cfg.Client.WebhookSecret, cfg.Client.ServerWebToken},
+		cfg.Client.WebTokens,
+		cfg.Client.WebReadOnlyTokens,
+	} {
+		utils.RegisterSecrets(secrets...)
+	}
+	return nil
+}
@@ -0,0 +1,404 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/musix/backhaul/internal/config"
+	"github.com/musix/backhaul/internal/server/transport"
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Validate loads the configuration file and checks every tunnel the way the
+// server or client would use it, without starting anything. It returns every
+// problem found.
+func Validate(configPath string) []error {
+	cfgs, err := loadTunnels(configPath)
+	if err != nil {
+		return []error{fmt.Errorf("failed to load configuration: %v", err)}
+	}
+	return validateTunnels(cfgs)
+}
+
+// validateTunnels checks every tunnel, a local port may only be used by one of them.
+func validateTunnels(cfgs []tunnelConfig) []error {
+	var errs []error
+	listeners := make(map[string]string)
+	for _, tc := range cfgs {
+		prefix := ""
+		if tc.name != "" {
+			prefix = "tunnel " + tc.name + ": "
+		}
+		switch {
+		case tc.relay:
+			errs = append(errs, validateRelay(prefix+"relay", tc.cfg, listeners)...)
+		case tc.cfg.Server.BindAddr != "":
+			errs = append(errs, validateServer(prefix+"server", tc.cfg.Server, listeners)...)
+		case tc.cfg.Client.RemoteAddr != "":
+			errs = append(errs, validateClient(prefix+"client", tc.cfg.Client)...)
+		default:
+			errs = append(errs, fmt.Errorf("%sneither server nor client configuration is properly set", prefix))
+		}
+	}
+	return errs
+}
+
+// validator collects errors, prefixed with the section they belong to.
+type validator struct {
+	section string
+	errs    []error
+}
+
+func (v *validator) errorf(format string, args ...any) {
+	v.errs = append(v.errs, fmt.Errorf(v.section+": "+format, args...))
+}
+
+func (v *validator) check(err error) {
+	if err != nil {
+		v.errorf("%v", err)
+	}
+}
+
+func validateServer(section string, cfg *config.ServerConfig, listeners map[string]string) []error {
+	v := &validator{section: section}
+
+	v.transport(cfg.Transport)
+	if err := validHostPort(cfg.BindAddr); err != nil {
+		v.errorf("invalid bind_addr %q: %v", cfg.BindAddr, err)
+	}
+	v.webPort(cfg.WebPort)
+	v.resumeGrace(cfg.Transport, cfg.ResumeGrace)
+	if cfg.AcceptShards < 0 || cfg.AcceptShards > runtime.NumCPU() {
+		v.errorf("invalid accept_shards %d, expected the number of listeners per port, at most the %d CPU threads, or 0", cfg.AcceptShards, runtime.NumCPU())
+	}
+
+	// Port mappings, a local port may only be used once
+	for _, mapping := range cfg.Ports {
+		locals, err := validatePortMapping(mapping)
+		if err != nil {
+			v.errorf("invalid port mapping %q: %v", mapping, err)
+			continue
+		}
+		for _, local := range locals {
+			if other, ok := listeners[local]; ok {
+				v.errorf("port mapping %q listens on %s like %s", mapping, local, other)
+			}
+			listeners[local] = fmt.Sprintf("%q of %s", mapping, section)
+		}
+	}
+	v.transparent(cfg, listeners)
+
+	// Tokens
+	entries := []utils.TokenEntry{{Token: cfg.Token}}
+	for _, token := range cfg.Tokens {
+		entries = append(entries, utils.TokenEntry{Token: token.Token, Expires: token.Expires})
+	}
+	if utils.NewTokenSet(entries).Len() == 0 {
+		v.errorf("no valid token, token and all [[server.tokens]] are empty or expired")
+	}
+	for _, token := range cfg.Tokens {
+		if token.Token == "" {
+			v.errorf("[[server.tokens]] entry without token")
+		}
+	}
+
+	// TLS of wss, wssmux, quic and the panel
+	usesTLS := cfg.Transport == config.WSS || cfg.Transport == config.WSSMUX || cfg.Transport == config.QUIC
+	if len(cfg.TLSACMEDomains) > 0 {
+		if cfg.TLSACMECA != "" {
+			_, err := utils.LoadCertPool(cfg.TLSACMECA)
+			v.check(err)
+		}
+		if cfg.TLSACMEDirectory != "" {
+			v.url("tls_acme_directory", cfg.TLSACMEDirectory)
+		}
+		if cfg.TLSACMEHTTPAddr != "" {
+			if err := validHostPort(cfg.TLSACMEHTTPAddr); err != nil {
+				v.errorf("invalid tls_acme_http_addr %q: %v", cfg.TLSACMEHTTPAddr, err)
+			}
+		}
+	} else if usesTLS || cfg.WebTLS {
+		v.serverKeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
+	if cfg.TLSClientCA != "" {
+		_, err := utils.LoadCertPool(cfg.TLSClientCA)
+		v.check(err)
+	}
+
+	// Web panel, access log and integrations
+	v.webBind(cfg.WebBind)
+	v.accessLog(cfg.AccessLog)
+	if cfg.BanThreshold > 0 {
+		_, err := web.NewBanList(cfg.BanThreshold, time.Minute, time.Minute, cfg.BanWhitelist, logrus.StandardLogger())
+		v.check(err)
+	}
+	v.webhooks(cfg.Webhooks, cfg.WebhookEvents)
+	if cfg.PortQuota < 0 {
+		v.errorf("invalid port_quota %d, expected MB or 0 to disable", cfg.PortQuota)
+	} else if cfg.PortQuota > 0 && (cfg.WebPort == 0 || cfg.Sniffer != nil && !*cfg.Sniffer) {
+		v.errorf("port_quota needs the sniffer and web_port, it is checked against the sniffer usage")
+	}
+	if _, err := utils.NewDecoyHandler(cfg.DecoyUpstream, cfg.DecoyDir); err != nil {
+		v.check(err)
+	}
+	v.obfuscation(cfg.Obfuscation)
+
+	return v.errs
+}
+
+// validateRelay checks both hops of a relay, only TCP connections can be relayed
+// and the downstream server has no ports of its own.
+func validateRelay(section string, cfg *config.Config, listeners map[string]string) []error {
+	errs := validateServer(section+".server", cfg.Server, listeners)
+	errs = append(errs, validateClient(section+".client", cfg.Client)...)
+
+	v := &validator{section: section}
+	if cfg.Server.Transport == config.UDP || cfg.Client.Transport == config.UDP {
+		v.errorf("udp transport can not be relayed")
+	}
+	if len(cfg.Server.Ports) > 0 {
+		v.errorf("server ports are not used, the relay forwards the ports of the upstream server")
+	}
+	if cfg.Server.AcceptUDP {
+		v.errorf("accept_udp can not be relayed")
+	}
+	return append(errs, v.errs...)
+}
+
+func validateClient(section string, cfg *config.ClientConfig) []error {
+	v := &validator{section: section}
+
+	v.transport(cfg.Transport)
+	if err := validHostPort(cfg.RemoteAddr); err != nil {
+		v.errorf("invalid remote_addr %q: %v", cfg.RemoteAddr, err)
+	}
+	v.webPort(cfg.WebPort)
+	v.resumeGrace(cfg.Transport, cfg.ResumeGrace)
+	if cfg.EdgeIP != "" && net.ParseIP(cfg.EdgeIP) == nil {
+		if err := validHostPort(cfg.EdgeIP); err != nil {
+			v.errorf("invalid edge_ip %q", cfg.EdgeIP)
+		}
+	}
+
+	switch cfg.Transport {
+	case config.WSS, config.WSSMUX, config.QUIC:
+		_, err := utils.NewClientTLSConfig(utils.ClientTLSOptions{
+			CertFile:   cfg.TLSCertFile,
+			KeyFile:    cfg.TLSKeyFile,
+			CAFile:     cfg.TLSCAFile,
+			ServerName: cfg.TLSServerName,
+			Pins:       cfg.TLSPins,
+		})
+		v.check(err)
+	}
+	if cfg.WebTLS {
+		if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+			v.errorf("web_tls requires tls_cert and tls_key")
+		} else {
+			_, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+			v.check(err)
+		}
+	}
+
+	v.webBind(cfg.WebBind)
+	v.accessLog(cfg.AccessLog)
+	v.webhooks(cfg.Webhooks, cfg.WebhookEvents)
+	v.obfuscation(cfg.Obfuscation)
+
+	return v.errs
+}
+
+func (v *validator) transport(transport config.TransportType) {
+	switch transport {
+	case config.TCP, config.TCPMUX, config.WS, config.WSS, config.WSMUX, config.WSSMUX, config.QUIC, config.UDP:
+	default:
+		v.errorf("invalid transport type %q", transport)
+	}
+}
+
+func (v *validator) webPort(port int) {
+	if port < 0 || port > 65535 {
+		v.errorf("invalid web_port %d", port)
+	}
+}
+
+// resumeGrace checks resume_grace, only the tcp and websocket transports can
+// resume a lost control channel.
+func (v *validator) resumeGrace(transport config.TransportType, seconds int) {
+	if seconds < 0 {
+		v.errorf("invalid resume_grace %d, expected seconds or 0 to disable", seconds)
+	} else if seconds > 0 && (transport == config.QUIC || transport == config.UDP) {
+		v.errorf("resume_grace is not supported by the %s transport, set it to 0", transport)
+	}
+}
+
+// transparent checks the transparent proxy settings, its listener takes part
+// in the duplicate check of the port mappings.
+func (v *validator) transparent(cfg *config.ServerConfig, listeners map[string]string) {
+	switch cfg.Transparent {
+	case "":
+		return
+	case transport.Redirect, transport.TProxy:
+	default:
+		v.errorf("invalid transparent %q, expected %q or %q", cfg.Transparent, transport.Redirect, transport.TProxy)
+		return
+	}
+
+	if runtime.GOOS != "linux" {
+		v.errorf("transparent proxy is only supported on linux")
+	}
+	switch cfg.Transport {
+	case config.QUIC:
+		v.errorf("transparent proxy is not supported by the quic transport")
+	case config.UDP:
+		if cfg.Transparent != transport.TProxy {
+			v.errorf("the udp transport needs transparent = %q, UDP can't be redirected", transport.TProxy)
+		}
+	}
+	if err := validHostPort(cfg.TransparentAddr); err != nil {
+		v.errorf("invalid transparent_addr %q: %v", cfg.TransparentAddr, err)
+	} else {
+		if other, ok := listeners[cfg.TransparentAddr]; ok {
+			v.errorf("transparent_addr listens on %s like %s", cfg.TransparentAddr, other)
+		}
+		listeners[cfg.TransparentAddr] = "transparent_addr of " + v.section
+	}
+	if cfg.TransparentHost != "" {
+		if net.ParseIP(cfg.TransparentHost) == nil && strings.ContainsAny(cfg.TransparentHost, ":[]/ ") {
+			v.errorf("invalid transparent_host %q, expected a host name or IP address", cfg.TransparentHost)
+		}
+	}
+}
+
+func (v *validator) webBind(bind string) {
+	if bind != "" && net.ParseIP(bind) == nil {
+		v.errorf("invalid web_bind %q, expected an IP address", bind)
+	}
+}
+
+func (v *validator) url(name, value string) {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		v.errorf("invalid %s %q, expected http(s)://host[:port]/path", name, value)
+	}
+}
+
+// serverKeyPair checks a configured key pair, a missing one is generated at start.
+func (v *validator) serverKeyPair(certFile, keyFile string) {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		return
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		v.errorf("failed to load tls_cert/tls_key: %v", err)
+	}
+}
+
+func (v *validator) accessLog(path string) {
+	if path == "" {
+		return
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		v.errorf("access_log %s is a directory", path)
+	}
+	if info, err := os.Stat(filepath.Dir(path)); err == nil && !info.IsDir() {
+		v.errorf("access_log directory %s is not a directory", filepath.Dir(path))
+	}
+}
+
+func (v *validator) webhooks(urls, events []string) {
+	for _, u := range urls {
+		v.url("webhooks entry", u)
+	}
+	_, err := utils.NewWebhooks(utils.WebhookConfig{URLs: urls, Events: events}, logrus.StandardLogger())
+	v.check(err)
+}
+
+func (v *validator) obfuscation(cfg config.ObfuscationConfig) {
+	for _, path := range cfg.Paths {
+		if !strings.HasPrefix(path, "/") {
+			v.errorf("obfuscation path %q must start with /", path)
+		}
+	}
+}
+
+// validHostPort checks an address of the form host:port, host may be empty.
+func validHostPort(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// validatePortMapping accepts the formats of the transports' parsePortMappings
+// and returns the local listen addresses of mapping.
+func validatePortMapping(mapping string) ([]string, error) {
+	parts := strings.Split(mapping, "=")
+	if len(parts) > 2 {
+		return nil, fmt.Errorf("expected local=remote")
+	}
+
+	local := strings.TrimSpace(parts[0])
+	if len(parts) == 2 {
+		remote := strings.TrimSpace(parts[1])
+		if port, err := strconv.Atoi(remote); err == nil {
+			if port < 1 || port > 65535 {
+				return nil, fmt.Errorf("invalid remote port %q", remote)
+			}
+		} else if err := validHostPort(remote); err != nil {
+			return nil, fmt.Errorf("invalid remote address %q: %v", remote, err)
+		}
+	}
+
+	// local port range
+	if strings.Contains(local, "-") {
+		rangeParts := strings.Split(local, "-")
+		if len(rangeParts) != 2 {
+			return nil, fmt.Errorf("invalid port range %q", local)
+		}
+		start, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
+		if err != nil || start < 1 || start > 65535 {
+			return nil, fmt.Errorf("invalid start port in range %q", local)
+		}
+		end, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
+		if err != nil || end < 1 || end > 65535 || end < start {
+			return nil, fmt.Errorf("invalid end port in range %q", local)
+		}
+		locals := make([]string, 0, end-start+1)
+		for port := start; port <= end; port++ {
+			locals = append(locals, fmt.Sprintf(":%d", port))
+		}
+		return locals, nil
+	}
+
+	// single local port or ip:port
+	if port, err := strconv.Atoi(local); err == nil {
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid local port %q", local)
+		}
+		return []string{fmt.Sprintf(":%d", port)}, nil
+	}
+	if len(parts) == 1 {
+		return nil, fmt.Errorf("invalid local port %q", local)
+	}
+	if err := validHostPort(local); err != nil {
+		return nil, fmt.Errorf("invalid local address %q: %v", local, err)
+	}
+	return []string{local}, nil
+}
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/musix/backhaul/internal/config"
+)
+
+func TestValidatePortMapping(t *testing.T) {
+	tests := []struct {
+		mapping string
+		want    []string // nil for an invalid mapping
+	}{
+		{"443", []string{":443"}},
+		{"443=8443", []string{":443"}},
+		{" 443 = 127.0.0.1:8443 ", []string{":443"}},
+		{"127.0.0.2:443=8443", []string{"127.0.0.2:443"}},
+		{"[::1]:443=[::1]:8443", []string{"[::1]:443"}},
+		{"443-445", []string{":443", ":444", ":445"}},
+		{"443-445=8443", []string{":443", ":444", ":445"}},
+		{"1=8443", []string{":1"}},
+		{"65535=8443", []string{":65535"}},
+		{"443=1", []string{":443"}},
+		{"443=65535", []string{":443"}},
+		{"65534-65535", []string{":65534", ":65535"}},
+		{"0=8443", nil},
+		{"0-2", nil},
+		{"65535-65536", nil},
+		{"443=8443=9443", nil},
+		{"0", nil},
+		{"65536=443", nil},
+		{"443=0", nil},
+		{"443=127.0.0.1:http", nil},
+		{"445-443", nil},
+		{"443-445-447", nil},
+		{"a-445", nil},
+		{"127.0.0.1:443", nil},
+		{"localhost=443", nil},
+	}
+	for _, tt := range tests {
+		got, err := validatePortMapping(tt.mapping)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("validatePortMapping(%q) = %v, want an error", tt.mapping, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("validatePortMapping(%q) = %v, %v, want %v", tt.mapping, got, err, tt.want)
+		}
+	}
+}
+
+func TestValidateAcceptShards(t *testing.T) {
+	for _, tt := range []struct {
+		shards int
+		valid  bool
+	}{{0, true}, {1, true}, {runtime.NumCPU(), true}, {-1, false}, {runtime.NumCPU() + 1, false}} {
+		cfg := &config.ServerConfig{Transport: config.TCP, BindAddr: "0.0.0.0:3080", AcceptShards: tt.shards}
+		rejected := false
+		for _, err := range validateServer("server", cfg, map[string]string{}) {
+			rejected = rejected || strings.Contains(err.Error(), "accept_shards")
+		}
+		if rejected == tt.valid {
+			t.Errorf("accept_shards = %d rejected %v, want %v", tt.shards, rejected, !tt.valid)
+		}
+	}
+}
+
+func TestValidateResumeGrace(t *testing.T) {
+	for _, tt := range []struct {
+		transport config.TransportType
+		grace     int
+		valid     bool
+	}{
+		{config.TCP, 30, true},
+		{config.WSSMUX, 30, true},
+		{config.QUIC, 0, true},
+		{config.QUIC, 30, false},
+		{config.UDP, 30, false},
+		{config.TCP, -1, false},
+	} {
+		server := &config.ServerConfig{Transport: tt.transport, BindAddr: "0.0.0.0:3080", ResumeGrace: tt.grace}
+		client := &config.ClientConfig{Transport: tt.transport, RemoteAddr: "127.0.0.1:3080", ResumeGrace: tt.grace}
+		errs := append(validateServer("server", server, map[string]string{}), validateClient("client", client)...)
+		rejected := 0
+		for _, err := range errs {
+			if strings.Contains(err.Error(), "resume_grace") {
+				rejected++
+			}
+		}
+		want := 0 // once for the server and once for the client otherwise
+		if !tt.valid {
+			want = 2
+		}
+		if rejected != want {
+			t.Errorf("%s resume_grace = %d rejected %d times, want %d", tt.transport, tt.grace, rejected, want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -16,8 +17,6 @@ import (
 
 	"github.com/musix/backhaul/internal/client/transport"
 
-	_ "net/http/pprof"
-
 	"github.com/sirupsen/logrus"
 )
 
@@ -29,6 +28,14 @@ type Client struct {
 	logger       *logrus.Logger
 	web          *web.Usage
 	usageMonitor *web.Usage // Added for usage monitoring
+	relay        transport.RelayFunc
+	panelClient  *http.Client // reads the server panel for the config sync
+}
+
+// SetRelay hands the connections received from the server to relay instead of
+// dialing their targets, it is called before Start.
+func (c *Client) SetRelay(relay transport.RelayFunc) {
+	c.relay = relay
 }
 
 func extractHostFromAddr(addr string) string {
@@ -39,10 +46,100 @@ func extractHostFromAddr(addr string) string {
 	return addr
 }
 
+// getServerConfig reads the server panel /config, with server_web_token if set.
+func (c *Client) getServerConfig(serverWebAddr string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodGet, serverWebAddr+"/config", nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.config.ServerWebToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.ServerWebToken)
+	}
+	resp, err := c.panelClient.Do(req)
+	if err == nil && resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("server panel returned %s", resp.Status)
+	}
+	return resp, err
+}
+
+// serverWebAddr returns the address of the server panel and sets up the client
+// reading it. With server_web_tls the panel certificate is verified like the
+// tunnel's, with tls_ca and tls_pins.
+func (c *Client) serverWebAddr() (string, error) {
+	host := extractHostFromAddr(c.config.RemoteAddr)
+	if !c.config.ServerWebTLS {
+		c.panelClient = http.DefaultClient
+		return "http://" + host + ":" + strconv.Itoa(c.config.WebPort), nil
+	}
+
+	tlsConfig, err := utils.NewClientTLSConfig(utils.ClientTLSOptions{
+		CAFile:     c.config.TLSCAFile,
+		ServerName: c.config.TLSServerName,
+		Pins:       c.config.TLSPins,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to load TLS configuration: %v", err)
+	}
+	c.panelClient = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return "https://" + host + ":" + strconv.Itoa(c.config.WebPort), nil
+}
+
+// panelConfig returns the web panel access settings, web_tls uses tls_cert/tls_key.
+func (c *Client) panelConfig() (web.PanelConfig, error) {
+	panel := web.PanelConfig{
+		BindAddr:         c.config.WebBind,
+		Password:         c.config.WebPassword,
+		ReadOnlyPassword: c.config.WebReadOnlyPassword,
+		Tokens:           c.config.WebTokens,
+		ReadOnlyTokens:   c.config.WebReadOnlyTokens,
+	}
+	if c.config.WebTLS {
+		if c.config.TLSCertFile == "" || c.config.TLSKeyFile == "" {
+			return panel, fmt.Errorf("web_tls requires tls_cert and tls_key")
+		}
+		panel.TLSCertFile = c.config.TLSCertFile
+		panel.TLSKeyFile = c.config.TLSKeyFile
+	}
+	return panel, nil
+}
+
+// accessLog opens the access log of forwarded connections, nil when disabled.
+// It is released when the tunnel stops.
+func (c *Client) accessLog() (*web.AccessLog, error) {
+	if c.config.AccessLog == "" {
+		return nil, nil
+	}
+	accessLog, err := web.NewAccessLog(c.config.AccessLog, c.config.AccessLogMaxSize, c.config.AccessLogMaxBackups, c.logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up access log: %v", err)
+	}
+	go func() {
+		<-c.ctx.Done()
+		accessLog.Close()
+	}()
+	return accessLog, nil
+}
+
+func (c *Client) webhooks() (*utils.Webhooks, error) {
+	webhooks, err := utils.NewWebhooks(utils.WebhookConfig{
+		URLs:      c.config.Webhooks,
+		Secret:    c.config.WebhookSecret,
+		Events:    c.config.WebhookEvents,
+		Retries:   c.config.WebhookRetries,
+		Role:      "client",
+		Transport: string(c.config.Transport),
+	}, c.logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up webhooks: %v", err)
+	}
+	return webhooks, nil
+}
+
 func (c *Client) syncKeepaliveWithServer(serverWebAddr string) {
 	go func() {
 		for {
-			resp, err := http.Get(serverWebAddr + "/config")
+			resp, err := c.getServerConfig(serverWebAddr)
 			if err == nil {
 				var serverCfg struct {
 					Keepalive int `json:"keepalive"`
@@ -55,7 +152,12 @@ func (c *Client) syncKeepaliveWithServer(serverWebAddr string) {
 				}
 				resp.Body.Close()
 			}
-			time.Sleep(10 * time.Second)
+
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(10 * time.Second):
+			}
 		}
 	}()
 }
@@ -63,7 +165,7 @@ func (c *Client) syncKeepaliveWithServer(serverWebAddr string) {
 func (c *Client) syncConfigWithServer(serverWebAddr string) {
 	go func() {
 		for {
-			resp, err := http.Get(serverWebAddr + "/config")
+			resp, err := c.getServerConfig(serverWebAddr)
 			if err == nil {
 				var serverCfg struct {
 					Keepalive        int `json:"keepalive_period"`
@@ -91,18 +193,25 @@ func (c *Client) syncConfigWithServer(serverWebAddr string) {
 				}
 				resp.Body.Close()
 			}
-			time.Sleep(10 * time.Second)
+
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-time.After(10 * time.Second):
+			}
 		}
 	}()
 }
 
-func NewClient(cfg *config.ClientConfig, parentCtx context.Context) *Client {
+// NewClient creates the client of cfg and starts its web panel, it returns an
+// error if the panel settings are invalid.
+func NewClient(cfg *config.ClientConfig, parentCtx context.Context) (*Client, error) {
 	ctx, cancel := context.WithCancel(parentCtx)
 	client := &Client{
 		config: cfg,
 		ctx:    ctx,
 		cancel: cancel,
-		logger: utils.NewLogger(cfg.LogLevel),
+		logger: utils.NewNamedLogger(cfg.LogLevel, cfg.Name),
 	}
 
 	// Initialize web panel if sniffer is enabled
@@ -111,20 +220,31 @@ func NewClient(cfg *config.ClientConfig, parentCtx context.Context) *Client {
 		sniffer = *cfg.Sniffer
 	}
 
-	var usageMonitor *web.Usage
+	// The monitor also drives the tunnel observers, so it exists without the panel
+	tunnelStatus := "connecting"
+	usageMonitor := web.NewDataStore(
+		fmt.Sprintf(":%d", cfg.WebPort),
+		ctx,
+		cfg.SnifferLog,
+		sniffer,
+		&tunnelStatus,
+		client.logger,
+	)
 	if sniffer && cfg.WebPort > 0 {
-		tunnelStatus := "connecting"
-		usageMonitor = web.NewDataStore(
-			fmt.Sprintf(":%d", cfg.WebPort),
-			ctx,
-			cfg.SnifferLog,
-			sniffer,
-			&tunnelStatus,
-			client.logger,
-		)
+		panel, err := client.panelConfig()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
 		client.web = usageMonitor
 		// Set config provider for web panel
-		web.SetConfigProvider(client)
+		tunnel := web.TunnelFrom(ctx)
+		tunnel.SetConfigProvider(client)
+		tunnel.SetPanelConfig(panel)
+		tunnel.SetReadiness(web.Readiness{
+			HeartbeatTimeout: time.Duration(cfg.ReadyHeartbeatTimeout) * time.Second,
+			MinPool:          cfg.ReadyMinPool,
+		})
 		// Start web panel
 		go usageMonitor.Monitor()
 		// Update tunnel status after a delay
@@ -134,37 +254,53 @@ func NewClient(cfg *config.ClientConfig, parentCtx context.Context) *Client {
 		}()
 	}
 
-	// Start keepalive sync with server web panel
+	// Start keepalive and config sync with server web panel
 	if cfg.RemoteAddr != "" && cfg.WebPort > 0 {
-		host := extractHostFromAddr(cfg.RemoteAddr)
-		serverWebAddr := "http://" + host + ":" + strconv.Itoa(cfg.WebPort)
+		serverWebAddr, err := client.serverWebAddr()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
 		client.syncKeepaliveWithServer(serverWebAddr)
-	}
-
-	// Start config sync with server web panel
-	if cfg.RemoteAddr != "" && cfg.WebPort > 0 {
-		host := extractHostFromAddr(cfg.RemoteAddr)
-		serverWebAddr := "http://" + host + ":" + strconv.Itoa(cfg.WebPort)
 		client.syncConfigWithServer(serverWebAddr)
 	}
 
 	client.usageMonitor = usageMonitor // Add this field to Client struct if not present
 
-	return client
+	return client, nil
 }
 
-// Run starts the client and begins dialing the tunnel server
-func (c *Client) Start() {
+// Start begins dialing the tunnel server in the background, it returns an error
+// if the client can't run with its configuration.
+func (c *Client) Start() error {
+	accessLog, err := c.accessLog()
+	if err != nil {
+		return err
+	}
+	webhooks, err := c.webhooks()
+	if err != nil {
+		return err
+	}
+
 	// for pprof
 	if c.config.PPROF {
-		go func() {
-			c.logger.Info("pprof started at port 6061")
-			http.ListenAndServe("0.0.0.0:6061", nil)
-		}()
+		utils.StartPprof("0.0.0.0:6061", c.logger)
 	}
 
 	c.logger.Infof("client with remote address %s started successfully", c.config.RemoteAddr)
 
+	tunnel := web.TunnelFrom(c.ctx)
+	tunnel.SetAccessLog(accessLog)
+
+	notifier := utils.NewSystemdNotifier(time.Duration(c.config.ReadyHeartbeatTimeout)*time.Second, c.logger)
+	notifier.Start(c.ctx)
+	if webhooks != nil {
+		webhooks.Start(c.ctx)
+		tunnel.SetTunnelObservers(notifier, webhooks)
+	} else {
+		tunnel.SetTunnelObservers(notifier)
+	}
+
 	sniffer := true
 	if c.config.Sniffer != nil {
 		sniffer = *c.config.Sniffer
@@ -172,6 +308,25 @@ func (c *Client) Start() {
 
 	usageMonitor := c.usageMonitor
 
+	// TLS settings for wss, wssmux and quic
+	var tlsConfig *tls.Config
+	switch c.config.Transport {
+	case config.WSS, config.WSSMUX, config.QUIC:
+		tlsConfig, err = utils.NewClientTLSConfig(utils.ClientTLSOptions{
+			CertFile:   c.config.TLSCertFile,
+			KeyFile:    c.config.TLSKeyFile,
+			CAFile:     c.config.TLSCAFile,
+			ServerName: c.config.TLSServerName,
+			Pins:       c.config.TLSPins,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to load TLS configuration: %v", err)
+		}
+		if c.config.TLSCAFile == "" && len(c.config.TLSPins) == 0 {
+			c.logger.Warn("server certificate is not verified, set tls_ca or tls_pins to prevent interception")
+		}
+	}
+
 	switch c.config.Transport {
 	case config.TCP:
 		tcpConfig := &transport.TcpConfig{
@@ -186,6 +341,8 @@ func (c *Client) Start() {
 			WebPort:        c.config.WebPort,
 			SnifferLog:     c.config.SnifferLog,
 			AggressivePool: c.config.AggressivePool,
+			Relay:          c.relay,
+			ResumeGrace:    time.Duration(c.config.ResumeGrace) * time.Second,
 		}
 		tcpClient := transport.NewTCPClient(c.ctx, tcpConfig, c.logger, usageMonitor)
 		go tcpClient.Start()
@@ -207,6 +364,8 @@ func (c *Client) Start() {
 			WebPort:          c.config.WebPort,
 			SnifferLog:       c.config.SnifferLog,
 			AggressivePool:   c.config.AggressivePool,
+			Relay:            c.relay,
+			ResumeGrace:      time.Duration(c.config.ResumeGrace) * time.Second,
 		}
 		tcpMuxClient := transport.NewMuxClient(c.ctx, tcpMuxConfig, c.logger, usageMonitor)
 		go tcpMuxClient.Start()
@@ -226,6 +385,11 @@ func (c *Client) Start() {
 			Mode:           c.config.Transport,
 			AggressivePool: c.config.AggressivePool,
 			EdgeIP:         c.config.EdgeIP,
+			TLSConfig:      tlsConfig,
+			Obfuscation:    utils.NewObfuscationProfile(c.config.Obfuscation),
+			Relay:          c.relay,
+			ResumeGrace:    time.Duration(c.config.ResumeGrace) * time.Second,
+			Coalesce:       c.config.WSCoalesce,
 		}
 		WsClient := transport.NewWSClient(c.ctx, WsConfig, c.logger, usageMonitor)
 		go WsClient.Start()
@@ -249,6 +413,10 @@ func (c *Client) Start() {
 			Mode:             c.config.Transport,
 			AggressivePool:   c.config.AggressivePool,
 			EdgeIP:           c.config.EdgeIP,
+			TLSConfig:        tlsConfig,
+			Obfuscation:      utils.NewObfuscationProfile(c.config.Obfuscation),
+			Relay:            c.relay,
+			ResumeGrace:      time.Duration(c.config.ResumeGrace) * time.Second,
 		}
 		wsMuxClient := transport.NewWSMuxClient(c.ctx, wsMuxConfig, c.logger, usageMonitor)
 		go wsMuxClient.Start()
@@ -266,17 +434,22 @@ func (c *Client) Start() {
 			WebPort:        c.config.WebPort,
 			SnifferLog:     c.config.SnifferLog,
 			AggressivePool: c.config.AggressivePool,
+			TLSConfig:      tlsConfig,
+			Relay:          c.relay,
 		}
 		quicClient := transport.NewQuicClient(c.ctx, quicConfig, c.logger, usageMonitor)
 		go quicClient.ChannelDialer(true)
 	}
 
-	<-c.ctx.Done()
+	go func() {
+		<-c.ctx.Done()
 
-	c.logger.Info("all workers stopped successfully")
+		c.logger.Info("all workers stopped successfully")
 
-	// suppress other logs
-	c.logger.SetLevel(logrus.FatalLevel)
+		// suppress other logs
+		c.logger.SetLevel(logrus.FatalLevel)
+	}()
+	return nil
 }
 func (c *Client) Stop() {
 	if c.cancel != nil {
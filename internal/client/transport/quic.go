@@ -48,6 +48,8 @@ type QuicConfig struct {
 	ConnectionPool   int
 	WebPort          int
 	AggressivePool   bool
+	TLSConfig        *tls.Config // client TLS settings (verification, client certificate)
+	Relay            RelayFunc   // hands connections to the next hop instead of dialing them
 }
 
 func NewQuicClient(parentCtx context.Context, config *QuicConfig, logger *logrus.Logger, usageMonitor *web.Usage) *QuicTransport {
@@ -83,6 +85,7 @@ func (c *QuicTransport) Restart() {
 	defer c.restartMutex.Unlock()
 
 	c.logger.Info("restarting client...")
+	c.usageMonitor.Restarting()
 	if c.cancel != nil {
 		c.cancel()
 	}
@@ -111,6 +114,11 @@ func (c *QuicTransport) ChannelDialer(coldStart bool) {
 	if coldStart && c.config.WebPort > 0 {
 		go c.usageMonitor.Monitor()
 	}
+	c.usageMonitor.SetPoolSize(func() int {
+		c.activeMu.Lock()
+		defer c.activeMu.Unlock()
+		return c.activeConnections
+	})
 	c.config.TunnelStatus = "Disconnected (Quic)"
 	c.logger.Info("attempting to establish a new quic control channel connection...")
 
@@ -172,6 +180,7 @@ func (c *QuicTransport) ChannelDialer(coldStart bool) {
 				stream.Close()
 
 				c.config.TunnelStatus = "Connected (Quic)"
+				c.usageMonitor.ControlChannelUp(c.config.TunnelStatus)
 
 				go c.channelListener()
 
@@ -181,7 +190,7 @@ func (c *QuicTransport) ChannelDialer(coldStart bool) {
 
 				return
 			} else {
-				c.logger.Errorf("invalid token received. Expected: %s, Received: %s. Retrying...", c.config.Token, message)
+				c.logger.Errorf("invalid token received from the server. Retrying...")
 				stream.Close()
 				qConn.CloseWithError(1, "invalid token error")
 				continue
@@ -265,6 +274,7 @@ func (c *QuicTransport) channelListener() {
 				go c.tunnelDialer()
 			case utils.SG_HB:
 				c.logger.Debug("heartbeat signal received successfully")
+				c.usageMonitor.Heartbeat()
 				tickerTimeout.Reset(3 * time.Second)
 			default:
 				c.logger.Errorf("unexpected response from channel: %v. Restarting client...", msg)
@@ -337,6 +347,11 @@ func (c *QuicTransport) handleTunnelConn(session quic.Connection) {
 }
 
 func (c *QuicTransport) localDialer(stream quic.Stream, remoteAddr string) {
+	remoteAddr, source := utils.SplitTarget(remoteAddr)
+	if source == "" {
+		source = c.config.RemoteAddr
+	}
+
 	// Extract the port
 	parts := strings.Split(remoteAddr, ":")
 	var port int
@@ -357,7 +372,12 @@ func (c *QuicTransport) localDialer(stream quic.Stream, remoteAddr string) {
 			return
 		}
 	}
-	localConnection, err := c.tcpDialer(remoteAddr)
+	var localConnection net.Conn
+	if c.config.Relay != nil {
+		localConnection, err = c.config.Relay(remoteAddr, source)
+	} else {
+		localConnection, err = c.tcpDialer(remoteAddr)
+	}
 	if err != nil {
 		c.logger.Errorf("connecting to local address %s is not possible", remoteAddr)
 		stream.Close()
@@ -365,7 +385,11 @@ func (c *QuicTransport) localDialer(stream quic.Stream, remoteAddr string) {
 	}
 
 	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
-	utils.QConnectionHandler(localConnection, stream, c.logger, c.usageMonitor, int(port), c.config.Sniffer)
+
+	tracked := c.usageMonitor.TrackConnection("quic", source, remoteAddr, port, func() { localConnection.Close() })
+	defer tracked.Done()
+
+	utils.QConnectionHandler(tracked.TargetConn(localConnection), stream, c.logger, c.usageMonitor, int(port), c.config.Sniffer)
 }
 
 func (c *QuicTransport) tcpDialer(address string) (*net.TCPConn, error) {
@@ -431,11 +455,17 @@ func (c *QuicTransport) poolChecker() {
 }
 
 func (c *QuicTransport) generateClientTLSConfig() *tls.Config {
-	// Skip certificate verification for simplicity (not recommended for production)
-	return &tls.Config{
-		InsecureSkipVerify: true,
-		NextProtos:         []string{"h3"}, // Set your supported protocol here
+	// Without CA bundle or pins the certificate verification is skipped
+	if c.config.TLSConfig == nil {
+		return &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"h3"}, // Set your supported protocol here
+		}
 	}
+
+	tlsConfig := c.config.TLSConfig.Clone()
+	tlsConfig.NextProtos = []string{"h3"}
+	return tlsConfig
 }
 
 // quicDialer establishes a QUIC connection to a given address
@@ -0,0 +1,27 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RelayFunc hands a connection for target over to the next hop of a relay,
+// source is the address of the user as reported by the server.
+type RelayFunc func(target, source string) (net.Conn, error)
+
+// dialTarget connects to the target of a tunnel connection, through relay when
+// it is set.
+func dialTarget(ctx context.Context, relay RelayFunc, target, source string, timeout, keepAlive time.Duration, logger *logrus.Logger) (net.Conn, error) {
+	if relay != nil {
+		return relay(target, source)
+	}
+	// Set Default S,R buffer to 32kb also enabling nodelay on send side of local network ( receive side should be handled by xray)
+	conn, err := TcpDialer(ctx, target, timeout, keepAlive, true, 1, 32*1024, 32*1024, logger)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,126 @@
+package transport
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/musix/backhaul/internal/utils"
+
+	"github.com/gorilla/websocket"
+)
+
+// controlSession is the client side of a control channel that can be resumed
+// within the grace period (resume_grace). The tunnel connections and mux
+// sessions are kept while the control channel is dialed again, without grace
+// period or session the client restarts.
+type controlSession struct {
+	grace time.Duration
+
+	mu      sync.Mutex
+	id      string    // granted by the server, empty when it can't resume
+	current any       // the control channel, losing another one is ignored
+	lostAt  time.Time // zero while the control channel is up
+}
+
+func newControlSession(grace time.Duration) *controlSession {
+	return &controlSession{grace: grace}
+}
+
+// hello returns the handshake message for token. It asks for a new session, or
+// for the lost one while resuming.
+func (cs *controlSession) hello(token string) string {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.grace <= 0 {
+		return token
+	}
+	return utils.JoinSession(token, cs.id)
+}
+
+// announce tells the server that conn is a tunnel connection of the session,
+// it is sent before anything else. Without session nothing is sent.
+func (cs *controlSession) announce(conn net.Conn) error {
+	cs.mu.Lock()
+	id := cs.id
+	cs.mu.Unlock()
+	if id == "" {
+		return nil
+	}
+	return utils.SendBinaryTransportString(conn, id, utils.SG_Tunnel)
+}
+
+// wsReply reads the reply of the server to the handshake of a websocket control
+// channel conn. Without grace period there is none, the token is the reply.
+func (cs *controlSession) wsReply(conn *websocket.Conn, token string) (string, error) {
+	if cs.grace <= 0 {
+		return token, nil
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		return "", err
+	}
+	_, reply, err := conn.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	return string(reply), conn.SetReadDeadline(time.Time{})
+}
+
+// accept checks the reply of the server to the handshake of conn. resumed
+// reports whether the server resumed the lost session, if it was lost.
+func (cs *controlSession) accept(token, reply string, conn any) (ok, resumed bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	id := ""
+	if reply != token {
+		replyToken, replyID, found := utils.SplitSession(reply)
+		if !found || replyToken != token || replyID == "" {
+			return false, false
+		}
+		id = replyID
+	}
+	resumed = !cs.lostAt.IsZero() && id != "" && id == cs.id
+	cs.id = id
+	cs.current = conn
+	cs.lostAt = time.Time{}
+	return true, resumed
+}
+
+// lose is called when conn, the control channel, fails. It returns false if
+// conn is not the control channel anymore, the loss is handled already.
+func (cs *controlSession) lose(conn any) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if conn == nil || conn != cs.current {
+		return false
+	}
+	cs.current = nil
+	if cs.id != "" {
+		cs.lostAt = time.Now()
+	}
+	return true
+}
+
+// resuming reports whether the control channel is lost and may be resumed.
+func (cs *controlSession) resuming() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return !cs.lostAt.IsZero()
+}
+
+// expired reports whether the grace period of the lost control channel ended.
+func (cs *controlSession) expired() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return !cs.lostAt.IsZero() && time.Since(cs.lostAt) > cs.grace
+}
+
+// reset forgets the session, the transport restarts.
+func (cs *controlSession) reset() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.id = ""
+	cs.current = nil
+	cs.lostAt = time.Time{}
+}
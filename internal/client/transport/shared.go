@@ -8,16 +8,15 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
-	"net/http"
 	"runtime"
 	"strconv"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/musix/backhaul/internal/config"
+	"github.com/musix/backhaul/internal/utils"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/exp/rand"
 )
@@ -26,103 +25,31 @@ import (
 var tfoEnabledAddresses = make(map[string]bool)
 var tfoMutex sync.RWMutex
 
-// Obfuscation configuration
-type ObfuscationConfig struct {
-	EnableHTTPSObfuscation     bool
-	EnableWebSocketObfuscation bool
-	EnableTLSFingerprinting    bool
-	CustomUserAgent            string
-	CustomHeaders              map[string]string
-}
-
-// Default obfuscation config
-var defaultObfuscationConfig = ObfuscationConfig{
-	EnableHTTPSObfuscation:     true,
-	EnableWebSocketObfuscation: true,
-	EnableTLSFingerprinting:    true,
-	CustomUserAgent:            "",
-	CustomHeaders:              make(map[string]string),
-}
-
-// Enhanced User-Agent list for better obfuscation
-var enhancedUserAgents = []string{
-	// Modern Chrome versions
-	"Mozilla/5.0 (Windows NT10 Win64; x64) AppleWebKit/53736(KHTML, like Gecko) Chrome/120000 Safari/537.36,Mozilla/5.0 (Macintosh; Intel Mac OS X10_157) AppleWebKit/53736(KHTML, like Gecko) Chrome/120000 Safari/537.36,Mozilla/5.0(X11; Linux x864) AppleWebKit/53736(KHTML, like Gecko) Chrome/120000 Safari/537.36,Mozilla/5.0 (Windows NT10 Win64; x64) AppleWebKit/53736(KHTML, like Gecko) Chrome/119000 Safari/537.36,Mozilla/5.0 (Macintosh; Intel Mac OS X10_157) AppleWebKit/53736(KHTML, like Gecko) Chrome/119000Safari/5370.36",
-	// Modern Firefox versions
-	"Mozilla/5.0 (Windows NT10.0Win64 x64; rv:1210o/2010101 Firefox/1210,Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:1210o/2010101 Firefox/1210,Mozilla/5.0(X11; Linux x864; rv:1210o/2010101 Firefox/1210,Mozilla/5.0 (Windows NT10.0Win64 x64; rv:1200o/2010101Firefox/120.0",
-	// Safari
-	"Mozilla/5.0 (Macintosh; Intel Mac OS X10_157) AppleWebKit/6050.115(KHTML, like Gecko) Version/170.1Safari/605.1.15,Mozilla/5.0 (Macintosh; Intel Mac OS X10_157) AppleWebKit/6050.115(KHTML, like Gecko) Version/170Safari/605.10.15",
-	// Edge
-	"Mozilla/5.0 (Windows NT10 Win64; x64) AppleWebKit/53736(KHTML, like Gecko) Chrome/120000 Safari/537.36 Edg/120.0.00,Mozilla/5.0 (Macintosh; Intel Mac OS X10_157) AppleWebKit/53736(KHTML, like Gecko) Chrome/120000 Safari/537.36dg/120.0",
-}
-
-// Realistic paths for obfuscation
-var realisticPaths = []string{"/api/v1/stream", "/cdn/assets", "/ws/chat", "/api/notifications", "/live/stream", "/api/analytics", "/cdn/static", "/api/status", "/ws/updates", "/api/metrics"}
-
-// Simple TLS configuration for obfuscation
-func getObfuscatedTLSConfig() *tls.Config {
-	return &tls.Config{
-		InsecureSkipVerify: true,
-		MinVersion:         tls.VersionTLS12,
-		MaxVersion:         tls.VersionTLS13,
-		CurvePreferences: []tls.CurveID{
-			tls.X25519,
-			tls.CurveP256,
-		},
-	}
-}
-
-// Generate realistic headers for obfuscation
-func generateObfuscatedHeaders(token string, randomUserID int32, customHeaders map[string]string) http.Header {
-	headers := http.Header{}
-
-	// Basic headers
-	headers.Add("Authorization", fmt.Sprintf("Bearer %v", token))
-	headers.Add("X-User-Id", fmt.Sprintf("%d", randomUserID))
-
-	// Random User-Agent
-	randomUserAgent := enhancedUserAgents[rand.Intn(len(enhancedUserAgents))]
-	headers.Add("User-Agent", randomUserAgent)
-
-	// Realistic headers that appear in normal HTTPS traffic
-	headers.Add("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,*/*;q=0.8")
-	headers.Add("Accept-Language", "en-US,en;q=0.5")
-	headers.Add("Accept-Encoding", "gzip, deflate, br")
-	headers.Add("DNT", "1")
-	// Note: Connection header is set by WebSocket library automatically
-	headers.Add("Upgrade-Insecure-Requests", "1")
-	headers.Add("Sec-Fetch-Dest", "document")
-	headers.Add("Sec-Fetch-Mode", "navigate")
-	headers.Add("Sec-Fetch-Site", "none")
-	headers.Add("Cache-Control", "max-age=0")
-
-	// Add custom headers if provided
-	for key, value := range customHeaders {
-		headers.Add(key, value)
+// Simple TLS configuration for obfuscation, layered on top of the verification settings
+func getObfuscatedTLSConfig(base *tls.Config) *tls.Config {
+	var tlsConfig *tls.Config
+	if base != nil {
+		tlsConfig = base.Clone()
+	} else {
+		tlsConfig = &tls.Config{InsecureSkipVerify: true}
 	}
 
-	return headers
-}
-
-// Generate realistic WebSocket path
-func generateObfuscatedPath(basePath string, randomUserID int32) string {
-	if basePath == "/channel" {
-		// Use a realistic path for control channel
-		realisticPath := realisticPaths[rand.Intn(len(realisticPaths))]
-		return fmt.Sprintf("%s/%d", realisticPath, randomUserID)
+	tlsConfig.MinVersion = tls.VersionTLS12
+	tlsConfig.MaxVersion = tls.VersionTLS13
+	tlsConfig.CurvePreferences = []tls.CurveID{
+		tls.X25519,
+		tls.CurveP256,
 	}
-	return fmt.Sprintf("%s/%d", basePath, randomUserID)
+	return tlsConfig
 }
 
 func ResolveRemoteAddr(remoteAddr string) (int, string, error) {
-	// Split the address into host and port
-	parts := strings.Split(remoteAddr, ":")
-	var port int
-	var err error
+	// Split the address into host and port, IPv6 hosts are in brackets
+	_, portStr, err := net.SplitHostPort(remoteAddr)
 
 	// Handle cases where only the port is sent or host:port format
-	if len(parts) < 2 {
-		port, err = strconv.Atoi(parts[0])
+	if err != nil {
+		port, err := strconv.Atoi(remoteAddr)
 		if err != nil {
 			return 0, "", fmt.Errorf("invalid port format: %v", err)
 		}
@@ -131,7 +58,7 @@ func ResolveRemoteAddr(remoteAddr string) (int, string, error) {
 	}
 
 	// If both host and port are provided
-	port, err = strconv.Atoi(parts[1])
+	port, err := strconv.Atoi(portStr)
 	if err != nil {
 		return 0, "", fmt.Errorf("invalid port format: %v", err)
 	}
@@ -248,7 +175,7 @@ func attemptTcpDialer(ctx context.Context, address string, timeout time.Duration
 	return tcpConn, nil
 }
 
-func WebSocketDialer(ctx context.Context, addr string, edgeIP string, path string, timeout time.Duration, keepalive time.Duration, nodelay bool, token string, mode config.TransportType, retry int, SO_RCVBUF int, SO_SNDBUF int, logger *logrus.Logger) (*websocket.Conn, error) {
+func WebSocketDialer(ctx context.Context, addr string, edgeIP string, path string, timeout time.Duration, keepalive time.Duration, nodelay bool, token string, mode config.TransportType, tlsConfig *tls.Config, obfuscation *utils.ObfuscationProfile, retry int, SO_RCVBUF int, SO_SNDBUF int, logger *logrus.Logger) (*websocket.Conn, error) {
 
 	var tunnelWSConn *websocket.Conn
 	var err error
@@ -258,7 +185,7 @@ func WebSocketDialer(ctx context.Context, addr string, edgeIP string, path strin
 
 	for i := 0; i < retries; i++ {
 		// Attempt to dial the WebSocket
-		tunnelWSConn, err = attemptDialWebSocket(ctx, addr, edgeIP, path, timeout, keepalive, nodelay, token, mode, SO_RCVBUF, SO_SNDBUF, logger)
+		tunnelWSConn, err = attemptDialWebSocket(ctx, addr, edgeIP, path, timeout, keepalive, nodelay, token, mode, tlsConfig, obfuscation, SO_RCVBUF, SO_SNDBUF, logger)
 		if err == nil {
 			// If successful, return the connection
 			return tunnelWSConn, nil
@@ -277,13 +204,13 @@ func WebSocketDialer(ctx context.Context, addr string, edgeIP string, path strin
 	return nil, err
 }
 
-func attemptDialWebSocket(ctx context.Context, addr string, edgeIP string, path string, timeout time.Duration, keepalive time.Duration, nodelay bool, token string, mode config.TransportType, SO_RCVBUF int, SO_SNDBUF int, logger *logrus.Logger) (*websocket.Conn, error) {
+func attemptDialWebSocket(ctx context.Context, addr string, edgeIP string, path string, timeout time.Duration, keepalive time.Duration, nodelay bool, token string, mode config.TransportType, tlsConfig *tls.Config, obfuscation *utils.ObfuscationProfile, SO_RCVBUF int, SO_SNDBUF int, logger *logrus.Logger) (*websocket.Conn, error) {
 	// Generate a random X-user-id
 	rand.Seed(uint64(time.Now().UnixNano()))
 	randomUserID := rand.Int31() // Generate a random int32 number
 
 	// Generate obfuscated headers
-	headers := generateObfuscatedHeaders(token, randomUserID, defaultObfuscationConfig.CustomHeaders)
+	headers := obfuscation.RequestHeaders(token, randomUserID)
 
 	var wsURL string
 	dialer := websocket.Dialer{}
@@ -301,12 +228,14 @@ func attemptDialWebSocket(ctx context.Context, addr string, edgeIP string, path
 	}
 
 	// Generate obfuscated path
-	obfuscatedPath := generateObfuscatedPath(path, randomUserID)
+	obfuscatedPath := obfuscation.RequestPath(path, randomUserID)
 
 	switch mode {
 	case config.WS, config.WSMUX:
 		wsURL = fmt.Sprintf("ws://%s%s", addr, obfuscatedPath)
 		dialer = websocket.Dialer{
+			ReadBufferSize:    16 * 1024,
+			WriteBufferSize:   16 * 1024,
 			EnableCompression: true,
 			HandshakeTimeout:  45 * time.Second, // default handshake timeout
 			NetDial: func(_, addr string) (net.Conn, error) {
@@ -320,8 +249,10 @@ func attemptDialWebSocket(ctx context.Context, addr string, edgeIP string, path
 	case config.WSS, config.WSSMUX:
 		wsURL = fmt.Sprintf("wss://%s%s", addr, obfuscatedPath)
 		// Use obfuscated TLS configuration
-		tlsConfig := getObfuscatedTLSConfig()
+		tlsConfig := getObfuscatedTLSConfig(tlsConfig)
 		dialer = websocket.Dialer{
+			ReadBufferSize:    16 * 1024,
+			WriteBufferSize:   16 * 1024,
 			EnableCompression: true,
 			TLSClientConfig:   tlsConfig,
 			HandshakeTimeout:  45 * time.Second, // default handshake timeout
@@ -336,6 +267,13 @@ func attemptDialWebSocket(ctx context.Context, addr string, edgeIP string, path
 	default:
 		return nil, fmt.Errorf("unsupported transport mode: %v", mode)
 	}
+	if mode == config.WSMUX || mode == config.WSSMUX {
+		// Carry the mux session in websocket messages if the server can
+		dialer.Subprotocols = []string{utils.WSMuxProtocol}
+	} else {
+		// Pass half-closed connections on if the server can
+		dialer.Subprotocols = []string{utils.WSHalfCloseProtocol}
+	}
 
 	// Dial to the WebSocket server
 	tunnelWSConn, _, err := dialer.Dial(wsURL, headers)
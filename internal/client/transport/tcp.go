@@ -2,7 +2,6 @@ package transport
 
 import (
 	"context"
-	"fmt"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -21,6 +20,7 @@ type TcpTransport struct {
 	cancel          context.CancelFunc
 	logger          *logrus.Logger
 	controlChannel  net.Conn
+	session         *controlSession
 	usageMonitor    *web.Usage
 	restartMutex    sync.Mutex
 	poolConnections int32
@@ -40,6 +40,8 @@ type TcpConfig struct {
 	Nodelay        bool
 	Sniffer        bool
 	AggressivePool bool
+	Relay          RelayFunc     // hands connections to the next hop instead of dialing them
+	ResumeGrace    time.Duration // resume a lost control channel, keeping the tunnel connections
 }
 
 func NewTCPClient(parentCtx context.Context, config *TcpConfig, logger *logrus.Logger, usageMonitor *web.Usage) *TcpTransport {
@@ -53,7 +55,8 @@ func NewTCPClient(parentCtx context.Context, config *TcpConfig, logger *logrus.L
 		ctx:             ctx,
 		cancel:          cancel,
 		logger:          logger,
-		controlChannel:  nil,          // will be set when a control connection is established
+		controlChannel:  nil, // will be set when a control connection is established
+		session:         newControlSession(config.ResumeGrace),
 		usageMonitor:    usageMonitor, // use the passed-in usageMonitor
 		poolConnections: 0,
 		loadConnections: 0,
@@ -66,6 +69,7 @@ func NewTCPClient(parentCtx context.Context, config *TcpConfig, logger *logrus.L
 func (c *TcpTransport) Start() {
 	// Do NOT start usageMonitor.Monitor here!
 	c.config.TunnelStatus = "Disconnected (TCP)"
+	c.usageMonitor.SetPoolSize(func() int { return int(atomic.LoadInt32(&c.poolConnections)) })
 
 	go c.channelDialer()
 }
@@ -77,6 +81,7 @@ func (c *TcpTransport) Restart() {
 	defer c.restartMutex.Unlock()
 
 	c.logger.Info("restarting client...")
+	c.usageMonitor.Restarting()
 
 	// for removing timeout logs
 	level := c.logger.Level
@@ -85,6 +90,7 @@ func (c *TcpTransport) Restart() {
 	if c.cancel != nil {
 		c.cancel()
 	}
+	c.session.reset()
 
 	// close control channel connection
 	if c.controlChannel != nil {
@@ -99,7 +105,7 @@ func (c *TcpTransport) Restart() {
 
 	// Re-initialize variables
 	c.controlChannel = nil
-	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
+	// keep the monitor, the web panel serves it
 	c.config.TunnelStatus = ""
 	c.poolConnections = 0
 	c.loadConnections = 0
@@ -119,6 +125,12 @@ func (c *TcpTransport) channelDialer() {
 		case <-c.ctx.Done():
 			return
 		default:
+			if c.session.expired() {
+				c.logger.Warn("control channel was not resumed in time, restarting...")
+				go c.Restart()
+				return
+			}
+
 			//set default behaviour of control channel to nodelay, also using default buffer parameters
 			tunnelTCPConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, c.config.KeepAlive, true, 3, 0, 0, c.logger)
 			if err != nil {
@@ -128,7 +140,7 @@ func (c *TcpTransport) channelDialer() {
 			}
 
 			// Sending security token
-			err = utils.SendBinaryTransportString(tunnelTCPConn, c.config.Token, utils.SG_Chan)
+			err = utils.SendBinaryTransportString(tunnelTCPConn, c.session.hello(c.config.Token), utils.SG_Chan)
 			if err != nil {
 				c.logger.Errorf("failed to send security token: %v", err)
 				tunnelTCPConn.Close()
@@ -157,18 +169,32 @@ func (c *TcpTransport) channelDialer() {
 			// Resetting the deadline (removes any existing deadline)
 			tunnelTCPConn.SetReadDeadline(time.Time{})
 
-			if message == c.config.Token {
-				c.controlChannel = tunnelTCPConn
-				c.logger.Info("control channel established successfully")
+			lost := c.session.resuming()
+			if ok, resumed := c.session.accept(c.config.Token, message, tunnelTCPConn); ok {
+				if lost && !resumed {
+					c.logger.Warn("server did not resume the control channel, restarting...")
+					tunnelTCPConn.Close()
+					go c.Restart()
+					return
+				}
 
+				c.controlChannel = tunnelTCPConn
 				c.config.TunnelStatus = "Connected (TCP)"
+				c.usageMonitor.ControlChannelUp(c.config.TunnelStatus)
+				if resumed {
+					c.logger.Info("control channel resumed")
+					go c.channelHandler()
+					return
+				}
+
+				c.logger.Info("control channel established successfully")
 				go c.poolMaintainer()
 				go c.channelHandler()
 
 				return
 
 			} else {
-				c.logger.Errorf("invalid token received. Expected: %s, Received: %s. Retrying...", c.config.Token, message)
+				c.logger.Errorf("invalid token received from the server. Retrying...")
 				tunnelTCPConn.Close() // Close connection if the token is invalid
 				time.Sleep(c.config.RetryInterval)
 				continue
@@ -247,6 +273,9 @@ func (c *TcpTransport) channelHandler() {
 	const baseBackoff = time.Second
 	msgChan := make(chan byte, 1000)
 
+	// A resumed control channel gets a new handler
+	controlChannel := c.controlChannel
+
 	// Goroutine to handle the blocking ReceiveBinaryString with retry/backoff
 	go func() {
 		retries := 0
@@ -255,15 +284,15 @@ func (c *TcpTransport) channelHandler() {
 			case <-c.ctx.Done():
 				return
 			default:
-				msg, err := utils.ReceiveBinaryByte(c.controlChannel)
+				msg, err := utils.ReceiveBinaryByte(controlChannel)
 				if err != nil {
 					c.logger.Errorf("failed to read from control channel (try %d/%d): %v", retries+1, maxRetries, err)
 					retries++
 					if retries >= maxRetries {
 						if c.cancel != nil {
-							c.logger.Error("max retries reached, restarting...")
-							go c.Restart()
+							c.controlChannelLost(controlChannel)
 						}
+						close(msgChan)
 						return
 					}
 					time.Sleep(baseBackoff * time.Duration(retries))
@@ -279,10 +308,14 @@ func (c *TcpTransport) channelHandler() {
 	for {
 		select {
 		case <-c.ctx.Done():
-			_ = utils.SendBinaryByte(c.controlChannel, utils.SG_Closed)
+			_ = utils.SendBinaryByte(controlChannel, utils.SG_Closed)
 			return
 
-		case msg := <-msgChan:
+		case msg, ok := <-msgChan:
+			if !ok {
+				return
+			}
+
 			switch msg {
 			case utils.SG_Chan:
 				atomic.AddInt32(&c.loadConnections, 1)
@@ -297,6 +330,7 @@ func (c *TcpTransport) channelHandler() {
 
 			case utils.SG_HB:
 				c.logger.Debug("heartbeat signal received successfully")
+				c.usageMonitor.Heartbeat()
 
 			case utils.SG_Closed:
 				c.logger.Warn("control channel has been closed by the server")
@@ -304,10 +338,10 @@ func (c *TcpTransport) channelHandler() {
 				return
 
 			case utils.SG_RTT:
-				err := utils.SendBinaryByte(c.controlChannel, utils.SG_RTT)
+				err := utils.SendBinaryByte(controlChannel, utils.SG_RTT)
 				if err != nil {
-					c.logger.Error("failed to send RTT signal, restarting client: ", err)
-					go c.Restart()
+					c.logger.Error("failed to send RTT signal: ", err)
+					c.controlChannelLost(controlChannel)
 					return
 				}
 
@@ -320,6 +354,25 @@ func (c *TcpTransport) channelHandler() {
 	}
 }
 
+// controlChannelLost dials the control channel again to resume the session, the
+// client restarts if it can't.
+func (c *TcpTransport) controlChannelLost(controlChannel net.Conn) {
+	if !c.session.lose(controlChannel) {
+		return
+	}
+	if !c.session.resuming() {
+		c.logger.Error("control channel lost, restarting...")
+		go c.Restart()
+		return
+	}
+
+	c.logger.Warnf("control channel lost, resuming it within %s", c.config.ResumeGrace)
+	controlChannel.Close()
+	c.config.TunnelStatus = "Resuming (TCP)"
+	c.usageMonitor.Resuming()
+	go c.channelDialer()
+}
+
 // Dialing to the tunnel server, chained functions, without retry
 func (c *TcpTransport) tunnelDialer() {
 	c.logger.Debugf("initiating new connection to tunnel server at %s", c.config.RemoteAddr)
@@ -334,6 +387,13 @@ func (c *TcpTransport) tunnelDialer() {
 		return
 	}
 
+	// With a session the server is told this is a tunnel connection
+	if err := c.session.announce(tcpConn); err != nil {
+		c.logger.Errorf("failed to announce tunnel connection: %v", err)
+		tcpConn.Close()
+		return
+	}
+
 	// Increment active connections counter
 	atomic.AddInt32(&c.poolConnections, 1)
 
@@ -350,6 +410,7 @@ func (c *TcpTransport) tunnelDialer() {
 	}
 
 	// Extract the port from the received address
+	remoteAddr, source := utils.SplitTarget(remoteAddr)
 	port, resolvedAddr, err := ResolveRemoteAddr(remoteAddr)
 	if err != nil {
 		c.logger.Infof("failed to resolve remote port: %v", err)
@@ -360,10 +421,17 @@ func (c *TcpTransport) tunnelDialer() {
 	switch transport {
 	case utils.SG_TCP:
 		// Dial local server using the received address
-		c.localDialer(tcpConn, resolvedAddr, port)
+		c.localDialer(tcpConn, resolvedAddr, source, port)
 
 	case utils.SG_UDP:
-		UDPDialer(tcpConn, resolvedAddr, c.logger, c.usageMonitor, port, c.config.Sniffer)
+		if c.config.Relay != nil {
+			c.logger.Errorf("udp connection to %s can not be relayed. close the connection.", resolvedAddr)
+			tcpConn.Close()
+			return
+		}
+		tracked := c.usageMonitor.TrackConnection("udp", c.config.RemoteAddr, resolvedAddr, port, func() { tcpConn.Close() })
+		UDPDialer(tracked.SourceConn(tcpConn), resolvedAddr, c.logger, c.usageMonitor, port, c.config.Sniffer)
+		tracked.Done()
 
 	default:
 		c.logger.Error("undefined transport. close the connection.")
@@ -371,9 +439,11 @@ func (c *TcpTransport) tunnelDialer() {
 	}
 }
 
-func (c *TcpTransport) localDialer(tcpConn net.Conn, remoteAddr string, port int) {
-	// Set Default S,R buffer to 32kb also enabling nodelay on send side of local network ( receive side should be handled by xray)
-	localConnection, err := TcpDialer(c.ctx, remoteAddr, c.config.DialTimeOut, c.config.KeepAlive, true, 1, 32*1024, 32*1024, c.logger)
+func (c *TcpTransport) localDialer(tcpConn net.Conn, remoteAddr, source string, port int) {
+	if source == "" {
+		source = c.config.RemoteAddr
+	}
+	localConnection, err := dialTarget(c.ctx, c.config.Relay, remoteAddr, source, c.config.DialTimeOut, c.config.KeepAlive, c.logger)
 	if err != nil {
 		c.logger.Errorf("local dialer: %v", err)
 		tcpConn.Close()
@@ -382,5 +452,8 @@ func (c *TcpTransport) localDialer(tcpConn net.Conn, remoteAddr string, port int
 
 	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
 
-	utils.TCPConnectionHandler(tcpConn, localConnection, c.logger, c.usageMonitor, port, c.config.Sniffer)
+	tracked := c.usageMonitor.TrackConnection("tcp", source, remoteAddr, port, func() { localConnection.Close() })
+	defer tracked.Done()
+
+	utils.TCPConnectionHandler(tcpConn, tracked.TargetConn(localConnection), c.logger, c.usageMonitor, port, c.config.Sniffer)
 }
@@ -2,7 +2,6 @@ package transport
 
 import (
 	"context"
-	"fmt"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -23,6 +22,7 @@ type TcpMuxTransport struct {
 	cancel          context.CancelFunc
 	logger          *logrus.Logger
 	controlChannel  net.Conn
+	session         *controlSession
 	usageMonitor    *web.Usage
 	restartMutex    sync.Mutex
 	poolConnections int32
@@ -47,6 +47,8 @@ type TcpMuxConfig struct {
 	ConnPoolSize     int
 	WebPort          int
 	AggressivePool   bool
+	Relay            RelayFunc     // hands connections to the next hop instead of dialing them
+	ResumeGrace      time.Duration // resume a lost control channel, keeping the mux sessions
 }
 
 func NewMuxClient(parentCtx context.Context, config *TcpMuxConfig, logger *logrus.Logger, usageMonitor *web.Usage) *TcpMuxTransport {
@@ -68,7 +70,8 @@ func NewMuxClient(parentCtx context.Context, config *TcpMuxConfig, logger *logru
 		ctx:             ctx,
 		cancel:          cancel,
 		logger:          logger,
-		controlChannel:  nil,          // will be set when a control connection is established
+		controlChannel:  nil, // will be set when a control connection is established
+		session:         newControlSession(config.ResumeGrace),
 		usageMonitor:    usageMonitor, // use the passed-in usageMonitor
 		poolConnections: 0,
 		loadConnections: 0,
@@ -81,6 +84,7 @@ func NewMuxClient(parentCtx context.Context, config *TcpMuxConfig, logger *logru
 func (c *TcpMuxTransport) Start() {
 	// Do NOT start usageMonitor.Monitor here!
 	c.config.TunnelStatus = "Disconnected (TCPMUX)"
+	c.usageMonitor.SetPoolSize(func() int { return int(atomic.LoadInt32(&c.poolConnections)) })
 	go c.channelDialer()
 }
 
@@ -92,6 +96,7 @@ func (c *TcpMuxTransport) Restart() {
 	defer c.restartMutex.Unlock()
 
 	c.logger.Info("restarting client...")
+	c.usageMonitor.Restarting()
 
 	// for removing timeout logs
 	level := c.logger.Level
@@ -100,6 +105,7 @@ func (c *TcpMuxTransport) Restart() {
 	if c.cancel != nil {
 		c.cancel()
 	}
+	c.session.reset()
 
 	// close control channel connection
 	if c.controlChannel != nil {
@@ -114,7 +120,7 @@ func (c *TcpMuxTransport) Restart() {
 
 	// Re-initialize variables
 	c.controlChannel = nil
-	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
+	// keep the monitor, the web panel serves it
 	c.config.TunnelStatus = ""
 	c.poolConnections = 0
 	c.loadConnections = 0
@@ -135,6 +141,12 @@ func (c *TcpMuxTransport) channelDialer() {
 		case <-c.ctx.Done():
 			return
 		default:
+			if c.session.expired() {
+				c.logger.Warn("control channel was not resumed in time, restarting...")
+				go c.Restart()
+				return
+			}
+
 			tunnelConn, err := TcpDialer(c.ctx, c.config.RemoteAddr, c.config.DialTimeOut, c.config.KeepAlive, true, 3, 0, 0, c.logger)
 			if err != nil {
 				c.logger.Errorf("channel dialer: %v", err)
@@ -143,7 +155,7 @@ func (c *TcpMuxTransport) channelDialer() {
 			}
 
 			// Sending security token
-			err = utils.SendBinaryTransportString(tunnelConn, c.config.Token, utils.SG_Chan)
+			err = utils.SendBinaryTransportString(tunnelConn, c.session.hello(c.config.Token), utils.SG_Chan)
 			if err != nil {
 				c.logger.Errorf("failed to send security token: %v", err)
 				tunnelConn.Close()
@@ -171,18 +183,31 @@ func (c *TcpMuxTransport) channelDialer() {
 			// Resetting the deadline (removes any existing deadline)
 			tunnelConn.SetReadDeadline(time.Time{})
 
-			if message == c.config.Token {
-				c.controlChannel = tunnelConn
-				c.logger.Info("control channel established successfully")
+			lost := c.session.resuming()
+			if ok, resumed := c.session.accept(c.config.Token, message, tunnelConn); ok {
+				if lost && !resumed {
+					c.logger.Warn("server did not resume the control channel, restarting...")
+					tunnelConn.Close()
+					go c.Restart()
+					return
+				}
 
+				c.controlChannel = tunnelConn
 				c.config.TunnelStatus = "Connected (TCPMux)"
+				c.usageMonitor.ControlChannelUp(c.config.TunnelStatus)
+				if resumed {
+					c.logger.Info("control channel resumed")
+					go c.channelHandler()
+					return
+				}
 
+				c.logger.Info("control channel established successfully")
 				go c.poolMaintainer()
 				go c.channelHandler()
 
 				return
 			} else {
-				c.logger.Errorf("invalid token received. Expected: %s, Received: %s. Retrying...", c.config.Token, message)
+				c.logger.Errorf("invalid token received from the server. Retrying...")
 				tunnelConn.Close() // Close connection if the token is invalid
 				time.Sleep(c.config.RetryInterval)
 				continue
@@ -262,6 +287,9 @@ func (c *TcpMuxTransport) channelHandler() {
 	const baseBackoff = time.Second
 	msgChan := make(chan byte, 1000)
 
+	// A resumed control channel gets a new handler
+	controlChannel := c.controlChannel
+
 	// Goroutine to handle the blocking ReceiveBinaryString with retry/backoff
 	go func() {
 		retries := 0
@@ -270,15 +298,15 @@ func (c *TcpMuxTransport) channelHandler() {
 			case <-c.ctx.Done():
 				return
 			default:
-				msg, err := utils.ReceiveBinaryByte(c.controlChannel)
+				msg, err := utils.ReceiveBinaryByte(controlChannel)
 				if err != nil {
 					c.logger.Errorf("failed to read from control channel (try %d/%d): %v", retries+1, maxRetries, err)
 					retries++
 					if retries >= maxRetries {
 						if c.cancel != nil {
-							c.logger.Error("max retries reached, restarting...")
-							go c.Restart()
+							c.controlChannelLost(controlChannel)
 						}
+						close(msgChan)
 						return
 					}
 					time.Sleep(baseBackoff * time.Duration(retries))
@@ -294,10 +322,14 @@ func (c *TcpMuxTransport) channelHandler() {
 	for {
 		select {
 		case <-c.ctx.Done():
-			_ = utils.SendBinaryByte(c.controlChannel, utils.SG_Closed)
+			_ = utils.SendBinaryByte(controlChannel, utils.SG_Closed)
 			return
 
-		case msg := <-msgChan:
+		case msg, ok := <-msgChan:
+			if !ok {
+				return
+			}
+
 			switch msg {
 			case utils.SG_Chan:
 				atomic.AddInt32(&c.loadConnections, 1)
@@ -312,6 +344,14 @@ func (c *TcpMuxTransport) channelHandler() {
 
 			case utils.SG_HB:
 				c.logger.Debug("heartbeat signal received successfully")
+				c.usageMonitor.Heartbeat()
+
+				// send it back, the server counts it as the client's heartbeat
+				if err := utils.SendBinaryByte(controlChannel, utils.SG_HB); err != nil {
+					c.logger.Error("failed to send heartbeat signal: ", err)
+					c.controlChannelLost(controlChannel)
+					return
+				}
 
 			case utils.SG_Closed:
 				c.logger.Warn("control channel has been closed by the server")
@@ -328,6 +368,25 @@ func (c *TcpMuxTransport) channelHandler() {
 	}
 }
 
+// controlChannelLost dials the control channel again to resume the session, the
+// client restarts if it can't.
+func (c *TcpMuxTransport) controlChannelLost(controlChannel net.Conn) {
+	if !c.session.lose(controlChannel) {
+		return
+	}
+	if !c.session.resuming() {
+		c.logger.Error("control channel lost, restarting...")
+		go c.Restart()
+		return
+	}
+
+	c.logger.Warnf("control channel lost, resuming it within %s", c.config.ResumeGrace)
+	controlChannel.Close()
+	c.config.TunnelStatus = "Resuming (TCPMux)"
+	c.usageMonitor.Resuming()
+	go c.channelDialer()
+}
+
 func (c *TcpMuxTransport) tunnelDialer() {
 	c.logger.Debugf("initiating new tunnel connection to address %s", c.config.RemoteAddr)
 
@@ -340,6 +399,13 @@ func (c *TcpMuxTransport) tunnelDialer() {
 		return
 	}
 
+	// With a session the server is told this is a mux connection
+	if err := c.session.announce(tunnelConn); err != nil {
+		c.logger.Errorf("failed to announce mux connection: %v", err)
+		tunnelConn.Close()
+		return
+	}
+
 	// Increment active connections counter
 	atomic.AddInt32(&c.poolConnections, 1)
 
@@ -384,14 +450,18 @@ func (c *TcpMuxTransport) handleSession(tunnelConn net.Conn) {
 
 func (c *TcpMuxTransport) localDialer(stream *smux.Stream, remoteAddr string) {
 	// Extract the port from the received address
+	remoteAddr, source := utils.SplitTarget(remoteAddr)
 	port, resolvedAddr, err := ResolveRemoteAddr(remoteAddr)
 	if err != nil {
 		c.logger.Infof("failed to resolve remote port: %v", err)
 		stream.Close()
 		return
 	}
+	if source == "" {
+		source = c.config.RemoteAddr
+	}
 
-	localConnection, err := TcpDialer(c.ctx, resolvedAddr, c.config.DialTimeOut, c.config.KeepAlive, true, 1, 32*1024, 32*1024, c.logger)
+	localConnection, err := dialTarget(c.ctx, c.config.Relay, resolvedAddr, source, c.config.DialTimeOut, c.config.KeepAlive, c.logger)
 	if err != nil {
 		c.logger.Errorf("local dialer: %v", err)
 		stream.Close()
@@ -400,5 +470,8 @@ func (c *TcpMuxTransport) localDialer(stream *smux.Stream, remoteAddr string) {
 
 	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
 
-	utils.TCPConnectionHandler(stream, localConnection, c.logger, c.usageMonitor, int(port), c.config.Sniffer)
+	tracked := c.usageMonitor.TrackConnection("tcpmux", source, resolvedAddr, port, func() { localConnection.Close() })
+	defer tracked.Done()
+
+	utils.TCPConnectionHandler(stream, tracked.TargetConn(localConnection), c.logger, c.usageMonitor, int(port), c.config.Sniffer)
 }
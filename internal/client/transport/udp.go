@@ -2,7 +2,6 @@ package transport
 
 import (
 	"context"
-	"fmt"
 	"net"
 	"strconv"
 	"sync"
@@ -64,6 +63,7 @@ func NewUDPClient(parentCtx context.Context, config *UdpConfig, logger *logrus.L
 func (c *UdpTransport) Start() {
 	// Do NOT start usageMonitor.Monitor here!
 	c.config.TunnelStatus = "Disconnected (UDP)"
+	c.usageMonitor.SetPoolSize(func() int { return int(atomic.LoadInt32(&c.poolConnections)) })
 
 	go c.channelDialer()
 }
@@ -76,6 +76,7 @@ func (c *UdpTransport) Restart() {
 	defer c.restartMutex.Unlock()
 
 	c.logger.Info("restarting client...")
+	c.usageMonitor.Restarting()
 
 	// for removing timeout logs
 	level := c.logger.Level
@@ -98,7 +99,7 @@ func (c *UdpTransport) Restart() {
 
 	// Re-initialize variables
 	c.controlChannel = nil
-	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
+	// keep the monitor, the web panel serves it
 	c.config.TunnelStatus = ""
 	c.poolConnections = 0
 	c.loadConnections = 0
@@ -162,6 +163,7 @@ func (c *UdpTransport) channelDialer() {
 				c.logger.Info("control channel established successfully")
 
 				c.config.TunnelStatus = "Connected (UDP)"
+				c.usageMonitor.ControlChannelUp(c.config.TunnelStatus)
 
 				go c.poolMaintainer()
 				go c.channelHandler()
@@ -169,7 +171,7 @@ func (c *UdpTransport) channelDialer() {
 				return
 
 			} else {
-				c.logger.Errorf("invalid token received. Expected: %s, Received: %s. Retrying...", c.config.Token, message)
+				c.logger.Errorf("invalid token received from the server. Retrying...")
 				tunnelTCPConn.Close() // Close connection if the token is invalid
 				time.Sleep(c.config.RetryInterval)
 				continue
@@ -298,6 +300,7 @@ func (c *UdpTransport) channelHandler() {
 
 			case utils.SG_HB:
 				c.logger.Debug("heartbeat signal received successfully")
+				c.usageMonitor.Heartbeat()
 
 			case utils.SG_Closed:
 				c.logger.Warn("control channel has been closed by the server")
@@ -424,20 +427,26 @@ func (c *UdpTransport) localDialer(remoteAddr string, port int, tunConn *net.UDP
 
 	defer remoteConn.Close()
 
+	tracked := c.usageMonitor.TrackConnection("udp", c.config.RemoteAddr, remoteAddr, port, func() {
+		remoteConn.Close()
+		tunConn.Close()
+	})
+	defer tracked.Done()
+
 	done := make(chan struct{})
 	c.logger.Debugf("start to copy from tunnel %s to local %s", tunConn.LocalAddr(), remoteAddr)
 	go func() {
-		c.udpCopy(remoteConn, tunConn, port)
+		c.udpCopy(remoteConn, tunConn, port, tracked, tracked.AddDown)
 		done <- struct{}{}
 	}()
 
-	c.udpCopy(tunConn, remoteConn, port)
+	c.udpCopy(tunConn, remoteConn, port, tracked, tracked.AddUp)
 
 	<-done
 
 }
 
-func (c *UdpTransport) udpCopy(srcConn, dstConn *net.UDPConn, port int) {
+func (c *UdpTransport) udpCopy(srcConn, dstConn *net.UDPConn, port int, tracked *web.TrackedConn, count func(int)) {
 	buf := make([]byte, 16*1024)
 	readTimeout := 60 * time.Second
 
@@ -454,6 +463,7 @@ func (c *UdpTransport) udpCopy(srcConn, dstConn *net.UDPConn, port int) {
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 				c.logger.Debug("read from UDP timed out")
+				tracked.SetCloseReason("idle timeout")
 				return // Exit on timeout
 			}
 			c.logger.Errorf("failed to read from UDP: %v", err)
@@ -475,6 +485,7 @@ func (c *UdpTransport) udpCopy(srcConn, dstConn *net.UDPConn, port int) {
 		if c.config.Sniffer {
 			c.usageMonitor.AddOrUpdatePort(port, uint64(totalWritten))
 		}
+		count(totalWritten)
 
 		c.logger.Debugf("forwarded %d bytes from %s to %s", n, srcConn.LocalAddr().String(), dstConn.RemoteAddr().String())
 	}
@@ -3,6 +3,7 @@ package transport
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"sync"
 	"sync/atomic"
@@ -23,6 +24,7 @@ type WsTransport struct {
 	cancel          context.CancelFunc
 	logger          *logrus.Logger
 	controlChannel  *websocket.Conn
+	session         *controlSession
 	restartMutex    sync.Mutex
 	usageMonitor    *web.Usage
 	poolConnections int32
@@ -44,6 +46,11 @@ type WsConfig struct {
 	Mode           config.TransportType
 	AggressivePool bool
 	EdgeIP         string
+	TLSConfig      *tls.Config               // client TLS settings for wss
+	Obfuscation    *utils.ObfuscationProfile // handshake paths and headers
+	Relay          RelayFunc                 // hands connections to the next hop instead of dialing them
+	ResumeGrace    time.Duration             // resume a lost control channel, keeping the tunnel connections
+	Coalesce       bool                      // send consecutive reads of a busy connection as one message
 }
 
 func NewWSClient(parentCtx context.Context, config *WsConfig, logger *logrus.Logger, usageMonitor *web.Usage) *WsTransport {
@@ -57,7 +64,8 @@ func NewWSClient(parentCtx context.Context, config *WsConfig, logger *logrus.Log
 		ctx:             ctx,
 		cancel:          cancel,
 		logger:          logger,
-		controlChannel:  nil,          // will be set when a control connection is established
+		controlChannel:  nil, // will be set when a control connection is established
+		session:         newControlSession(config.ResumeGrace),
 		usageMonitor:    usageMonitor, // use the passed-in usageMonitor
 		poolConnections: 0,
 		loadConnections: 0,
@@ -70,6 +78,7 @@ func NewWSClient(parentCtx context.Context, config *WsConfig, logger *logrus.Log
 func (c *WsTransport) Start() {
 	// Do NOT start usageMonitor.Monitor here!
 	c.config.TunnelStatus = fmt.Sprintf("Disconnected (%s)", c.config.Mode)
+	c.usageMonitor.SetPoolSize(func() int { return int(atomic.LoadInt32(&c.poolConnections)) })
 
 	go c.channelDialer()
 
@@ -82,6 +91,7 @@ func (c *WsTransport) Restart() {
 	defer c.restartMutex.Unlock()
 
 	c.logger.Info("restarting client...")
+	c.usageMonitor.Restarting()
 
 	// for removing timeout logs
 	level := c.logger.Level
@@ -90,6 +100,7 @@ func (c *WsTransport) Restart() {
 	if c.cancel != nil {
 		c.cancel()
 	}
+	c.session.reset()
 
 	// close control channel connection
 	if c.controlChannel != nil {
@@ -104,7 +115,7 @@ func (c *WsTransport) Restart() {
 
 	// Re-initialize variables
 	c.controlChannel = nil
-	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
+	// keep the monitor, the web panel serves it
 	c.config.TunnelStatus = ""
 	c.poolConnections = 0
 	c.loadConnections = 0
@@ -124,6 +135,12 @@ func (c *WsTransport) channelDialer() {
 		case <-c.ctx.Done():
 			return
 		default:
+			if c.session.expired() {
+				c.logger.Warn("control channel was not resumed in time, restarting...")
+				go c.Restart()
+				return
+			}
+
 			tunnelWSConn, err := WebSocketDialer(
 				c.ctx,
 				c.config.RemoteAddr,
@@ -132,8 +149,10 @@ func (c *WsTransport) channelDialer() {
 				c.config.DialTimeOut,
 				c.config.KeepAlive,
 				true,
-				c.config.Token,
+				c.session.hello(c.config.Token),
 				c.config.Mode,
+				c.config.TLSConfig,
+				c.config.Obfuscation,
 				3,
 				0,
 				0,
@@ -144,11 +163,39 @@ func (c *WsTransport) channelDialer() {
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
-			c.controlChannel = tunnelWSConn
-			c.logger.Info("control channel established successfully")
 
+			// Clients that can resume get the session id first
+			reply, err := c.session.wsReply(tunnelWSConn, c.config.Token)
+			if err != nil {
+				c.logger.Errorf("failed to receive control channel session: %v", err)
+				tunnelWSConn.Close()
+				time.Sleep(c.config.RetryInterval)
+				continue
+			}
+			lost := c.session.resuming()
+			ok, resumed := c.session.accept(c.config.Token, reply, tunnelWSConn)
+			if !ok {
+				c.logger.Errorf("invalid control channel session received from the server. Retrying...")
+				tunnelWSConn.Close()
+				time.Sleep(c.config.RetryInterval)
+				continue
+			} else if lost && !resumed {
+				c.logger.Warn("server did not resume the control channel, restarting...")
+				tunnelWSConn.Close()
+				go c.Restart()
+				return
+			}
+
+			c.controlChannel = tunnelWSConn
 			c.config.TunnelStatus = fmt.Sprintf("Connected (%s)", c.config.Mode)
+			c.usageMonitor.ControlChannelUp(c.config.TunnelStatus)
+			if resumed {
+				c.logger.Info("control channel resumed")
+				go c.channelHandler()
+				return
+			}
 
+			c.logger.Info("control channel established successfully")
 			go c.poolMaintainer()
 			go c.channelHandler()
 
@@ -227,6 +274,9 @@ func (c *WsTransport) channelHandler() {
 	const baseBackoff = time.Second
 	msgChan := make(chan byte, 1000)
 
+	// A resumed control channel gets a new handler
+	controlChannel := c.controlChannel
+
 	// Goroutine to handle the blocking ReceiveBinaryString with retry/backoff
 	go func() {
 		retries := 0
@@ -235,15 +285,15 @@ func (c *WsTransport) channelHandler() {
 			case <-c.ctx.Done():
 				return
 			default:
-				_, msg, err := c.controlChannel.ReadMessage()
+				_, msg, err := controlChannel.ReadMessage()
 				if err != nil {
 					c.logger.Errorf("failed to read from channel connection (try %d/%d): %v", retries+1, maxRetries, err)
 					retries++
 					if retries >= maxRetries {
 						if c.cancel != nil {
-							c.logger.Error("max retries reached, restarting...")
-							go c.Restart()
+							c.controlChannelLost(controlChannel)
 						}
+						close(msgChan)
 						return
 					}
 					time.Sleep(baseBackoff * time.Duration(retries))
@@ -263,10 +313,14 @@ func (c *WsTransport) channelHandler() {
 	for {
 		select {
 		case <-c.ctx.Done():
-			_ = c.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Closed})
+			_ = controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Closed})
 			return
 
-		case msg := <-msgChan:
+		case msg, ok := <-msgChan:
+			if !ok {
+				return
+			}
+
 			switch msg {
 			case utils.SG_Chan:
 				atomic.AddInt32(&c.loadConnections, 1)
@@ -280,11 +334,12 @@ func (c *WsTransport) channelHandler() {
 
 			case utils.SG_HB:
 				c.logger.Debug("heartbeat signal received successfully")
+				c.usageMonitor.Heartbeat()
 				// send heartbeat back
-				err := c.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_HB})
+				err := controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_HB})
 				if err != nil {
 					c.logger.Errorf("failed to send heartbeat: %v", msg)
-					go c.Restart()
+					c.controlChannelLost(controlChannel)
 					return
 				}
 				c.logger.Trace("heartbeat signal sent successfully")
@@ -303,6 +358,25 @@ func (c *WsTransport) channelHandler() {
 	}
 }
 
+// controlChannelLost dials the control channel again to resume the session, the
+// client restarts if it can't.
+func (c *WsTransport) controlChannelLost(controlChannel *websocket.Conn) {
+	if !c.session.lose(controlChannel) {
+		return
+	}
+	if !c.session.resuming() {
+		c.logger.Error("control channel lost, restarting...")
+		go c.Restart()
+		return
+	}
+
+	c.logger.Warnf("control channel lost, resuming it within %s", c.config.ResumeGrace)
+	controlChannel.Close()
+	c.config.TunnelStatus = fmt.Sprintf("Resuming (%s)", c.config.Mode)
+	c.usageMonitor.Resuming()
+	go c.channelDialer()
+}
+
 func (c *WsTransport) tunnelDialer() {
 	c.logger.Debugf("initiating new websocket tunnel connection to address %s", c.config.RemoteAddr)
 
@@ -317,6 +391,8 @@ func (c *WsTransport) tunnelDialer() {
 		c.config.Nodelay,
 		c.config.Token,
 		c.config.Mode,
+		c.config.TLSConfig,
+		c.config.Obfuscation,
 		3,
 		1024*1024,
 		1024*1024,
@@ -356,7 +432,7 @@ func (c *WsTransport) tunnelDialer() {
 			// Decrement active connections
 			atomic.AddInt32(&c.poolConnections, -1)
 
-			remoteAddr := string(remoteAddrBytes)
+			remoteAddr, source := utils.SplitTarget(string(remoteAddrBytes))
 
 			// Extract the port from the received address
 			port, resolvedAddr, err := ResolveRemoteAddr(remoteAddr)
@@ -366,14 +442,17 @@ func (c *WsTransport) tunnelDialer() {
 				return
 			}
 
-			c.localDialer(tunnelConn, resolvedAddr, port)
+			c.localDialer(tunnelConn, resolvedAddr, source, port)
 			return
 		}
 	}
 }
 
-func (c *WsTransport) localDialer(tunnelCon *websocket.Conn, remoteAddr string, port int) {
-	localConnection, err := TcpDialer(c.ctx, remoteAddr, c.config.DialTimeOut, c.config.KeepAlive, true, 1, 32*1024, 32*1024, c.logger)
+func (c *WsTransport) localDialer(tunnelCon *websocket.Conn, remoteAddr, source string, port int) {
+	if source == "" {
+		source = c.config.RemoteAddr
+	}
+	localConnection, err := dialTarget(c.ctx, c.config.Relay, remoteAddr, source, c.config.DialTimeOut, c.config.KeepAlive, c.logger)
 	if err != nil {
 		c.logger.Errorf("local dialer: %v", err)
 		tunnelCon.Close()
@@ -381,5 +460,8 @@ func (c *WsTransport) localDialer(tunnelCon *websocket.Conn, remoteAddr string,
 	}
 	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
 
-	utils.WSConnectionHandler(tunnelCon, localConnection, c.logger, c.usageMonitor, int(port), c.config.Sniffer)
+	tracked := c.usageMonitor.TrackConnection("ws", source, remoteAddr, port, func() { localConnection.Close() })
+	defer tracked.Done()
+
+	utils.WSConnectionHandler(tunnelCon, tracked.TargetConn(localConnection), c.logger, c.usageMonitor, int(port), c.config.Sniffer, c.config.Coalesce)
 }
@@ -2,6 +2,7 @@ package transport
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"sync"
 	"sync/atomic"
@@ -24,6 +25,7 @@ type WsMuxTransport struct {
 	cancel          context.CancelFunc
 	logger          *logrus.Logger
 	controlChannel  *websocket.Conn
+	session         *controlSession
 	usageMonitor    *web.Usage
 	restartMutex    sync.Mutex
 	poolConnections int32
@@ -49,6 +51,10 @@ type WsMuxConfig struct {
 	Mode             config.TransportType
 	AggressivePool   bool
 	EdgeIP           string
+	TLSConfig        *tls.Config               // client TLS settings for wssmux
+	Obfuscation      *utils.ObfuscationProfile // handshake paths and headers
+	Relay            RelayFunc                 // hands connections to the next hop instead of dialing them
+	ResumeGrace      time.Duration             // resume a lost control channel, keeping the mux sessions
 }
 
 func NewWSMuxClient(parentCtx context.Context, config *WsMuxConfig, logger *logrus.Logger, usageMonitor *web.Usage) *WsMuxTransport {
@@ -69,6 +75,7 @@ func NewWSMuxClient(parentCtx context.Context, config *WsMuxConfig, logger *logr
 		cancel:          cancel,
 		logger:          logger,
 		controlChannel:  nil,
+		session:         newControlSession(config.ResumeGrace),
 		usageMonitor:    usageMonitor, // use the passed-in usageMonitor
 		poolConnections: 0,
 		loadConnections: 0,
@@ -81,6 +88,7 @@ func NewWSMuxClient(parentCtx context.Context, config *WsMuxConfig, logger *logr
 func (c *WsMuxTransport) Start() {
 	// Do NOT start usageMonitor.Monitor here!
 	c.config.TunnelStatus = fmt.Sprintf("Disconnected (%s)", c.config.Mode)
+	c.usageMonitor.SetPoolSize(func() int { return int(atomic.LoadInt32(&c.poolConnections)) })
 	go c.channelDialer()
 }
 
@@ -92,6 +100,7 @@ func (c *WsMuxTransport) Restart() {
 	defer c.restartMutex.Unlock()
 
 	c.logger.Info("restarting client...")
+	c.usageMonitor.Restarting()
 
 	// for removing timeout logs
 	level := c.logger.Level
@@ -100,6 +109,7 @@ func (c *WsMuxTransport) Restart() {
 	if c.cancel != nil {
 		c.cancel()
 	}
+	c.session.reset()
 
 	// close control channel connection
 	if c.controlChannel != nil {
@@ -114,7 +124,7 @@ func (c *WsMuxTransport) Restart() {
 
 	// Re-initialize variables
 	c.controlChannel = nil
-	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
+	// keep the monitor, the web panel serves it
 	c.config.TunnelStatus = ""
 	c.poolConnections = 0
 	c.loadConnections = 0
@@ -136,6 +146,12 @@ func (c *WsMuxTransport) channelDialer() {
 		case <-c.ctx.Done():
 			return
 		default:
+			if c.session.expired() {
+				c.logger.Warn("control channel was not resumed in time, restarting...")
+				go c.Restart()
+				return
+			}
+
 			tunnelWSConn, err := WebSocketDialer(
 				c.ctx,
 				c.config.RemoteAddr,
@@ -144,8 +160,10 @@ func (c *WsMuxTransport) channelDialer() {
 				c.config.DialTimeOut,
 				c.config.KeepAlive,
 				true,
-				c.config.Token,
+				c.session.hello(c.config.Token),
 				c.config.Mode,
+				c.config.TLSConfig,
+				c.config.Obfuscation,
 				3,
 				0,
 				0,
@@ -156,11 +174,39 @@ func (c *WsMuxTransport) channelDialer() {
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
-			c.controlChannel = tunnelWSConn
-			c.logger.Info("control channel established successfully")
 
+			// Clients that can resume get the session id first
+			reply, err := c.session.wsReply(tunnelWSConn, c.config.Token)
+			if err != nil {
+				c.logger.Errorf("failed to receive control channel session: %v", err)
+				tunnelWSConn.Close()
+				time.Sleep(c.config.RetryInterval)
+				continue
+			}
+			lost := c.session.resuming()
+			ok, resumed := c.session.accept(c.config.Token, reply, tunnelWSConn)
+			if !ok {
+				c.logger.Errorf("invalid control channel session received from the server. Retrying...")
+				tunnelWSConn.Close()
+				time.Sleep(c.config.RetryInterval)
+				continue
+			} else if lost && !resumed {
+				c.logger.Warn("server did not resume the control channel, restarting...")
+				tunnelWSConn.Close()
+				go c.Restart()
+				return
+			}
+
+			c.controlChannel = tunnelWSConn
 			c.config.TunnelStatus = fmt.Sprintf("Connected (%s)", c.config.Mode)
+			c.usageMonitor.ControlChannelUp(c.config.TunnelStatus)
+			if resumed {
+				c.logger.Info("control channel resumed")
+				go c.channelHandler()
+				return
+			}
 
+			c.logger.Info("control channel established successfully")
 			go c.poolMaintainer()
 			go c.channelHandler()
 
@@ -239,6 +285,9 @@ func (c *WsMuxTransport) channelHandler() {
 	const baseBackoff = time.Second
 	msgChan := make(chan byte, 1000)
 
+	// A resumed control channel gets a new handler
+	controlChannel := c.controlChannel
+
 	// Goroutine to handle the blocking ReceiveBinaryString with retry/backoff
 	go func() {
 		retries := 0
@@ -247,15 +296,15 @@ func (c *WsMuxTransport) channelHandler() {
 			case <-c.ctx.Done():
 				return
 			default:
-				_, msg, err := c.controlChannel.ReadMessage()
+				_, msg, err := controlChannel.ReadMessage()
 				if err != nil {
 					c.logger.Errorf("failed to read from channel connection (try %d/%d): %v", retries+1, maxRetries, err)
 					retries++
 					if retries >= maxRetries {
 						if c.cancel != nil {
-							c.logger.Error("max retries reached, restarting...")
-							go c.Restart()
+							c.controlChannelLost(controlChannel)
 						}
+						close(msgChan)
 						return
 					}
 					time.Sleep(baseBackoff * time.Duration(retries))
@@ -274,10 +323,14 @@ func (c *WsMuxTransport) channelHandler() {
 	for {
 		select {
 		case <-c.ctx.Done():
-			_ = c.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Closed})
+			_ = controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Closed})
 			return
 
-		case msg := <-msgChan:
+		case msg, ok := <-msgChan:
+			if !ok {
+				return
+			}
+
 			switch msg {
 			case utils.SG_Chan:
 				atomic.AddInt32(&c.loadConnections, 1)
@@ -291,10 +344,11 @@ func (c *WsMuxTransport) channelHandler() {
 
 			case utils.SG_HB:
 				c.logger.Debug("heartbeat received successfully")
-				err := c.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_HB})
+				c.usageMonitor.Heartbeat()
+				err := controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_HB})
 				if err != nil {
 					c.logger.Errorf("failed to send heartbeat: %v", msg)
-					go c.Restart()
+					c.controlChannelLost(controlChannel)
 					return
 				}
 				c.logger.Trace("heartbeat signal sent successfully")
@@ -314,6 +368,25 @@ func (c *WsMuxTransport) channelHandler() {
 	}
 }
 
+// controlChannelLost dials the control channel again to resume the session, the
+// client restarts if it can't.
+func (c *WsMuxTransport) controlChannelLost(controlChannel *websocket.Conn) {
+	if !c.session.lose(controlChannel) {
+		return
+	}
+	if !c.session.resuming() {
+		c.logger.Error("control channel lost, restarting...")
+		go c.Restart()
+		return
+	}
+
+	c.logger.Warnf("control channel lost, resuming it within %s", c.config.ResumeGrace)
+	controlChannel.Close()
+	c.config.TunnelStatus = fmt.Sprintf("Resuming (%s)", c.config.Mode)
+	c.usageMonitor.Resuming()
+	go c.channelDialer()
+}
+
 func (c *WsMuxTransport) tunnelDialer() {
 	c.logger.Debugf("initiating new %s tunnel connection to address %s", c.config.Mode, c.config.RemoteAddr)
 
@@ -328,6 +401,8 @@ func (c *WsMuxTransport) tunnelDialer() {
 		c.config.Nodelay,
 		c.config.Token,
 		c.config.Mode,
+		c.config.TLSConfig,
+		c.config.Obfuscation,
 		3,
 		2*1024*1024,
 		2*1024*1024,
@@ -351,7 +426,7 @@ func (c *WsMuxTransport) handleSession(tunnelConn *websocket.Conn) {
 	}()
 
 	// SMUX server
-	session, err := smux.Server(tunnelConn.NetConn(), c.smuxConfig)
+	session, err := smux.Server(utils.WSMuxConn(tunnelConn), c.smuxConfig)
 	if err != nil {
 		c.logger.Errorf("failed to create mux session: %v", err)
 		return
@@ -383,14 +458,18 @@ func (c *WsMuxTransport) handleSession(tunnelConn *websocket.Conn) {
 
 func (c *WsMuxTransport) localDialer(stream *smux.Stream, remoteAddr string) {
 	// Extract the port from the received address
+	remoteAddr, source := utils.SplitTarget(remoteAddr)
 	port, resolvedAddr, err := ResolveRemoteAddr(remoteAddr)
 	if err != nil {
 		c.logger.Infof("failed to resolve remote port: %v", err)
 		stream.Close()
 		return
 	}
+	if source == "" {
+		source = c.config.RemoteAddr
+	}
 
-	localConnection, err := TcpDialer(c.ctx, resolvedAddr, c.config.DialTimeOut, c.config.KeepAlive, true, 1, 32*1024, 32*1024, c.logger)
+	localConnection, err := dialTarget(c.ctx, c.config.Relay, resolvedAddr, source, c.config.DialTimeOut, c.config.KeepAlive, c.logger)
 	if err != nil {
 		c.logger.Errorf("local dialer: %v", err)
 		stream.Close()
@@ -399,5 +478,8 @@ func (c *WsMuxTransport) localDialer(stream *smux.Stream, remoteAddr string) {
 
 	c.logger.Debugf("connected to local address %s successfully", remoteAddr)
 
-	utils.TCPConnectionHandler(stream, localConnection, c.logger, c.usageMonitor, int(port), c.config.Sniffer)
+	tracked := c.usageMonitor.TrackConnection("wsmux", source, resolvedAddr, port, func() { localConnection.Close() })
+	defer tracked.Done()
+
+	utils.TCPConnectionHandler(stream, tracked.TargetConn(localConnection), c.logger, c.usageMonitor, int(port), c.config.Sniffer)
 }
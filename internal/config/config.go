@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 // TransportType defines the type of transport.
 type TransportType string
 
@@ -19,9 +21,12 @@ type ServerConfig struct {
 	BindAddr         string        `toml:"bind_addr"`
 	Transport        TransportType `toml:"transport"`
 	Token            string        `toml:"token"`
+	TokenFile        string        `toml:"token_file"` // read the token from this file instead
+	Tokens           []TokenConfig `toml:"tokens"`     // additional tokens, for rotation
 	Nodelay          bool          `toml:"nodelay"`
 	Keepalive        int           `toml:"keepalive_period"`
 	LogLevel         string        `toml:"log_level"`
+	Name             string        `toml:"-"` // name of the [[tunnel]] entry, prefixes the log
 	Ports            []string      `toml:"ports"`
 	PPROF            bool          `toml:"pprof"`
 	MuxSession       int           `toml:"mux_session"`
@@ -34,10 +39,61 @@ type ServerConfig struct {
 	SnifferLog       string        `toml:"sniffer_log"`
 	TLSCertFile      string        `toml:"tls_cert"`
 	TLSKeyFile       string        `toml:"tls_key"`
+	TLSClientCA      string        `toml:"tls_client_ca"`    // require client certificates signed by this CA
+	TLSACMEDomains   []string      `toml:"tls_acme_domains"` // enables ACME certificate management
+	TLSACMEEmail     string        `toml:"tls_acme_email"`
+	TLSACMEDirectory string        `toml:"tls_acme_directory"` // default: Let's Encrypt
+	TLSACMECache     string        `toml:"tls_acme_cache"`
+	TLSACMECA        string        `toml:"tls_acme_ca"`        // CA bundle of the ACME directory (e.g. pebble)
+	TLSACMEHTTPAddr  string        `toml:"tls_acme_http_addr"` // optional extra HTTP-01 listener, e.g. ":80"
+	TLSExpiryWarn    int           `toml:"tls_expiry_warn"`    // days before certificate expiry to start warning
 	Heartbeat        int           `toml:"heartbeat"`
 	MuxCon           int           `toml:"mux_con"`
 	AcceptUDP        bool          `toml:"accept_udp"`
+	SourceMetadata   bool          `toml:"source_metadata"` // send the user's address with each connection, needs an up to date client
+	ResumeGrace      int           `toml:"resume_grace"`    // seconds a lost control channel may be resumed, 0 restarts at once
+	AcceptShards     int           `toml:"accept_shards"`   // SO_REUSEPORT listeners per forwarded port (linux), 0 or 1 opens one
+	WSCoalesce       bool          `toml:"ws_coalesce"`     // ws(s): send consecutive reads of a busy connection as one message
+	DecoyUpstream    string        `toml:"decoy_upstream"`  // reverse proxy unauthenticated ws requests here
+	DecoyDir         string        `toml:"decoy_dir"`       // or serve them from this directory
 	ChannelSize      int           // Managed by tuner
+
+	// Transparent proxy (linux)
+	Transparent     string `toml:"transparent"`      // "redirect" or "tproxy", forward the traffic redirected to transparent_addr
+	TransparentAddr string `toml:"transparent_addr"` // where the firewall redirects the traffic to
+	TransparentHost string `toml:"transparent_host"` // forward the original port to this host instead of the original address
+
+	// Web panel access
+	WebBind             string   `toml:"web_bind"` // listen address of the panel, all interfaces when empty
+	WebTLS              bool     `toml:"web_tls"`  // serve the panel over HTTPS with tls_cert/tls_key
+	WebPassword         string   `toml:"web_password"`
+	WebReadOnlyPassword string   `toml:"web_readonly_password"`
+	WebTokens           []string `toml:"web_tokens"`
+	WebReadOnlyTokens   []string `toml:"web_readonly_tokens"`
+
+	// Access log of forwarded connections (JSON lines), disabled when empty
+	AccessLog           string `toml:"access_log"`
+	AccessLogMaxSize    int    `toml:"access_log_max_size"`    // MB before the file is rotated
+	AccessLogMaxBackups int    `toml:"access_log_max_backups"` // rotated files to keep
+
+	// Readiness thresholds of /readyz
+	ReadyMinPool          int `toml:"ready_min_pool"`          // idle tunnel connections required, 0 disables the check
+	ReadyHeartbeatTimeout int `toml:"ready_heartbeat_timeout"` // seconds without heartbeat before not ready
+
+	// Webhook notifications of tunnel events, disabled without URLs
+	Webhooks       []string `toml:"webhooks"`
+	WebhookSecret  string   `toml:"webhook_secret"`  // signs the body with HMAC-SHA256 when set
+	WebhookEvents  []string `toml:"webhook_events"`  // events to send, all when empty
+	WebhookRetries int      `toml:"webhook_retries"` // attempts after a failed delivery
+	PortQuota      int      `toml:"port_quota"`      // MB of sniffer usage per forwarded port before quota_reached, 0 disables
+
+	// Banning of hosts that fail authentication, disabled when ban_threshold is 0
+	BanThreshold int      `toml:"ban_threshold"` // failed authentications within ban_window
+	BanWindow    int      `toml:"ban_window"`    // seconds
+	BanDuration  int      `toml:"ban_duration"`  // seconds
+	BanWhitelist []string `toml:"ban_whitelist"` // IPs or CIDRs that are never banned
+
+	Obfuscation ObfuscationConfig `toml:"obfuscation"` // [server.obfuscation]
 }
 
 // ClientConfig represents the configuration for the client.
@@ -45,10 +101,12 @@ type ClientConfig struct {
 	RemoteAddr       string        `toml:"remote_addr"`
 	Transport        TransportType `toml:"transport"`
 	Token            string        `toml:"token"`
+	TokenFile        string        `toml:"token_file"` // read the token from this file instead
 	RetryInterval    int           `toml:"retry_interval"`
 	Nodelay          bool          `toml:"nodelay"`
 	Keepalive        int           `toml:"keepalive_period"`
 	LogLevel         string        `toml:"log_level"`
+	Name             string        `toml:"-"` // name of the [[tunnel]] entry, prefixes the log
 	PPROF            bool          `toml:"pprof"`
 	MuxSession       int           `toml:"mux_session"`
 	MuxVersion       int           `toml:"mux_version"`
@@ -60,12 +118,83 @@ type ClientConfig struct {
 	SnifferLog       string        `toml:"sniffer_log"`
 	DialTimeout      int           `toml:"dial_timeout"`
 	AggressivePool   bool          `toml:"aggressive_pool"`
+	ResumeGrace      int           `toml:"resume_grace"` // seconds to resume a lost control channel, 0 restarts at once
+	WSCoalesce       bool          `toml:"ws_coalesce"`  // ws(s): send consecutive reads of a busy connection as one message
 	EdgeIP           string        `toml:"edge_ip"`
+	TLSCertFile      string        `toml:"tls_cert"` // client certificate for mutual TLS
+	TLSKeyFile       string        `toml:"tls_key"`
+	TLSCAFile        string        `toml:"tls_ca"` // CA bundle to verify the server certificate
+	TLSServerName    string        `toml:"tls_server_name"`
+	TLSPins          []string      `toml:"tls_pins"` // SPKI pins of the server certificate
 	ConnectionPool   int           // Managed by tuner
+
+	// Web panel access
+	WebBind             string   `toml:"web_bind"` // listen address of the panel, all interfaces when empty
+	WebTLS              bool     `toml:"web_tls"`  // serve the panel over HTTPS with tls_cert/tls_key
+	WebPassword         string   `toml:"web_password"`
+	WebReadOnlyPassword string   `toml:"web_readonly_password"`
+	WebTokens           []string `toml:"web_tokens"`
+	WebReadOnlyTokens   []string `toml:"web_readonly_tokens"`
+
+	// Config sync with the server panel
+	ServerWebToken string `toml:"server_web_token"` // read-only token of the server panel, nothing is sent when empty
+	ServerWebTLS   bool   `toml:"server_web_tls"`   // the server panel is served over HTTPS (web_tls)
+
+	// Access log of forwarded connections (JSON lines), disabled when empty
+	AccessLog           string `toml:"access_log"`
+	AccessLogMaxSize    int    `toml:"access_log_max_size"`    // MB before the file is rotated
+	AccessLogMaxBackups int    `toml:"access_log_max_backups"` // rotated files to keep
+
+	// Readiness thresholds of /readyz
+	ReadyMinPool          int `toml:"ready_min_pool"`          // idle tunnel connections required, 0 disables the check
+	ReadyHeartbeatTimeout int `toml:"ready_heartbeat_timeout"` // seconds without heartbeat before not ready
+
+	// Webhook notifications of tunnel events, disabled without URLs
+	Webhooks       []string `toml:"webhooks"`
+	WebhookSecret  string   `toml:"webhook_secret"`  // signs the body with HMAC-SHA256 when set
+	WebhookEvents  []string `toml:"webhook_events"`  // events to send, all when empty
+	WebhookRetries int      `toml:"webhook_retries"` // attempts after a failed delivery
+
+	Obfuscation ObfuscationConfig `toml:"obfuscation"` // [client.obfuscation]
+}
+
+// TokenConfig is an additional token accepted by the server ([[server.tokens]]).
+type TokenConfig struct {
+	Token   string    `toml:"token"`
+	Expires time.Time `toml:"expires"` // not accepted after this time, never expires when unset
+}
+
+// ObfuscationConfig customizes the websocket handshake ([server.obfuscation] / [client.obfuscation]).
+// Both sides must use the same paths.
+type ObfuscationConfig struct {
+	Enabled    *bool             `toml:"enabled"` // pointer: default true if nil
+	Paths      []string          `toml:"paths"`
+	Headers    map[string]string `toml:"headers"`
+	UserAgents []string          `toml:"user_agents"`
+	Host       string            `toml:"host"`
 }
 
 // Config represents the complete configuration, including both server and client settings.
 type Config struct {
+	Server  *ServerConfig  `toml:"server"`
+	Client  *ClientConfig  `toml:"client"`
+	Relay   *RelayConfig   `toml:"relay"`
+	Tunnels []TunnelConfig `toml:"tunnel"` // several tunnels in one process, instead of [server]/[client]
+}
+
+// RelayConfig chains two hops: Client connects to the upstream server, the
+// connections it receives are handed to the clients of Server, which has no
+// ports of its own. The hops may use different transports.
+type RelayConfig struct {
+	Server *ServerConfig `toml:"server"` // [relay.server], downstream
+	Client *ClientConfig `toml:"client"` // [relay.client], upstream
+}
+
+// TunnelConfig is one [[tunnel]] entry, a server, client or relay with its own
+// transport, ports, web panel and log prefix.
+type TunnelConfig struct {
+	Name   string        `toml:"name"`
 	Server *ServerConfig `toml:"server"`
 	Client *ClientConfig `toml:"client"`
+	Relay  *RelayConfig  `toml:"relay"`
 }
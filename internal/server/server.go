@@ -2,8 +2,10 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"sync/atomic"
 	"time"
 
 	"github.com/musix/backhaul/internal/config"
@@ -19,6 +21,15 @@ type Server struct {
 	ctx    context.Context
 	cancel context.CancelFunc
 	logger *logrus.Logger
+	tokens *utils.TokenSet
+
+	// forwarder is the running transport, it carries the connections of Dial
+	forwarder atomic.Value
+
+	// lifecycle tells Start whether the transport listens, failed receives the
+	// error the transport stopped with after that
+	lifecycle *transport.Lifecycle
+	failed    chan error
 }
 
 // پیاده‌سازی ConfigProvider
@@ -33,52 +44,127 @@ func (s *Server) GetClientConfig() *config.ClientConfig {
 
 func NewServer(cfg *config.ServerConfig, parentCtx context.Context) *Server {
 	ctx, cancel := context.WithCancel(parentCtx)
-	return &Server{
+	s := &Server{
 		config: cfg,
 		ctx:    ctx,
 		cancel: cancel,
-		logger: utils.NewLogger(cfg.LogLevel),
+		logger: utils.NewNamedLogger(cfg.LogLevel, cfg.Name),
+		tokens: utils.NewTokenSet(tokenEntries(cfg)),
+		failed: make(chan error, 1),
+	}
+	s.lifecycle = transport.NewLifecycle(s.fail)
+	return s
+}
+
+// tokenEntries returns token and the [[server.tokens]] entries.
+func tokenEntries(cfg *config.ServerConfig) []utils.TokenEntry {
+	entries := []utils.TokenEntry{{Token: cfg.Token}}
+	for _, token := range cfg.Tokens {
+		entries = append(entries, utils.TokenEntry{Token: token.Token, Expires: token.Expires})
 	}
+	return entries
+}
+
+// Dial connects to target through the tunnel as if a user at source had
+// connected to a local port, it is used by a relay to hand over the streams of
+// its upstream. Only TCP transports can carry relayed connections.
+func (s *Server) Dial(target, source string) (net.Conn, error) {
+	forwarder, ok := s.forwarder.Load().(transport.Forwarder)
+	if !ok {
+		return nil, fmt.Errorf("transport %s can not relay connections", s.config.Transport)
+	}
+	return transport.Relay(forwarder, target, source)
+}
+
+// UpdateTokens applies the tokens of cfg to the running transport, established
+// tunnels are kept.
+func (s *Server) UpdateTokens(cfg *config.ServerConfig) {
+	s.tokens.Update(tokenEntries(cfg))
+	s.logger.Infof("tunnel tokens updated, %d valid", s.tokens.Len())
 }
 
-func (s *Server) Start() {
+// Start runs the transport in the background and returns once it listens on
+// bind_addr, or with the error the server failed to start with.
+func (s *Server) Start() error {
+	panel, err := s.panelConfig()
+	if err != nil {
+		return err
+	}
+	accessLog, err := s.accessLog()
+	if err != nil {
+		return err
+	}
+	bans, err := s.banList()
+	if err != nil {
+		return err
+	}
+	webhooks, err := s.webhooks()
+	if err != nil {
+		return err
+	}
+
 	// ثبت provider برای web panel
-	web.SetConfigProvider(s)
+	tunnel := web.TunnelFrom(s.ctx)
+	tunnel.SetConfigProvider(s)
+	tunnel.SetPanelConfig(panel)
+	tunnel.SetAccessLog(accessLog)
+	tunnel.SetBanList(bans)
+	tunnel.SetPortQuota(web.NewPortQuota(uint64(s.config.PortQuota) * 1024 * 1024))
+	tunnel.SetReadiness(web.Readiness{
+		HeartbeatTimeout: time.Duration(s.config.ReadyHeartbeatTimeout) * time.Second,
+		MinPool:          s.config.ReadyMinPool,
+	})
+	notifier := utils.NewSystemdNotifier(time.Duration(s.config.ReadyHeartbeatTimeout)*time.Second, s.logger)
+	notifier.Start(s.ctx)
+	if webhooks != nil {
+		webhooks.Start(s.ctx)
+		tunnel.SetTunnelObservers(notifier, webhooks)
+	} else {
+		tunnel.SetTunnelObservers(notifier)
+	}
 	// for pprof and debugging
 	if s.config.PPROF {
-		go func() {
-			s.logger.Info("pprof started at port 6060")
-			http.ListenAndServe("0.0.0.0:6060", nil)
-		}()
+		utils.StartPprof("0.0.0.0:6060", s.logger)
 	}
 
 	switch s.config.Transport {
 	case config.TCP:
 		tcpConfig := &transport.TcpConfig{
-			BindAddr:    s.config.BindAddr,
-			Nodelay:     s.config.Nodelay,
-			KeepAlive:   time.Duration(s.config.Keepalive) * time.Second,
-			Heartbeat:   time.Duration(s.config.Heartbeat) * time.Second,
-			Token:       s.config.Token,
-			ChannelSize: s.config.ChannelSize,
-			Ports:       s.config.Ports,
-			Sniffer:     *s.config.Sniffer,
-			WebPort:     s.config.WebPort,
-			SnifferLog:  s.config.SnifferLog,
-			AcceptUDP:   s.config.AcceptUDP,
+			Lifecycle:      s.lifecycle,
+			BindAddr:       s.config.BindAddr,
+			Nodelay:        s.config.Nodelay,
+			KeepAlive:      time.Duration(s.config.Keepalive) * time.Second,
+			Heartbeat:      time.Duration(s.config.Heartbeat) * time.Second,
+			Tokens:         s.tokens,
+			SourceMetadata: s.config.SourceMetadata,
+			ResumeGrace:    time.Duration(s.config.ResumeGrace) * time.Second,
+			ChannelSize:    s.config.ChannelSize,
+			Transparent:    s.transparentProxy(),
+			AcceptShards:   s.config.AcceptShards,
+			Ports:          s.config.Ports,
+			Sniffer:        *s.config.Sniffer,
+			WebPort:        s.config.WebPort,
+			SnifferLog:     s.config.SnifferLog,
+			AcceptUDP:      s.config.AcceptUDP,
 		}
 
 		tcpServer := transport.NewTCPServer(s.ctx, tcpConfig, s.logger)
+		s.forwarder.Store(tcpServer)
 		go tcpServer.Start()
 
 	case config.TCPMUX:
 		tcpMuxConfig := &transport.TcpMuxConfig{
+			Lifecycle:        s.lifecycle,
 			BindAddr:         s.config.BindAddr,
 			Nodelay:          s.config.Nodelay,
 			KeepAlive:        time.Duration(s.config.Keepalive) * time.Second,
 			Heartbeat:        time.Duration(s.config.Heartbeat) * time.Second,
-			Token:            s.config.Token,
+			Tokens:           s.tokens,
+			SourceMetadata:   s.config.SourceMetadata,
+			ResumeGrace:      time.Duration(s.config.ResumeGrace) * time.Second,
 			ChannelSize:      s.config.ChannelSize,
+			Transparent:      s.transparentProxy(),
+			AcceptShards:     s.config.AcceptShards,
 			Ports:            s.config.Ports,
 			MuxCon:           s.config.MuxCon,
 			MuxVersion:       s.config.MuxVersion,
@@ -91,36 +177,62 @@ func (s *Server) Start() {
 		}
 
 		tcpMuxServer := transport.NewTcpMuxServer(s.ctx, tcpMuxConfig, s.logger)
+		s.forwarder.Store(tcpMuxServer)
 		go tcpMuxServer.Start()
 
 	case config.WS, config.WSS:
+		decoy, err := s.decoyHandler()
+		if err != nil {
+			return err
+		}
 		wsConfig := &transport.WsConfig{
-			BindAddr:    s.config.BindAddr,
-			Nodelay:     s.config.Nodelay,
-			KeepAlive:   time.Duration(s.config.Keepalive) * time.Second,
-			Heartbeat:   time.Duration(s.config.Heartbeat) * time.Second,
-			Token:       s.config.Token,
-			ChannelSize: s.config.ChannelSize,
-			Ports:       s.config.Ports,
-			Sniffer:     *s.config.Sniffer,
-			WebPort:     s.config.WebPort,
-			SnifferLog:  s.config.SnifferLog,
-			Mode:        s.config.Transport,
-			TLSCertFile: s.config.TLSCertFile,
-			TLSKeyFile:  s.config.TLSKeyFile,
+			Lifecycle:      s.lifecycle,
+			BindAddr:       s.config.BindAddr,
+			Nodelay:        s.config.Nodelay,
+			KeepAlive:      time.Duration(s.config.Keepalive) * time.Second,
+			Heartbeat:      time.Duration(s.config.Heartbeat) * time.Second,
+			Tokens:         s.tokens,
+			SourceMetadata: s.config.SourceMetadata,
+			ResumeGrace:    time.Duration(s.config.ResumeGrace) * time.Second,
+			Coalesce:       s.config.WSCoalesce,
+			ChannelSize:    s.config.ChannelSize,
+			Transparent:    s.transparentProxy(),
+			AcceptShards:   s.config.AcceptShards,
+			Ports:          s.config.Ports,
+			Sniffer:        *s.config.Sniffer,
+			WebPort:        s.config.WebPort,
+			SnifferLog:     s.config.SnifferLog,
+			Mode:           s.config.Transport,
+			TLSCertFile:    s.config.TLSCertFile,
+			TLSKeyFile:     s.config.TLSKeyFile,
+			TLSClientCA:    s.config.TLSClientCA,
+			ACME:           s.acmeConfig(),
+			TLSExpiryWarn:  s.config.TLSExpiryWarn,
+			Obfuscation:    utils.NewObfuscationProfile(s.config.Obfuscation),
+			Decoy:          decoy,
 		}
 
 		wsServer := transport.NewWSServer(s.ctx, wsConfig, s.logger)
+		s.forwarder.Store(wsServer)
 		go wsServer.Start()
 
 	case config.WSMUX, config.WSSMUX:
+		decoy, err := s.decoyHandler()
+		if err != nil {
+			return err
+		}
 		wsMuxConfig := &transport.WsMuxConfig{
+			Lifecycle:        s.lifecycle,
 			BindAddr:         s.config.BindAddr,
 			Nodelay:          s.config.Nodelay,
 			KeepAlive:        time.Duration(s.config.Keepalive) * time.Second,
 			Heartbeat:        time.Duration(s.config.Heartbeat) * time.Second,
-			Token:            s.config.Token,
+			Tokens:           s.tokens,
+			SourceMetadata:   s.config.SourceMetadata,
+			ResumeGrace:      time.Duration(s.config.ResumeGrace) * time.Second,
 			ChannelSize:      s.config.ChannelSize,
+			Transparent:      s.transparentProxy(),
+			AcceptShards:     s.config.AcceptShards,
 			Ports:            s.config.Ports,
 			MuxCon:           s.config.MuxCon,
 			MuxVersion:       s.config.MuxVersion,
@@ -133,37 +245,51 @@ func (s *Server) Start() {
 			Mode:             s.config.Transport,
 			TLSCertFile:      s.config.TLSCertFile,
 			TLSKeyFile:       s.config.TLSKeyFile,
+			TLSClientCA:      s.config.TLSClientCA,
+			ACME:             s.acmeConfig(),
+			TLSExpiryWarn:    s.config.TLSExpiryWarn,
+			Obfuscation:      utils.NewObfuscationProfile(s.config.Obfuscation),
+			Decoy:            decoy,
 		}
 
 		wsMuxServer := transport.NewWSMuxServer(s.ctx, wsMuxConfig, s.logger)
+		s.forwarder.Store(wsMuxServer)
 		go wsMuxServer.Start()
 
 	case config.QUIC:
 		quicConfig := &transport.QuicConfig{
-			BindAddr:    s.config.BindAddr,
-			Nodelay:     s.config.Nodelay,
-			KeepAlive:   time.Duration(s.config.Keepalive) * time.Second,
-			Heartbeat:   time.Duration(s.config.Heartbeat) * time.Second,
-			Token:       s.config.Token,
-			MuxCon:      s.config.MuxCon,
-			ChannelSize: s.config.ChannelSize,
-			Ports:       s.config.Ports,
-			Sniffer:     *s.config.Sniffer,
-			WebPort:     s.config.WebPort,
-			SnifferLog:  s.config.SnifferLog,
-			TLSCertFile: s.config.TLSCertFile,
-			TLSKeyFile:  s.config.TLSKeyFile,
+			Lifecycle:      s.lifecycle,
+			BindAddr:       s.config.BindAddr,
+			Nodelay:        s.config.Nodelay,
+			KeepAlive:      time.Duration(s.config.Keepalive) * time.Second,
+			Heartbeat:      time.Duration(s.config.Heartbeat) * time.Second,
+			Tokens:         s.tokens,
+			SourceMetadata: s.config.SourceMetadata,
+			MuxCon:         s.config.MuxCon,
+			ChannelSize:    s.config.ChannelSize,
+			Ports:          s.config.Ports,
+			Sniffer:        *s.config.Sniffer,
+			WebPort:        s.config.WebPort,
+			SnifferLog:     s.config.SnifferLog,
+			TLSCertFile:    s.config.TLSCertFile,
+			TLSKeyFile:     s.config.TLSKeyFile,
+			TLSClientCA:    s.config.TLSClientCA,
+			ACME:           s.acmeConfig(),
+			TLSExpiryWarn:  s.config.TLSExpiryWarn,
 		}
 
 		quicServer := transport.NewQuicServer(s.ctx, quicConfig, s.logger)
+		s.forwarder.Store(quicServer)
 		go quicServer.TunnelListener()
 
 	case config.UDP:
 		udpConfig := &transport.UdpConfig{
+			Lifecycle:   s.lifecycle,
 			BindAddr:    s.config.BindAddr,
 			Heartbeat:   time.Duration(s.config.Heartbeat) * time.Second,
-			Token:       s.config.Token,
+			Tokens:      s.tokens,
 			ChannelSize: s.config.ChannelSize,
+			Transparent: s.transparentProxy(),
 			Ports:       s.config.Ports,
 			Sniffer:     *s.config.Sniffer,
 			WebPort:     s.config.WebPort,
@@ -174,15 +300,136 @@ func (s *Server) Start() {
 		go udpServer.Start()
 
 	default:
-		s.logger.Fatal("invalid transport type: ", s.config.Transport)
+		return fmt.Errorf("invalid transport type: %s", s.config.Transport)
+	}
+
+	go func() {
+		<-s.ctx.Done()
+
+		s.logger.Info("all workers stopped successfully")
+
+		// suppress other logs
+		s.logger.SetLevel(logrus.FatalLevel)
+	}()
+
+	return s.lifecycle.Started(s.ctx)
+}
+
+// fail stops the tunnel after its transport failed with err, the other tunnels
+// of the process keep running.
+func (s *Server) fail(err error) {
+	web.NotifyTunnelDown(s.ctx, err.Error())
+	s.failed <- err
+	s.cancel()
+}
+
+// Failed receives the error the transport stopped with once it runs, a failure
+// to start is returned by Start.
+func (s *Server) Failed() <-chan error {
+	return s.failed
+}
+
+// acmeConfig returns the ACME settings, or nil when no domain is configured
+func (s *Server) acmeConfig() *utils.ACMEConfig {
+	if len(s.config.TLSACMEDomains) == 0 {
+		return nil
+	}
+	return &utils.ACMEConfig{
+		Domains:      s.config.TLSACMEDomains,
+		Email:        s.config.TLSACMEEmail,
+		DirectoryURL: s.config.TLSACMEDirectory,
+		CacheDir:     s.config.TLSACMECache,
+		CAFile:       s.config.TLSACMECA,
+		HTTPAddr:     s.config.TLSACMEHTTPAddr,
+	}
+}
+
+// transparentProxy returns the transparent proxy settings, nil if it is off.
+func (s *Server) transparentProxy() *transport.TransparentProxy {
+	if s.config.Transparent == "" {
+		return nil
 	}
+	return &transport.TransparentProxy{
+		Mode: s.config.Transparent,
+		Addr: s.config.TransparentAddr,
+		Host: s.config.TransparentHost,
+	}
+}
+
+// panelConfig returns the web panel access settings, with web_tls the panel
+// shares the tunnel certificate (a self-signed one is generated if missing).
+func (s *Server) panelConfig() (web.PanelConfig, error) {
+	panel := web.PanelConfig{
+		BindAddr:         s.config.WebBind,
+		Password:         s.config.WebPassword,
+		ReadOnlyPassword: s.config.WebReadOnlyPassword,
+		Tokens:           s.config.WebTokens,
+		ReadOnlyTokens:   s.config.WebReadOnlyTokens,
+	}
+	if s.config.WebTLS && s.config.WebPort > 0 {
+		host, _, _ := net.SplitHostPort(s.config.BindAddr)
+		if host == "" {
+			host = "localhost"
+		}
+		if err := utils.EnsureSelfSignedCert(s.config.TLSCertFile, s.config.TLSKeyFile, host); err != nil {
+			return panel, fmt.Errorf("failed to prepare web panel certificate: %v", err)
+		}
+		panel.TLSCertFile = s.config.TLSCertFile
+		panel.TLSKeyFile = s.config.TLSKeyFile
+	}
+	return panel, nil
+}
+
+// accessLog opens the access log of forwarded connections, nil when disabled.
+// It is released when the tunnel stops.
+func (s *Server) accessLog() (*web.AccessLog, error) {
+	if s.config.AccessLog == "" {
+		return nil, nil
+	}
+	accessLog, err := web.NewAccessLog(s.config.AccessLog, s.config.AccessLogMaxSize, s.config.AccessLogMaxBackups, s.logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up access log: %v", err)
+	}
+	go func() {
+		<-s.ctx.Done()
+		accessLog.Close()
+	}()
+	return accessLog, nil
+}
 
-	<-s.ctx.Done()
+func (s *Server) banList() (*web.BanList, error) {
+	if s.config.BanThreshold <= 0 {
+		return nil, nil
+	}
+	bans, err := web.NewBanList(s.config.BanThreshold, time.Duration(s.config.BanWindow)*time.Second, time.Duration(s.config.BanDuration)*time.Second, s.config.BanWhitelist, s.logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up banning: %v", err)
+	}
+	return bans, nil
+}
 
-	s.logger.Info("all workers stopped successfully")
+func (s *Server) webhooks() (*utils.Webhooks, error) {
+	webhooks, err := utils.NewWebhooks(utils.WebhookConfig{
+		URLs:      s.config.Webhooks,
+		Secret:    s.config.WebhookSecret,
+		Events:    s.config.WebhookEvents,
+		Retries:   s.config.WebhookRetries,
+		Role:      "server",
+		Transport: string(s.config.Transport),
+	}, s.logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up webhooks: %v", err)
+	}
+	return webhooks, nil
+}
 
-	// suppress other logs
-	s.logger.SetLevel(logrus.FatalLevel)
+// decoyHandler builds the website shown to unauthenticated websocket requests.
+func (s *Server) decoyHandler() (http.Handler, error) {
+	decoy, err := utils.NewDecoyHandler(s.config.DecoyUpstream, s.config.DecoyDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up decoy website: %v", err)
+	}
+	return decoy, nil
 }
 
 // Stop shuts down the server gracefully
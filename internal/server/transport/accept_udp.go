@@ -2,6 +2,7 @@ package transport
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
 	"sync"
@@ -14,15 +15,13 @@ import (
 
 const BufferSize = 16 * 1024
 
-func (s *TcpTransport) udpListener(localAddr string, remoteAddr string) {
-	localUDPAddr, err := net.ResolveUDPAddr("udp", localAddr)
+// udpListener forwards the UDP traffic of a port mapping, or with proxy the
+// traffic redirected to the transparent proxy.
+func (s *TcpTransport) udpListener(localAddr string, remoteAddr string, proxy *TransparentProxy) {
+	listener, err := listenLocalUDP(localAddr, proxy)
 	if err != nil {
-		s.logger.Fatalf("failed to resolve local address: %v", err)
-	}
-
-	listener, err := net.ListenUDP("udp", localUDPAddr)
-	if err != nil {
-		s.logger.Fatalf("failed to listen on local UDP port: %v", err)
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to listen on local UDP port: %v", err))
+		return
 	}
 
 	defer listener.Close()
@@ -35,6 +34,12 @@ func (s *TcpTransport) udpListener(localAddr string, remoteAddr string) {
 	// Buffer for UDP reads
 	buf := make([]byte, BufferSize-2) // 2 bytes reserved for header
 
+	// the original destination of the transparent proxy's packets
+	var oob []byte
+	if proxy != nil {
+		oob = make([]byte, 128)
+	}
+
 	// make a new channel for recieve udp packets
 	udpChan := make(chan *LocalAcceptUDPConn, s.config.ChannelSize)
 
@@ -50,14 +55,14 @@ func (s *TcpTransport) udpListener(localAddr string, remoteAddr string) {
 			case <-s.ctx.Done():
 				return
 			default:
-				n, addr, err := listener.ReadFromUDP(buf)
+				n, addr, dst, err := readLocalUDP(listener, buf, oob)
 				if err != nil {
 					s.logger.Errorf("failed to read from UDP listener: %v", err)
 					continue
 				}
 
 				// Create a unique identifier for the connection based on IP and port
-				key := addr.String()
+				key := udpFlowKey(addr, dst)
 
 				mu.Lock()
 				// Check if the connection is already active
@@ -85,6 +90,16 @@ func (s *TcpTransport) udpListener(localAddr string, remoteAddr string) {
 
 				mu.Unlock()
 
+				// The transparent proxy replies from the original destination
+				target, replyConn := remoteAddr, listener
+				if dst != nil {
+					target = proxy.target(dst.IP, dst.Port)
+					if replyConn, err = replyUDP(dst); err != nil {
+						s.logger.Warnf("failed to open UDP reply socket for %s: %v", dst.String(), err)
+						continue
+					}
+				}
+
 				// Create a new payload channel for this connection,  Buffer up to 100,0000 packets for the connection
 				// Generally affect the upload speed
 				payloadChan := make(chan []byte, 100_000)
@@ -93,10 +108,12 @@ func (s *TcpTransport) udpListener(localAddr string, remoteAddr string) {
 				newUDPConn := LocalAcceptUDPConn{
 					timeCreated: time.Now().UnixNano(), // Just for debugging
 					payload:     payloadChan,
-					remoteAddr:  remoteAddr,
-					listener:    listener,
+					remoteAddr:  target,
+					listener:    replyConn,
 					clientAddr:  addr,
 					IsCongested: false,
+					key:         key,
+					transparent: dst != nil,
 				}
 
 				mu.Lock()
@@ -117,6 +134,9 @@ func (s *TcpTransport) udpListener(localAddr string, remoteAddr string) {
 
 				default:
 					s.logger.Warn("UDP channel is full, dropping packet.")
+					if newUDPConn.transparent {
+						replyConn.Close()
+					}
 				}
 			}
 		}
@@ -146,7 +166,8 @@ func (s *TcpTransport) handleUDPLoop(udpChan chan *LocalAcceptUDPConn, activeCon
 					}
 
 					// Handle data exchange between connections
-					go UDPConnectionHandler(localConn, tunnelConn, s.logger, s.usageMonitor, localConn.listener.LocalAddr().(*net.UDPAddr).Port, s.config.Sniffer, s.rtt, activeConnections, mu)
+					tracked := s.usageMonitor.TrackConnection("udp", localConn.clientAddr.String(), localConn.remoteAddr, localConn.listener.LocalAddr().(*net.UDPAddr).Port, func() { tunnelConn.Close() })
+					go UDPConnectionHandler(localConn, tracked.TargetConn(tunnelConn), tracked, s.logger, s.usageMonitor, localConn.listener.LocalAddr().(*net.UDPAddr).Port, s.config.Sniffer, s.rtt, activeConnections, mu)
 
 					s.logger.Debugf("initiate new handler for connection %s with timestamp %d", localConn.clientAddr.String(), localConn.timeCreated)
 					break loop
@@ -156,7 +177,7 @@ func (s *TcpTransport) handleUDPLoop(udpChan chan *LocalAcceptUDPConn, activeCon
 	}
 }
 
-func UDPConnectionHandler(udp *LocalAcceptUDPConn, tcp net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool, rtt int64, activeConnections *map[string]*LocalAcceptUDPConn, mu *sync.Mutex) {
+func UDPConnectionHandler(udp *LocalAcceptUDPConn, tcp net.Conn, tracked *web.TrackedConn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool, rtt int64, activeConnections *map[string]*LocalAcceptUDPConn, mu *sync.Mutex) {
 	done := make(chan struct{})
 
 	if rtt == 0 {
@@ -167,7 +188,7 @@ func UDPConnectionHandler(udp *LocalAcceptUDPConn, tcp net.Conn, logger *logrus.
 	}
 
 	go func() {
-		udpToTCP(tcp, udp, logger, usage, remotePort, sniffer)
+		udpToTCP(tcp, udp, tracked, logger, usage, remotePort, sniffer)
 		tcp.Close()
 		done <- struct{}{}
 	}()
@@ -176,17 +197,22 @@ func UDPConnectionHandler(udp *LocalAcceptUDPConn, tcp net.Conn, logger *logrus.
 	tcp.Close()
 
 	<-done
+	tracked.Done()
 
 	mu.Lock()
 	close(udp.payload)
 
 	if !udp.IsCongested {
-		delete(*activeConnections, udp.clientAddr.String())
+		delete(*activeConnections, udp.key)
 	}
 	mu.Unlock()
+
+	if udp.transparent {
+		udp.listener.Close()
+	}
 }
 
-func udpToTCP(tcp net.Conn, udp *LocalAcceptUDPConn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+func udpToTCP(tcp net.Conn, udp *LocalAcceptUDPConn, tracked *web.TrackedConn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
 	// Create a header (2 bytes) to hold the size of the data
 	header := make([]byte, 2)
 
@@ -228,8 +254,12 @@ func udpToTCP(tcp net.Conn, udp *LocalAcceptUDPConn, logger *logrus.Logger, usag
 				usage.AddOrUpdatePort(remotePort, uint64(totalWritten))
 			}
 
+		case <-tracked.Closed(): // closed from the web panel
+			return
+
 		case <-time.After(inactivityTimeout): // Timeout after 30 seconds of inactivity
 			logger.Debugf("connection with timestamp %d and address %s idle for 60 seconds, closing", udp.timeCreated, udp.clientAddr.String())
+			tracked.SetCloseReason("idle timeout")
 			return
 		}
 	}
@@ -0,0 +1,53 @@
+package transport
+
+import (
+	"context"
+	"sync"
+)
+
+// Lifecycle connects a transport to the server running it. The transport calls
+// Listening once it listens on bind_addr and Fail with an error it can't run
+// with, like a port it can't listen on: the tunnel stops, while the process and
+// its other tunnels keep running.
+type Lifecycle struct {
+	started chan error
+	once    sync.Once
+	stop    func(err error)
+}
+
+// NewLifecycle returns the lifecycle of a transport, stop is called with the
+// first error the transport fails with.
+func NewLifecycle(stop func(err error)) *Lifecycle {
+	return &Lifecycle{started: make(chan error, 1), stop: stop}
+}
+
+// Listening reports that the transport listens on bind_addr, again after each
+// restart of the transport.
+func (l *Lifecycle) Listening() {
+	select {
+	case l.started <- nil:
+	default:
+	}
+}
+
+// Fail stops the tunnel because of err.
+func (l *Lifecycle) Fail(err error) {
+	l.once.Do(func() {
+		select {
+		case l.started <- err:
+		default:
+		}
+		l.stop(err)
+	})
+}
+
+// Started waits until the transport listens on bind_addr. It returns the error
+// the transport failed with before, nil if ctx is done first.
+func (l *Lifecycle) Started(ctx context.Context) error {
+	select {
+	case err := <-l.started:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
@@ -0,0 +1,82 @@
+package transport
+
+import (
+	"sync/atomic"
+)
+
+// muxQueues holds the local connections of a mux transport in one queue per
+// accept shard, so the shards don't contend on one channel. Every mux session
+// serves one queue, a new session goes to the queue that needs it most.
+type muxQueues struct {
+	queues []*muxQueue
+	muxCon int32
+	next   atomic.Uint32 // round robin for connections of no shard
+}
+
+// muxQueue is the queue of one shard with the sessions serving it.
+type muxQueue struct {
+	conns    chan LocalTCPConn
+	streams  atomic.Int32 // queued and forwarded connections
+	sessions atomic.Int32
+}
+
+// newMuxQueues splits channelSize between the queues of shards, a single
+// listener has one queue.
+func newMuxQueues(shards, channelSize, muxCon int) *muxQueues {
+	shards = max(shards, 1)
+	q := &muxQueues{muxCon: int32(muxCon)}
+	for i := 0; i < shards; i++ {
+		q.queues = append(q.queues, &muxQueue{conns: make(chan LocalTCPConn, max(channelSize/shards, 1))})
+	}
+	return q
+}
+
+// shard returns the queue of the i-th listener of a local port.
+func (q *muxQueues) shard(i int) *muxQueue {
+	return q.queues[i%len(q.queues)]
+}
+
+// any returns the queues in turn, for connections that don't come from a shard
+// like the transparent proxy's or relayed ones.
+func (q *muxQueues) any() *muxQueue {
+	return q.queues[int(q.next.Add(1))%len(q.queues)]
+}
+
+// assign returns the queue a new session serves: the one with the most
+// connections its sessions can't take, the one with the fewest sessions if
+// none lacks a session.
+func (q *muxQueues) assign() *muxQueue {
+	best := q.queues[0]
+	for _, queue := range q.queues[1:] {
+		if need, bestNeed := q.unserved(queue), q.unserved(best); need > bestNeed || (need == bestNeed && queue.sessions.Load() < best.sessions.Load()) {
+			best = queue
+		}
+	}
+	best.sessions.Add(1)
+	return best
+}
+
+func (q *muxQueues) unserved(queue *muxQueue) int32 {
+	return queue.streams.Load() - queue.sessions.Load()*q.muxCon
+}
+
+// sessions returns the number of sessions serving the queues.
+func (q *muxQueues) sessions() int {
+	n := 0
+	for _, queue := range q.queues {
+		n += int(queue.sessions.Load())
+	}
+	return n
+}
+
+// push queues conn, false if the queue is full. needSession tells that the
+// sessions of the queue are at mux_con and another one should be requested.
+func (q *muxQueues) push(queue *muxQueue, conn LocalTCPConn) (ok, needSession bool) {
+	select {
+	case queue.conns <- conn:
+		streams := queue.streams.Add(1)
+		return true, streams >= queue.sessions.Load()*q.muxCon
+	default:
+		return false, false
+	}
+}
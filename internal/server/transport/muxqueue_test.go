@@ -0,0 +1,47 @@
+package transport
+
+import "testing"
+
+func TestMuxQueuesAssign(t *testing.T) {
+	q := newMuxQueues(2, 8, 2)
+
+	// Without traffic the sessions spread over the shards
+	if a, b := q.assign(), q.assign(); a == b {
+		t.Fatal("both sessions assigned to the same shard")
+	}
+
+	// The shard with connections its sessions can't take gets the next session
+	busy := q.shard(1)
+	for i := 0; i < 3; i++ {
+		ok, needSession := q.push(busy, LocalTCPConn{})
+		if !ok {
+			t.Fatalf("push %d rejected", i)
+		}
+		if want := i >= 1; needSession != want {
+			t.Errorf("push %d needSession = %v, want %v", i, needSession, want)
+		}
+	}
+	if got := q.assign(); got != busy {
+		t.Error("new session not assigned to the busy shard")
+	}
+	if got := q.sessions(); got != 3 {
+		t.Errorf("sessions() = %d, want 3", got)
+	}
+}
+
+func TestMuxQueuesPushFull(t *testing.T) {
+	q := newMuxQueues(4, 4, 8)
+	queue := q.shard(5)
+	if queue != q.shard(1) {
+		t.Error("shard() doesn't wrap around the queues")
+	}
+	if ok, _ := q.push(queue, LocalTCPConn{}); !ok {
+		t.Fatal("push rejected")
+	}
+	if ok, needSession := q.push(queue, LocalTCPConn{}); ok || needSession {
+		t.Errorf("push into a full queue = %v, %v, want false, false", ok, needSession)
+	}
+	if got := queue.streams.Load(); got != 1 {
+		t.Errorf("streams = %d, want 1", got)
+	}
+}
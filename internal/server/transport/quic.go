@@ -2,9 +2,7 @@ package transport
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
-	"log"
 	"net"
 	"strconv"
 	"strings"
@@ -35,20 +33,25 @@ type QuicTransport struct {
 }
 
 type QuicConfig struct {
-	BindAddr     string
-	TunnelStatus string
-	SnifferLog   string
-	Token        string
-	Ports        []string
-	Nodelay      bool
-	Sniffer      bool
-	ChannelSize  int
-	MuxCon       int
-	WebPort      int
-	KeepAlive    time.Duration
-	Heartbeat    time.Duration // in seconds
-	TLSCertFile  string        // Path to the TLS certificate file
-	TLSKeyFile   string        // Path to the TLS key file
+	BindAddr       string
+	TunnelStatus   string
+	Lifecycle      *Lifecycle // tells the server that the transport listens or failed
+	SnifferLog     string
+	Tokens         *utils.TokenSet // accepted tokens, updated without restart
+	SourceMetadata bool            // send the source address with the target
+	Ports          []string
+	Nodelay        bool
+	Sniffer        bool
+	ChannelSize    int
+	MuxCon         int
+	WebPort        int
+	KeepAlive      time.Duration
+	Heartbeat      time.Duration     // in seconds
+	TLSCertFile    string            // Path to the TLS certificate file
+	TLSKeyFile     string            // Path to the TLS key file
+	TLSClientCA    string            // CA bundle for client certificates (mutual TLS)
+	ACME           *utils.ACMEConfig // automatic certificates, nil when disabled
+	TLSExpiryWarn  int               // days before certificate expiry to start warning
 
 }
 
@@ -87,6 +90,7 @@ func (s *QuicTransport) Restart() {
 	defer s.restartMutex.Unlock()
 
 	s.logger.Info("restarting server...")
+	s.usageMonitor.Restarting()
 	if s.cancel != nil {
 		s.cancel()
 	}
@@ -197,6 +201,7 @@ func (s *QuicTransport) keepalive() {
 			switch result.message {
 			case utils.SG_HB:
 				s.logger.Info("heartbeat signal received successfully")
+				s.usageMonitor.Heartbeat()
 				tickerTimeout.Reset(3 * time.Second)
 
 			case utils.SG_Closed:
@@ -221,7 +226,8 @@ func (s *QuicTransport) portConfigReader() {
 		if len(parts) < 2 {
 			port, err := strconv.Atoi(parts[0])
 			if err != nil {
-				s.logger.Fatalf("invalid port mapping format: %s", portMapping)
+				s.config.Lifecycle.Fail(fmt.Errorf("invalid port mapping format: %s", portMapping))
+				return
 			}
 			localAddr = fmt.Sprintf(":%d", port)
 			parts = append(parts, strconv.Itoa(port))
@@ -267,14 +273,16 @@ func (s *QuicTransport) channelHandshake(qConn quic.Connection) {
 	// Resetting the deadline (removes any existing deadline)
 	stream.SetReadDeadline(time.Time{})
 
-	if msg != s.config.Token {
-		s.logger.Warnf("invalid security token received: %s, exptected: %s", msg, s.config.Token)
+	if !s.config.Tokens.Valid(msg) {
+		s.logger.Warnf("invalid security token received from %s", qConn.RemoteAddr().String())
+		s.usageMonitor.InvalidToken(qConn.RemoteAddr().String())
 		stream.Close()
 		qConn.CloseWithError(1, "close on invalid token")
 		return
 	}
 
-	err = utils.SendBinaryString(stream, s.config.Token)
+	// echo the presented token, the client checks it
+	err = utils.SendBinaryString(stream, msg)
 	if err != nil {
 		s.logger.Errorf("failed to send security token: %v", err)
 		stream.Close()
@@ -297,54 +305,61 @@ func (s *QuicTransport) channelHandshake(qConn quic.Connection) {
 	go s.keepalive()
 
 	s.config.TunnelStatus = "Connected (QUIC)"
+	s.usageMonitor.ControlChannelUp(s.config.TunnelStatus)
 }
 
-func (s *QuicTransport) generateTLSConfig() *tls.Config {
-	// You should replace this with proper certificate and key files
-	cert, err := tls.LoadX509KeyPair(s.config.TLSCertFile, s.config.TLSKeyFile)
+func (s *QuicTransport) generateTLSConfig() *serverTLS {
+	serverTLS, err := loadServerTLS(s.config.BindAddr, s.config.TLSCertFile, s.config.TLSKeyFile, s.config.TLSClientCA, s.config.ACME, s.config.TLSExpiryWarn, s.logger)
 	if err != nil {
-		log.Fatal(err)
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to load TLS configuration: %v", err))
+		return nil
 	}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		NextProtos:   []string{"h3"},
-	}
+	serverTLS.config.NextProtos = []string{"h3"}
+	return serverTLS
 }
 
 func (s *QuicTransport) TunnelListener() {
 	// for  webui
 	if s.config.WebPort > 0 {
+		s.usageMonitor.SetPoolSize(func() int { return len(s.tunnelChan) })
 		go s.usageMonitor.Monitor()
 	}
 	s.config.TunnelStatus = "Disconnected (QUIC)"
 
-	// Ensure self-signed cert exists
-	host, _, _ := net.SplitHostPort(s.config.BindAddr)
-	if host == "" {
-		host = "localhost"
-	}
-	if err := utils.EnsureSelfSignedCert(s.config.TLSCertFile, s.config.TLSKeyFile, host); err != nil {
-		s.logger.Fatalf("failed to generate self-signed certificate: %v", err)
+	// Load the certificate (self-signed one is generated if missing)
+	serverTLS := s.generateTLSConfig()
+	if serverTLS == nil {
+		return
 	}
 
 	// Create a UDP connection
 	udpAddr, err := net.ResolveUDPAddr("udp", s.config.BindAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to resolve UDP address: %v", err)
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to resolve UDP address: %v", err))
+		return
 	}
 
 	udpConn, err := net.ListenUDP("udp", udpAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to listen on UDP: %v", err)
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to listen on UDP: %v", err))
+		return
 	}
 	defer udpConn.Close()
 
 	// Create a QUIC listener
-	listener, err := quic.Listen(udpConn, s.generateTLSConfig(), s.quicConfig)
+	listener, err := quic.Listen(udpConn, serverTLS.config, s.quicConfig)
 	if err != nil {
-		s.logger.Fatalf("failed to create QUIC listener: %v", err)
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to create QUIC listener: %v", err))
+		return
 	}
+	s.config.Lifecycle.Listening()
+
+	// ACME challenges can't be answered over QUIC, they are served on the TCP side of the bind port
+	if serverTLS.acme != nil {
+		go serverTLS.acme.ServeChallenges(s.ctx, s.config.BindAddr)
+	}
+	serverTLS.start(s.ctx, s.usageMonitor)
 
 	s.logger.Infof("listening for QUIC connections on %s...", s.config.BindAddr)
 
@@ -372,6 +387,13 @@ func (s *QuicTransport) acceptTunCon(listener *quic.Listener) {
 				continue
 			}
 
+			// Refuse hosts banned for failed authentication
+			if s.usageMonitor.Banned(conn.RemoteAddr().String()) {
+				s.logger.Debugf("refused tunnel connection from banned host %s", conn.RemoteAddr().String())
+				conn.CloseWithError(1, "banned")
+				continue
+			}
+
 			// Drop all suspicious packets from other address rather than server
 			if s.controlChannel != nil && s.controlChannel.RemoteAddr().(*net.UDPAddr).IP.String() != conn.RemoteAddr().(*net.UDPAddr).IP.String() {
 				s.logger.Debugf("suspicious packet from %v. expected address: %v. discarding packet...", conn.RemoteAddr().(*net.UDPAddr).IP.String(), s.controlChannel.RemoteAddr().(*net.UDPAddr).IP.String())
@@ -400,7 +422,7 @@ func (s *QuicTransport) acceptTunCon(listener *quic.Listener) {
 func (s *QuicTransport) localListener(localAddr string, remoteAddr string) {
 	listener, err := net.Listen("tcp", localAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to start listener on %s: %v", localAddr, err)
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to start listener on %s: %v", localAddr, err))
 		return
 	}
 
@@ -461,6 +483,16 @@ func (s *QuicTransport) acceptLocalCon(listener net.Listener, remoteAddr string)
 
 }
 
+// Forward queues a connection handed over by a relay, like acceptLocalCon does.
+func (s *QuicTransport) Forward(conn net.Conn, target string) bool {
+	select {
+	case s.localChan <- LocalTCPConn{conn: conn, remoteAddr: target}:
+		return true
+	default:
+		return false
+	}
+}
+
 func (s *QuicTransport) handleTunConn() {
 	next := make(chan struct{})
 	for {
@@ -498,7 +530,7 @@ func (s *QuicTransport) handleSession(session quic.Connection, next chan struct{
 			}
 
 			// Send the target port over the tunnel connection
-			err = utils.SendBinaryString(stream, incomingConn.remoteAddr)
+			err = utils.SendBinaryString(stream, incomingConn.target(s.config.SourceMetadata))
 			if err != nil {
 				s.logger.Errorf("failed to send address %v over stream: %v", incomingConn.remoteAddr, err)
 
@@ -511,8 +543,10 @@ func (s *QuicTransport) handleSession(session quic.Connection, next chan struct{
 			}
 
 			// Handle data exchange between connections
+			tracked, conn := incomingConn.track(s.usageMonitor, "quic")
 			go func() {
-				utils.QConnectionHandler(incomingConn.conn, stream, s.logger, s.usageMonitor, incomingConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
+				utils.QConnectionHandler(conn, stream, s.logger, s.usageMonitor, incomingConn.port(), s.config.Sniffer)
+				tracked.Done()
 				done <- struct{}{}
 			}()
 
@@ -0,0 +1,146 @@
+package transport
+
+import (
+	"sync"
+	"time"
+
+	"github.com/musix/backhaul/internal/utils"
+)
+
+// controlSession lets a client resume a lost control channel within the grace
+// period (resume_grace). The local listeners, tunnel connections and mux
+// sessions are kept meanwhile, without grace period the server restarts.
+type controlSession struct {
+	grace time.Duration
+
+	mu      sync.Mutex
+	id      string      // empty when the client can't resume
+	current any         // the control channel, losing another one is ignored
+	timer   *time.Timer // runs while the control channel is lost
+}
+
+func newControlSession(grace time.Duration) *controlSession {
+	return &controlSession{grace: grace}
+}
+
+// open checks the handshake msg of a new control channel conn and returns the
+// reply. msg is the token, clients that can resume add a session suffix and
+// get the id of their new session back.
+func (cs *controlSession) open(tokens *utils.TokenSet, msg string, conn any) (string, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.resetLocked()
+
+	if !validHello(tokens, msg) {
+		return "", false
+	}
+	reply := msg
+	if !tokens.Valid(msg) {
+		// without grace period the plain token tells the client it can't resume
+		token, _, _ := utils.SplitSession(msg)
+		reply = token
+		if cs.grace > 0 {
+			cs.id = utils.NewSessionID()
+			reply = utils.JoinSession(token, cs.id)
+		}
+	}
+	cs.current = conn
+	return reply, true
+}
+
+// resume checks the handshake msg of conn, a control channel dialed again by a
+// client with a session. The client may notice the loss before the server, the
+// control channel it replaces has to be closed then. valid is false for a wrong
+// token, resumed is false if the client does not resume the session: it
+// restarted and the server has to as well.
+func (cs *controlSession) resume(tokens *utils.TokenSet, msg string, conn any) (reply string, resumed, valid bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if !validHello(tokens, msg) {
+		return "", false, false
+	}
+	_, id, ok := utils.SplitSession(msg)
+	if tokens.Valid(msg) || !ok || cs.id == "" || id != cs.id {
+		return "", false, true
+	}
+	if cs.timer != nil {
+		cs.timer.Stop()
+		cs.timer = nil
+	}
+	cs.current = conn
+	return msg, true, true
+}
+
+// granted reports whether the client has a session. It announces its tunnel
+// connections then, so they are told apart from a resumed control channel.
+func (cs *controlSession) granted() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.id != ""
+}
+
+// tunnel reports whether id, announced by a tunnel connection, is the session.
+func (cs *controlSession) tunnel(id string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.id != "" && id == cs.id
+}
+
+// validHello reports whether the handshake msg, a token that may have a session
+// suffix, carries a valid token.
+func validHello(tokens *utils.TokenSet, msg string) bool {
+	if tokens.Valid(msg) {
+		return true
+	}
+	token, _, ok := utils.SplitSession(msg)
+	return ok && tokens.Valid(token)
+}
+
+// lose is called when conn, the control channel, fails. It returns false if
+// conn is not the control channel anymore, the loss is handled already. Unless
+// the client can't resume, expire runs when the grace period ends.
+func (cs *controlSession) lose(conn any, expire func()) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if conn == nil || conn != cs.current {
+		return false
+	}
+	cs.current = nil
+	if cs.id != "" {
+		var timer *time.Timer
+		timer = time.AfterFunc(cs.grace, func() {
+			cs.mu.Lock()
+			expired := cs.timer == timer
+			cs.mu.Unlock()
+			if expired {
+				expire()
+			}
+		})
+		cs.timer = timer
+	}
+	return true
+}
+
+// resuming reports whether the control channel is lost and may be resumed.
+func (cs *controlSession) resuming() bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.timer != nil
+}
+
+// reset forgets the session, the transport restarts.
+func (cs *controlSession) reset() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.resetLocked()
+}
+
+func (cs *controlSession) resetLocked() {
+	if cs.timer != nil {
+		cs.timer.Stop()
+		cs.timer = nil
+	}
+	cs.id = ""
+	cs.current = nil
+}
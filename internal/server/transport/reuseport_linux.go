@@ -0,0 +1,51 @@
+//go:build linux
+// +build linux
+
+package transport
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenShards opens shards listeners on addr that share the port with
+// SO_REUSEPORT, the kernel spreads new connections across them. With shards
+// below 2 it opens a single ordinary listener.
+func listenShards(addr string, shards int) ([]net.Listener, error) {
+	if shards < 2 {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	}
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var controlErr error
+			err := c.Control(func(fd uintptr) {
+				controlErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return controlErr
+		},
+	}
+
+	listeners := make([]net.Listener, 0, shards)
+	for i := 0; i < shards; i++ {
+		listener, err := lc.Listen(context.Background(), "tcp", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
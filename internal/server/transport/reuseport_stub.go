@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package transport
+
+import "net"
+
+// listenShards opens a single listener on addr, accept sharding with
+// SO_REUSEPORT is only supported on linux.
+func listenShards(addr string, shards int) ([]net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{listener}, nil
+}
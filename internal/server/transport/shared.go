@@ -1,12 +1,22 @@
 package transport
 
 import (
+	"fmt"
 	"net"
+	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
 )
 
+// maxHandleLoops caps the loops dispatching local connections into the tunnel
+// pool, of the transport and of every sharded port.
+const maxHandleLoops = 4
+
 type TunnelChannel struct { // for websocket
 	conn *websocket.Conn
 	ping chan struct{}
@@ -17,6 +27,118 @@ type LocalTCPConn struct {
 	conn        net.Conn
 	remoteAddr  string
 	timeCreated int64
+	localPort   int // the port usage is counted on, 0 for the port of conn
+}
+
+// port returns the local port of the connection, the original destination
+// port for the transparent proxy's.
+func (c *LocalTCPConn) port() int {
+	if c.localPort != 0 {
+		return c.localPort
+	}
+	return c.conn.LocalAddr().(*net.TCPAddr).Port
+}
+
+// track adds the connection to the web panel's connection table. The returned
+// conn counts its traffic, closing it from the panel closes the user side.
+func (c *LocalTCPConn) track(usage *web.Usage, transport string) (*web.TrackedConn, net.Conn) {
+	tracked := usage.TrackConnection(transport, c.conn.RemoteAddr().String(), c.remoteAddr, c.port(), func() { c.conn.Close() })
+	return tracked, tracked.SourceConn(c.conn)
+}
+
+// target returns the target message of the connection, with the address of the
+// user when sourceMetadata is enabled.
+func (c *LocalTCPConn) target(sourceMetadata bool) string {
+	if !sourceMetadata {
+		return c.remoteAddr
+	}
+	return utils.JoinTarget(c.remoteAddr, c.conn.RemoteAddr().String())
+}
+
+// Forwarder is a transport that also serves connections handed over by a relay,
+// as if they were accepted on a local port.
+type Forwarder interface {
+	// Forward queues conn for target, false if the channel is full.
+	Forward(conn net.Conn, target string) bool
+}
+
+// relayedConn is a connection handed over by a relay. It reports the address of
+// the user and the target port like an accepted TCP connection.
+type relayedConn struct {
+	net.Conn
+	local  *net.TCPAddr
+	source relayAddr
+}
+
+func (c *relayedConn) LocalAddr() net.Addr  { return c.local }
+func (c *relayedConn) RemoteAddr() net.Addr { return c.source }
+
+// NetConn returns the pipe, so the connection can be half-closed.
+func (c *relayedConn) NetConn() net.Conn { return c.Conn }
+
+// relayAddr is the source address received from the upstream server.
+type relayAddr string
+
+func (a relayAddr) Network() string { return "tcp" }
+func (a relayAddr) String() string  { return string(a) }
+
+// relayPipe is one end of an in-memory connection like net.Pipe that can also be
+// half-closed, each direction is a pipe of its own. The tunnel connections on
+// both sides of a relay keep their half-close this way.
+type relayPipe struct {
+	r net.Conn // reads what the other end writes
+	w net.Conn // writes what the other end reads
+}
+
+func newRelayPipe() (*relayPipe, *relayPipe) {
+	r1, w1 := net.Pipe()
+	r2, w2 := net.Pipe()
+	return &relayPipe{r: r1, w: w2}, &relayPipe{r: r2, w: w1}
+}
+
+func (p *relayPipe) Read(b []byte) (int, error)  { return p.r.Read(b) }
+func (p *relayPipe) Write(b []byte) (int, error) { return p.w.Write(b) }
+
+// CloseWrite closes the sending direction, the other end reads EOF while it
+// can still answer.
+func (p *relayPipe) CloseWrite() error { return p.w.Close() }
+
+func (p *relayPipe) Close() error {
+	p.w.Close()
+	return p.r.Close()
+}
+
+func (p *relayPipe) LocalAddr() net.Addr  { return p.r.LocalAddr() }
+func (p *relayPipe) RemoteAddr() net.Addr { return p.r.RemoteAddr() }
+
+func (p *relayPipe) SetDeadline(t time.Time) error {
+	p.w.SetDeadline(t)
+	return p.r.SetDeadline(t)
+}
+
+func (p *relayPipe) SetReadDeadline(t time.Time) error  { return p.r.SetReadDeadline(t) }
+func (p *relayPipe) SetWriteDeadline(t time.Time) error { return p.w.SetWriteDeadline(t) }
+
+// Relay connects to target through f as if a user at source had connected to a
+// local port, it returns the relay's end of the connection.
+func Relay(f Forwarder, target, source string) (net.Conn, error) {
+	_, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay target %s: %v", target, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay target %s: %v", target, err)
+	}
+
+	local, relayed := newRelayPipe()
+	conn := &relayedConn{Conn: relayed, local: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, source: relayAddr(source)}
+	if !f.Forward(conn, target) {
+		local.Close()
+		relayed.Close()
+		return nil, fmt.Errorf("relay channel is full, discarding connection to %s", target)
+	}
+	return local, nil
 }
 
 type LocalAcceptUDPConn struct {
@@ -25,7 +147,9 @@ type LocalAcceptUDPConn struct {
 	remoteAddr  string
 	listener    *net.UDPConn
 	clientAddr  *net.UDPAddr
-	IsCongested bool // for congested tcp connection
+	IsCongested bool   // for congested tcp connection
+	key         string // in the active connections
+	transparent bool   // listener is the flow's own reply socket, closed with it
 }
 
 type LocalUDPConn struct {
@@ -34,6 +158,34 @@ type LocalUDPConn struct {
 	remoteAddr  string
 	listener    *net.UDPConn
 	addr        *net.UDPAddr
+	key         string // in the active connections
+	transparent bool   // listener is the flow's own reply socket, closed with it
+}
+
+// refuseBanned answers a request of a banned host without telling it that a
+// tunnel is there: like a stranger it gets the decoy website, without one the
+// connection is closed without a response.
+func refuseBanned(w http.ResponseWriter, r *http.Request, decoy http.Handler) {
+	if decoy != nil {
+		decoy.ServeHTTP(w, r)
+		return
+	}
+	if hijacker, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hijacker.Hijack(); err == nil {
+			conn.Close()
+			return
+		}
+	}
+	panic(http.ErrAbortHandler)
+}
+
+// udpFlowKey returns the key of a UDP flow in the active connections. The
+// transparent proxy tells a client's flows to different destinations apart.
+func udpFlowKey(addr, dst *net.UDPAddr) string {
+	if dst == nil {
+		return addr.String()
+	}
+	return addr.String() + ">" + dst.String()
 }
 
 type TunnelUDPConn struct {
@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type forwarderFunc func(conn net.Conn, target string) bool
+
+func (f forwarderFunc) Forward(conn net.Conn, target string) bool { return f(conn, target) }
+
+func TestRelayHalfClose(t *testing.T) {
+	forwarded := make(chan net.Conn, 1)
+	local, err := Relay(forwarderFunc(func(conn net.Conn, target string) bool {
+		forwarded <- conn
+		return true
+	}), "127.0.0.1:8080", "192.0.2.1:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	relayed := <-forwarded
+	defer relayed.Close()
+
+	if got := relayed.RemoteAddr().String(); got != "192.0.2.1:1234" {
+		t.Errorf("RemoteAddr() = %s, want the source", got)
+	}
+	if got := relayed.LocalAddr().(*net.TCPAddr).Port; got != 8080 {
+		t.Errorf("LocalAddr() port = %d, want 8080", got)
+	}
+
+	// The relay finished sending, the target still answers
+	go func() {
+		local.Write([]byte("request"))
+		local.(*relayPipe).CloseWrite()
+	}()
+	request, err := io.ReadAll(relayed)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("ReadAll() = %q, %v, want the request and EOF", request, err)
+	}
+
+	go func() {
+		relayed.Write([]byte("response"))
+		relayed.Close()
+	}()
+	local.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := io.ReadAll(local)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("ReadAll() = %q, %v, want the response after the half-close", response, err)
+	}
+}
+
+func TestRelayInvalidTarget(t *testing.T) {
+	full := forwarderFunc(func(conn net.Conn, target string) bool { return false })
+	for _, target := range []string{"127.0.0.1", "127.0.0.1:http"} {
+		if _, err := Relay(full, target, ""); err == nil {
+			t.Errorf("Relay(%q) accepted", target)
+		}
+	}
+	if _, err := Relay(full, "127.0.0.1:80", ""); err == nil {
+		t.Error("Relay() with a full channel accepted")
+	}
+}
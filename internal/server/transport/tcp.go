@@ -26,24 +26,30 @@ type TcpTransport struct {
 	localChannel   chan LocalTCPConn
 	reqNewConnChan chan struct{}
 	controlChannel net.Conn
+	session        *controlSession
 	restartMutex   sync.Mutex
 	usageMonitor   *web.Usage
 	rtt            int64 // in ms, for UDP
 }
 
 type TcpConfig struct {
-	BindAddr     string
-	Token        string
-	SnifferLog   string
-	TunnelStatus string
-	Ports        []string
-	Nodelay      bool
-	Sniffer      bool
-	KeepAlive    time.Duration
-	Heartbeat    time.Duration // in seconds
-	ChannelSize  int
-	WebPort      int
-	AcceptUDP    bool
+	BindAddr       string
+	Tokens         *utils.TokenSet // accepted tokens, updated without restart
+	SourceMetadata bool            // send the source address with the target
+	SnifferLog     string
+	TunnelStatus   string
+	Lifecycle      *Lifecycle // tells the server that the transport listens or failed
+	Ports          []string
+	Nodelay        bool
+	Sniffer        bool
+	KeepAlive      time.Duration
+	Heartbeat      time.Duration // in seconds
+	ChannelSize    int
+	Transparent    *TransparentProxy // nil without transparent proxy
+	AcceptShards   int               // SO_REUSEPORT listeners per local port
+	WebPort        int
+	AcceptUDP      bool
+	ResumeGrace    time.Duration // keep the tunnel while the client resumes a lost control channel
 }
 
 func NewTCPServer(parentCtx context.Context, config *TcpConfig, logger *logrus.Logger) *TcpTransport {
@@ -61,6 +67,7 @@ func NewTCPServer(parentCtx context.Context, config *TcpConfig, logger *logrus.L
 		localChannel:   make(chan LocalTCPConn, config.ChannelSize),
 		reqNewConnChan: make(chan struct{}, config.ChannelSize),
 		controlChannel: nil, // will be set when a control connection is established
+		session:        newControlSession(config.ResumeGrace),
 		usageMonitor:   web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
 		rtt:            0,
 	}
@@ -72,6 +79,7 @@ func (s *TcpTransport) Start() {
 	s.config.TunnelStatus = "Disconnected (TCP)"
 
 	if s.config.WebPort > 0 {
+		s.usageMonitor.SetPoolSize(func() int { return len(s.tunnelChannel) })
 		go s.usageMonitor.Monitor()
 	}
 
@@ -81,19 +89,24 @@ func (s *TcpTransport) Start() {
 
 	if s.controlChannel != nil {
 		s.config.TunnelStatus = "Connected (TCP)"
+		s.usageMonitor.ControlChannelUp(s.config.TunnelStatus)
 
 		numCPU := runtime.NumCPU()
-		if numCPU > 4 {
-			numCPU = 4 // Max allowed handler is 4
+		if numCPU > maxHandleLoops {
+			numCPU = maxHandleLoops // Max allowed handler is 4
 		}
 
 		go s.parsePortMappings()
 		go s.channelHandler()
 
+		if s.config.Transparent != nil {
+			go s.transparentListener()
+		}
+
 		s.logger.Infof("starting %d handle loops on each CPU thread", numCPU)
 
 		for i := 0; i < numCPU; i++ {
-			go s.handleLoop()
+			go s.handleLoop(s.localChannel)
 		}
 	}
 }
@@ -105,6 +118,7 @@ func (s *TcpTransport) Restart() {
 	defer s.restartMutex.Unlock()
 
 	s.logger.Info("restarting server...")
+	s.usageMonitor.Restarting()
 
 	// for removing timeout logs
 	level := s.logger.Level
@@ -113,6 +127,7 @@ func (s *TcpTransport) Restart() {
 	if s.cancel != nil {
 		s.cancel()
 	}
+	s.session.reset()
 
 	// Close open connection
 	if s.controlChannel != nil {
@@ -170,13 +185,16 @@ func (s *TcpTransport) channelHandshake() {
 			// Resetting the deadline (removes any existing deadline)
 			conn.SetReadDeadline(time.Time{})
 
-			if msg != s.config.Token {
-				s.logger.Warnf("invalid security token received: %s", msg)
+			reply, ok := s.session.open(s.config.Tokens, msg, conn)
+			if !ok {
+				s.logger.Warnf("invalid security token received from %s", conn.RemoteAddr().String())
+				s.usageMonitor.InvalidToken(conn.RemoteAddr().String())
 				conn.Close()
 				continue
 			}
 
-			err = utils.SendBinaryTransportString(conn, s.config.Token, utils.SG_Chan)
+			// echo the presented token, the client checks it
+			err = utils.SendBinaryTransportString(conn, reply, utils.SG_Chan)
 			if err != nil {
 				s.logger.Errorf("failed to send security token: %v", err)
 				conn.Close()
@@ -197,6 +215,9 @@ func (s *TcpTransport) channelHandler() {
 	ticker := time.NewTicker(s.config.Heartbeat)
 	defer ticker.Stop()
 
+	// A resumed control channel gets a new handler
+	controlChannel := s.controlChannel
+
 	// Channel to receive the message or error
 	messageChan := make(chan byte, 1)
 
@@ -207,15 +228,15 @@ func (s *TcpTransport) channelHandler() {
 			case <-s.ctx.Done():
 				return
 			default:
-				message, err := utils.ReceiveBinaryByte(s.controlChannel)
+				message, err := utils.ReceiveBinaryByte(controlChannel)
 				if err != nil {
 					s.logger.Errorf("failed to read from channel connection (try %d/%d): %v", retries+1, maxRetries, err)
 					retries++
 					if retries >= maxRetries {
 						if s.cancel != nil {
-							s.logger.Error("max retries reached, restarting...")
-							go s.Restart()
+							s.controlChannelLost(controlChannel)
 						}
+						close(messageChan)
 						return
 					}
 					time.Sleep(baseBackoff * time.Duration(retries))
@@ -227,38 +248,52 @@ func (s *TcpTransport) channelHandler() {
 		}
 	}()
 
-	// RTT measurment
+	// RTT measurment, repeated with every heartbeat
 	rtt := time.Now()
-	err := utils.SendBinaryByte(s.controlChannel, utils.SG_RTT)
+	logRTT := s.logger.Infof
+	err := utils.SendBinaryByte(controlChannel, utils.SG_RTT)
 	if err != nil {
-		s.logger.Error("failed to send RTT signal, attempting to restart server...")
-		go s.Restart()
+		s.logger.Error("failed to send RTT signal")
+		s.controlChannelLost(controlChannel)
 		return
 	}
 
 	for {
 		select {
 		case <-s.ctx.Done():
-			_ = utils.SendBinaryByte(s.controlChannel, utils.SG_Closed)
+			_ = utils.SendBinaryByte(controlChannel, utils.SG_Closed)
 			return
 
 		case <-s.reqNewConnChan:
-			err := utils.SendBinaryByte(s.controlChannel, utils.SG_Chan)
+			err := utils.SendBinaryByte(controlChannel, utils.SG_Chan)
 			if err != nil {
 				s.logger.Error("failed to send request new connection signal. ", err)
-				go s.Restart()
+				// ask again on the resumed control channel
+				select {
+				case s.reqNewConnChan <- struct{}{}:
+				default:
+				}
+				s.controlChannelLost(controlChannel)
 				return
 			}
 
 		case <-ticker.C:
-			err := utils.SendBinaryByte(s.controlChannel, utils.SG_HB)
+			err := utils.SendBinaryByte(controlChannel, utils.SG_HB)
 			if err != nil {
 				s.logger.Error("failed to send heartbeat signal")
-				go s.Restart()
+				s.controlChannelLost(controlChannel)
 				return
 			}
 			s.logger.Trace("heartbeat signal sent successfully")
 
+			// The client answers RTT signals, the answer is its heartbeat
+			rtt = time.Now()
+			if err := utils.SendBinaryByte(controlChannel, utils.SG_RTT); err != nil {
+				s.logger.Error("failed to send RTT signal")
+				s.controlChannelLost(controlChannel)
+				return
+			}
+
 		case message, ok := <-messageChan:
 			if !ok {
 				s.logger.Error("channel closed, likely due to an error in TCP read")
@@ -273,7 +308,10 @@ func (s *TcpTransport) channelHandler() {
 			} else if message == utils.SG_RTT {
 				measureRTT := time.Since(rtt)
 				s.rtt = measureRTT.Milliseconds()
-				s.logger.Infof("Round Trip Time (RTT): %d ms", s.rtt)
+				s.usageMonitor.SetRTT(s.rtt)
+				s.usageMonitor.Heartbeat()
+				logRTT("Round Trip Time (RTT): %d ms", s.rtt)
+				logRTT = s.logger.Debugf
 			}
 		}
 	}
@@ -282,12 +320,13 @@ func (s *TcpTransport) channelHandler() {
 func (s *TcpTransport) tunnelListener() {
 	listener, err := net.Listen("tcp", s.config.BindAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to start listener on %s: %v", s.config.BindAddr, err)
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to start listener on %s: %v", s.config.BindAddr, err))
 		return
 	}
 
 	defer listener.Close()
 
+	s.config.Lifecycle.Listening()
 	s.logger.Infof("server started successfully, listening on address: %s", listener.Addr().String())
 
 	go s.acceptTunnelConn(listener)
@@ -316,6 +355,13 @@ func (s *TcpTransport) acceptTunnelConn(listener net.Listener) {
 				continue
 			}
 
+			// Refuse hosts banned for failed authentication
+			if s.usageMonitor.Banned(conn.RemoteAddr().String()) {
+				s.logger.Debugf("refused tunnel connection from banned host %s", conn.RemoteAddr().String())
+				conn.Close()
+				continue
+			}
+
 			// Drop all suspicious packets from other address rather than server
 			if s.controlChannel != nil && s.controlChannel.RemoteAddr().(*net.TCPAddr).IP.String() != tcpConn.RemoteAddr().(*net.TCPAddr).IP.String() {
 				s.logger.Debugf("suspicious packet from %v. expected address: %v. discarding packet...", tcpConn.RemoteAddr().(*net.TCPAddr).IP.String(), s.controlChannel.RemoteAddr().(*net.TCPAddr).IP.String())
@@ -342,16 +388,109 @@ func (s *TcpTransport) acceptTunnelConn(listener net.Listener) {
 				s.logger.Warnf("failed to set TCP keep-alive period for %s: %v", tcpConn.RemoteAddr().String(), err)
 			}
 
-			select {
-			case s.tunnelChannel <- conn:
-			default: // The channel is full, do nothing
-				s.logger.Warnf("tunnel listener channel is full, discarding TCP connection from %s", conn.LocalAddr().String())
-				conn.Close()
+			// A client with a session announces its tunnel connections
+			if s.session.granted() {
+				go s.sessionHandshake(conn)
+				continue
 			}
+
+			s.queueTunnelConn(conn)
 		}
 	}
 }
 
+func (s *TcpTransport) queueTunnelConn(conn net.Conn) {
+	select {
+	case s.tunnelChannel <- conn:
+	default: // The channel is full, do nothing
+		s.logger.Warnf("tunnel listener channel is full, discarding TCP connection from %s", conn.LocalAddr().String())
+		conn.Close()
+	}
+}
+
+// controlChannelLost waits for the client to resume the session of the lost
+// control channel, the server restarts if it can't.
+func (s *TcpTransport) controlChannelLost(controlChannel net.Conn) {
+	if !s.session.lose(controlChannel, s.resumeExpired) {
+		return
+	}
+	if !s.session.resuming() {
+		s.logger.Error("control channel lost, restarting...")
+		go s.Restart()
+		return
+	}
+
+	s.logger.Warnf("control channel lost, waiting %s for the client to resume it", s.config.ResumeGrace)
+	controlChannel.Close()
+	s.config.TunnelStatus = "Resuming (TCP)"
+	s.usageMonitor.Resuming()
+}
+
+func (s *TcpTransport) resumeExpired() {
+	s.logger.Error("control channel was not resumed in time, restarting...")
+	s.Restart()
+}
+
+// sessionHandshake reads what a client with a session sends first on conn. A
+// tunnel connection announces the session and is queued, a control channel
+// dialed again resumes the session with a handshake.
+func (s *TcpTransport) sessionHandshake(conn net.Conn) {
+	if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		conn.Close()
+		return
+	}
+	msg, transport, err := utils.ReceiveBinaryTransportString(conn)
+	if err != nil || (transport != utils.SG_Tunnel && transport != utils.SG_Chan) {
+		s.logger.Debugf("invalid session handshake from %s: %v", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if transport == utils.SG_Tunnel {
+		if !s.session.tunnel(msg) {
+			s.logger.Debugf("tunnel connection from %s announced an unknown session", conn.RemoteAddr().String())
+			conn.Close()
+			return
+		}
+		s.queueTunnelConn(conn)
+		return
+	}
+
+	previous := s.controlChannel
+
+	reply, resumed, valid := s.session.resume(s.config.Tokens, msg, conn)
+	if !valid {
+		s.logger.Warnf("invalid security token received from %s", conn.RemoteAddr().String())
+		s.usageMonitor.InvalidToken(conn.RemoteAddr().String())
+		conn.Close()
+		return
+	} else if !resumed {
+		s.logger.Warn("new control channel requested instead of resuming, restarting...")
+		conn.Close()
+		go s.Restart()
+		return
+	}
+
+	if err := utils.SendBinaryTransportString(conn, reply, utils.SG_Chan); err != nil {
+		s.logger.Errorf("failed to send security token: %v", err)
+		s.controlChannelLost(conn)
+		return
+	}
+
+	// The client may have noticed the loss before the server did
+	if previous != nil && previous != conn {
+		previous.Close()
+	}
+
+	s.controlChannel = conn
+	s.config.TunnelStatus = "Connected (TCP)"
+	s.usageMonitor.ControlChannelUp(s.config.TunnelStatus)
+	s.logger.Info("control channel resumed")
+
+	go s.channelHandler()
+}
+
 func (s *TcpTransport) parsePortMappings() {
 	for _, portMapping := range s.config.Ports {
 		parts := strings.Split(portMapping, "=")
@@ -367,18 +506,21 @@ func (s *TcpTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					return
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					return
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					return
 				}
 
 				// Create listeners for all ports in the range
@@ -392,7 +534,8 @@ func (s *TcpTransport) parsePortMappings() {
 				// Handle single port case
 				port, err := strconv.Atoi(localPortOrRange)
 				if err != nil || port < 1 || port > 65535 {
-					s.logger.Fatalf("invalid port format: %s", localPortOrRange)
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid port format: %s", localPortOrRange))
+					return
 				}
 				localAddr = fmt.Sprintf(":%d", port)
 			}
@@ -405,18 +548,21 @@ func (s *TcpTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					return
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					return
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					return
 				}
 
 				// Create listeners for all ports in the range
@@ -429,14 +575,15 @@ func (s *TcpTransport) parsePortMappings() {
 			} else {
 				// Handle single local port case
 				port, err := strconv.Atoi(localPortOrRange)
-				if err == nil && port > 1 && port < 65535 { // format port=remoteAddress
+				if err == nil && port >= 1 && port <= 65535 { // format port=remoteAddress
 					localAddr = fmt.Sprintf(":%d", port)
 				} else {
 					localAddr = localPortOrRange // format ip:port=remoteAddress
 				}
 			}
 		} else {
-			s.logger.Fatalf("invalid port mapping format: %s", portMapping)
+			s.config.Lifecycle.Fail(fmt.Errorf("invalid port mapping format: %s", portMapping))
+			return
 		}
 		// Start listeners for single port
 		go s.startListeners(localAddr, remoteAddr)
@@ -449,29 +596,67 @@ func (s *TcpTransport) startListeners(localAddr, remoteAddr string) {
 
 	// Start UDP listener if configured
 	if s.config.AcceptUDP {
-		go s.udpListener(localAddr, remoteAddr)
+		go s.udpListener(localAddr, remoteAddr, nil)
 	}
 
 	s.logger.Debugf("Started listening on %s, forwarding to %s", localAddr, remoteAddr)
 }
 
 func (s *TcpTransport) localListener(localAddr string, remoteAddr string) {
-	listener, err := net.Listen("tcp", localAddr)
+	listeners, err := listenShards(localAddr, s.config.AcceptShards)
+	if err != nil {
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to listen on %s: %v", localAddr, err))
+		return
+	}
+
+	for _, listener := range listeners {
+		defer listener.Close()
+	}
+
+	s.logger.Infof("listener started successfully, listening on address: %s", listeners[0].Addr().String())
+
+	if len(listeners) == 1 {
+		go s.acceptLocalConn(listeners[0], remoteAddr, s.localChannel)
+	} else {
+		// The shards of the port share a queue and a few loops dispatching it
+		// to the tunnel pool, so a port range doesn't start loops per shard
+		s.logger.Debugf("accepting on %s with %d listeners", localAddr, len(listeners))
+		localChannel := make(chan LocalTCPConn, s.config.ChannelSize)
+		for i := 0; i < min(len(listeners), maxHandleLoops); i++ {
+			go s.handleLoop(localChannel)
+		}
+		for _, listener := range listeners {
+			go s.acceptLocalConn(listener, remoteAddr, localChannel)
+		}
+	}
+
+	<-s.ctx.Done()
+}
+
+// transparentListener accepts the traffic the firewall redirects to the
+// transparent proxy, UDP too with accept_udp in tproxy mode.
+func (s *TcpTransport) transparentListener() {
+	listener, err := s.config.Transparent.listen()
 	if err != nil {
-		s.logger.Fatalf("failed to listen on %s: %v", localAddr, err)
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to start transparent proxy on %s: %v", s.config.Transparent.Addr, err))
 		return
 	}
 
 	defer listener.Close()
 
-	s.logger.Infof("listener started successfully, listening on address: %s", listener.Addr().String())
+	s.logger.Infof("transparent proxy (%s) started successfully, listening on address: %s", s.config.Transparent.Mode, listener.Addr().String())
+
+	go s.acceptLocalConn(listener, "", s.localChannel)
 
-	go s.acceptLocalConn(listener, remoteAddr)
+	// UDP can't be redirected
+	if s.config.AcceptUDP && s.config.Transparent.Mode == TProxy {
+		go s.udpListener(s.config.Transparent.Addr, "", s.config.Transparent)
+	}
 
 	<-s.ctx.Done()
 }
 
-func (s *TcpTransport) acceptLocalConn(listener net.Listener, remoteAddr string) {
+func (s *TcpTransport) acceptLocalConn(listener net.Listener, remoteAddr string, localChannel chan LocalTCPConn) {
 	for {
 		select {
 		case <-s.ctx.Done():
@@ -493,6 +678,14 @@ func (s *TcpTransport) acceptLocalConn(listener net.Listener, remoteAddr string)
 				continue
 			}
 
+			// the transparent proxy's connections go to their original destination
+			target, port, err := localTarget(listener, tcpConn, remoteAddr)
+			if err != nil {
+				s.logger.Warnf("discarded connection from %s: %v", tcpConn.RemoteAddr().String(), err)
+				conn.Close()
+				continue
+			}
+
 			// trying to disable tcpnodelay
 			if !s.config.Nodelay {
 				if err := tcpConn.SetNoDelay(s.config.Nodelay); err != nil {
@@ -503,7 +696,7 @@ func (s *TcpTransport) acceptLocalConn(listener net.Listener, remoteAddr string)
 			}
 
 			select {
-			case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: remoteAddr, timeCreated: time.Now().UnixMilli()}:
+			case localChannel <- LocalTCPConn{conn: conn, remoteAddr: target, timeCreated: time.Now().UnixMilli(), localPort: port}:
 
 				select {
 				case s.reqNewConnChan <- struct{}{}:
@@ -523,12 +716,27 @@ func (s *TcpTransport) acceptLocalConn(listener net.Listener, remoteAddr string)
 	}
 }
 
-func (s *TcpTransport) handleLoop() {
+// Forward queues a connection handed over by a relay, like acceptLocalConn does.
+func (s *TcpTransport) Forward(conn net.Conn, target string) bool {
+	select {
+	case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: target, timeCreated: time.Now().UnixMilli()}:
+		select {
+		case s.reqNewConnChan <- struct{}{}:
+		default:
+			s.logger.Warn("channel is full, cannot request a new connection")
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *TcpTransport) handleLoop(localChannel chan LocalTCPConn) {
 	for {
 		select {
 		case <-s.ctx.Done():
 			return
-		case localConn := <-s.localChannel:
+		case localConn := <-localChannel:
 		loop:
 			for {
 				if time.Now().UnixMilli()-localConn.timeCreated > 3000 { // 3000ms
@@ -543,14 +751,18 @@ func (s *TcpTransport) handleLoop() {
 
 				case tunnelConn := <-s.tunnelChannel:
 					// Send the target addr over the connection
-					if err := utils.SendBinaryTransportString(tunnelConn, localConn.remoteAddr, utils.SG_TCP); err != nil {
+					if err := utils.SendBinaryTransportString(tunnelConn, localConn.target(s.config.SourceMetadata), utils.SG_TCP); err != nil {
 						s.logger.Errorf("%v", err)
 						tunnelConn.Close()
 						continue loop
 					}
 
 					// Handle data exchange between connections
-					go utils.TCPConnectionHandler(localConn.conn, tunnelConn, s.logger, s.usageMonitor, localConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
+					tracked, conn := localConn.track(s.usageMonitor, "tcp")
+					go func() {
+						defer tracked.Done()
+						utils.TCPConnectionHandler(conn, tunnelConn, s.logger, s.usageMonitor, localConn.port(), s.config.Sniffer)
+					}()
 					break loop
 
 				}
@@ -8,7 +8,6 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/musix/backhaul/internal/utils"
@@ -27,24 +26,27 @@ type TcpMuxTransport struct {
 	logger           *logrus.Logger
 	tunnelChannel    chan *smux.Session
 	handshakeChannel chan net.Conn
-	localChannel     chan LocalTCPConn
+	queues           *muxQueues // local connections by accept shard
 	reqNewConnChan   chan struct{}
 	controlChannel   net.Conn
+	session          *controlSession
 	usageMonitor     *web.Usage
 	restartMutex     sync.Mutex
-	streamCounter    int32
-	sessionCounter   int32
 }
 
 type TcpMuxConfig struct {
 	BindAddr         string
 	TunnelStatus     string
+	Lifecycle        *Lifecycle // tells the server that the transport listens or failed
 	SnifferLog       string
-	Token            string
+	Tokens           *utils.TokenSet // accepted tokens, updated without restart
+	SourceMetadata   bool            // send the source address with the target
 	Ports            []string
 	Nodelay          bool
 	Sniffer          bool
 	ChannelSize      int
+	Transparent      *TransparentProxy // nil without transparent proxy
+	AcceptShards     int               // SO_REUSEPORT listeners per local port
 	MuxCon           int
 	MuxVersion       int
 	MaxFrameSize     int
@@ -53,7 +55,7 @@ type TcpMuxConfig struct {
 	WebPort          int
 	KeepAlive        time.Duration
 	Heartbeat        time.Duration // in seconds
-
+	ResumeGrace      time.Duration // keep the mux sessions while the client resumes a lost control channel
 }
 
 func NewTcpMuxServer(parentCtx context.Context, config *TcpMuxConfig, logger *logrus.Logger) *TcpMuxTransport {
@@ -77,11 +79,10 @@ func NewTcpMuxServer(parentCtx context.Context, config *TcpMuxConfig, logger *lo
 		logger:           logger,
 		tunnelChannel:    make(chan *smux.Session, config.ChannelSize),
 		handshakeChannel: make(chan net.Conn),
-		localChannel:     make(chan LocalTCPConn, config.ChannelSize),
+		session:          newControlSession(config.ResumeGrace),
+		queues:           newMuxQueues(config.AcceptShards, config.ChannelSize, config.MuxCon),
 		reqNewConnChan:   make(chan struct{}, config.ChannelSize),
 		controlChannel:   nil, // will be set when a control connection is established
-		streamCounter:    0,
-		sessionCounter:   0,
 		usageMonitor:     web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
 	}
 
@@ -90,6 +91,7 @@ func NewTcpMuxServer(parentCtx context.Context, config *TcpMuxConfig, logger *lo
 
 func (s *TcpMuxTransport) Start() {
 	if s.config.WebPort > 0 {
+		s.usageMonitor.SetPoolSize(func() int { return len(s.tunnelChannel) + s.queues.sessions() })
 		go s.usageMonitor.Monitor()
 	}
 	s.config.TunnelStatus = "Disconnected (TCPMux)"
@@ -100,15 +102,20 @@ func (s *TcpMuxTransport) Start() {
 
 	if s.controlChannel != nil {
 		s.config.TunnelStatus = "Connected (TCPMux)"
+		s.usageMonitor.ControlChannelUp(s.config.TunnelStatus)
 
 		numCPU := runtime.NumCPU()
-		if numCPU > 4 {
-			numCPU = 4 // Max allowed handler is 4
+		if numCPU > maxHandleLoops {
+			numCPU = maxHandleLoops // Max allowed handler is 4
 		}
 
 		go s.parsePortMappings()
 		go s.channelHandler()
 
+		if s.config.Transparent != nil {
+			go s.transparentListener()
+		}
+
 		s.logger.Infof("starting %d handle loops on each CPU thread", numCPU)
 
 		for i := 0; i < numCPU; i++ {
@@ -126,9 +133,11 @@ func (s *TcpMuxTransport) Restart() {
 	defer s.restartMutex.Unlock()
 
 	s.logger.Info("restarting server...")
+	s.usageMonitor.Restarting()
 	if s.cancel != nil {
 		s.cancel()
 	}
+	s.session.reset()
 
 	// for removing timeout logs
 	level := s.logger.Level
@@ -147,14 +156,12 @@ func (s *TcpMuxTransport) Restart() {
 
 	// Re-initialize variables
 	s.tunnelChannel = make(chan *smux.Session, s.config.ChannelSize)
-	s.localChannel = make(chan LocalTCPConn, s.config.ChannelSize)
+	s.queues = newMuxQueues(s.config.AcceptShards, s.config.ChannelSize, s.config.MuxCon)
 	s.reqNewConnChan = make(chan struct{}, s.config.ChannelSize)
 	s.handshakeChannel = make(chan net.Conn)
 	s.controlChannel = nil
 	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
 	s.config.TunnelStatus = ""
-	s.streamCounter = 0
-	s.sessionCounter = 0
 
 	// set the log level again
 	s.logger.SetLevel(level)
@@ -192,13 +199,16 @@ func (s *TcpMuxTransport) channelHandshake() {
 			// Resetting the deadline (removes any existing deadline)
 			conn.SetReadDeadline(time.Time{})
 
-			if msg != s.config.Token {
-				s.logger.Warnf("invalid security token received: %s", msg)
+			reply, ok := s.session.open(s.config.Tokens, msg, conn)
+			if !ok {
+				s.logger.Warnf("invalid security token received from %s", conn.RemoteAddr().String())
+				s.usageMonitor.InvalidToken(conn.RemoteAddr().String())
 				conn.Close()
 				continue
 			}
 
-			err = utils.SendBinaryTransportString(conn, s.config.Token, utils.SG_Chan)
+			// echo the presented token, the client checks it
+			err = utils.SendBinaryTransportString(conn, reply, utils.SG_Chan)
 			if err != nil {
 				s.logger.Errorf("failed to send security token: %v", err)
 				conn.Close()
@@ -230,6 +240,13 @@ func (s *TcpMuxTransport) channelHandler() {
 	ticker := time.NewTicker(s.config.Heartbeat)
 	defer ticker.Stop()
 
+	// A resumed control channel gets a new handler
+	controlChannel := s.controlChannel
+
+	// Clients answer heartbeats since they send them back, older ones don't
+	// and their heartbeat is counted when it is sent
+	echoes := false
+
 	// Channel to receive the message or error
 	messageChan := make(chan byte, 1)
 
@@ -240,15 +257,15 @@ func (s *TcpMuxTransport) channelHandler() {
 			case <-s.ctx.Done():
 				return
 			default:
-				message, err := utils.ReceiveBinaryByte(s.controlChannel)
+				message, err := utils.ReceiveBinaryByte(controlChannel)
 				if err != nil {
 					s.logger.Errorf("failed to read from channel connection (try %d/%d): %v", retries+1, maxRetries, err)
 					retries++
 					if retries >= maxRetries {
 						if s.cancel != nil {
-							s.logger.Error("max retries reached, restarting...")
-							go s.Restart()
+							s.controlChannelLost(controlChannel)
 						}
+						close(messageChan)
 						return
 					}
 					time.Sleep(baseBackoff * time.Duration(retries))
@@ -263,25 +280,33 @@ func (s *TcpMuxTransport) channelHandler() {
 	for {
 		select {
 		case <-s.ctx.Done():
-			_ = utils.SendBinaryByte(s.controlChannel, utils.SG_Closed)
+			_ = utils.SendBinaryByte(controlChannel, utils.SG_Closed)
 			return
 
 		case <-s.reqNewConnChan:
-			err := utils.SendBinaryByte(s.controlChannel, utils.SG_Chan)
+			err := utils.SendBinaryByte(controlChannel, utils.SG_Chan)
 			if err != nil {
 				s.logger.Error("failed to send request new connection signal. ", err)
-				go s.Restart()
+				// ask again on the resumed control channel
+				select {
+				case s.reqNewConnChan <- struct{}{}:
+				default:
+				}
+				s.controlChannelLost(controlChannel)
 				return
 			}
 
 		case <-ticker.C:
-			err := utils.SendBinaryByte(s.controlChannel, utils.SG_HB)
+			err := utils.SendBinaryByte(controlChannel, utils.SG_HB)
 			if err != nil {
 				s.logger.Error("failed to send heartbeat signal")
-				go s.Restart()
+				s.controlChannelLost(controlChannel)
 				return
 			}
 			s.logger.Trace("heartbeat signal sent successfully")
+			if !echoes {
+				s.usageMonitor.Heartbeat()
+			}
 
 		case message, ok := <-messageChan:
 			if !ok {
@@ -293,6 +318,11 @@ func (s *TcpMuxTransport) channelHandler() {
 				s.logger.Warn("control channel has been closed by the client")
 				go s.Restart()
 				return
+
+			} else if message == utils.SG_HB {
+				s.logger.Trace("heartbeat signal received successfully")
+				echoes = true
+				s.usageMonitor.Heartbeat()
 			}
 		}
 	}
@@ -301,12 +331,13 @@ func (s *TcpMuxTransport) channelHandler() {
 func (s *TcpMuxTransport) tunnelListener() {
 	listener, err := net.Listen("tcp", s.config.BindAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to start listener on %s: %v", s.config.BindAddr, err)
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to start listener on %s: %v", s.config.BindAddr, err))
 		return
 	}
 
 	defer listener.Close()
 
+	s.config.Lifecycle.Listening()
 	s.logger.Infof("server started successfully, listening on address: %s", listener.Addr().String())
 
 	go s.acceptTunnelConn(listener)
@@ -335,6 +366,13 @@ func (s *TcpMuxTransport) acceptTunnelConn(listener net.Listener) {
 				continue
 			}
 
+			// Refuse hosts banned for failed authentication
+			if s.usageMonitor.Banned(conn.RemoteAddr().String()) {
+				s.logger.Debugf("refused tunnel connection from banned host %s", conn.RemoteAddr().String())
+				conn.Close()
+				continue
+			}
+
 			// Drop all suspicious packets from other address rather than server
 			if s.controlChannel != nil && s.controlChannel.RemoteAddr().(*net.TCPAddr).IP.String() != tcpConn.RemoteAddr().(*net.TCPAddr).IP.String() {
 				s.logger.Debugf("suspicious packet from %v. expected address: %v. discarding packet...", tcpConn.RemoteAddr().(*net.TCPAddr).IP.String(), s.controlChannel.RemoteAddr().(*net.TCPAddr).IP.String())
@@ -373,22 +411,121 @@ func (s *TcpMuxTransport) acceptTunnelConn(listener net.Listener) {
 				continue
 			}
 
-			session, err := smux.Client(conn, s.smuxConfig)
-			if err != nil {
-				s.logger.Errorf("failed to create MUX session for connection %s: %v", conn.RemoteAddr().String(), err)
-				conn.Close()
+			// A client with a session announces its tunnel connections
+			if s.session.granted() {
+				go s.sessionHandshake(tcpConn)
 				continue
 			}
 
-			select {
-			case s.tunnelChannel <- session: // ok
-			default:
-				s.logger.Warnf("tunnel listener channel is full, discarding TCP connection from %s", conn.LocalAddr().String())
-				session.Close()
-			}
+			s.queueTunnelConn(conn)
+		}
+	}
+
+}
+
+func (s *TcpMuxTransport) queueTunnelConn(conn net.Conn) {
+	session, err := smux.Client(conn, s.smuxConfig)
+	if err != nil {
+		s.logger.Errorf("failed to create MUX session for connection %s: %v", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+
+	select {
+	case s.tunnelChannel <- session: // ok
+	default:
+		s.logger.Warnf("tunnel listener channel is full, discarding TCP connection from %s", conn.LocalAddr().String())
+		session.Close()
+	}
+}
+
+// controlChannelLost waits for the client to resume the session of the lost
+// control channel, the server restarts if it can't.
+func (s *TcpMuxTransport) controlChannelLost(controlChannel net.Conn) {
+	if !s.session.lose(controlChannel, s.resumeExpired) {
+		return
+	}
+	if !s.session.resuming() {
+		s.logger.Error("control channel lost, restarting...")
+		go s.Restart()
+		return
+	}
+
+	s.logger.Warnf("control channel lost, waiting %s for the client to resume it", s.config.ResumeGrace)
+	controlChannel.Close()
+	s.config.TunnelStatus = "Resuming (TCPMux)"
+	s.usageMonitor.Resuming()
+}
+
+func (s *TcpMuxTransport) resumeExpired() {
+	s.logger.Error("control channel was not resumed in time, restarting...")
+	s.Restart()
+}
+
+// sessionHandshake reads what a client with a session sends first on tcpConn.
+// A mux connection announces the session and is queued, a control channel
+// dialed again resumes the session with a handshake.
+func (s *TcpMuxTransport) sessionHandshake(tcpConn *net.TCPConn) {
+	var conn net.Conn = tcpConn
+	if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		conn.Close()
+		return
+	}
+	msg, transport, err := utils.ReceiveBinaryTransportString(conn)
+	if err != nil || (transport != utils.SG_Tunnel && transport != utils.SG_Chan) {
+		s.logger.Debugf("invalid session handshake from %s: %v", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if transport == utils.SG_Tunnel {
+		if !s.session.tunnel(msg) {
+			s.logger.Debugf("mux connection from %s announced an unknown session", conn.RemoteAddr().String())
+			conn.Close()
+			return
 		}
+		s.queueTunnelConn(conn)
+		return
+	}
+
+	previous := s.controlChannel
+
+	reply, resumed, valid := s.session.resume(s.config.Tokens, msg, conn)
+	if !valid {
+		s.logger.Warnf("invalid security token received from %s", conn.RemoteAddr().String())
+		s.usageMonitor.InvalidToken(conn.RemoteAddr().String())
+		conn.Close()
+		return
+	} else if !resumed {
+		s.logger.Warn("new control channel requested instead of resuming, restarting...")
+		conn.Close()
+		go s.Restart()
+		return
+	}
+
+	if err := utils.SendBinaryTransportString(conn, reply, utils.SG_Chan); err != nil {
+		s.logger.Errorf("failed to send security token: %v", err)
+		s.controlChannelLost(conn)
+		return
+	}
+
+	//FORCE CONTROL CHANNEL TO BE TCP_NODELAY
+	if err := tcpConn.SetNoDelay(true); err != nil {
+		s.logger.Warnf("failed to set TCP_NODELAY for Control Channel %s: %v", conn.RemoteAddr().String(), err)
 	}
 
+	// The client may have noticed the loss before the server did
+	if previous != nil && previous != conn {
+		previous.Close()
+	}
+
+	s.controlChannel = conn
+	s.config.TunnelStatus = "Connected (TCPMux)"
+	s.usageMonitor.ControlChannelUp(s.config.TunnelStatus)
+	s.logger.Info("control channel resumed")
+
+	go s.channelHandler()
 }
 
 func (s *TcpMuxTransport) parsePortMappings() {
@@ -406,18 +543,21 @@ func (s *TcpMuxTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					return
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					return
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					return
 				}
 
 				// Create listeners for all ports in the range
@@ -431,7 +571,8 @@ func (s *TcpMuxTransport) parsePortMappings() {
 				// Handle single port case
 				port, err := strconv.Atoi(localPortOrRange)
 				if err != nil || port < 1 || port > 65535 {
-					s.logger.Fatalf("invalid port format: %s", localPortOrRange)
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid port format: %s", localPortOrRange))
+					return
 				}
 				localAddr = fmt.Sprintf(":%d", port)
 			}
@@ -444,18 +585,21 @@ func (s *TcpMuxTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					return
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					return
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					return
 				}
 
 				// Create listeners for all ports in the range
@@ -468,14 +612,15 @@ func (s *TcpMuxTransport) parsePortMappings() {
 			} else {
 				// Handle single local port case
 				port, err := strconv.Atoi(localPortOrRange)
-				if err == nil && port > 1 && port < 65535 { // format port=remoteAddress
+				if err == nil && port >= 1 && port <= 65535 { // format port=remoteAddress
 					localAddr = fmt.Sprintf(":%d", port)
 				} else {
 					localAddr = localPortOrRange // format ip:port=remoteAddress
 				}
 			}
 		} else {
-			s.logger.Fatalf("invalid port mapping format: %s", portMapping)
+			s.config.Lifecycle.Fail(fmt.Errorf("invalid port mapping format: %s", portMapping))
+			return
 		}
 		// Start listeners for single port
 		go s.localListener(localAddr, remoteAddr)
@@ -483,22 +628,48 @@ func (s *TcpMuxTransport) parsePortMappings() {
 }
 
 func (s *TcpMuxTransport) localListener(localAddr string, remoteAddr string) {
-	listener, err := net.Listen("tcp", localAddr)
+	listeners, err := listenShards(localAddr, s.config.AcceptShards)
 	if err != nil {
-		s.logger.Fatalf("failed to start listener on %s: %v", localAddr, err)
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to start listener on %s: %v", localAddr, err))
 		return
 	}
 
+	for _, listener := range listeners {
+		defer listener.Close()
+	}
+
+	s.logger.Infof("listener started successfully, listening on address: %s", listeners[0].Addr().String())
+
+	// Every shard queues its connections for the sessions serving it
+	for i, listener := range listeners {
+		go s.acceptLocalConn(listener, remoteAddr, s.queues.shard(i))
+	}
+
+	<-s.ctx.Done()
+}
+
+// transparentListener accepts the traffic the firewall redirects to the
+// transparent proxy.
+func (s *TcpMuxTransport) transparentListener() {
+	listener, err := s.config.Transparent.listen()
+	if err != nil {
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to start transparent proxy on %s: %v", s.config.Transparent.Addr, err))
+		return
+	}
+
+	//close the listener after context cancellation
 	defer listener.Close()
 
-	s.logger.Infof("listener started successfully, listening on address: %s", listener.Addr().String())
+	s.logger.Infof("transparent proxy (%s) started successfully, listening on address: %s", s.config.Transparent.Mode, listener.Addr().String())
 
-	go s.acceptLocalConn(listener, remoteAddr)
+	go s.acceptLocalConn(listener, "", nil)
 
 	<-s.ctx.Done()
 }
 
-func (s *TcpMuxTransport) acceptLocalConn(listener net.Listener, remoteAddr string) {
+// acceptLocalConn queues the connections of listener in queue, the queues in
+// turn if nil.
+func (s *TcpMuxTransport) acceptLocalConn(listener net.Listener, remoteAddr string, queue *muxQueue) {
 	for {
 		select {
 		case <-s.ctx.Done():
@@ -519,6 +690,14 @@ func (s *TcpMuxTransport) acceptLocalConn(listener net.Listener, remoteAddr stri
 				continue
 			}
 
+			// the transparent proxy's connections go to their original destination
+			target, port, err := localTarget(listener, tcpConn, remoteAddr)
+			if err != nil {
+				s.logger.Warnf("discarded connection from %s: %v", tcpConn.RemoteAddr().String(), err)
+				conn.Close()
+				continue
+			}
+
 			// trying to disable tcpnodelay
 			if !s.config.Nodelay {
 				if err := tcpConn.SetNoDelay(s.config.Nodelay); err != nil {
@@ -528,16 +707,17 @@ func (s *TcpMuxTransport) acceptLocalConn(listener net.Listener, remoteAddr stri
 				}
 			}
 
-			select {
-			case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: remoteAddr, timeCreated: time.Now().UnixMilli()}:
+			q := queue
+			if q == nil {
+				q = s.queues.any()
+			}
+			ok, needSession := s.queues.push(q, LocalTCPConn{conn: conn, remoteAddr: target, timeCreated: time.Now().UnixMilli(), localPort: port})
+			switch {
+			case ok:
 				s.logger.Debugf("accepted incoming TCP connection from %s", tcpConn.RemoteAddr().String())
 
-				// +1 for stream counter
-				atomic.AddInt32(&s.streamCounter, 1)
-
-				if atomic.LoadInt32(&s.streamCounter) >= atomic.LoadInt32(&s.sessionCounter)*int32(s.config.MuxCon) {
-					s.logger.Tracef("stream counter: %v, session counter: %v", atomic.LoadInt32(&s.streamCounter), atomic.LoadInt32(&s.sessionCounter))
-
+				if needSession {
+					s.logger.Tracef("stream counter: %v, session counter: %v", q.streams.Load(), q.sessions.Load())
 					select { // Attempt to request a new connection
 					case s.reqNewConnChan <- struct{}{}:
 					default:
@@ -555,6 +735,19 @@ func (s *TcpMuxTransport) acceptLocalConn(listener net.Listener, remoteAddr stri
 
 }
 
+// Forward queues a connection handed over by a relay, like acceptLocalConn does.
+func (s *TcpMuxTransport) Forward(conn net.Conn, target string) bool {
+	ok, needSession := s.queues.push(s.queues.any(), LocalTCPConn{conn: conn, remoteAddr: target, timeCreated: time.Now().UnixMilli()})
+	if needSession {
+		select {
+		case s.reqNewConnChan <- struct{}{}:
+		default:
+			s.logger.Warn("failed to request new connection. channel is full")
+		}
+	}
+	return ok
+}
+
 func (s *TcpMuxTransport) handleLoop() {
 	for {
 		select {
@@ -562,15 +755,13 @@ func (s *TcpMuxTransport) handleLoop() {
 			return
 
 		case session := <-s.tunnelChannel:
-			// +1 for session counter
-			atomic.AddInt32(&s.sessionCounter, 1)
-
-			go s.handleSession(session)
+			// the session serves the queue that needs it most
+			go s.handleSession(session, s.queues.assign())
 		}
 	}
 }
 
-func (s *TcpMuxTransport) handleSession(session *smux.Session) {
+func (s *TcpMuxTransport) handleSession(session *smux.Session, queue *muxQueue) {
 	counter := make(chan struct{}, s.config.MuxCon)
 	defer session.Close()
 	defer close(counter)
@@ -583,49 +774,51 @@ func (s *TcpMuxTransport) handleSession(session *smux.Session) {
 		case <-s.ctx.Done():
 			return
 
-		case incomingConn := <-s.localChannel:
+		case incomingConn := <-queue.conns:
 			if time.Now().UnixMilli()-incomingConn.timeCreated > 3000 { // 3000ms
 				s.logger.Debugf("timeouted local connection: %d ms", time.Now().UnixMilli()-incomingConn.timeCreated)
 				incomingConn.conn.Close()
 
 				// Decrement the counter
-				atomic.AddInt32(&s.streamCounter, -1)
+				queue.streams.Add(-1)
 				<-counter
 				continue
 			}
 
 			stream, err := session.OpenStream()
 			if err != nil {
-				s.handleSessionError(&incomingConn, err)
+				s.handleSessionError(queue, &incomingConn, err)
 				return
 			}
 
 			// Send the target port over the tunnel connection
-			if err := utils.SendBinaryString(stream, incomingConn.remoteAddr); err != nil {
+			if err := utils.SendBinaryString(stream, incomingConn.target(s.config.SourceMetadata)); err != nil {
 				s.logger.Tracef("failed to send address over stream: %v", err)
 				// Put local connection back to local channel
-				s.localChannel <- incomingConn
+				queue.conns <- incomingConn
 				continue
 			}
 
 			// Handle data exchange between connections
+			tracked, conn := incomingConn.track(s.usageMonitor, "tcpmux")
 			go func() {
-				utils.TCPConnectionHandler(stream, incomingConn.conn, s.logger, s.usageMonitor, incomingConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
-				atomic.AddInt32(&s.streamCounter, -1)
+				utils.TCPConnectionHandler(stream, conn, s.logger, s.usageMonitor, incomingConn.port(), s.config.Sniffer)
+				tracked.Done()
+				queue.streams.Add(-1)
 				<-counter // read signal from the channel
 			}()
 		}
 	}
 }
 
-func (s *TcpMuxTransport) handleSessionError(incomingConn *LocalTCPConn, err error) {
+func (s *TcpMuxTransport) handleSessionError(queue *muxQueue, incomingConn *LocalTCPConn, err error) {
 	s.logger.Tracef("failed to handle session: %v", err)
 
 	// decrease session value
-	atomic.AddInt32(&s.sessionCounter, -1)
+	queue.sessions.Add(-1)
 
 	// Put local connection back to local channel
-	s.localChannel <- *incomingConn
+	queue.conns <- *incomingConn
 
 	// Attempt to request a new connection
 	select {
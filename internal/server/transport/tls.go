@@ -0,0 +1,77 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/musix/backhaul/internal/utils"
+	"github.com/musix/backhaul/internal/web"
+
+	"github.com/sirupsen/logrus"
+)
+
+// serverTLS is the TLS state of wss, wssmux and quic listeners. The certificate
+// comes either from ACME or from a key pair on disk that is reloaded on change.
+type serverTLS struct {
+	config *tls.Config
+	acme   *utils.ACMEManager  // nil when ACME is disabled
+	certs  *utils.CertReloader // nil when ACME is enabled
+}
+
+// loadServerTLS prepares the TLS configuration of wss, wssmux and quic listeners.
+// Without ACME the configured key pair is used (a self-signed one is generated if missing).
+func loadServerTLS(bindAddr, certFile, keyFile, clientCA string, acmeConfig *utils.ACMEConfig, expiryWarnDays int, logger *logrus.Logger) (*serverTLS, error) {
+	if clientCA != "" {
+		logger.Info("mutual TLS enabled, client certificates are required")
+	}
+
+	if acmeConfig != nil {
+		acmeManager, err := utils.NewACMEManager(acmeConfig, logger)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig, err := acmeManager.TLSConfig(clientCA)
+		if err != nil {
+			return nil, err
+		}
+		logger.Infof("acme certificate management enabled for %v", acmeConfig.Domains)
+		return &serverTLS{config: tlsConfig, acme: acmeManager}, nil
+	}
+
+	host, _, _ := net.SplitHostPort(bindAddr)
+	if host == "" {
+		host = "localhost"
+	}
+	if err := utils.EnsureSelfSignedCert(certFile, keyFile, host); err != nil {
+		return nil, err
+	}
+
+	certs, err := utils.NewCertReloader(certFile, keyFile, expiryWarnDays, logger)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := utils.NewServerTLSConfig(certs, clientCA)
+	if err != nil {
+		return nil, err
+	}
+	if pin, err := utils.CertFilePin(certFile); err == nil {
+		logger.Infof("server certificate SPKI pin: %s", pin)
+	}
+	logger.Infof("server certificate valid until %s", certs.NotAfter().Format(time.RFC3339))
+
+	return &serverTLS{config: tlsConfig, certs: certs}, nil
+}
+
+// start begins certificate renewal (ACME) or file watching and publishes the
+// certificate expiry on the web panel. It must be called once the bind port is listening.
+func (t *serverTLS) start(ctx context.Context, usage *web.Usage) {
+	if t.acme != nil {
+		t.acme.Start(ctx)
+		usage.SetCertExpiry(t.acme.NotAfter)
+		return
+	}
+	go t.certs.Watch(ctx)
+	usage.SetCertExpiry(t.certs.NotAfter)
+}
@@ -0,0 +1,73 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Transparent proxy modes, how the traffic reaches the transparent listener
+const (
+	Redirect = "redirect" // iptables/nftables REDIRECT (NAT), TCP only
+	TProxy   = "tproxy"   // iptables/nftables TPROXY, TCP and UDP
+)
+
+// TransparentProxy is a listener for traffic that the firewall redirects to
+// the server, every connection is forwarded to its original destination.
+type TransparentProxy struct {
+	Mode string // Redirect or TProxy
+	Addr string // the address the traffic is redirected to
+	Host string // forward the original port to this host instead of the original address
+}
+
+// target returns the target of traffic sent to dst.
+func (p *TransparentProxy) target(ip net.IP, port int) string {
+	if p.Host != "" {
+		return net.JoinHostPort(p.Host, strconv.Itoa(port))
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// transparentListener accepts the connections of the transparent proxy.
+type transparentListener struct {
+	*net.TCPListener
+	proxy *TransparentProxy
+}
+
+// localTarget returns the target of conn accepted on listener and the local
+// port its usage is counted on: remoteAddr and the listener's port for port
+// mappings, the original destination for the transparent proxy.
+func localTarget(listener net.Listener, conn *net.TCPConn, remoteAddr string) (string, int, error) {
+	l, ok := listener.(*transparentListener)
+	if !ok {
+		return remoteAddr, conn.LocalAddr().(*net.TCPAddr).Port, nil
+	}
+	dst, err := l.proxy.originalDst(conn)
+	if err != nil {
+		return "", 0, fmt.Errorf("no original destination: %v", err)
+	}
+	return l.proxy.target(dst.IP, dst.Port), dst.Port, nil
+}
+
+// listenLocalUDP opens the UDP listener of a port mapping, or the transparent
+// proxy's when proxy is set.
+func listenLocalUDP(localAddr string, proxy *TransparentProxy) (*net.UDPConn, error) {
+	if proxy != nil {
+		return proxy.listenUDP()
+	}
+	localUDPAddr, err := net.ResolveUDPAddr("udp", localAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve local address: %v", err)
+	}
+	return net.ListenUDP("udp", localUDPAddr)
+}
+
+// readLocalUDP reads a packet from a UDP listener, with oob from the
+// transparent proxy's and its original destination.
+func readLocalUDP(listener *net.UDPConn, buf, oob []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	if oob == nil {
+		n, addr, err := listener.ReadFromUDP(buf)
+		return n, addr, nil, err
+	}
+	return readUDP(listener, buf, oob)
+}
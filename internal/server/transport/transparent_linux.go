@@ -0,0 +1,191 @@
+//go:build linux
+// +build linux
+
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// Socket options missing from syscall
+const (
+	soOriginalDst       = 80 // SO_ORIGINAL_DST, IP6T_SO_ORIGINAL_DST
+	ipv6RecvOrigDstAddr = 74 // IPV6_RECVORIGDSTADDR, also the control message type
+)
+
+// transparentControl sets IP_TRANSPARENT, so a socket accepts traffic for and
+// sends from addresses that aren't local. With recvOrigDst received UDP
+// packets come with their original destination, and the reply sockets bound
+// to it may share the listener's address.
+func transparentControl(recvOrigDst bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var controlErr error
+		err := c.Control(func(fd uintptr) {
+			// IP_TRANSPARENT also applies to the IPv6 traffic of an IPv6 socket
+			if controlErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); controlErr != nil {
+				return
+			}
+			if !recvOrigDst {
+				return
+			}
+			if controlErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); controlErr != nil {
+				return
+			}
+			if controlErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1); controlErr != nil {
+				return
+			}
+			if network == "udp6" {
+				controlErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return controlErr
+	}
+}
+
+// listen opens the TCP listener of the transparent proxy.
+func (p *TransparentProxy) listen() (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if p.Mode == TProxy {
+		lc.Control = transparentControl(false)
+	}
+	listener, err := lc.Listen(context.Background(), "tcp", p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return &transparentListener{TCPListener: listener.(*net.TCPListener), proxy: p}, nil
+}
+
+// originalDst returns the address a redirected connection was sent to. With
+// TPROXY the connection keeps it as its local address, REDIRECT replaced it
+// and the NAT table has it.
+func (p *TransparentProxy) originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	if p.Mode == TProxy {
+		return local, nil
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var dst *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// sockaddr_in fits the 20 bytes of an ipv6_mreq
+			var mreq *syscall.IPv6Mreq
+			mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+			if sockErr == nil {
+				dst = mreqOriginalDst(mreq)
+			}
+			return
+		}
+		// and sockaddr_in6 the 32 bytes of an ip6_mtuinfo
+		var info *syscall.IPv6MTUInfo
+		info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+		if sockErr == nil {
+			dst = mtuInfoOriginalDst(info)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dst, sockErr
+}
+
+// mreqOriginalDst decodes the sockaddr_in SO_ORIGINAL_DST wrote to mreq.
+func mreqOriginalDst(mreq *syscall.IPv6Mreq) *net.TCPAddr {
+	sa := mreq.Multiaddr
+	return &net.TCPAddr{IP: net.IPv4(sa[4], sa[5], sa[6], sa[7]), Port: int(binary.BigEndian.Uint16(sa[2:4]))}
+}
+
+// mtuInfoOriginalDst decodes the sockaddr_in6 IP6T_SO_ORIGINAL_DST wrote to info.
+func mtuInfoOriginalDst(info *syscall.IPv6MTUInfo) *net.TCPAddr {
+	port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+	return &net.TCPAddr{IP: net.IP(append([]byte(nil), info.Addr.Addr[:]...)), Port: int(binary.BigEndian.Uint16(port[:]))}
+}
+
+// listenUDP opens the UDP listener of the transparent proxy, only TPROXY can
+// redirect UDP.
+func (p *TransparentProxy) listenUDP() (*net.UDPConn, error) {
+	if p.Mode != TProxy {
+		return nil, errors.New("UDP needs the tproxy mode")
+	}
+	lc := net.ListenConfig{Control: transparentControl(true)}
+	conn, err := lc.ListenPacket(context.Background(), "udp", p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// readUDP reads a packet from the transparent UDP listener with its source
+// and original destination.
+func readUDP(listener *net.UDPConn, buf, oob []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	n, oobn, _, addr, err := listener.ReadMsgUDP(buf, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	dst, err := originalDstFromControl(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return n, addr, dst, nil
+}
+
+// originalDstFromControl returns the original destination in the control
+// messages oob of a received packet.
+func originalDstFromControl(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		// the message is a sockaddr_in or sockaddr_in6, the port at the same offset
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_ORIGDSTADDR && len(msg.Data) >= 8:
+			ip := net.IPv4(msg.Data[4], msg.Data[5], msg.Data[6], msg.Data[7])
+			return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(msg.Data[2:4]))}, nil
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == ipv6RecvOrigDstAddr && len(msg.Data) >= 24:
+			ip := net.IP(append([]byte(nil), msg.Data[8:24]...))
+			return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(msg.Data[2:4]))}, nil
+		}
+	}
+	return nil, errors.New("packet without original destination")
+}
+
+// replyUDP opens the socket the replies to a transparent UDP flow are sent
+// from, it is bound to the original destination.
+func replyUDP(dst *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var controlErr error
+		err := c.Control(func(fd uintptr) {
+			// the listener and other flows are bound to the address too
+			if controlErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); controlErr != nil {
+				return
+			}
+			controlErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return controlErr
+	}}
+	network := "udp6"
+	if dst.IP.To4() != nil {
+		network = "udp4"
+	}
+	conn, err := lc.ListenPacket(context.Background(), network, dst.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,118 @@
+//go:build linux
+// +build linux
+
+package transport
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// controlMessage encodes a socket control message like the kernel does.
+func controlMessage(level, typ int, data []byte) []byte {
+	b := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(b[syscall.CmsgLen(0):], data)
+	return b
+}
+
+func sockaddrInet4(ip net.IP, port int) []byte {
+	sa := make([]byte, syscall.SizeofSockaddrInet4)
+	binary.LittleEndian.PutUint16(sa[0:2], syscall.AF_INET)
+	binary.BigEndian.PutUint16(sa[2:4], uint16(port))
+	copy(sa[4:8], ip.To4())
+	return sa
+}
+
+func sockaddrInet6(ip net.IP, port int) []byte {
+	sa := make([]byte, syscall.SizeofSockaddrInet6)
+	binary.LittleEndian.PutUint16(sa[0:2], syscall.AF_INET6)
+	binary.BigEndian.PutUint16(sa[2:4], uint16(port))
+	copy(sa[8:24], ip.To16())
+	return sa
+}
+
+func TestOriginalDstFromControl(t *testing.T) {
+	other := controlMessage(syscall.SOL_SOCKET, syscall.SCM_TIMESTAMP, make([]byte, 16))
+	tests := []struct {
+		name string
+		oob  []byte
+		want string
+	}{
+		{"ipv4", controlMessage(syscall.SOL_IP, syscall.IP_ORIGDSTADDR, sockaddrInet4(net.IPv4(192, 0, 2, 1), 53)), "192.0.2.1:53"},
+		{"ipv6", controlMessage(syscall.SOL_IPV6, ipv6RecvOrigDstAddr, sockaddrInet6(net.ParseIP("2001:db8::1"), 443)), "[2001:db8::1]:443"},
+		{"after another message", append(other, controlMessage(syscall.SOL_IP, syscall.IP_ORIGDSTADDR, sockaddrInet4(net.IPv4(198, 51, 100, 7), 8080))...), "198.51.100.7:8080"},
+		{"none", other, ""},
+		{"truncated", controlMessage(syscall.SOL_IP, syscall.IP_ORIGDSTADDR, make([]byte, 4)), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, err := originalDstFromControl(tt.oob)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("originalDstFromControl() = %v, want an error", dst)
+				}
+				return
+			}
+			if err != nil || dst.String() != tt.want {
+				t.Fatalf("originalDstFromControl() = %v, %v, want %s", dst, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOriginalDstSockopt(t *testing.T) {
+	var mreq syscall.IPv6Mreq
+	copy(mreq.Multiaddr[:], sockaddrInet4(net.IPv4(192, 0, 2, 1), 8443))
+	if got := mreqOriginalDst(&mreq).String(); got != "192.0.2.1:8443" {
+		t.Errorf("mreqOriginalDst() = %s, want 192.0.2.1:8443", got)
+	}
+
+	var info syscall.IPv6MTUInfo
+	copy((*[syscall.SizeofSockaddrInet6]byte)(unsafe.Pointer(&info.Addr))[:], sockaddrInet6(net.ParseIP("2001:db8::2"), 8443))
+	if got := mtuInfoOriginalDst(&info).String(); got != "[2001:db8::2]:8443" {
+		t.Errorf("mtuInfoOriginalDst() = %s, want [2001:db8::2]:8443", got)
+	}
+}
+
+func TestReadUDPOriginalDst(t *testing.T) {
+	// IP_RECVORIGDSTADDR needs no privileges, unlike IP_TRANSPARENT
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	raw, err := listener.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sockErr error
+	raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1)
+	})
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+
+	sender, err := net.DialUDP("udp4", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	sender.Write([]byte("packet"))
+
+	buf, oob := make([]byte, 64), make([]byte, 128)
+	n, src, dst, err := readUDP(listener, buf, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "packet" || src.String() != sender.LocalAddr().String() || dst.String() != listener.LocalAddr().String() {
+		t.Fatalf("readUDP() = %q from %v to %v, want the packet from %v to %v", buf[:n], src, dst, sender.LocalAddr(), listener.LocalAddr())
+	}
+}
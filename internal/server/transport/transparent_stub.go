@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+package transport
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxy is only supported on linux")
+
+func (p *TransparentProxy) listen() (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func (p *TransparentProxy) originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errTransparentUnsupported
+}
+
+func (p *TransparentProxy) listenUDP() (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
+
+func readUDP(listener *net.UDPConn, buf, oob []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	return 0, nil, nil, errTransparentUnsupported
+}
+
+func replyUDP(dst *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
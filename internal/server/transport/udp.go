@@ -32,13 +32,15 @@ type UdpTransport struct {
 
 type UdpConfig struct {
 	BindAddr     string
-	Token        string
+	Tokens       *utils.TokenSet // accepted tokens, updated without restart
 	SnifferLog   string
 	TunnelStatus string
+	Lifecycle    *Lifecycle // tells the server that the transport listens or failed
 	Ports        []string
 	Sniffer      bool
 	Heartbeat    time.Duration // in seconds, for udp conn and control channel
 	ChannelSize  int
+	Transparent  *TransparentProxy // nil without transparent proxy
 	WebPort      int
 }
 
@@ -68,6 +70,7 @@ func (s *UdpTransport) Start() {
 	s.config.TunnelStatus = "Disconnected (UDP)"
 
 	if s.config.WebPort > 0 {
+		s.usageMonitor.SetPoolSize(func() int { return len(s.tunnelChannel) })
 		go s.usageMonitor.Monitor()
 	}
 
@@ -82,6 +85,7 @@ func (s *UdpTransport) Restart() {
 	defer s.restartMutex.Unlock()
 
 	s.logger.Info("restarting server...")
+	s.usageMonitor.Restarting()
 
 	// for removing timeout logs
 	level := s.logger.Level
@@ -120,10 +124,11 @@ func (s *UdpTransport) Restart() {
 func (s *UdpTransport) channelHandshake() {
 	listener, err := net.Listen("tcp", s.config.BindAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to start listener on %s: %v", s.config.BindAddr, err)
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to start listener on %s: %v", s.config.BindAddr, err))
 		return
 	}
 
+	s.config.Lifecycle.Listening()
 	s.logger.Infof("server started successfully, listening on address: %s", listener.Addr().String())
 
 	defer listener.Close()
@@ -140,6 +145,13 @@ loop:
 				continue
 			}
 
+			// Refuse hosts banned for failed authentication
+			if s.usageMonitor.Banned(conn.RemoteAddr().String()) {
+				s.logger.Debugf("refused tunnel connection from banned host %s", conn.RemoteAddr().String())
+				conn.Close()
+				continue
+			}
+
 			// Set a read deadline for the token response
 			if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
 				s.logger.Errorf("failed to set read deadline: %v", err)
@@ -166,13 +178,15 @@ loop:
 			// Resetting the deadline (removes any existing deadline)
 			conn.SetReadDeadline(time.Time{})
 
-			if msg != s.config.Token {
-				s.logger.Warnf("invalid security token received: %s", msg)
+			if !s.config.Tokens.Valid(msg) {
+				s.logger.Warnf("invalid security token received from %s", conn.RemoteAddr().String())
+				s.usageMonitor.InvalidToken(conn.RemoteAddr().String())
 				conn.Close()
 				continue
 			}
 
-			err = utils.SendBinaryTransportString(conn, s.config.Token, utils.SG_Chan)
+			// echo the presented token, the client checks it
+			err = utils.SendBinaryTransportString(conn, msg, utils.SG_Chan)
 			if err != nil {
 				s.logger.Errorf("failed to send security token: %v", err)
 				conn.Close()
@@ -180,6 +194,7 @@ loop:
 			}
 
 			s.controlChannel = conn
+			s.usageMonitor.ControlChannelUp(s.config.TunnelStatus)
 
 			s.logger.Info("control channel successfully established.")
 
@@ -189,6 +204,10 @@ loop:
 
 	go s.tunnelListener()
 	go s.parsePortMappings()
+
+	if s.config.Transparent != nil {
+		go s.localListener(s.config.Transparent.Addr, "", s.config.Transparent)
+	}
 	go s.channelHandler()
 
 	<-s.ctx.Done()
@@ -230,8 +249,9 @@ func (s *UdpTransport) channelHandler() {
 		}
 	}()
 
-	// RTT measurment
+	// RTT measurment, repeated with every heartbeat
 	rtt := time.Now()
+	logRTT := s.logger.Infof
 	err := utils.SendBinaryByte(s.controlChannel, utils.SG_RTT)
 	if err != nil {
 		s.logger.Error("failed to send RTT signal, attempting to restart server...")
@@ -262,6 +282,14 @@ func (s *UdpTransport) channelHandler() {
 			}
 			s.logger.Trace("heartbeat signal sent successfully")
 
+			// The client answers RTT signals, the answer is its heartbeat
+			rtt = time.Now()
+			if err := utils.SendBinaryByte(s.controlChannel, utils.SG_RTT); err != nil {
+				s.logger.Error("failed to send RTT signal, attempting to restart server...")
+				go s.Restart()
+				return
+			}
+
 		case message, ok := <-messageChan:
 			if !ok {
 				s.logger.Error("channel closed, likely due to an error in TCP read")
@@ -276,7 +304,10 @@ func (s *UdpTransport) channelHandler() {
 			} else if message == utils.SG_RTT {
 				measureRTT := time.Since(rtt)
 				s.rtt = measureRTT.Milliseconds()
-				s.logger.Infof("Round Trip Time (RTT): %d ms", s.rtt)
+				s.usageMonitor.SetRTT(s.rtt)
+				s.usageMonitor.Heartbeat()
+				logRTT("Round Trip Time (RTT): %d ms", s.rtt)
+				logRTT = s.logger.Debugf
 			}
 		}
 	}
@@ -285,12 +316,14 @@ func (s *UdpTransport) channelHandler() {
 func (s *UdpTransport) tunnelListener() {
 	tunnelUDPAddr, err := net.ResolveUDPAddr("udp", s.config.BindAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to resolve tunnel address: %v", err)
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to resolve tunnel address: %v", err))
+		return
 	}
 
 	listener, err := net.ListenUDP("udp", tunnelUDPAddr)
 	if err != nil {
-		s.logger.Fatalf("failed to listen on tunnel UDP port: %v", err)
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to listen on tunnel UDP port: %v", err))
+		return
 	}
 
 	defer listener.Close()
@@ -337,8 +370,14 @@ func (s *UdpTransport) acceptTunnelConn(listener *net.UDPConn) {
 
 			s.activeMu.Unlock()
 
-			if string(buf[:n]) != s.config.Token { // For new connections, validate the token
+			if s.usageMonitor.Banned(key) { // Refuse new connections from banned hosts
+				s.logger.Debugf("dropped UDP packet from banned host %s", key)
+				continue
+			}
+
+			if !s.config.Tokens.Valid(string(buf[:n])) { // For new connections, validate the token
 				s.logger.Errorf("invalid token received from %s", addr.String())
+				s.usageMonitor.InvalidToken(addr.String())
 				continue
 			}
 
@@ -390,32 +429,36 @@ func (s *UdpTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					return
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					return
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					return
 				}
 
 				// Create listeners for all ports in the range
 				for port := startPort; port <= endPort; port++ {
 					localAddr = fmt.Sprintf(":%d", port)
-					go s.localListener(localAddr, strconv.Itoa(port)) // Use port as the remoteAddr
-					time.Sleep(1 * time.Millisecond)                  // for wide port ranges
+					go s.localListener(localAddr, strconv.Itoa(port), nil) // Use port as the remoteAddr
+					time.Sleep(1 * time.Millisecond)                       // for wide port ranges
 				}
 				continue
 			} else {
 				// Handle single port case
 				port, err := strconv.Atoi(localPortOrRange)
 				if err != nil || port < 1 || port > 65535 {
-					s.logger.Fatalf("invalid port format: %s", localPortOrRange)
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid port format: %s", localPortOrRange))
+					return
 				}
 				localAddr = fmt.Sprintf(":%d", port)
 			}
@@ -428,53 +471,55 @@ func (s *UdpTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					return
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					return
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					return
 				}
 
 				// Create listeners for all ports in the range
 				for port := startPort; port <= endPort; port++ {
 					localAddr = fmt.Sprintf(":%d", port)
-					go s.localListener(localAddr, remoteAddr)
+					go s.localListener(localAddr, remoteAddr, nil)
 					time.Sleep(1 * time.Millisecond) // for wide port ranges
 				}
 				continue
 			} else {
 				// Handle single local port case
 				port, err := strconv.Atoi(localPortOrRange)
-				if err == nil && port > 1 && port < 65535 { // format port=remoteAddress
+				if err == nil && port >= 1 && port <= 65535 { // format port=remoteAddress
 					localAddr = fmt.Sprintf(":%d", port)
 				} else {
 					localAddr = localPortOrRange // format ip:port=remoteAddress
 				}
 			}
 		} else {
-			s.logger.Fatalf("invalid port mapping format: %s", portMapping)
+			s.config.Lifecycle.Fail(fmt.Errorf("invalid port mapping format: %s", portMapping))
+			return
 		}
 		// Start listeners for single port
-		go s.localListener(localAddr, remoteAddr)
+		go s.localListener(localAddr, remoteAddr, nil)
 	}
 }
 
-func (s *UdpTransport) localListener(localAddr, remoteAddr string) {
-	localUDPAddr, err := net.ResolveUDPAddr("udp", localAddr)
-	if err != nil {
-		s.logger.Fatalf("failed to resolve local address: %v", err)
-	}
-
-	listener, err := net.ListenUDP("udp", localUDPAddr)
+// localListener forwards the traffic of a port mapping, or with proxy the
+// traffic redirected to the transparent proxy.
+func (s *UdpTransport) localListener(localAddr, remoteAddr string, proxy *TransparentProxy) {
+	listener, err := listenLocalUDP(localAddr, proxy)
 	if err != nil {
-		s.logger.Fatalf("failed to listen on local UDP port: %v", err)
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to listen on local UDP port: %v", err))
+		return
 	}
 
 	defer listener.Close()
@@ -484,6 +529,12 @@ func (s *UdpTransport) localListener(localAddr, remoteAddr string) {
 	// Buffer for UDP reads
 	buf := make([]byte, 16*1024)
 
+	// the original destination of the transparent proxy's packets
+	var oob []byte
+	if proxy != nil {
+		oob = make([]byte, 128)
+	}
+
 	// Track active connections
 	activeConnections := map[string]*LocalUDPConn{}
 
@@ -502,14 +553,14 @@ func (s *UdpTransport) localListener(localAddr, remoteAddr string) {
 			case <-s.ctx.Done():
 				return
 			default:
-				n, addr, err := listener.ReadFromUDP(buf)
+				n, addr, dst, err := readLocalUDP(listener, buf, oob)
 				if err != nil {
 					s.logger.Errorf("failed to read from UDP listener: %v", err)
 					continue
 				}
 
 				// Create a unique identifier for the connection based on IP and port
-				key := addr.String()
+				key := udpFlowKey(addr, dst)
 
 				mu.Lock()
 				// Check if the connection is already active
@@ -527,6 +578,16 @@ func (s *UdpTransport) localListener(localAddr, remoteAddr string) {
 
 				mu.Unlock()
 
+				// The transparent proxy replies from the original destination
+				target, replyConn := remoteAddr, listener
+				if dst != nil {
+					target = proxy.target(dst.IP, dst.Port)
+					if replyConn, err = replyUDP(dst); err != nil {
+						s.logger.Warnf("failed to open UDP reply socket for %s: %v", dst.String(), err)
+						continue
+					}
+				}
+
 				// Create a new payload channel for this connection, Buffer up to 100,000 packets for the connection
 				payloadChan := make(chan []byte, 100_000)
 
@@ -534,9 +595,11 @@ func (s *UdpTransport) localListener(localAddr, remoteAddr string) {
 				newUDPConn := LocalUDPConn{
 					timeCreated: time.Now().UnixMilli(), // Just for debugging
 					payload:     payloadChan,
-					remoteAddr:  remoteAddr,
-					listener:    listener,
+					remoteAddr:  target,
+					listener:    replyConn,
 					addr:        addr,
+					key:         key,
+					transparent: dst != nil,
 				}
 
 				mu.Lock()
@@ -563,6 +626,9 @@ func (s *UdpTransport) localListener(localAddr, remoteAddr string) {
 					// Close the newly created connection as it couldn't be added
 					close(newUDPConn.payload)
 					delete(activeConnections, key)
+					if newUDPConn.transparent {
+						replyConn.Close()
+					}
 				}
 			}
 		}
@@ -580,6 +646,9 @@ func (s *UdpTransport) handleLoop(udpChan chan *LocalUDPConn, activeConnections
 		case localConn := <-udpChan:
 			if time.Now().UnixMilli()-localConn.timeCreated > 3000 { // 3000ms
 				s.logger.Debugf("timeouted local connection: %d ms", time.Now().UnixMilli()-localConn.timeCreated)
+				if localConn.transparent {
+					localConn.listener.Close()
+				}
 				continue
 			}
 
@@ -600,7 +669,8 @@ func (s *UdpTransport) handleLoop(udpChan chan *LocalUDPConn, activeConnections
 					}
 
 					// Handle data exchange between connections
-					go s.udpCopy(localConn, tunnelConn, activeConnections, mu)
+					tracked := s.usageMonitor.TrackConnection("udp", localConn.addr.String(), localConn.remoteAddr, localConn.listener.LocalAddr().(*net.UDPAddr).Port, nil)
+					go s.udpCopy(localConn, tunnelConn, tracked, activeConnections, mu)
 
 					s.logger.Debugf("initiate new handler for connection %s with timestamp %d", localConn.addr.String(), localConn.timeCreated)
 					break loop
@@ -610,27 +680,32 @@ func (s *UdpTransport) handleLoop(udpChan chan *LocalUDPConn, activeConnections
 	}
 }
 
-func (s *UdpTransport) udpCopy(udpLocal *LocalUDPConn, udpTunnel *TunnelUDPConn, activeConnections *map[string]*LocalUDPConn, mu *sync.Mutex) {
+func (s *UdpTransport) udpCopy(udpLocal *LocalUDPConn, udpTunnel *TunnelUDPConn, tracked *web.TrackedConn, activeConnections *map[string]*LocalUDPConn, mu *sync.Mutex) {
 	done := make(chan struct{})
 
 	// Handle data from local to tunnel
 	go func() {
 		defer close(done)
-		s.udpLocalCopy(udpLocal, udpTunnel)
+		s.udpLocalCopy(udpLocal, udpTunnel, tracked)
 	}()
 
 	// Handle data from tunnel to local
-	s.udpTunnelCopy(udpTunnel, udpLocal)
+	s.udpTunnelCopy(udpTunnel, udpLocal, tracked)
 
 	// Wait until one of the directions is done (connection closed or idle)
 	<-done
+	tracked.Done()
 
 	// Remove local connection from active connections and close the channel
 	mu.Lock()
 	close(udpLocal.payload)
-	delete(*activeConnections, udpLocal.addr.String())
+	delete(*activeConnections, udpLocal.key)
 	mu.Unlock()
 
+	if udpLocal.transparent {
+		udpLocal.listener.Close()
+	}
+
 	// Remove tunnel connection from active connections and close the channel
 	s.activeMu.Lock()
 	close(udpTunnel.payload)
@@ -639,7 +714,7 @@ func (s *UdpTransport) udpCopy(udpLocal *LocalUDPConn, udpTunnel *TunnelUDPConn,
 
 }
 
-func (s *UdpTransport) udpLocalCopy(from *LocalUDPConn, to *TunnelUDPConn) {
+func (s *UdpTransport) udpLocalCopy(from *LocalUDPConn, to *TunnelUDPConn, tracked *web.TrackedConn) {
 	inactivityTimeout := 60 * time.Second // Define a 60-second inactivity timeout
 
 	for {
@@ -665,17 +740,22 @@ func (s *UdpTransport) udpLocalCopy(from *LocalUDPConn, to *TunnelUDPConn) {
 			if s.config.Sniffer {
 				s.usageMonitor.AddOrUpdatePort(from.listener.LocalAddr().(*net.UDPAddr).Port, uint64(totalWritten))
 			}
+			tracked.AddUp(totalWritten)
 
 			s.logger.Debugf("forwarded %d bytes from local connection %s to tunnel", packetSize, from.addr.String())
 
+		case <-tracked.Closed(): // closed from the web panel
+			return
+
 		case <-time.After(inactivityTimeout): // Timeout after 30 seconds of inactivity
 			s.logger.Debugf("connection idle for 60 seconds, closing UDP connection for %s", from.addr.String())
+			tracked.SetCloseReason("idle timeout")
 			return
 		}
 	}
 }
 
-func (s *UdpTransport) udpTunnelCopy(from *TunnelUDPConn, to *LocalUDPConn) {
+func (s *UdpTransport) udpTunnelCopy(from *TunnelUDPConn, to *LocalUDPConn, tracked *web.TrackedConn) {
 	inactivityTimeout := 60 * time.Second // Define a 60-second inactivity timeout
 
 	for {
@@ -701,11 +781,16 @@ func (s *UdpTransport) udpTunnelCopy(from *TunnelUDPConn, to *LocalUDPConn) {
 			if s.config.Sniffer {
 				s.usageMonitor.AddOrUpdatePort(to.listener.LocalAddr().(*net.UDPAddr).Port, uint64(totalWritten))
 			}
+			tracked.AddDown(totalWritten)
 
 			s.logger.Debugf("forwarded %d bytes from local connection %s to tunnel", packetSize, from.addr.String())
 
+		case <-tracked.Closed(): // closed from the web panel
+			return
+
 		case <-time.After(inactivityTimeout): // Timeout after 30 seconds of inactivity
 			s.logger.Debugf("connection idle for 60 seconds, closing UDP connection for %s", from.addr.String())
+			tracked.SetCloseReason("idle timeout")
 			return
 		}
 	}
@@ -29,26 +29,37 @@ type WsTransport struct {
 	localChannel   chan LocalTCPConn
 	reqNewConnChan chan struct{}
 	controlChannel *websocket.Conn
+	session        *controlSession
 	restartMutex   sync.Mutex
 	usageMonitor   *web.Usage
 }
 
 type WsConfig struct {
-	BindAddr     string
-	SnifferLog   string
-	TLSCertFile  string // Path to the TLS certificate file
-	TLSKeyFile   string // Path to the TLS key file
-	TunnelStatus string
-	Token        string
-	Ports        []string
-	Nodelay      bool
-	Sniffer      bool
-	KeepAlive    time.Duration
-	Heartbeat    time.Duration // in seconds
-	ChannelSize  int
-	WebPort      int
-	Mode         config.TransportType // ws or wss
-
+	BindAddr       string
+	SnifferLog     string
+	TLSCertFile    string                    // Path to the TLS certificate file
+	TLSKeyFile     string                    // Path to the TLS key file
+	TLSClientCA    string                    // CA bundle for client certificates (mutual TLS)
+	ACME           *utils.ACMEConfig         // automatic certificates, nil when disabled
+	TLSExpiryWarn  int                       // days before certificate expiry to start warning
+	Obfuscation    *utils.ObfuscationProfile // handshake paths and headers
+	Decoy          http.Handler              // serves unauthenticated requests, nil for a plain 401
+	TunnelStatus   string
+	Lifecycle      *Lifecycle      // tells the server that the transport listens or failed
+	Tokens         *utils.TokenSet // accepted tokens, updated without restart
+	SourceMetadata bool            // send the source address with the target
+	Ports          []string
+	Nodelay        bool
+	Sniffer        bool
+	KeepAlive      time.Duration
+	Heartbeat      time.Duration // in seconds
+	ChannelSize    int
+	Transparent    *TransparentProxy // nil without transparent proxy
+	AcceptShards   int               // SO_REUSEPORT listeners per local port
+	WebPort        int
+	Mode           config.TransportType // ws or wss
+	ResumeGrace    time.Duration        // keep the tunnel while the client resumes a lost control channel
+	Coalesce       bool                 // send consecutive reads of a busy connection as one message
 }
 
 func NewWSServer(parentCtx context.Context, config *WsConfig, logger *logrus.Logger) *WsTransport {
@@ -66,6 +77,7 @@ func NewWSServer(parentCtx context.Context, config *WsConfig, logger *logrus.Log
 		localChannel:   make(chan LocalTCPConn, config.ChannelSize),
 		reqNewConnChan: make(chan struct{}, config.ChannelSize),
 		controlChannel: nil, // will be set when a control connection is established
+		session:        newControlSession(config.ResumeGrace),
 		usageMonitor:   web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
 	}
 
@@ -75,6 +87,7 @@ func NewWSServer(parentCtx context.Context, config *WsConfig, logger *logrus.Log
 func (s *WsTransport) Start() {
 	// for  webui
 	if s.config.WebPort > 0 {
+		s.usageMonitor.SetPoolSize(func() int { return len(s.tunnelChannel) })
 		go s.usageMonitor.Monitor()
 	}
 
@@ -91,6 +104,7 @@ func (s *WsTransport) Restart() {
 	defer s.restartMutex.Unlock()
 
 	s.logger.Info("restarting server...")
+	s.usageMonitor.Restarting()
 
 	level := s.logger.Level
 	s.logger.SetLevel(logrus.FatalLevel)
@@ -98,6 +112,7 @@ func (s *WsTransport) Restart() {
 	if s.cancel != nil {
 		s.cancel()
 	}
+	s.session.reset()
 
 	// Close control channel connection
 	if s.controlChannel != nil {
@@ -131,6 +146,9 @@ func (s *WsTransport) channelHandler() {
 	defer ticker.Stop()
 	messageChan := make(chan byte, 10)
 
+	// A resumed control channel gets a new handler
+	controlChannel := s.controlChannel
+
 	// Separate goroutine to continuously listen for messages with retry/backoff
 	go func() {
 		retries := 0
@@ -139,15 +157,15 @@ func (s *WsTransport) channelHandler() {
 			case <-s.ctx.Done():
 				return
 			default:
-				_, msg, err := s.controlChannel.ReadMessage()
+				_, msg, err := controlChannel.ReadMessage()
 				if err != nil {
 					s.logger.Errorf("failed to read from channel connection (try %d/%d): %v", retries+1, maxRetries, err)
 					retries++
 					if retries >= maxRetries {
 						if s.cancel != nil {
-							s.logger.Error("max retries reached, restarting...")
-							go s.Restart()
+							s.controlChannelLost(controlChannel)
 						}
+						close(messageChan)
 						return
 					}
 					time.Sleep(baseBackoff * time.Duration(retries))
@@ -166,21 +184,26 @@ func (s *WsTransport) channelHandler() {
 	for {
 		select {
 		case <-s.ctx.Done():
-			_ = s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Closed})
+			_ = controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Closed})
 			return
 		case <-s.reqNewConnChan:
-			err := s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Chan})
+			err := controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Chan})
 			if err != nil {
 				s.logger.Error("failed to send request new connection signal. ", err)
-				go s.Restart()
+				// ask again on the resumed control channel
+				select {
+				case s.reqNewConnChan <- struct{}{}:
+				default:
+				}
+				s.controlChannelLost(controlChannel)
 				return
 			}
 
 		case <-ticker.C:
-			err := s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_HB})
+			err := controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_HB})
 			if err != nil {
 				s.logger.Errorf("failed to send heartbeat signal. Error: %v.", err)
-				go s.Restart()
+				s.controlChannelLost(controlChannel)
 				return
 			}
 			s.logger.Debug("heartbeat signal sent successfully")
@@ -193,6 +216,7 @@ func (s *WsTransport) channelHandler() {
 			switch msg {
 			case utils.SG_HB:
 				s.logger.Trace("heartbeat signal received successfully")
+				s.usageMonitor.Heartbeat()
 
 			case utils.SG_Closed:
 				s.logger.Warn("control channel has been closed by the client")
@@ -215,6 +239,7 @@ func (s *WsTransport) tunnelListener() {
 		ReadBufferSize:   16 * 1024,
 		WriteBufferSize:  16 * 1024,
 		HandshakeTimeout: 45 * time.Second,
+		Subprotocols:     []string{utils.WSHalfCloseProtocol},
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
@@ -227,46 +252,47 @@ func (s *WsTransport) tunnelListener() {
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			s.logger.Tracef("received http request from %s", r.RemoteAddr)
 
+			// Refuse hosts banned for failed authentication
+			if s.usageMonitor.Banned(r.RemoteAddr) {
+				s.logger.Debugf("refused request from banned host %s", r.RemoteAddr)
+				refuseBanned(w, r, s.config.Decoy)
+				return
+			}
+
 			// Read the "Authorization" header
 			authHeader := r.Header.Get("Authorization")
-			if authHeader != fmt.Sprintf("Bearer %v", s.config.Token) {
+			token, bearer := strings.CutPrefix(authHeader, "Bearer ")
+			if !bearer || !validHello(s.config.Tokens, token) || !s.config.Obfuscation.MatchHost(r.Host) {
+				if authHeader != "" {
+					// a client with a wrong token, not a browser or scanner
+					s.usageMonitor.InvalidToken(r.RemoteAddr)
+				}
+				if s.config.Decoy != nil {
+					s.logger.Debugf("unauthorized request from %s, serving decoy website", r.RemoteAddr)
+					s.config.Decoy.ServeHTTP(w, r)
+					return
+				}
 				s.logger.Warnf("unauthorized request from %s, closing connection", r.RemoteAddr)
 				http.Error(w, "unauthorized", http.StatusUnauthorized) // Send 401 Unauthorized response
 				return
 			}
 
-			// Handle obfuscated paths - extract the actual path
-			requestPath := r.URL.Path
-			s.logger.Tracef("received request for path: %s", requestPath)
+			// Handle obfuscated paths, matched the same way the client builds them
+			s.logger.Tracef("received request for path: %s", r.URL.Path)
+			isControl := s.config.Obfuscation.IsControlPath(r.URL.Path)
 
-			// Check if this is an obfuscated path (contains realistic path patterns)
-			obfuscatedPaths := []string{
-				"/api/v1/stream", "/cdn/assets", "/ws/chat", "/api/notifications",
-				"/live/stream", "/api/analytics", "/cdn/static", "/api/status",
-				"/ws/updates", "/api/metrics",
-			}
-
-			// Check if this is an obfuscated control channel path
-			isObfuscatedControl := false
-			for _, obfPath := range obfuscatedPaths {
-				if strings.HasPrefix(requestPath, obfPath) {
-					s.logger.Tracef("detected obfuscated path: %s", requestPath)
-					// Check if this is a control channel (contains user ID)
-					if strings.Contains(requestPath, "/") && len(strings.Split(requestPath, "/")) >= 3 {
-						isObfuscatedControl = true
-					}
-					break
-				}
-			}
-
-			conn, err := upgrader.Upgrade(w, r, nil)
+			conn, err := upgrader.Upgrade(w, r, s.config.Obfuscation.ResponseHeaders())
 			if err != nil {
 				s.logger.Errorf("failed to upgrade connection from %s: %v", r.RemoteAddr, err)
 				return
 			}
 
 			// Handle control channel (both normal and obfuscated)
-			if r.URL.Path == "/channel" || isObfuscatedControl {
+			if isControl {
+				if s.session.resuming() {
+					s.resumeControlChannel(conn, token)
+					return
+				}
 				if s.controlChannel != nil {
 					s.logger.Warn("new control channel requested.")
 					s.controlChannel.Close()
@@ -274,27 +300,43 @@ func (s *WsTransport) tunnelListener() {
 					go s.Restart()
 					return
 				}
+
+				// Clients that can resume get the session id first
+				reply, _ := s.session.open(s.config.Tokens, token, conn)
+				if !s.config.Tokens.Valid(token) {
+					if err := conn.WriteMessage(websocket.TextMessage, []byte(reply)); err != nil {
+						s.logger.Errorf("failed to send control channel session: %v", err)
+						s.session.reset()
+						conn.Close()
+						return
+					}
+				}
 				s.controlChannel = conn
 
 				s.logger.Info("control channel established successfully")
 
 				numCPU := runtime.NumCPU()
-				if numCPU > 4 {
-					numCPU = 4 // Max allowed handler is 4
+				if numCPU > maxHandleLoops {
+					numCPU = maxHandleLoops // Max allowed handler is 4
 				}
 
 				go s.channelHandler()
 				go s.parsePortMappings()
 
+				if s.config.Transparent != nil {
+					go s.transparentListener()
+				}
+
 				s.logger.Infof("starting %d handle loops on each CPU thread", numCPU)
 
 				for i := 0; i < numCPU; i++ {
-					go s.handleLoop()
+					go s.handleLoop(s.localChannel)
 				}
 
 				s.config.TunnelStatus = fmt.Sprintf("Connected (%s)", s.config.Mode)
+				s.usageMonitor.ControlChannelUp(s.config.TunnelStatus)
 
-			} else if strings.HasPrefix(r.URL.Path, "/tunnel") {
+			} else if s.config.Obfuscation.IsTunnelPath(r.URL.Path) {
 				wsConn := TunnelChannel{
 					conn: conn,
 					ping: make(chan struct{}),
@@ -314,30 +356,43 @@ func (s *WsTransport) tunnelListener() {
 
 	if s.config.Mode == config.WS {
 		go func() {
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				s.config.Lifecycle.Fail(fmt.Errorf("failed to listen on %s: %v", addr, err))
+				return
+			}
+			s.config.Lifecycle.Listening()
 			s.logger.Infof("ws server starting, listening on %s", addr)
 			if s.controlChannel == nil {
 				s.logger.Info("waiting for ws control channel connection")
 			}
-			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				s.logger.Fatalf("failed to listen on %s: %v", addr, err)
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				s.config.Lifecycle.Fail(fmt.Errorf("failed to listen on %s: %v", addr, err))
+				return
 			}
 		}()
 	} else {
 		go func() {
-			host, _, _ := net.SplitHostPort(addr)
-			if host == "" {
-				host = "localhost"
+			serverTLS, err := loadServerTLS(addr, s.config.TLSCertFile, s.config.TLSKeyFile, s.config.TLSClientCA, s.config.ACME, s.config.TLSExpiryWarn, s.logger)
+			if err != nil {
+				s.config.Lifecycle.Fail(fmt.Errorf("failed to load TLS configuration: %v", err))
+				return
 			}
-			err := utils.EnsureSelfSignedCert(s.config.TLSCertFile, s.config.TLSKeyFile, host)
+			listener, err := net.Listen("tcp", addr)
 			if err != nil {
-				s.logger.Fatalf("failed to generate self-signed certificate: %v", err)
+				s.config.Lifecycle.Fail(fmt.Errorf("failed to listen on %s: %v", addr, err))
+				return
 			}
+			s.config.Lifecycle.Listening()
 			s.logger.Infof("wss server starting, listening on %s", addr)
 			if s.controlChannel == nil {
 				s.logger.Info("waiting for wss control channel connection")
 			}
-			if err := server.ListenAndServeTLS(s.config.TLSCertFile, s.config.TLSKeyFile); err != nil && err != http.ErrServerClosed {
-				s.logger.Fatalf("failed to listen on %s: %v", addr, err)
+			serverTLS.start(s.ctx, s.usageMonitor)
+			server.TLSConfig = serverTLS.config
+			if err := utils.ServeTLSWithACME(server, listener, serverTLS.acme); err != nil && err != http.ErrServerClosed {
+				s.config.Lifecycle.Fail(fmt.Errorf("failed to listen on %s: %v", addr, err))
+				return
 			}
 		}()
 	}
@@ -356,6 +411,54 @@ func (s *WsTransport) tunnelListener() {
 
 }
 
+// controlChannelLost waits for the client to resume the session of the lost
+// control channel, the server restarts if it can't.
+func (s *WsTransport) controlChannelLost(controlChannel *websocket.Conn) {
+	if !s.session.lose(controlChannel, s.resumeExpired) {
+		return
+	}
+	if !s.session.resuming() {
+		s.logger.Error("control channel lost, restarting...")
+		go s.Restart()
+		return
+	}
+
+	s.logger.Warnf("control channel lost, waiting %s for the client to resume it", s.config.ResumeGrace)
+	controlChannel.Close()
+	s.config.TunnelStatus = fmt.Sprintf("Resuming (%s)", s.config.Mode)
+	s.usageMonitor.Resuming()
+}
+
+func (s *WsTransport) resumeExpired() {
+	s.logger.Error("control channel was not resumed in time, restarting...")
+	s.Restart()
+}
+
+// resumeControlChannel takes conn as the control channel if the client resumes
+// the lost session with it, hello is its token with the session suffix.
+func (s *WsTransport) resumeControlChannel(conn *websocket.Conn, hello string) {
+	reply, resumed, _ := s.session.resume(s.config.Tokens, hello, conn)
+	if !resumed {
+		s.logger.Warn("new control channel requested instead of resuming, restarting...")
+		conn.Close()
+		go s.Restart()
+		return
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(reply)); err != nil {
+		s.logger.Errorf("failed to send control channel session: %v", err)
+		s.controlChannelLost(conn)
+		return
+	}
+
+	s.controlChannel = conn
+	s.config.TunnelStatus = fmt.Sprintf("Connected (%s)", s.config.Mode)
+	s.usageMonitor.ControlChannelUp(s.config.TunnelStatus)
+	s.logger.Info("control channel resumed")
+
+	go s.channelHandler()
+}
+
 func (s *WsTransport) parsePortMappings() {
 	for _, portMapping := range s.config.Ports {
 		parts := strings.Split(portMapping, "=")
@@ -371,18 +474,21 @@ func (s *WsTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					return
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					return
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					return
 				}
 
 				// Create listeners for all ports in the range
@@ -396,7 +502,8 @@ func (s *WsTransport) parsePortMappings() {
 				// Handle single port case
 				port, err := strconv.Atoi(localPortOrRange)
 				if err != nil || port < 1 || port > 65535 {
-					s.logger.Fatalf("invalid port format: %s", localPortOrRange)
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid port format: %s", localPortOrRange))
+					return
 				}
 				localAddr = fmt.Sprintf(":%d", port)
 			}
@@ -409,18 +516,21 @@ func (s *WsTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					return
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					return
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					return
 				}
 
 				// Create listeners for all ports in the range
@@ -433,14 +543,15 @@ func (s *WsTransport) parsePortMappings() {
 			} else {
 				// Handle single local port case
 				port, err := strconv.Atoi(localPortOrRange)
-				if err == nil && port > 1 && port < 65535 { // format port=remoteAddress
+				if err == nil && port >= 1 && port <= 65535 { // format port=remoteAddress
 					localAddr = fmt.Sprintf(":%d", port)
 				} else {
 					localAddr = localPortOrRange // format ip:port=remoteAddress
 				}
 			}
 		} else {
-			s.logger.Fatalf("invalid port mapping format: %s", portMapping)
+			s.config.Lifecycle.Fail(fmt.Errorf("invalid port mapping format: %s", portMapping))
+			return
 		}
 		// Start listeners for single port
 		go s.localListener(localAddr, remoteAddr)
@@ -448,23 +559,57 @@ func (s *WsTransport) parsePortMappings() {
 }
 
 func (s *WsTransport) localListener(localAddr string, remoteAddr string) {
-	portListener, err := net.Listen("tcp", localAddr)
+	portListeners, err := listenShards(localAddr, s.config.AcceptShards)
+	if err != nil {
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to start listener on %s: %v", localAddr, err))
+		return
+	}
+
+	//close local listeners after context cancellation
+	for _, portListener := range portListeners {
+		defer portListener.Close()
+	}
+
+	s.logger.Infof("listener started successfully, listening on address: %s", portListeners[0].Addr().String())
+
+	if len(portListeners) == 1 {
+		go s.acceptLocalConn(portListeners[0], remoteAddr, s.localChannel)
+	} else {
+		// The shards of the port share a queue and a few loops dispatching it
+		// to the tunnel pool, so a port range doesn't start loops per shard
+		s.logger.Debugf("accepting on %s with %d listeners", localAddr, len(portListeners))
+		localChannel := make(chan LocalTCPConn, s.config.ChannelSize)
+		for i := 0; i < min(len(portListeners), maxHandleLoops); i++ {
+			go s.handleLoop(localChannel)
+		}
+		for _, portListener := range portListeners {
+			go s.acceptLocalConn(portListener, remoteAddr, localChannel)
+		}
+	}
+
+	<-s.ctx.Done()
+}
+
+// transparentListener accepts the traffic the firewall redirects to the
+// transparent proxy.
+func (s *WsTransport) transparentListener() {
+	listener, err := s.config.Transparent.listen()
 	if err != nil {
-		s.logger.Fatalf("failed to start listener on %s: %v", localAddr, err)
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to start transparent proxy on %s: %v", s.config.Transparent.Addr, err))
 		return
 	}
 
-	//close local listener after context cancellation
-	defer portListener.Close()
+	//close the listener after context cancellation
+	defer listener.Close()
 
-	s.logger.Infof("listener started successfully, listening on address: %s", portListener.Addr().String())
+	s.logger.Infof("transparent proxy (%s) started successfully, listening on address: %s", s.config.Transparent.Mode, listener.Addr().String())
 
-	go s.acceptLocalConn(portListener, remoteAddr)
+	go s.acceptLocalConn(listener, "", s.localChannel)
 
 	<-s.ctx.Done()
 }
 
-func (s *WsTransport) acceptLocalConn(listener net.Listener, remoteAddr string) {
+func (s *WsTransport) acceptLocalConn(listener net.Listener, remoteAddr string, localChannel chan LocalTCPConn) {
 	for {
 		select {
 		case <-s.ctx.Done():
@@ -486,6 +631,14 @@ func (s *WsTransport) acceptLocalConn(listener net.Listener, remoteAddr string)
 				continue
 			}
 
+			// the transparent proxy's connections go to their original destination
+			target, port, err := localTarget(listener, tcpConn, remoteAddr)
+			if err != nil {
+				s.logger.Warnf("discarded connection from %s: %v", tcpConn.RemoteAddr().String(), err)
+				conn.Close()
+				continue
+			}
+
 			// trying to enable tcpnodelay
 			if !s.config.Nodelay {
 				if err := tcpConn.SetNoDelay(s.config.Nodelay); err != nil {
@@ -506,7 +659,7 @@ func (s *WsTransport) acceptLocalConn(listener net.Listener, remoteAddr string)
 			}
 
 			select {
-			case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: remoteAddr, timeCreated: time.Now().UnixMilli()}:
+			case localChannel <- LocalTCPConn{conn: conn, remoteAddr: target, timeCreated: time.Now().UnixMilli(), localPort: port}:
 
 				select {
 				case s.reqNewConnChan <- struct{}{}:
@@ -526,12 +679,27 @@ func (s *WsTransport) acceptLocalConn(listener net.Listener, remoteAddr string)
 	}
 }
 
-func (s *WsTransport) handleLoop() {
+// Forward queues a connection handed over by a relay, like acceptLocalConn does.
+func (s *WsTransport) Forward(conn net.Conn, target string) bool {
+	select {
+	case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: target, timeCreated: time.Now().UnixMilli()}:
+		select {
+		case s.reqNewConnChan <- struct{}{}:
+		default:
+			s.logger.Warn("channel is full, cannot request a new connection")
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *WsTransport) handleLoop(localChannel chan LocalTCPConn) {
 	for {
 		select {
 		case <-s.ctx.Done():
 			return
-		case localConn := <-s.localChannel:
+		case localConn := <-localChannel:
 		loop:
 			for {
 				if time.Now().UnixMilli()-localConn.timeCreated > 3000 { // 3000ms
@@ -546,13 +714,17 @@ func (s *WsTransport) handleLoop() {
 				case tunnelConnection := <-s.tunnelChannel:
 					close(tunnelConnection.ping)
 					tunnelConnection.mu.Lock()
-					if err := tunnelConnection.conn.WriteMessage(websocket.TextMessage, []byte(localConn.remoteAddr)); err != nil {
+					if err := tunnelConnection.conn.WriteMessage(websocket.TextMessage, []byte(localConn.target(s.config.SourceMetadata))); err != nil {
 						s.logger.Debugf("%v", err) // failed to send port number
 						tunnelConnection.conn.Close()
 						continue loop
 					}
 					// Handle data exchange between connections
-					go utils.WSConnectionHandler(tunnelConnection.conn, localConn.conn, s.logger, s.usageMonitor, localConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
+					tracked, conn := localConn.track(s.usageMonitor, "ws")
+					go func() {
+						defer tracked.Done()
+						utils.WSConnectionHandler(tunnelConnection.conn, conn, s.logger, s.usageMonitor, localConn.port(), s.config.Sniffer, s.config.Coalesce)
+					}()
 					break loop
 				}
 			}
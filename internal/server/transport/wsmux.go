@@ -9,7 +9,6 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/musix/backhaul/internal/config" // for mode
@@ -29,28 +28,36 @@ type WsMuxTransport struct {
 	cancel         context.CancelFunc
 	logger         *logrus.Logger
 	tunnelChannel  chan *smux.Session
-	localChannel   chan LocalTCPConn
+	queues         *muxQueues // local connections by accept shard
 	reqNewConnChan chan struct{}
 	controlChannel *websocket.Conn
+	session        *controlSession
 	usageMonitor   *web.Usage
 	restartMutex   sync.Mutex
-	streamCounter  int32
-	sessionCounter int32
 }
 
 type WsMuxConfig struct {
 	BindAddr         string
-	Token            string
+	Tokens           *utils.TokenSet // accepted tokens, updated without restart
+	SourceMetadata   bool            // send the source address with the target
 	SnifferLog       string
-	TLSCertFile      string // Path to the TLS certificate file
-	TLSKeyFile       string // Path to the TLS key file
+	TLSCertFile      string                    // Path to the TLS certificate file
+	TLSKeyFile       string                    // Path to the TLS key file
+	TLSClientCA      string                    // CA bundle for client certificates (mutual TLS)
+	ACME             *utils.ACMEConfig         // automatic certificates, nil when disabled
+	TLSExpiryWarn    int                       // days before certificate expiry to start warning
+	Obfuscation      *utils.ObfuscationProfile // handshake paths and headers
+	Decoy            http.Handler              // serves unauthenticated requests, nil for a plain 401
 	TunnelStatus     string
+	Lifecycle        *Lifecycle // tells the server that the transport listens or failed
 	Ports            []string
 	Nodelay          bool
 	Sniffer          bool
 	KeepAlive        time.Duration
 	Heartbeat        time.Duration // in seconds
 	ChannelSize      int
+	Transparent      *TransparentProxy // nil without transparent proxy
+	AcceptShards     int               // SO_REUSEPORT listeners per local port
 	MuxCon           int
 	MuxVersion       int
 	MaxFrameSize     int
@@ -58,7 +65,7 @@ type WsMuxConfig struct {
 	MaxStreamBuffer  int
 	WebPort          int
 	Mode             config.TransportType // ws or wss
-
+	ResumeGrace      time.Duration        // keep the mux sessions while the client resumes a lost control channel
 }
 
 func NewWSMuxServer(parentCtx context.Context, config *WsMuxConfig, logger *logrus.Logger) *WsMuxTransport {
@@ -81,11 +88,10 @@ func NewWSMuxServer(parentCtx context.Context, config *WsMuxConfig, logger *logr
 		cancel:         cancel,
 		logger:         logger,
 		tunnelChannel:  make(chan *smux.Session, config.ChannelSize),
-		localChannel:   make(chan LocalTCPConn, config.ChannelSize),
+		queues:         newMuxQueues(config.AcceptShards, config.ChannelSize, config.MuxCon),
 		reqNewConnChan: make(chan struct{}, config.ChannelSize),
-		streamCounter:  0,
-		sessionCounter: 0,
 		controlChannel: nil, // will be set when a control connection is established
+		session:        newControlSession(config.ResumeGrace),
 		usageMonitor:   web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
 	}
 
@@ -95,6 +101,7 @@ func NewWSMuxServer(parentCtx context.Context, config *WsMuxConfig, logger *logr
 func (s *WsMuxTransport) Start() {
 	// for  webui
 	if s.config.WebPort > 0 {
+		s.usageMonitor.SetPoolSize(func() int { return len(s.tunnelChannel) + s.queues.sessions() })
 		go s.usageMonitor.Monitor()
 	}
 
@@ -112,6 +119,7 @@ func (s *WsMuxTransport) Restart() {
 	defer s.restartMutex.Unlock()
 
 	s.logger.Info("restarting server...")
+	s.usageMonitor.Restarting()
 
 	// for removing timeout logs
 	level := s.logger.Level
@@ -120,6 +128,7 @@ func (s *WsMuxTransport) Restart() {
 	if s.cancel != nil {
 		s.cancel()
 	}
+	s.session.reset()
 
 	// Close control channel connection
 	if s.controlChannel != nil {
@@ -134,13 +143,11 @@ func (s *WsMuxTransport) Restart() {
 
 	// Re-initialize variables
 	s.tunnelChannel = make(chan *smux.Session, s.config.ChannelSize)
-	s.localChannel = make(chan LocalTCPConn, s.config.ChannelSize)
+	s.queues = newMuxQueues(s.config.AcceptShards, s.config.ChannelSize, s.config.MuxCon)
 	s.reqNewConnChan = make(chan struct{}, s.config.ChannelSize)
 	s.controlChannel = nil
 	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
 	s.config.TunnelStatus = ""
-	s.streamCounter = 0
-	s.sessionCounter = 0
 
 	// set the log level again
 	s.logger.SetLevel(level)
@@ -157,6 +164,9 @@ func (s *WsMuxTransport) channelHandler() {
 	// Channel to receive the message or error
 	messageChan := make(chan byte, 10)
 
+	// A resumed control channel gets a new handler
+	controlChannel := s.controlChannel
+
 	// Separate goroutine to continuously listen for messages with retry/backoff
 	go func() {
 		retries := 0
@@ -165,15 +175,15 @@ func (s *WsMuxTransport) channelHandler() {
 			case <-s.ctx.Done():
 				return
 			default:
-				_, msg, err := s.controlChannel.ReadMessage()
+				_, msg, err := controlChannel.ReadMessage()
 				if err != nil {
 					s.logger.Errorf("failed to read from channel connection (try %d/%d): %v", retries+1, maxRetries, err)
 					retries++
 					if retries >= maxRetries {
 						if s.cancel != nil {
-							s.logger.Error("max retries reached, restarting...")
-							go s.Restart()
+							s.controlChannelLost(controlChannel)
 						}
+						close(messageChan)
 						return
 					}
 					time.Sleep(baseBackoff * time.Duration(retries))
@@ -192,21 +202,26 @@ func (s *WsMuxTransport) channelHandler() {
 	for {
 		select {
 		case <-s.ctx.Done():
-			_ = s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Closed})
+			_ = controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Closed})
 			return
 		case <-s.reqNewConnChan:
-			err := s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Chan})
+			err := controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_Chan})
 			if err != nil {
 				s.logger.Error("failed to send request new connection signal. ", err)
-				go s.Restart()
+				// ask again on the resumed control channel
+				select {
+				case s.reqNewConnChan <- struct{}{}:
+				default:
+				}
+				s.controlChannelLost(controlChannel)
 				return
 			}
 
 		case <-ticker.C:
-			err := s.controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_HB})
+			err := controlChannel.WriteMessage(websocket.BinaryMessage, []byte{utils.SG_HB})
 			if err != nil {
 				s.logger.Errorf("failed to send heartbeat signal. Error: %v.", err)
-				go s.Restart()
+				s.controlChannelLost(controlChannel)
 				return
 			}
 			s.logger.Debug("heartbeat signal sent successfully")
@@ -219,6 +234,7 @@ func (s *WsMuxTransport) channelHandler() {
 			switch msg {
 			case utils.SG_HB:
 				s.logger.Trace("heartbeat signal received successfully")
+				s.usageMonitor.Heartbeat()
 
 			case utils.SG_Closed:
 				s.logger.Warn("control channel has been closed by the client")
@@ -241,6 +257,7 @@ func (s *WsMuxTransport) tunnelListener() {
 		ReadBufferSize:   16 * 1024,
 		WriteBufferSize:  16 * 1024,
 		HandshakeTimeout: 45 * time.Second,
+		Subprotocols:     []string{utils.WSMuxProtocol},
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
@@ -253,46 +270,47 @@ func (s *WsMuxTransport) tunnelListener() {
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			s.logger.Tracef("received http request from %s", r.RemoteAddr)
 
+			// Refuse hosts banned for failed authentication
+			if s.usageMonitor.Banned(r.RemoteAddr) {
+				s.logger.Debugf("refused request from banned host %s", r.RemoteAddr)
+				refuseBanned(w, r, s.config.Decoy)
+				return
+			}
+
 			// Read the "Authorization" header
 			authHeader := r.Header.Get("Authorization")
-			if authHeader != fmt.Sprintf("Bearer %v", s.config.Token) {
+			token, bearer := strings.CutPrefix(authHeader, "Bearer ")
+			if !bearer || !validHello(s.config.Tokens, token) || !s.config.Obfuscation.MatchHost(r.Host) {
+				if authHeader != "" {
+					// a client with a wrong token, not a browser or scanner
+					s.usageMonitor.InvalidToken(r.RemoteAddr)
+				}
+				if s.config.Decoy != nil {
+					s.logger.Debugf("unauthorized request from %s, serving decoy website", r.RemoteAddr)
+					s.config.Decoy.ServeHTTP(w, r)
+					return
+				}
 				s.logger.Warnf("unauthorized request from %s, closing connection", r.RemoteAddr)
 				http.Error(w, "unauthorized", http.StatusUnauthorized) // Send 401 Unauthorized response
 				return
 			}
 
-			// Handle obfuscated paths - extract the actual path
-			requestPath := r.URL.Path
-			s.logger.Tracef("received request for path: %s", requestPath)
-
-			// Check if this is an obfuscated path (contains realistic path patterns)
-			obfuscatedPaths := []string{
-				"/api/v1/stream", "/cdn/assets", "/ws/chat", "/api/notifications",
-				"/live/stream", "/api/analytics", "/cdn/static", "/api/status",
-				"/ws/updates", "/api/metrics",
-			}
+			// Handle obfuscated paths, matched the same way the client builds them
+			s.logger.Tracef("received request for path: %s", r.URL.Path)
+			isControl := s.config.Obfuscation.IsControlPath(r.URL.Path)
 
-			// Check if this is an obfuscated control channel path
-			isObfuscatedControl := false
-			for _, obfPath := range obfuscatedPaths {
-				if strings.HasPrefix(requestPath, obfPath) {
-					s.logger.Tracef("detected obfuscated path: %s", requestPath)
-					// Check if this is a control channel (contains user ID)
-					if strings.Contains(requestPath, "/") && len(strings.Split(requestPath, "/")) >= 3 {
-						isObfuscatedControl = true
-					}
-					break
-				}
-			}
-
-			conn, err := upgrader.Upgrade(w, r, nil)
+			conn, err := upgrader.Upgrade(w, r, s.config.Obfuscation.ResponseHeaders())
 			if err != nil {
 				s.logger.Errorf("failed to upgrade connection from %s: %v", r.RemoteAddr, err)
 				return
 			}
 
 			// Handle control channel (both normal and obfuscated)
-			if r.URL.Path == "/channel" || isObfuscatedControl {
+			if isControl {
+				if s.session.resuming() {
+					s.resumeControlChannel(conn, token)
+					return
+				}
 				if s.controlChannel != nil {
 					s.logger.Warn("new control channel requested.")
 					s.controlChannel.Close()
@@ -301,18 +319,32 @@ func (s *WsMuxTransport) tunnelListener() {
 					return
 				}
 
+				// Clients that can resume get the session id first
+				reply, _ := s.session.open(s.config.Tokens, token, conn)
+				if !s.config.Tokens.Valid(token) {
+					if err := conn.WriteMessage(websocket.TextMessage, []byte(reply)); err != nil {
+						s.logger.Errorf("failed to send control channel session: %v", err)
+						s.session.reset()
+						conn.Close()
+						return
+					}
+				}
 				s.controlChannel = conn
 
 				s.logger.Info("control channel established successfully")
 
 				numCPU := runtime.NumCPU()
-				if numCPU > 4 {
-					numCPU = 4 // Max allowed handler is 4
+				if numCPU > maxHandleLoops {
+					numCPU = maxHandleLoops // Max allowed handler is 4
 				}
 
 				go s.channelHandler()
 				go s.parsePortMappings()
 
+				if s.config.Transparent != nil {
+					go s.transparentListener()
+				}
+
 				s.logger.Infof("starting %d handle loops on each CPU thread", numCPU)
 
 				for i := 0; i < numCPU; i++ {
@@ -320,9 +352,10 @@ func (s *WsMuxTransport) tunnelListener() {
 				}
 
 				s.config.TunnelStatus = fmt.Sprintf("Connected (%s)", s.config.Mode)
+				s.usageMonitor.ControlChannelUp(s.config.TunnelStatus)
 
-			} else if strings.HasPrefix(r.URL.Path, "/tunnel") {
-				session, err := smux.Client(conn.NetConn(), s.smuxConfig)
+			} else if s.config.Obfuscation.IsTunnelPath(r.URL.Path) {
+				session, err := smux.Client(utils.WSMuxConn(conn), s.smuxConfig)
 				if err != nil {
 					s.logger.Errorf("failed to create MUX session for connection %s: %v", conn.RemoteAddr().String(), err)
 					conn.Close()
@@ -340,30 +373,43 @@ func (s *WsMuxTransport) tunnelListener() {
 
 	if s.config.Mode == config.WSMUX {
 		go func() {
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				s.config.Lifecycle.Fail(fmt.Errorf("failed to listen on %s: %v", addr, err))
+				return
+			}
+			s.config.Lifecycle.Listening()
 			s.logger.Infof("%s server starting, listening on %s", s.config.Mode, addr)
 			if s.controlChannel == nil {
 				s.logger.Infof("waiting for %s control channel connection", s.config.Mode)
 			}
-			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				s.logger.Fatalf("failed to listen on %s: %v", addr, err)
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				s.config.Lifecycle.Fail(fmt.Errorf("failed to listen on %s: %v", addr, err))
+				return
 			}
 		}()
 	} else {
 		go func() {
-			host, _, _ := net.SplitHostPort(addr)
-			if host == "" {
-				host = "localhost"
+			serverTLS, err := loadServerTLS(addr, s.config.TLSCertFile, s.config.TLSKeyFile, s.config.TLSClientCA, s.config.ACME, s.config.TLSExpiryWarn, s.logger)
+			if err != nil {
+				s.config.Lifecycle.Fail(fmt.Errorf("failed to load TLS configuration: %v", err))
+				return
 			}
-			err := utils.EnsureSelfSignedCert(s.config.TLSCertFile, s.config.TLSKeyFile, host)
+			listener, err := net.Listen("tcp", addr)
 			if err != nil {
-				s.logger.Fatalf("failed to generate self-signed certificate: %v", err)
+				s.config.Lifecycle.Fail(fmt.Errorf("failed to listen on %s: %v", addr, err))
+				return
 			}
+			s.config.Lifecycle.Listening()
 			s.logger.Infof("%s server starting, listening on %s", s.config.Mode, addr)
 			if s.controlChannel == nil {
 				s.logger.Infof("waiting for %s control channel connection", s.config.Mode)
 			}
-			if err := server.ListenAndServeTLS(s.config.TLSCertFile, s.config.TLSKeyFile); err != nil && err != http.ErrServerClosed {
-				s.logger.Fatalf("failed to listen on %s: %v", addr, err)
+			serverTLS.start(s.ctx, s.usageMonitor)
+			server.TLSConfig = serverTLS.config
+			if err := utils.ServeTLSWithACME(server, listener, serverTLS.acme); err != nil && err != http.ErrServerClosed {
+				s.config.Lifecycle.Fail(fmt.Errorf("failed to listen on %s: %v", addr, err))
+				return
 			}
 		}()
 	}
@@ -382,6 +428,54 @@ func (s *WsMuxTransport) tunnelListener() {
 	}
 }
 
+// controlChannelLost waits for the client to resume the session of the lost
+// control channel, the server restarts if it can't.
+func (s *WsMuxTransport) controlChannelLost(controlChannel *websocket.Conn) {
+	if !s.session.lose(controlChannel, s.resumeExpired) {
+		return
+	}
+	if !s.session.resuming() {
+		s.logger.Error("control channel lost, restarting...")
+		go s.Restart()
+		return
+	}
+
+	s.logger.Warnf("control channel lost, waiting %s for the client to resume it", s.config.ResumeGrace)
+	controlChannel.Close()
+	s.config.TunnelStatus = fmt.Sprintf("Resuming (%s)", s.config.Mode)
+	s.usageMonitor.Resuming()
+}
+
+func (s *WsMuxTransport) resumeExpired() {
+	s.logger.Error("control channel was not resumed in time, restarting...")
+	s.Restart()
+}
+
+// resumeControlChannel takes conn as the control channel if the client resumes
+// the lost session with it, hello is its token with the session suffix.
+func (s *WsMuxTransport) resumeControlChannel(conn *websocket.Conn, hello string) {
+	reply, resumed, _ := s.session.resume(s.config.Tokens, hello, conn)
+	if !resumed {
+		s.logger.Warn("new control channel requested instead of resuming, restarting...")
+		conn.Close()
+		go s.Restart()
+		return
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(reply)); err != nil {
+		s.logger.Errorf("failed to send control channel session: %v", err)
+		s.controlChannelLost(conn)
+		return
+	}
+
+	s.controlChannel = conn
+	s.config.TunnelStatus = fmt.Sprintf("Connected (%s)", s.config.Mode)
+	s.usageMonitor.ControlChannelUp(s.config.TunnelStatus)
+	s.logger.Info("control channel resumed")
+
+	go s.channelHandler()
+}
+
 func (s *WsMuxTransport) parsePortMappings() {
 	for _, portMapping := range s.config.Ports {
 		parts := strings.Split(portMapping, "=")
@@ -397,18 +491,21 @@ func (s *WsMuxTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					return
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					return
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					return
 				}
 
 				// Create listeners for all ports in the range
@@ -422,7 +519,8 @@ func (s *WsMuxTransport) parsePortMappings() {
 				// Handle single port case
 				port, err := strconv.Atoi(localPortOrRange)
 				if err != nil || port < 1 || port > 65535 {
-					s.logger.Fatalf("invalid port format: %s", localPortOrRange)
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid port format: %s", localPortOrRange))
+					return
 				}
 				localAddr = fmt.Sprintf(":%d", port)
 			}
@@ -435,18 +533,21 @@ func (s *WsMuxTransport) parsePortMappings() {
 			if strings.Contains(localPortOrRange, "-") {
 				rangeParts := strings.Split(localPortOrRange, "-")
 				if len(rangeParts) != 2 {
-					s.logger.Fatalf("invalid port range format: %s", localPortOrRange)
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid port range format: %s", localPortOrRange))
+					return
 				}
 
 				// Parse and validate start and end ports
 				startPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[0]))
 				if err != nil || startPort < 1 || startPort > 65535 {
-					s.logger.Fatalf("invalid start port in range: %s", rangeParts[0])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid start port in range: %s", rangeParts[0]))
+					return
 				}
 
 				endPort, err := strconv.Atoi(strings.TrimSpace(rangeParts[1]))
 				if err != nil || endPort < 1 || endPort > 65535 || endPort < startPort {
-					s.logger.Fatalf("invalid end port in range: %s", rangeParts[1])
+					s.config.Lifecycle.Fail(fmt.Errorf("invalid end port in range: %s", rangeParts[1]))
+					return
 				}
 
 				// Create listeners for all ports in the range
@@ -459,14 +560,15 @@ func (s *WsMuxTransport) parsePortMappings() {
 			} else {
 				// Handle single local port case
 				port, err := strconv.Atoi(localPortOrRange)
-				if err == nil && port > 1 && port < 65535 { // format port=remoteAddress
+				if err == nil && port >= 1 && port <= 65535 { // format port=remoteAddress
 					localAddr = fmt.Sprintf(":%d", port)
 				} else {
 					localAddr = localPortOrRange // format ip:port=remoteAddress
 				}
 			}
 		} else {
-			s.logger.Fatalf("invalid port mapping format: %s", portMapping)
+			s.config.Lifecycle.Fail(fmt.Errorf("invalid port mapping format: %s", portMapping))
+			return
 		}
 		// Start listeners for single port
 		go s.localListener(localAddr, remoteAddr)
@@ -474,23 +576,49 @@ func (s *WsMuxTransport) parsePortMappings() {
 }
 
 func (s *WsMuxTransport) localListener(localAddr string, remoteAddr string) {
-	listener, err := net.Listen("tcp", localAddr)
+	listeners, err := listenShards(localAddr, s.config.AcceptShards)
 	if err != nil {
-		s.logger.Fatalf("failed to start listener on %s: %v", localAddr, err)
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to start listener on %s: %v", localAddr, err))
 		return
 	}
 
-	//close local listener after context cancellation
+	//close local listeners after context cancellation
+	for _, listener := range listeners {
+		defer listener.Close()
+	}
+
+	// Every shard queues its connections for the sessions serving it
+	for i, listener := range listeners {
+		go s.acceptLocalConn(listener, remoteAddr, s.queues.shard(i))
+	}
+
+	s.logger.Infof("listener started successfully, listening on address: %s", listeners[0].Addr().String())
+
+	<-s.ctx.Done()
+}
+
+// transparentListener accepts the traffic the firewall redirects to the
+// transparent proxy.
+func (s *WsMuxTransport) transparentListener() {
+	listener, err := s.config.Transparent.listen()
+	if err != nil {
+		s.config.Lifecycle.Fail(fmt.Errorf("failed to start transparent proxy on %s: %v", s.config.Transparent.Addr, err))
+		return
+	}
+
+	//close the listener after context cancellation
 	defer listener.Close()
 
-	go s.acceptLocalConn(listener, remoteAddr)
+	s.logger.Infof("transparent proxy (%s) started successfully, listening on address: %s", s.config.Transparent.Mode, listener.Addr().String())
 
-	s.logger.Infof("listener started successfully, listening on address: %s", listener.Addr().String())
+	go s.acceptLocalConn(listener, "", nil)
 
 	<-s.ctx.Done()
 }
 
-func (s *WsMuxTransport) acceptLocalConn(listener net.Listener, remoteAddr string) {
+// acceptLocalConn queues the connections of listener in queue, the queues in
+// turn if nil.
+func (s *WsMuxTransport) acceptLocalConn(listener net.Listener, remoteAddr string, queue *muxQueue) {
 	for {
 		select {
 		case <-s.ctx.Done():
@@ -511,6 +639,14 @@ func (s *WsMuxTransport) acceptLocalConn(listener net.Listener, remoteAddr strin
 				continue
 			}
 
+			// the transparent proxy's connections go to their original destination
+			target, port, err := localTarget(listener, tcpConn, remoteAddr)
+			if err != nil {
+				s.logger.Warnf("discarded connection from %s: %v", tcpConn.RemoteAddr().String(), err)
+				conn.Close()
+				continue
+			}
+
 			// trying to enable tcpnodelay
 			if !s.config.Nodelay {
 				if err := tcpConn.SetNoDelay(s.config.Nodelay); err != nil {
@@ -530,15 +666,17 @@ func (s *WsMuxTransport) acceptLocalConn(listener net.Listener, remoteAddr strin
 				s.logger.Warnf("failed to set TCP keep-alive period for %s: %v", tcpConn.RemoteAddr().String(), err)
 			}
 
-			select {
-			case s.localChannel <- LocalTCPConn{conn: conn, remoteAddr: remoteAddr, timeCreated: time.Now().UnixMilli()}:
+			q := queue
+			if q == nil {
+				q = s.queues.any()
+			}
+			ok, needSession := s.queues.push(q, LocalTCPConn{conn: conn, remoteAddr: target, timeCreated: time.Now().UnixMilli(), localPort: port})
+			switch {
+			case ok:
 				s.logger.Debugf("accepted incoming TCP connection from %s", tcpConn.RemoteAddr().String())
 
-				// +1 for stream counter
-				atomic.AddInt32(&s.streamCounter, 1)
-
-				if atomic.LoadInt32(&s.streamCounter) >= atomic.LoadInt32(&s.sessionCounter)*int32(s.config.MuxCon) {
-					s.logger.Tracef("stream counter: %v, session counter: %v", atomic.LoadInt32(&s.streamCounter), atomic.LoadInt32(&s.sessionCounter))
+				if needSession {
+					s.logger.Tracef("stream counter: %v, session counter: %v", q.streams.Load(), q.sessions.Load())
 					// Attempt to request a new connection
 					select {
 					case s.reqNewConnChan <- struct{}{}:
@@ -556,6 +694,19 @@ func (s *WsMuxTransport) acceptLocalConn(listener net.Listener, remoteAddr strin
 
 }
 
+// Forward queues a connection handed over by a relay, like acceptLocalConn does.
+func (s *WsMuxTransport) Forward(conn net.Conn, target string) bool {
+	ok, needSession := s.queues.push(s.queues.any(), LocalTCPConn{conn: conn, remoteAddr: target, timeCreated: time.Now().UnixMilli()})
+	if needSession {
+		select {
+		case s.reqNewConnChan <- struct{}{}:
+		default:
+			s.logger.Warn("failed to request new connection. channel is full")
+		}
+	}
+	return ok
+}
+
 func (s *WsMuxTransport) handleLoop() {
 	for {
 		select {
@@ -563,15 +714,13 @@ func (s *WsMuxTransport) handleLoop() {
 			return
 
 		case session := <-s.tunnelChannel:
-			// +1 for session counter
-			atomic.AddInt32(&s.sessionCounter, 1)
-
-			go s.handleSession(session)
+			// the session serves the queue that needs it most
+			go s.handleSession(session, s.queues.assign())
 		}
 	}
 }
 
-func (s *WsMuxTransport) handleSession(session *smux.Session) {
+func (s *WsMuxTransport) handleSession(session *smux.Session, queue *muxQueue) {
 	counter := make(chan struct{}, s.config.MuxCon)
 	defer session.Close()
 	defer close(counter)
@@ -584,49 +733,51 @@ func (s *WsMuxTransport) handleSession(session *smux.Session) {
 		case <-s.ctx.Done():
 			return
 
-		case incomingConn := <-s.localChannel:
+		case incomingConn := <-queue.conns:
 			if time.Now().UnixMilli()-incomingConn.timeCreated > 3000 { // 3000ms
 				s.logger.Debugf("timeouted local connection: %d ms", time.Now().UnixMilli()-incomingConn.timeCreated)
 				incomingConn.conn.Close()
 
 				// Decrement the counter
-				atomic.AddInt32(&s.streamCounter, -1)
+				queue.streams.Add(-1)
 				<-counter
 				continue
 			}
 
 			stream, err := session.OpenStream()
 			if err != nil {
-				s.handleSessionError(&incomingConn, err)
+				s.handleSessionError(queue, &incomingConn, err)
 				return
 			}
 
 			// Send the target port over the tunnel connection
-			if err := utils.SendBinaryString(stream, incomingConn.remoteAddr); err != nil {
+			if err := utils.SendBinaryString(stream, incomingConn.target(s.config.SourceMetadata)); err != nil {
 				s.logger.Tracef("failed to send address over stream: %v", err)
 				// Put local connection back to local channel
-				s.localChannel <- incomingConn
+				queue.conns <- incomingConn
 				continue
 			}
 
 			// Handle data exchange between connections
+			tracked, conn := incomingConn.track(s.usageMonitor, "wsmux")
 			go func() {
-				utils.TCPConnectionHandler(stream, incomingConn.conn, s.logger, s.usageMonitor, incomingConn.conn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
-				atomic.AddInt32(&s.streamCounter, -1)
+				utils.TCPConnectionHandler(stream, conn, s.logger, s.usageMonitor, incomingConn.port(), s.config.Sniffer)
+				tracked.Done()
+				queue.streams.Add(-1)
 				<-counter // read signal from the channel
 			}()
 		}
 	}
 }
 
-func (s *WsMuxTransport) handleSessionError(incomingConn *LocalTCPConn, err error) {
+func (s *WsMuxTransport) handleSessionError(queue *muxQueue, incomingConn *LocalTCPConn, err error) {
 	s.logger.Tracef("failed to handle session: %v", err)
 
 	// decrease session value
-	atomic.AddInt32(&s.sessionCounter, -1)
+	queue.sessions.Add(-1)
 
 	// Put local connection back to local channel
-	s.localChannel <- *incomingConn
+	queue.conns <- *incomingConn
 
 	// Attempt to request a new connection
 	select {
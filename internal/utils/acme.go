@@ -0,0 +1,228 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEConfig holds the settings for automatic certificate management.
+type ACMEConfig struct {
+	Domains      []string
+	Email        string
+	DirectoryURL string // ACME directory, Let's Encrypt when empty
+	CacheDir     string // where account keys and certificates are stored
+	CAFile       string // CA bundle trusted when talking to the ACME directory (e.g. pebble)
+	HTTPAddr     string // optional extra listener for HTTP-01 challenges (e.g. ":80")
+}
+
+// ACMEManager obtains and renews certificates and serves them through GetCertificate,
+// so renewed certificates are picked up without restarting the listener.
+type ACMEManager struct {
+	config  *ACMEConfig
+	manager *autocert.Manager
+	logger  *logrus.Logger
+
+	mu       sync.RWMutex
+	notAfter time.Time // expiry of the last certificate handed out
+}
+
+func NewACMEManager(cfg *ACMEConfig, logger *logrus.Logger) (*ACMEManager, error) {
+	if len(cfg.Domains) == 0 {
+		return nil, fmt.Errorf("acme requires at least one domain")
+	}
+
+	client := &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	if cfg.DirectoryURL == "" {
+		client.DirectoryURL = autocert.DefaultACMEDirectory
+	}
+	if cfg.CAFile != "" {
+		pool, err := LoadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		client.HTTPClient = &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+
+	return &ACMEManager{
+		config: cfg,
+		manager: &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cfg.CacheDir),
+			HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+			Email:      cfg.Email,
+			Client:     client,
+		},
+		logger: logger,
+	}, nil
+}
+
+// GetCertificate returns the current certificate. Clients that connect by IP
+// send no SNI, they receive the certificate of the first domain.
+func (a *ACMEManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName == "" {
+		h := *hello
+		h.ServerName = a.config.Domains[0]
+		hello = &h
+	}
+	cert, err := a.manager.GetCertificate(hello)
+	if err == nil {
+		a.observe(cert)
+	}
+	return cert, err
+}
+
+// NotAfter returns the expiry of the most recent certificate, zero until one is obtained.
+func (a *ACMEManager) NotAfter() time.Time {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.notAfter
+}
+
+func (a *ACMEManager) observe(cert *tls.Certificate) {
+	if cert.Leaf == nil {
+		return
+	}
+	a.mu.Lock()
+	a.notAfter = cert.Leaf.NotAfter
+	a.mu.Unlock()
+}
+
+// TLSConfig returns a server TLS configuration that answers TLS-ALPN-01 challenges.
+func (a *ACMEManager) TLSConfig(clientCAFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		GetCertificate: a.GetCertificate,
+		NextProtos:     []string{"http/1.1", acme.ALPNProto},
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pool, err := LoadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		// Challenge connections from the CA carry no client certificate
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if cs.NegotiatedProtocol != acme.ALPNProto && len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("client certificate required")
+			}
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// HTTPHandler answers HTTP-01 challenges and passes everything else to fallback.
+func (a *ACMEManager) HTTPHandler(fallback http.Handler) http.Handler {
+	if fallback == nil {
+		fallback = http.NotFoundHandler()
+	}
+	return a.manager.HTTPHandler(fallback)
+}
+
+// Start runs the optional HTTP-01 listener and requests the certificates in the
+// background. It must be called once the bind port is listening, the CA connects
+// back to it while validating.
+func (a *ACMEManager) Start(ctx context.Context) {
+	// Creating the handler also allows HTTP-01 next to TLS-ALPN-01
+	handler := a.HTTPHandler(nil)
+
+	if a.config.HTTPAddr != "" {
+		server := &http.Server{Addr: a.config.HTTPAddr, Handler: handler}
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+		go func() {
+			a.logger.Infof("acme http-01 listener started on %s", a.config.HTTPAddr)
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				a.logger.Errorf("acme http-01 listener on %s failed: %v", a.config.HTTPAddr, err)
+			}
+		}()
+	}
+
+	go a.prefetch(ctx)
+}
+
+func (a *ACMEManager) prefetch(ctx context.Context) {
+	for _, domain := range a.config.Domains {
+		for attempt := 1; ; attempt++ {
+			hello := &tls.ClientHelloInfo{
+				ServerName:   domain,
+				CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			}
+			cert, err := a.manager.GetCertificate(hello)
+			if err == nil {
+				a.observe(cert)
+				if cert.Leaf != nil {
+					a.logger.Infof("acme certificate for %s is valid until %s", domain, cert.Leaf.NotAfter.Format(time.RFC3339))
+				}
+				break
+			}
+			a.logger.Errorf("failed to obtain acme certificate for %s (try %d): %v", domain, attempt, err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(attempt) * 30 * time.Second):
+			}
+		}
+	}
+}
+
+// ServeChallenges answers both challenge types on a TCP address. It is used by
+// transports that do not serve HTTPS themselves (QUIC listens on UDP).
+func (a *ACMEManager) ServeChallenges(ctx context.Context, addr string) {
+	tlsConfig, err := a.TLSConfig("")
+	if err != nil {
+		a.logger.Errorf("acme challenge listener: %v", err)
+		return
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		a.logger.Errorf("failed to start acme challenge listener on %s: %v", addr, err)
+		return
+	}
+
+	server := &http.Server{Handler: http.NotFoundHandler(), TLSConfig: tlsConfig}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	a.logger.Infof("acme challenge listener started on tcp %s", addr)
+	if err := ServeTLSWithACME(server, listener, a); err != nil && err != http.ErrServerClosed {
+		a.logger.Errorf("acme challenge listener on %s failed: %v", addr, err)
+	}
+}
+
+// ServeTLSWithACME serves HTTPS on listener. With an ACME manager, plain HTTP
+// requests on the same port are answered as HTTP-01 challenges.
+func ServeTLSWithACME(server *http.Server, listener net.Listener, a *ACMEManager) error {
+	if a == nil {
+		return server.ServeTLS(listener, "", "")
+	}
+
+	tlsListener, plainListener := SplitTLSListener(listener)
+	go http.Serve(plainListener, a.HTTPHandler(nil))
+
+	return server.ServeTLS(tlsListener, "", "")
+}
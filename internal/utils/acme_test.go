@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestACMEPebble obtains a certificate from a local pebble ACME server, it runs
+// only when BACKHAUL_PEBBLE_DIRECTORY is set, e.g.
+//
+//	PEBBLE_VA_ALWAYS_VALID=1 pebble -config test/config/pebble-config.json
+//	BACKHAUL_PEBBLE_DIRECTORY=https://127.0.0.1:14000/dir \
+//	BACKHAUL_PEBBLE_CA=test/certs/pebble.minica.pem go test -run Pebble ./internal/utils
+//
+// Without PEBBLE_VA_ALWAYS_VALID pebble validates against its default ports,
+// TLS-ALPN-01 on 5001 and HTTP-01 on 5002, which the test serves on 127.0.0.1:
+// BACKHAUL_PEBBLE_DOMAIN must then resolve there for pebble.
+func TestACMEPebble(t *testing.T) {
+	directory := os.Getenv("BACKHAUL_PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("BACKHAUL_PEBBLE_DIRECTORY not set")
+	}
+	domain := os.Getenv("BACKHAUL_PEBBLE_DOMAIN")
+	if domain == "" {
+		domain = "backhaul.test"
+	}
+
+	manager, err := NewACMEManager(&ACMEConfig{
+		Domains:      []string{domain},
+		Email:        "admin@" + domain,
+		DirectoryURL: directory,
+		CAFile:       os.Getenv("BACKHAUL_PEBBLE_CA"),
+		CacheDir:     t.TempDir(),
+		HTTPAddr:     "127.0.0.1:5002",
+	}, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go manager.ServeChallenges(ctx, "127.0.0.1:5001")
+	manager.Start(ctx)
+
+	deadline := time.Now().Add(time.Minute)
+	for manager.NotAfter().IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatal("no certificate obtained within a minute")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !manager.NotAfter().After(time.Now()) {
+		t.Fatalf("NotAfter() = %v, want a valid certificate", manager.NotAfter())
+	}
+
+	// The listener serves the certificate, to clients without SNI too
+	tlsConfig, err := manager.TLSConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	for _, serverName := range []string{domain, ""} {
+		// pebble's issuing CA changes with every start, the name is what matters
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("handshake with SNI %q: %v", serverName, err)
+		}
+		if names := conn.ConnectionState().PeerCertificates[0].DNSNames; !slices.Contains(names, domain) {
+			t.Errorf("certificate for SNI %q has names %v, want %s", serverName, names, domain)
+		}
+		conn.Close()
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strings"
 
 	"github.com/quic-go/quic-go"
 )
@@ -165,6 +166,26 @@ func ReceiveBinaryTransportString(conn interface{}) (string, byte, error) {
 	return string(messageBuf), transport, nil
 }
 
+// sourceSeparator separates the target address from the source address in the
+// target message, it can't appear in a host name or an IP address.
+const sourceSeparator = "|"
+
+// JoinTarget appends the address of the user connection to the target message
+// (source_metadata). Clients older than source metadata can't parse it.
+func JoinTarget(target, source string) string {
+	if source == "" {
+		return target
+	}
+	return target + sourceSeparator + source
+}
+
+// SplitTarget returns the target and the source address of a target message,
+// source is empty if the server does not send it.
+func SplitTarget(message string) (target, source string) {
+	target, source, _ = strings.Cut(message, sourceSeparator)
+	return target, source
+}
+
 // SendPort sends the port number as a 2-byte big-endian unsigned integer.
 func SendBinaryInt(conn net.Conn, port uint16) error {
 	// Create a 2-byte slice to hold the port number
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"sync"
+	"time"
+
+	"github.com/musix/backhaul/internal/web"
+)
+
+// bufferSize is the size of the buffers relaying data in user space.
+const bufferSize = 16 * 1024 // 16K
+
+// bufferPool holds the relay buffers, so a connection doesn't allocate one
+// per direction.
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, bufferSize)
+		return &buf
+	},
+}
+
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+func putBuffer(buf *[]byte) {
+	bufferPool.Put(buf)
+}
+
+const (
+	// The sniffer usage of a direction is flushed after this much traffic or time
+	flushBytes    = 1024 * 1024 // 1M
+	flushInterval = time.Second
+)
+
+// portCounter batches the sniffer accounting of one direction of a connection,
+// Usage is updated once per flushBytes or flushInterval instead of on every
+// write. A nil *portCounter counts nothing, it is not safe for concurrent use.
+type portCounter struct {
+	usage   *web.Usage
+	port    int
+	pending uint64
+	flushed time.Time
+}
+
+// newPortCounter returns the counter of a direction, nil unless sniffer is on.
+func newPortCounter(usage *web.Usage, remotePort int, sniffer bool) *portCounter {
+	if !sniffer {
+		return nil
+	}
+	return &portCounter{usage: usage, port: remotePort, flushed: time.Now()}
+}
+
+func (p *portCounter) add(n int) {
+	if p == nil {
+		return
+	}
+	p.pending += uint64(n)
+	if p.pending >= flushBytes || time.Since(p.flushed) >= flushInterval {
+		p.flush()
+	}
+}
+
+// flush adds the pending usage to the port, call it when the direction ends.
+func (p *portCounter) flush() {
+	if p == nil || p.pending == 0 {
+		return
+	}
+	p.usage.AddOrUpdatePort(p.port, p.pending)
+	p.pending = 0
+	p.flushed = time.Now()
+}
@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/musix/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	certReloadInterval = 30 * time.Second // how often the key pair is checked for changes
+	certWarnInterval   = 24 * time.Hour   // how often an upcoming expiry is logged
+)
+
+// CertReloader serves a key pair from disk through GetCertificate and reloads it
+// when the files change, so replaced certificates apply without a restart.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	warnDays int
+	logger   *logrus.Logger
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	notAfter time.Time
+	modTime  time.Time
+	lastWarn time.Time
+}
+
+func NewCertReloader(certFile, keyFile string, warnDays int, logger *logrus.Logger) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		warnDays: warnDays,
+		logger:   logger,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the last successfully loaded key pair.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// NotAfter returns the expiry time of the loaded certificate.
+func (r *CertReloader) NotAfter() time.Time {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.notAfter
+}
+
+// Watch polls the key pair until ctx is done. A pair that fails to load is
+// ignored and the previous certificate stays in use.
+func (r *CertReloader) Watch(ctx context.Context) {
+	r.checkExpiry(ctx)
+
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if r.changed() {
+				if err := r.reload(); err != nil {
+					r.logger.Errorf("failed to reload TLS certificate, keeping the current one: %v", err)
+				} else {
+					r.logger.Infof("TLS certificate %s reloaded, valid until %s", r.certFile, r.NotAfter().Format(time.RFC3339))
+				}
+			}
+			r.checkExpiry(ctx)
+		}
+	}
+}
+
+func (r *CertReloader) changed() bool {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return !modTime.Equal(r.modTime)
+}
+
+func (r *CertReloader) latestModTime() (time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+func (r *CertReloader) reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS key pair: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse TLS certificate: %w", err)
+	}
+	cert.Leaf = leaf
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.notAfter = leaf.NotAfter
+	r.modTime = modTime
+	r.lastWarn = time.Time{}
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *CertReloader) checkExpiry(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	left := time.Until(r.notAfter)
+	if left > time.Duration(r.warnDays)*24*time.Hour || time.Since(r.lastWarn) < certWarnInterval {
+		return
+	}
+	r.lastWarn = time.Now()
+	web.NotifyCertExpiring(ctx, r.certFile, r.notAfter)
+
+	if left <= 0 {
+		r.logger.Errorf("TLS certificate %s expired on %s, replace it (a missing self-signed pair is regenerated on restart)", r.certFile, r.notAfter.Format(time.RFC3339))
+		return
+	}
+	r.logger.Warnf("TLS certificate %s expires in %d days (%s)", r.certFile, int(left.Hours()/24), r.notAfter.Format(time.RFC3339))
+}
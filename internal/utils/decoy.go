@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+)
+
+// NewDecoyHandler returns the handler that answers unauthenticated requests, so the
+// bind port looks like an ordinary website. Requests are reverse-proxied to upstream
+// or served from dir. It returns nil when neither is set.
+func NewDecoyHandler(upstream, dir string) (http.Handler, error) {
+	switch {
+	case upstream != "" && dir != "":
+		return nil, fmt.Errorf("decoy_upstream and decoy_dir can't be used together")
+
+	case upstream != "":
+		target, err := url.Parse(upstream)
+		if err != nil || target.Host == "" || (target.Scheme != "http" && target.Scheme != "https") {
+			return nil, fmt.Errorf("invalid decoy upstream %q, expected http(s)://host[:port]", upstream)
+		}
+		return &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(target)
+				// Failed tunnel credentials are not passed on to the upstream
+				r.Out.Header.Del("Authorization")
+				r.Out.Header.Del("X-User-Id")
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			},
+		}, nil
+
+	case dir != "":
+		info, err := os.Stat(dir)
+		if err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("decoy directory %s does not exist", dir)
+		}
+		return http.FileServer(http.Dir(dir)), nil
+	}
+
+	return nil, nil
+}
@@ -3,12 +3,58 @@ package utils
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 )
 
-type CustomFormatter struct{}
+// minSecretLength keeps very short secrets from masking ordinary words.
+const minSecretLength = 4
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string // longest first, so a secret containing another is masked whole
+)
+
+// RegisterSecrets masks the given values in every log message. Secrets stay
+// registered after a reload so old tokens remain masked.
+func RegisterSecrets(values ...string) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	for _, value := range values {
+		if len(value) < minSecretLength {
+			continue
+		}
+		known := false
+		for _, secret := range secrets {
+			known = known || secret == value
+		}
+		if !known {
+			secrets = append(secrets, value)
+		}
+	}
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+}
+
+// Redact replaces the registered secrets in s.
+func Redact(s string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, "[REDACTED]")
+	}
+	return s
+}
+
+type CustomFormatter struct {
+	Name string // tunnel name, prefixes every message when set
+}
 
 func (f *CustomFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	timestamp := entry.Time.Format("02-Jan 15:04:05")
@@ -16,11 +62,31 @@ func (f *CustomFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	level := strings.ToUpper(entry.Level.String())
 	coloredLevel := f.colorize(entry.Level, level)
 
-	logMessage := fmt.Sprintf("%s [%s] %s\n", timestamp, coloredLevel, entry.Message)
+	message := Redact(entry.Message)
+	if f.Name != "" {
+		message = "[" + f.Name + "] " + message
+	}
+	logMessage := fmt.Sprintf("%s [%s] %s%s\n", timestamp, coloredLevel, message, formatFields(entry.Data))
 
 	return []byte(logMessage), nil
 }
 
+// formatFields returns the fields of an entry as " key=value" in key order, the
+// values redacted like the message.
+func formatFields(data logrus.Fields) string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		b.WriteString(" " + key + "=" + Redact(fmt.Sprint(data[key])))
+	}
+	return b.String()
+}
+
 // colorize the output
 func (f *CustomFormatter) colorize(level logrus.Level, text string) string {
 	switch level {
@@ -58,3 +124,11 @@ func NewLogger(logLevel string) *logrus.Logger {
 
 	return log
 }
+
+// NewNamedLogger returns a logger whose messages are prefixed with name, the
+// tunnel name of [[tunnel]] entries. An empty name adds no prefix.
+func NewNamedLogger(logLevel, name string) *logrus.Logger {
+	log := NewLogger(logLevel)
+	log.SetFormatter(&CustomFormatter{Name: name})
+	return log
+}
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRedact(t *testing.T) {
+	RegisterSecrets("s3cr3t-token", "s3cr3t-token-long", "abc", "")
+	// registering again keeps a single entry
+	RegisterSecrets("s3cr3t-token")
+
+	tests := []struct {
+		in, want string
+	}{
+		{"invalid token s3cr3t-token from 192.0.2.1", "invalid token [REDACTED] from 192.0.2.1"},
+		{"token s3cr3t-token-long", "token [REDACTED]"},
+		{"s3cr3t-tokens3cr3t-token", "[REDACTED][REDACTED]"},
+		{"short secrets like abc are not masked", "short secrets like abc are not masked"},
+		{"nothing to hide", "nothing to hide"},
+	}
+	for _, tt := range tests {
+		if got := Redact(tt.in); got != tt.want {
+			t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCustomFormatterRedactsFields(t *testing.T) {
+	RegisterSecrets("field-s3cr3t")
+
+	logger := logrus.New()
+	var out strings.Builder
+	logger.SetOutput(&out)
+	logger.SetFormatter(&CustomFormatter{Name: "tunnel"})
+
+	logger.WithFields(logrus.Fields{
+		"token":  "field-s3cr3t",
+		"error":  errors.New("invalid token field-s3cr3t"),
+		"source": "192.0.2.1",
+	}).Warn("rejected field-s3cr3t")
+
+	got := out.String()
+	if strings.Contains(got, "field-s3cr3t") {
+		t.Fatalf("secret logged: %q", got)
+	}
+	if want := "[tunnel] rejected [REDACTED] error=invalid token [REDACTED] source=192.0.2.1 token=[REDACTED]\n"; !strings.HasSuffix(got, want) {
+		t.Fatalf("logged %q, want the suffix %q", got, want)
+	}
+}
@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/musix/backhaul/internal/config"
+	"golang.org/x/exp/rand"
+)
+
+// Control channel paths used when the profile does not define any
+var defaultObfuscationPaths = []string{"/api/v1/stream", "/cdn/assets", "/ws/chat", "/api/notifications", "/live/stream", "/api/analytics", "/cdn/static", "/api/status", "/ws/updates", "/api/metrics"}
+
+// User-Agents used when the profile does not define any
+var defaultUserAgents = []string{
+	// Chrome
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/119.0.0.0 Safari/537.36",
+	// Firefox
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:121.0) Gecko/20100101 Firefox/121.0",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:121.0) Gecko/20100101 Firefox/121.0",
+	"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0",
+	// Safari
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15",
+	// Edge
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0",
+}
+
+// Headers a browser sends when opening a page, added to every obfuscated handshake
+var browserHeaders = [][2]string{
+	{"Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,image/webp,*/*;q=0.8"},
+	{"Accept-Language", "en-US,en;q=0.5"},
+	{"Accept-Encoding", "gzip, deflate, br"},
+	{"DNT", "1"},
+	// Note: Connection header is set by WebSocket library automatically
+	{"Upgrade-Insecure-Requests", "1"},
+	{"Sec-Fetch-Dest", "document"},
+	{"Sec-Fetch-Mode", "navigate"},
+	{"Sec-Fetch-Site", "none"},
+	{"Cache-Control", "max-age=0"},
+}
+
+// ObfuscationProfile disguises websocket handshakes as browser traffic. The same
+// profile is used by the client to build requests and by the server to match them.
+type ObfuscationProfile struct {
+	Enabled    bool
+	Paths      []string          // control channel paths, a random user id is appended
+	Headers    map[string]string // extra handshake headers (client) or response headers (server)
+	UserAgents []string          // one is picked per handshake (client only)
+	Host       string            // Host header sent by the client and required by the server
+}
+
+func NewObfuscationProfile(cfg config.ObfuscationConfig) *ObfuscationProfile {
+	p := &ObfuscationProfile{
+		Enabled:    cfg.Enabled == nil || *cfg.Enabled,
+		Paths:      defaultObfuscationPaths,
+		Headers:    cfg.Headers,
+		UserAgents: defaultUserAgents,
+		Host:       cfg.Host,
+	}
+
+	if len(cfg.Paths) > 0 {
+		p.Paths = nil
+		for _, path := range cfg.Paths {
+			path = "/" + strings.Trim(strings.TrimSpace(path), "/")
+			if path != "/" {
+				p.Paths = append(p.Paths, path)
+			}
+		}
+	}
+	if len(cfg.UserAgents) > 0 {
+		p.UserAgents = cfg.UserAgents
+	}
+
+	return p
+}
+
+// RequestPath returns the handshake path for basePath ("/channel" or "/tunnel").
+// Control channels use one of the profile paths, tunnels keep their base path.
+func (p *ObfuscationProfile) RequestPath(basePath string, userID int32) string {
+	if basePath != "/channel" {
+		return fmt.Sprintf("%s/%d", basePath, userID)
+	}
+	if !p.Enabled || len(p.Paths) == 0 {
+		return basePath
+	}
+	return fmt.Sprintf("%s/%d", p.Paths[rand.Intn(len(p.Paths))], userID)
+}
+
+// IsControlPath reports whether path was built by RequestPath for a control channel
+// with the same paths. The plain "/channel" is always accepted.
+func (p *ObfuscationProfile) IsControlPath(path string) bool {
+	if path == "/channel" {
+		return true
+	}
+	for _, prefix := range p.Paths {
+		if userID, ok := strings.CutPrefix(path, prefix+"/"); ok && isDigits(userID) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTunnelPath reports whether path is a tunnel connection path.
+func (p *ObfuscationProfile) IsTunnelPath(path string) bool {
+	return strings.HasPrefix(path, "/tunnel")
+}
+
+// MatchHost reports whether the request Host is accepted, any host matches if none is set.
+func (p *ObfuscationProfile) MatchHost(host string) bool {
+	if p.Host == "" {
+		return true
+	}
+	if h, _, ok := strings.Cut(host, ":"); ok {
+		host = h
+	}
+	return strings.EqualFold(host, p.Host)
+}
+
+// RequestHeaders builds the handshake headers of a client connection.
+func (p *ObfuscationProfile) RequestHeaders(token string, userID int32) http.Header {
+	headers := http.Header{}
+
+	headers.Add("Authorization", fmt.Sprintf("Bearer %v", token))
+	headers.Add("X-User-Id", fmt.Sprintf("%d", userID))
+	headers.Add("User-Agent", p.UserAgents[rand.Intn(len(p.UserAgents))])
+	if p.Host != "" {
+		headers.Set("Host", p.Host)
+	}
+	if !p.Enabled {
+		return headers
+	}
+
+	for _, header := range browserHeaders {
+		headers.Add(header[0], header[1])
+	}
+	for key, value := range p.Headers {
+		headers.Set(key, value)
+	}
+
+	return headers
+}
+
+// ResponseHeaders returns the headers the server adds to upgrade responses.
+func (p *ObfuscationProfile) ResponseHeaders() http.Header {
+	if !p.Enabled || len(p.Headers) == 0 {
+		return nil
+	}
+	headers := http.Header{}
+	for key, value := range p.Headers {
+		headers.Set(key, value)
+	}
+	return headers
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// pprofAddrs holds the addresses pprof listens on, it serves the whole process
+// so the tunnels that enable it share one listener per address.
+var pprofAddrs sync.Map
+
+// StartPprof serves pprof on addr unless the process already does. A failed
+// listen is logged and tried again by the next tunnel that starts.
+func StartPprof(addr string, logger *logrus.Logger) {
+	if _, started := pprofAddrs.LoadOrStore(addr, struct{}{}); started {
+		return
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		pprofAddrs.Delete(addr)
+		logger.Errorf("failed to start pprof on %s: %v", addr, err)
+		return
+	}
+
+	logger.Infof("pprof started at %s", addr)
+	go http.Serve(listener, nil)
+}
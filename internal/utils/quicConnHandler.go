@@ -10,45 +10,46 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// QConnectionHandler copies data between a TCP connection and a QUIC stream.
+// EOF in one direction closes the write side of the other end, the stream
+// with Close and the TCP connection with CloseWrite, and the other direction
+// keeps flowing until it ends too.
 func QConnectionHandler(from net.Conn, to quic.Stream, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
 	done := make(chan struct{})
+	halfClose := canCloseWrite(from)
 
 	go func() {
 		defer close(done)
-		q1transferData(from, to, from, to, logger, usage, remotePort, sniffer)
+		q1transferData(from, to, halfClose, to.Close, from, to, logger, newPortCounter(usage, remotePort, sniffer))
 	}()
 
-	q1transferData(to, from, from, to, logger, usage, remotePort, sniffer)
+	q1transferData(to, from, halfClose, func() error { return closeWrite(from) }, from, to, logger, newPortCounter(usage, remotePort, sniffer))
 
 	<-done
+	from.Close()
+	to.Close()
 }
 
 // Using direct Read and Write for transferring data
-func q1transferData(from io.ReadWriter, to io.ReadWriter, tcp net.Conn, quic quic.Stream, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
-	buf := make([]byte, 16*1024) // 16K
+func q1transferData(from io.ReadWriter, to io.ReadWriter, halfClose bool, closeWrite func() error, tcp net.Conn, quic quic.Stream, logger *logrus.Logger, counter *portCounter) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	defer counter.flush()
+
 	for {
-		// Read data from the source connection
-		r, err := from.Read(buf)
-		if err != nil {
-			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
-				logger.Trace("reader stream closed or EOF received")
-			} else {
-				logger.Trace("unable to read from the connection: ", err)
-			}
-			tcp.Close()
-			quic.Close()
-			return
-		}
+		// Read data from the source connection, a stream may return its last
+		// data together with EOF
+		r, err := from.Read(*buf)
 
 		totalWritten := 0
 		for totalWritten < r {
 			// Write data to the destination connection
-			w, err := to.Write(buf[totalWritten:r])
-			if err != nil {
-				if errors.Is(err, net.ErrClosed) {
+			w, werr := to.Write((*buf)[totalWritten:r])
+			if werr != nil {
+				if errors.Is(werr, net.ErrClosed) {
 					logger.Trace("writer stream closed or EOF received")
 				} else {
-					logger.Trace("unable to write to the connection: ", err)
+					logger.Trace("unable to write to the connection: ", werr)
 				}
 				tcp.Close()
 				quic.Close()
@@ -57,9 +58,24 @@ func q1transferData(from io.ReadWriter, to io.ReadWriter, tcp net.Conn, quic qui
 			totalWritten += w
 		}
 
-		logger.Tracef("read data: %d bytes, written data: %d bytes", r, totalWritten)
-		if sniffer {
-			usage.AddOrUpdatePort(remotePort, uint64(totalWritten))
+		if r > 0 {
+			logger.Tracef("read data: %d bytes, written data: %d bytes", r, totalWritten)
+			counter.add(totalWritten)
+		}
+
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				logger.Trace("reader stream closed or EOF received")
+			} else {
+				logger.Trace("unable to read from the connection: ", err)
+			}
+			// the source is done sending, the destination may still answer
+			if halfClose && errors.Is(err, io.EOF) && closeWrite() == nil {
+				return
+			}
+			tcp.Close()
+			quic.Close()
+			return
 		}
 	}
 
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+// sessionSeparator separates the token from the session id in the control
+// channel handshake of clients that can resume a lost control channel.
+const sessionSeparator = "|"
+
+// JoinSession returns the handshake message of a client that can resume its
+// control channel, id is empty to ask for a new session.
+func JoinSession(token, id string) string {
+	return token + sessionSeparator + id
+}
+
+// SplitSession returns the token and the session id of a handshake message, ok
+// is false for a client that can't resume. The id never contains the separator,
+// the token may.
+func SplitSession(message string) (token, id string, ok bool) {
+	i := strings.LastIndex(message, sessionSeparator)
+	if i < 0 {
+		return message, "", false
+	}
+	return message[:i], message[i+len(sessionSeparator):], true
+}
+
+// NewSessionID returns a random id for a control channel session.
+func NewSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,28 @@
+package utils
+
+import "testing"
+
+func TestSplitSession(t *testing.T) {
+	tests := []struct {
+		message   string
+		token, id string
+		ok        bool
+	}{
+		{"token", "token", "", false},
+		{"token|", "token", "", true},
+		{"token|0123abcd", "token", "0123abcd", true},
+		{"to|ken|0123abcd", "to|ken", "0123abcd", true},
+		{"", "", "", false},
+	}
+	for _, tt := range tests {
+		token, id, ok := SplitSession(tt.message)
+		if token != tt.token || id != tt.id || ok != tt.ok {
+			t.Errorf("SplitSession(%q) = %q, %q, %v, want %q, %q, %v", tt.message, token, id, ok, tt.token, tt.id, tt.ok)
+		}
+	}
+
+	id := NewSessionID()
+	if token, got, ok := SplitSession(JoinSession("to|ken", id)); token != "to|ken" || got != id || !ok {
+		t.Errorf("SplitSession(JoinSession()) = %q, %q, %v", token, got, ok)
+	}
+}
@@ -8,4 +8,5 @@ const (
 	SG_TCP                // TCP Transport ID
 	SG_UDP                // TCP Transport ID
 	SG_RTT                // For RTT measurment
+	SG_Tunnel             // announces a tunnel connection of a control session
 )
@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+package utils
+
+import (
+	"net"
+	"syscall"
+)
+
+// A spliced destination's send buffer must hold this many segments. Splicing
+// into a buffer of about one segment, like a 32K buffer on loopback, waits for
+// a retransmission timer on nearly every segment.
+const spliceMinSegments = 4
+
+// canSplice tells whether data is spliced to conn by the kernel, that is when
+// its send buffer is large enough.
+func canSplice(conn *net.TCPConn) bool {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var sndbuf, mss int
+	var sndbufErr, mssErr error
+	err = raw.Control(func(fd uintptr) {
+		sndbuf, sndbufErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		mss, mssErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_MAXSEG)
+	})
+	if err != nil || sndbufErr != nil || mssErr != nil {
+		return false
+	}
+	return sndbuf >= spliceMinSegments*mss
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package utils
+
+import "net"
+
+// canSplice is false outside linux, there (*net.TCPConn).ReadFrom copies
+// through a fresh buffer on every call.
+func canSplice(conn *net.TCPConn) bool {
+	return false
+}
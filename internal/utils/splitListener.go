@@ -0,0 +1,112 @@
+package utils
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// SplitTLSListener separates TLS connections from plain ones on a single listener
+// by peeking at the first byte (0x16 is a TLS handshake record). Closing either
+// returned listener closes the underlying one.
+func SplitTLSListener(listener net.Listener) (net.Listener, net.Listener) {
+	split := &splitListener{
+		listener: listener,
+		done:     make(chan struct{}),
+	}
+	tlsListener := &subListener{parent: split, conns: make(chan net.Conn)}
+	plainListener := &subListener{parent: split, conns: make(chan net.Conn)}
+
+	go split.acceptLoop(tlsListener, plainListener)
+
+	return tlsListener, plainListener
+}
+
+type splitListener struct {
+	listener  net.Listener
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func (l *splitListener) acceptLoop(tlsListener, plainListener *subListener) {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			l.err = err
+			l.close()
+			return
+		}
+		go l.dispatch(conn, tlsListener, plainListener)
+	}
+}
+
+func (l *splitListener) dispatch(conn net.Conn, tlsListener, plainListener *subListener) {
+	first := make([]byte, 1)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Read(first); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	target := plainListener
+	if first[0] == 0x16 {
+		target = tlsListener
+	}
+
+	select {
+	case target.conns <- &peekedConn{Conn: conn, peeked: first}:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *splitListener) close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.listener.Close()
+	})
+	return err
+}
+
+type subListener struct {
+	parent *splitListener
+	conns  chan net.Conn
+}
+
+func (l *subListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.parent.done:
+		if l.parent.err != nil {
+			return nil, l.parent.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *subListener) Close() error {
+	return l.parent.close()
+}
+
+func (l *subListener) Addr() net.Addr {
+	return l.parent.listener.Addr()
+}
+
+// peekedConn replays the bytes consumed while detecting the protocol.
+type peekedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(b, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
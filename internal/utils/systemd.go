@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SdNotify sends state to the service manager over $NOTIFY_SOCKET, see sd_notify(3).
+// It does nothing when the process is not run by systemd with Type=notify.
+func SdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	addr := &net.UnixAddr{Name: socket, Net: "unixgram"}
+	if strings.HasPrefix(socket, "@") {
+		// abstract namespace socket
+		addr.Name = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// SdReloading tells the service manager that the configuration is being reloaded,
+// READY=1 follows once the tunnel is up again.
+func SdReloading() error {
+	return SdNotify("RELOADING=1\nSTATUS=Reloading configuration")
+}
+
+// sdWatchdogInterval returns the WatchdogSec= of the unit, 0 if the watchdog is
+// disabled or meant for another process.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// SystemdNotifier reports the tunnel state to systemd: READY=1 and STATUS= when
+// the control channel is established, and WATCHDOG=1 pings as long as heartbeats
+// arrive. It implements web.TunnelObserver.
+type SystemdNotifier struct {
+	heartbeatTimeout time.Duration
+	logger           *logrus.Logger
+	up               atomic.Bool
+	lastHeartbeat    atomic.Int64
+}
+
+// NewSystemdNotifier creates a notifier, the watchdog is no longer pinged while the
+// tunnel is up and the last heartbeat is older than heartbeatTimeout.
+func NewSystemdNotifier(heartbeatTimeout time.Duration, logger *logrus.Logger) *SystemdNotifier {
+	return &SystemdNotifier{
+		heartbeatTimeout: heartbeatTimeout,
+		logger:           logger,
+	}
+}
+
+func (n *SystemdNotifier) notify(state string) {
+	if err := SdNotify(state); err != nil {
+		n.logger.Debugf("failed to notify systemd: %v", err)
+	}
+}
+
+func (n *SystemdNotifier) TunnelUp(status string) {
+	n.lastHeartbeat.Store(time.Now().UnixNano())
+	n.up.Store(true)
+	n.notify("READY=1\nSTATUS=" + status)
+}
+
+func (n *SystemdNotifier) TunnelDown(reason string) {
+	n.up.Store(false)
+	n.notify("STATUS=Disconnected (" + reason + ")")
+}
+
+func (n *SystemdNotifier) Heartbeat() {
+	n.lastHeartbeat.Store(time.Now().UnixNano())
+}
+
+func (n *SystemdNotifier) InvalidToken(source string) {}
+
+func (n *SystemdNotifier) QuotaReached(port int, usage, quota uint64) {}
+
+func (n *SystemdNotifier) CertExpiring(certFile string, notAfter time.Time) {}
+
+// healthy reports whether the watchdog should be pinged. While the tunnel is down
+// the transport keeps retrying on its own, so only a stalled control channel counts.
+func (n *SystemdNotifier) healthy() bool {
+	if !n.up.Load() {
+		return true
+	}
+	return time.Since(time.Unix(0, n.lastHeartbeat.Load())) <= n.heartbeatTimeout
+}
+
+// Start sends the initial status and pings the watchdog at half its interval
+// until ctx is done.
+func (n *SystemdNotifier) Start(ctx context.Context) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	n.notify("STATUS=Waiting for the control channel")
+
+	interval := sdWatchdogInterval()
+	if interval <= 0 {
+		return
+	}
+	n.logger.Infof("systemd watchdog enabled, interval %v", interval)
+
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if n.healthy() {
+					n.notify("WATCHDOG=1")
+				} else {
+					n.logger.Warn("no heartbeat on the control channel, systemd watchdog is not pinged")
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// notifySocket stands in for the service manager: it listens on a unixgram
+// socket and points NOTIFY_SOCKET at it.
+func notifySocket(t *testing.T, name string) *net.UnixConn {
+	t.Helper()
+	if runtime.GOOS != "linux" {
+		t.Skip("systemd runs on linux only")
+	}
+	addr := &net.UnixAddr{Name: name, Net: "unixgram"}
+	if strings.HasPrefix(name, "@") {
+		addr.Name = "\x00" + name[1:]
+	}
+	conn, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", name)
+	return conn
+}
+
+func readNotification(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	buf := make([]byte, 512)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no notification: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	for _, name := range []string{filepath.Join(t.TempDir(), "notify"), "@backhaul-test-" + NewSessionID()} {
+		conn := notifySocket(t, name)
+		if err := SdNotify("READY=1"); err != nil {
+			t.Fatalf("SdNotify() on %s: %v", name, err)
+		}
+		if got := readNotification(t, conn); got != "READY=1" {
+			t.Errorf("notification on %s = %q, want READY=1", name, got)
+		}
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := SdNotify("READY=1"); err != nil {
+		t.Errorf("SdNotify() without NOTIFY_SOCKET: %v", err)
+	}
+}
+
+func TestSystemdNotifierWatchdog(t *testing.T) {
+	conn := notifySocket(t, filepath.Join(t.TempDir(), "notify"))
+	t.Setenv("WATCHDOG_USEC", "100000")
+	t.Setenv("WATCHDOG_PID", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n := NewSystemdNotifier(time.Hour, testLogger())
+	n.Start(ctx)
+	if got := readNotification(t, conn); got != "STATUS=Waiting for the control channel" {
+		t.Fatalf("first notification = %q", got)
+	}
+
+	n.TunnelUp("Connected (TCP)")
+	for got := readNotification(t, conn); got != "READY=1\nSTATUS=Connected (TCP)"; got = readNotification(t, conn) {
+		if got != "WATCHDOG=1" {
+			t.Fatalf("unexpected notification %q", got)
+		}
+	}
+	if got := readNotification(t, conn); got != "WATCHDOG=1" {
+		t.Fatalf("notification = %q, want WATCHDOG=1", got)
+	}
+
+	// A stalled control channel stops the pings, once the one in flight is read
+	n.lastHeartbeat.Store(time.Now().Add(-2 * time.Hour).UnixNano())
+	time.Sleep(60 * time.Millisecond)
+	buf := make([]byte, 512)
+	for {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if _, err := conn.Read(buf); err != nil {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if size, err := conn.Read(buf); err == nil {
+		t.Fatalf("watchdog pinged without heartbeats: %q", buf[:size])
+	}
+}
@@ -9,31 +9,61 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// Between two TCP connections data is spliced in chunks of this size, so
+// traffic is counted while a connection runs.
+const spliceChunk = 256 * 1024 // 256K
+
+// TCPConnectionHandler relays data both ways until both directions ended.
+// Between two TCP connections the kernel moves the data (splice) unless the
+// destination's send buffer is too small, otherwise it is copied through
+// pooled buffers. When both connections can be
+// half-closed, EOF in one direction is passed on as CloseWrite and the other
+// direction keeps flowing, otherwise the first EOF closes both.
 func TCPConnectionHandler(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
 	done := make(chan struct{})
+	halfClose := canCloseWrite(from) && canCloseWrite(to)
 
 	go func() {
 		defer close(done)
-		transferData(from, to, logger, usage, remotePort, sniffer)
+		transferFunc(from, to)(from, to, halfClose, logger, newPortCounter(usage, remotePort, sniffer))
 	}()
 
-	transferData(to, from, logger, usage, remotePort, sniffer)
+	transferFunc(to, from)(to, from, halfClose, logger, newPortCounter(usage, remotePort, sniffer))
 
 	<-done
+	from.Close()
+	to.Close()
+}
+
+// transferFunc picks how data is moved from one connection to the other.
+func transferFunc(from net.Conn, to net.Conn) func(net.Conn, net.Conn, bool, *logrus.Logger, *portCounter) {
+	if _, _, ok := spliceable(from); ok {
+		if dst, _, ok := spliceable(to); ok && canSplice(dst) {
+			return spliceData
+		}
+	}
+	return transferData
 }
 
 // Using direct Read and Write for transferring data
-func transferData(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
-	buf := make([]byte, 16*1024) // 16K
+func transferData(from net.Conn, to net.Conn, halfClose bool, logger *logrus.Logger, counter *portCounter) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	defer counter.flush()
+
 	for {
 		// Read data from the source connection
-		r, err := from.Read(buf)
+		r, err := from.Read(*buf)
 		if err != nil {
 			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 				logger.Trace("reader stream closed or EOF received")
 			} else {
 				logger.Trace("unable to read from the connection: ", err)
 			}
+			// the source is done sending, the destination may still answer
+			if halfClose && errors.Is(err, io.EOF) && closeWrite(to) == nil {
+				return
+			}
 			from.Close()
 			to.Close()
 			return
@@ -42,7 +72,7 @@ func transferData(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.
 		totalWritten := 0
 		for totalWritten < r {
 			// Write data to the destination connection
-			w, err := to.Write(buf[totalWritten:r])
+			w, err := to.Write((*buf)[totalWritten:r])
 			if err != nil {
 				if errors.Is(err, net.ErrClosed) {
 					logger.Trace("writer stream closed or EOF received")
@@ -58,9 +88,110 @@ func transferData(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.
 		}
 
 		logger.Tracef("read data: %d bytes, written data: %d bytes", r, totalWritten)
-		if sniffer {
-			usage.AddOrUpdatePort(remotePort, uint64(totalWritten))
+		counter.add(totalWritten)
+	}
+
+}
+
+// spliceData moves data between two TCP connections without copying it through
+// user space, the web panel wrappers are passed by and told the traffic.
+func spliceData(from net.Conn, to net.Conn, halfClose bool, logger *logrus.Logger, counter *portCounter) {
+	defer counter.flush()
+
+	src, srcCounter, _ := spliceable(from)
+	dst, dstCounter, _ := spliceable(to)
+	chunk := &io.LimitedReader{R: src}
+	for {
+		chunk.N = spliceChunk
+		n, err := dst.ReadFrom(chunk)
+		if n > 0 {
+			if srcCounter != nil {
+				srcCounter.CountRead(n, nil)
+			}
+			if dstCounter != nil {
+				dstCounter.CountWritten(n, nil)
+			}
+			logger.Tracef("spliced data: %d bytes", n)
+			counter.add(int(n))
+		}
+		if err == nil && chunk.N > 0 {
+			// ReadFrom stops early only at EOF of the source
+			err = io.EOF
+		}
+		if err == nil {
+			continue
+		}
+
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+			logger.Trace("reader stream closed or EOF received")
+		} else {
+			logger.Trace("unable to splice the connection: ", err)
 		}
+		if srcCounter != nil {
+			srcCounter.CountRead(0, err)
+		}
+		// the source is done sending, the destination may still answer
+		if halfClose && errors.Is(err, io.EOF) && closeWrite(to) == nil {
+			return
+		}
+		from.Close()
+		to.Close()
+		return
+	}
+}
+
+// trafficCounter is a wrapper counting the traffic of the connection it wraps,
+// like the web panel's. Data spliced past it is reported with CountRead and
+// CountWritten as if it had been read or written through it.
+type trafficCounter interface {
+	NetConn() net.Conn
+	CountRead(n int64, err error)
+	CountWritten(n int64, err error)
+}
+
+// spliceable returns the TCP connection of conn and its counter, if conn is a
+// TCP connection or a counter right around one.
+func spliceable(conn net.Conn) (*net.TCPConn, trafficCounter, bool) {
+	counter, _ := conn.(trafficCounter)
+	if counter != nil {
+		conn = counter.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	return tcpConn, counter, ok
+}
+
+// closeWriter is a connection whose write direction can be closed on its own,
+// like *net.TCPConn: the peer reads EOF while the connection still reads.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWriterOf returns the closeWriter of conn, looking through wrappers that
+// expose the connection they wrap with NetConn.
+func closeWriterOf(conn net.Conn) (closeWriter, bool) {
+	for {
+		if cw, ok := conn.(closeWriter); ok {
+			return cw, true
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil, false
+		}
+		conn = wrapper.NetConn()
 	}
+}
 
+// canCloseWrite reports whether conn can be half-closed. EOF read from such a
+// connection means its peer half-closed it, from others that the peer is gone.
+func canCloseWrite(conn net.Conn) bool {
+	_, ok := closeWriterOf(conn)
+	return ok
+}
+
+// closeWrite half-closes conn, errors.ErrUnsupported if it can't.
+func closeWrite(conn net.Conn) error {
+	if cw, ok := closeWriterOf(conn); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
 }
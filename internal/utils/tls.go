@@ -3,16 +3,32 @@ package utils
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"math/big"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
+// ClientTLSOptions describes how the client authenticates itself and verifies the server.
+type ClientTLSOptions struct {
+	CertFile   string   // Client certificate presented to the server (mutual TLS)
+	KeyFile    string   // Private key of the client certificate
+	CAFile     string   // CA bundle used to verify the server certificate
+	ServerName string   // Expected server name, defaults to the dialed host
+	Pins       []string // SPKI pins of the server certificate ("sha256/<base64>")
+}
+
 // EnsureSelfSignedCert checks if certFile/keyFile exist, and if not, generates a self-signed certificate and key.
 func EnsureSelfSignedCert(certFile, keyFile, host string) error {
 	if fileExists(certFile) && fileExists(keyFile) {
@@ -93,3 +109,149 @@ func generateSelfSignedCert(certFile, keyFile, host string) error {
 
 	return nil
 }
+
+// NewServerTLSConfig serves the key pair of certs and, if clientCAFile is set,
+// requires every client to present a certificate signed by that CA bundle.
+func NewServerTLSConfig(certs *CertReloader, clientCAFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pool, err := LoadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// NewClientTLSConfig builds the client side TLS configuration. Without a CA bundle
+// or pins the server certificate is not verified, which keeps the old behaviour.
+func NewClientTLSConfig(opts ClientTLSOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: opts.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client TLS key pair: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	pins, err := parseSPKIPins(opts.Pins)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.CAFile != "" {
+		pool, err := LoadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	} else {
+		// Chain verification is skipped, pins (if any) are checked below
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	if len(pins) > 0 {
+		verifyChain := opts.CAFile != ""
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			return verifySPKIPins(rawCerts, verifiedChains, verifyChain, pins)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// LoadCertPool reads a PEM encoded CA bundle.
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA bundle %s: %w", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no valid certificates found in CA bundle %s", caFile)
+	}
+	return pool, nil
+}
+
+// SPKIPin returns the pin of a certificate in "sha256/<base64>" form.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// CertFilePin returns the SPKI pin of the first certificate in a PEM file.
+func CertFilePin(certFile string) (string, error) {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", fmt.Errorf("no certificate found in %s", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	return SPKIPin(cert), nil
+}
+
+func parseSPKIPins(pins []string) ([][]byte, error) {
+	var parsed [][]byte
+	for _, pin := range pins {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+		if pin == "" {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin: %s", pin)
+		}
+		parsed = append(parsed, sum)
+	}
+	return parsed, nil
+}
+
+// verifySPKIPins checks the server certificate against the pins. With a
+// verified chain any certificate of it may match, e.g. the pinned CA.
+// Otherwise the chain was not verified and the other certificates the server
+// sent prove nothing, only the leaf may match.
+func verifySPKIPins(rawCerts [][]byte, verifiedChains [][]*x509.Certificate, verifyChain bool, pins [][]byte) error {
+	if verifyChain {
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if matchSPKIPin(cert, pins) {
+					return nil
+				}
+			}
+		}
+	} else if len(rawCerts) > 0 {
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err == nil && matchSPKIPin(cert, pins) {
+			return nil
+		}
+	}
+	return errors.New("server certificate does not match any configured SPKI pin")
+}
+
+func matchSPKIPin(cert *x509.Certificate, pins [][]byte) bool {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	for _, pin := range pins {
+		if subtle.ConstantTimeCompare(sum[:], pin) == 1 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCert creates a certificate signed by parent, self-signed without one.
+func testCert(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestVerifySPKIPins(t *testing.T) {
+	ca, caKey := testCert(t, "ca", true, nil, nil)
+	server, _ := testCert(t, "server", false, ca, caKey)
+	attacker, _ := testCert(t, "attacker", false, nil, nil)
+
+	pins, err := parseSPKIPins([]string{SPKIPin(server)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPins, err := parseSPKIPins([]string{SPKIPin(ca)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		rawCerts    [][]byte
+		chains      [][]*x509.Certificate
+		verifyChain bool
+		pins        [][]byte
+		ok          bool
+	}{
+		{"pinned leaf", [][]byte{server.Raw}, nil, false, pins, true},
+		{"other leaf", [][]byte{attacker.Raw}, nil, false, pins, false},
+		{"pinned certificate appended to other leaf", [][]byte{attacker.Raw, server.Raw}, nil, false, pins, false},
+		{"pinned CA without verified chain", [][]byte{server.Raw, ca.Raw}, nil, false, caPins, false},
+		{"pinned CA in verified chain", [][]byte{server.Raw, ca.Raw}, [][]*x509.Certificate{{server, ca}}, true, caPins, true},
+		{"pinned certificate outside verified chain", [][]byte{attacker.Raw, server.Raw}, [][]*x509.Certificate{{attacker}}, true, pins, false},
+		{"no certificate", nil, nil, false, pins, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifySPKIPins(tt.rawCerts, tt.chains, tt.verifyChain, tt.pins)
+			if (err == nil) != tt.ok {
+				t.Fatalf("verifySPKIPins() error = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestParseSPKIPins(t *testing.T) {
+	ca, _ := testCert(t, "ca", true, nil, nil)
+	if _, err := parseSPKIPins([]string{SPKIPin(ca), " ", ""}); err != nil {
+		t.Fatalf("valid pin rejected: %v", err)
+	}
+	for _, pin := range []string{"sha256/not-base64", "sha256/AAAA"} {
+		if _, err := parseSPKIPins([]string{pin}); err == nil {
+			t.Errorf("invalid pin %q accepted", pin)
+		}
+	}
+}
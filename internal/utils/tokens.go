@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"sync/atomic"
+	"time"
+)
+
+// TokenEntry is a token accepted by the server, Expires zero means it never expires.
+type TokenEntry struct {
+	Token   string
+	Expires time.Time
+}
+
+// TokenSet holds the tokens accepted by the server. It can be updated while
+// the transport runs, so tokens are rotated without dropping the tunnel.
+type TokenSet struct {
+	entries atomic.Pointer[[]TokenEntry]
+}
+
+func NewTokenSet(entries []TokenEntry) *TokenSet {
+	t := &TokenSet{}
+	t.Update(entries)
+	return t
+}
+
+// Update replaces the accepted tokens, connections authenticated before stay up.
+func (t *TokenSet) Update(entries []TokenEntry) {
+	valid := make([]TokenEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Token != "" {
+			valid = append(valid, entry)
+		}
+	}
+	t.entries.Store(&valid)
+}
+
+// Valid reports whether token is accepted and not expired.
+func (t *TokenSet) Valid(token string) bool {
+	now := time.Now()
+	valid := false
+	for _, entry := range *t.entries.Load() {
+		// compare every entry, the time taken does not depend on which one matches
+		match := subtle.ConstantTimeCompare([]byte(token), []byte(entry.Token)) == 1
+		valid = valid || match && (entry.Expires.IsZero() || now.Before(entry.Expires))
+	}
+	return valid
+}
+
+// Len returns the number of tokens that have not expired.
+func (t *TokenSet) Len() int {
+	now := time.Now()
+	n := 0
+	for _, entry := range *t.entries.Load() {
+		if entry.Expires.IsZero() || now.Before(entry.Expires) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenSetValid(t *testing.T) {
+	tokens := NewTokenSet([]TokenEntry{
+		{Token: "current"},
+		{Token: "rotating", Expires: time.Now().Add(time.Hour)},
+		{Token: "expired", Expires: time.Now().Add(-time.Hour)},
+		{Token: ""},
+	})
+	tests := []struct {
+		token string
+		want  bool
+	}{
+		{"current", true},
+		{"rotating", true},
+		{"expired", false},
+		{"", false},
+		{"curren", false},
+		{"current ", false},
+	}
+	for _, tt := range tests {
+		if got := tokens.Valid(tt.token); got != tt.want {
+			t.Errorf("Valid(%q) = %v, want %v", tt.token, got, tt.want)
+		}
+	}
+	if got := tokens.Len(); got != 2 {
+		t.Errorf("Len() = %d, want 2", got)
+	}
+
+	tokens.Update([]TokenEntry{{Token: "next"}})
+	if tokens.Valid("current") || !tokens.Valid("next") {
+		t.Error("Update() didn't replace the tokens")
+	}
+}
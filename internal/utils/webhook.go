@@ -0,0 +1,286 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Webhook event names, also the values of webhook_events.
+const (
+	WebhookTunnelUp          = "tunnel_up"
+	WebhookTunnelDown        = "tunnel_down"
+	WebhookRestartLoop       = "restart_loop"
+	WebhookQuotaReached      = "quota_reached"
+	WebhookCertExpiring      = "cert_expiring"
+	WebhookInvalidTokenStorm = "invalid_token_storm"
+)
+
+var webhookEventNames = []string{
+	WebhookTunnelUp,
+	WebhookTunnelDown,
+	WebhookRestartLoop,
+	WebhookQuotaReached,
+	WebhookCertExpiring,
+	WebhookInvalidTokenStorm,
+}
+
+const (
+	restartLoopWindow  = 5 * time.Minute // restarts counted for restart_loop
+	restartLoopCount   = 5
+	invalidTokenWindow = time.Minute // failed authentications counted for invalid_token_storm
+	invalidTokenStorm  = 10
+	webhookTimeout     = 10 * time.Second
+	webhookMaxBackoff  = time.Minute
+	webhookQueueSize   = 64
+)
+
+// WebhookEvent is the JSON body posted to every webhook URL.
+type WebhookEvent struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	Role      string    `json:"role"` // server or client
+	Transport string    `json:"transport"`
+	Host      string    `json:"host"`
+	Data      any       `json:"data,omitempty"`
+}
+
+// WebhookConfig configures the webhook notifications.
+type WebhookConfig struct {
+	URLs      []string
+	Secret    string   // signs the body with HMAC-SHA256 when set
+	Events    []string // events to send, all when empty
+	Retries   int      // attempts after a failed delivery
+	Role      string
+	Transport string
+}
+
+// Webhooks posts tunnel events to HTTP endpoints. Deliveries run in the background
+// and are retried with exponential backoff. It implements web.TunnelObserver.
+type Webhooks struct {
+	config WebhookConfig
+	events map[string]bool
+	host   string
+	client *http.Client
+	queue  chan WebhookEvent
+	logger *logrus.Logger
+
+	mu              sync.Mutex
+	restarts        []time.Time
+	restartLoopSent time.Time
+	tokenWindow     time.Time
+	tokenFailures   int
+	tokenSources    map[string]int
+}
+
+// NewWebhooks validates cfg, it returns nil without URLs.
+func NewWebhooks(cfg WebhookConfig, logger *logrus.Logger) (*Webhooks, error) {
+	if len(cfg.URLs) == 0 {
+		return nil, nil
+	}
+
+	events := make(map[string]bool)
+	for _, event := range cfg.Events {
+		known := false
+		for _, name := range webhookEventNames {
+			known = known || event == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown webhook event %q", event)
+		}
+		events[event] = true
+	}
+	if len(events) == 0 {
+		events = nil
+	}
+
+	host, _ := os.Hostname()
+	return &Webhooks{
+		config: cfg,
+		events: events,
+		host:   host,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan WebhookEvent, webhookQueueSize),
+		logger: logger,
+	}, nil
+}
+
+// Send queues an event for delivery, it is dropped if the queue is full.
+func (w *Webhooks) Send(event string, data any) {
+	if w.events != nil && !w.events[event] {
+		return
+	}
+	select {
+	case w.queue <- WebhookEvent{
+		Event:     event,
+		Time:      time.Now(),
+		Role:      w.config.Role,
+		Transport: w.config.Transport,
+		Host:      w.host,
+		Data:      data,
+	}:
+	default:
+		w.logger.Warnf("webhook queue is full, dropping %s event", event)
+	}
+}
+
+// Start delivers queued events until ctx is done.
+func (w *Webhooks) Start(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-w.queue:
+				w.deliver(ctx, event)
+			}
+		}
+	}()
+}
+
+func (w *Webhooks) deliver(ctx context.Context, event WebhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		w.logger.Errorf("failed to encode webhook event: %v", err)
+		return
+	}
+
+	for _, url := range w.config.URLs {
+		backoff := time.Second
+		for attempt := 0; ; attempt++ {
+			err := w.post(ctx, url, event.Event, body)
+			if err == nil {
+				w.logger.Debugf("webhook %s delivered to %s", event.Event, url)
+				break
+			}
+			if attempt >= w.config.Retries {
+				w.logger.Errorf("failed to deliver webhook %s to %s: %v", event.Event, url, err)
+				break
+			}
+			w.logger.Warnf("failed to deliver webhook %s to %s, retrying in %v: %v", event.Event, url, backoff, err)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, webhookMaxBackoff)
+		}
+	}
+}
+
+func (w *Webhooks) post(ctx context.Context, url, event string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "backhaul-webhook")
+	req.Header.Set("X-Backhaul-Event", event)
+	if w.config.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.config.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Backhaul-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (w *Webhooks) TunnelUp(status string) {
+	w.Send(WebhookTunnelUp, map[string]string{"status": status})
+}
+
+// TunnelDown also sends restart_loop when the tunnel restarted restartLoopCount
+// times within restartLoopWindow, at most once per window.
+func (w *Webhooks) TunnelDown(reason string) {
+	w.Send(WebhookTunnelDown, map[string]string{"reason": reason})
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	recent := w.restarts[:0]
+	for _, t := range w.restarts {
+		if now.Sub(t) < restartLoopWindow {
+			recent = append(recent, t)
+		}
+	}
+	w.restarts = append(recent, now)
+
+	if len(w.restarts) >= restartLoopCount && now.Sub(w.restartLoopSent) >= restartLoopWindow {
+		w.restartLoopSent = now
+		w.Send(WebhookRestartLoop, map[string]any{
+			"restarts":      len(w.restarts),
+			"windowSeconds": int(restartLoopWindow.Seconds()),
+		})
+	}
+}
+
+func (w *Webhooks) Heartbeat() {}
+
+// InvalidToken sends invalid_token_storm once invalidTokenStorm authentications
+// failed within invalidTokenWindow.
+func (w *Webhooks) InvalidToken(source string) {
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		source = host
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(w.tokenWindow) >= invalidTokenWindow {
+		w.tokenWindow = now
+		w.tokenFailures = 0
+		w.tokenSources = make(map[string]int)
+	}
+	w.tokenFailures++
+	w.tokenSources[source]++
+
+	if w.tokenFailures == invalidTokenStorm {
+		sources := make(map[string]int, len(w.tokenSources))
+		for k, v := range w.tokenSources {
+			sources[k] = v
+		}
+		w.Send(WebhookInvalidTokenStorm, map[string]any{
+			"failures":      w.tokenFailures,
+			"windowSeconds": int(invalidTokenWindow.Seconds()),
+			"sources":       sources,
+		})
+	}
+}
+
+func (w *Webhooks) QuotaReached(port int, usage, quota uint64) {
+	w.Send(WebhookQuotaReached, map[string]any{
+		"port":  port,
+		"usage": usage,
+		"quota": quota,
+	})
+}
+
+func (w *Webhooks) CertExpiring(certFile string, notAfter time.Time) {
+	w.Send(WebhookCertExpiring, map[string]any{
+		"certFile": certFile,
+		"notAfter": notAfter,
+		"daysLeft": int(time.Until(notAfter).Hours() / 24),
+	})
+}
@@ -0,0 +1,170 @@
+package utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+// webhookReceiver is a local stand-in for a webhook endpoint, it answers with
+// the statuses in order and 200 after them.
+type webhookReceiver struct {
+	t        *testing.T
+	secret   string
+	statuses []int
+	requests atomic.Int32
+	events   chan WebhookEvent
+}
+
+func newWebhookReceiver(t *testing.T, secret string, statuses ...int) (*webhookReceiver, string) {
+	r := &webhookReceiver{t: t, secret: secret, statuses: statuses, events: make(chan WebhookEvent, 16)}
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return r, server.URL
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	n := int(r.requests.Add(1))
+	if n <= len(r.statuses) {
+		w.WriteHeader(r.statuses[n-1])
+		return
+	}
+
+	body, _ := io.ReadAll(req.Body)
+	if r.secret != "" {
+		mac := hmac.New(sha256.New, []byte(r.secret))
+		mac.Write(body)
+		if got, want := req.Header.Get("X-Backhaul-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+			r.t.Errorf("signature = %q, want %q", got, want)
+		}
+	}
+	var event WebhookEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		r.t.Errorf("invalid webhook body %q: %v", body, err)
+	}
+	if got := req.Header.Get("X-Backhaul-Event"); got != event.Event {
+		r.t.Errorf("X-Backhaul-Event = %q, want %q", got, event.Event)
+	}
+	r.events <- event
+}
+
+func (r *webhookReceiver) next(t *testing.T, timeout time.Duration) WebhookEvent {
+	t.Helper()
+	select {
+	case event := <-r.events:
+		return event
+	case <-time.After(timeout):
+		t.Fatal("no webhook delivered")
+		return WebhookEvent{}
+	}
+}
+
+func startWebhooks(t *testing.T, cfg WebhookConfig) *Webhooks {
+	t.Helper()
+	w, err := NewWebhooks(cfg, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	w.Start(ctx)
+	return w
+}
+
+func TestNewWebhooksEvents(t *testing.T) {
+	if w, err := NewWebhooks(WebhookConfig{}, testLogger()); w != nil || err != nil {
+		t.Fatalf("NewWebhooks() without URLs = %v, %v, want nil, nil", w, err)
+	}
+	for _, event := range []string{"traffic_quota", "tunnel-up"} {
+		if _, err := NewWebhooks(WebhookConfig{URLs: []string{"http://127.0.0.1"}, Events: []string{event}}, testLogger()); err == nil {
+			t.Errorf("event %q accepted", event)
+		}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	receiver, url := newWebhookReceiver(t, "secret")
+	w := startWebhooks(t, WebhookConfig{
+		URLs:      []string{url},
+		Secret:    "secret",
+		Events:    []string{WebhookTunnelDown},
+		Role:      "server",
+		Transport: "tcp",
+	})
+
+	// tunnel_up is filtered out
+	w.TunnelUp("connected")
+	w.TunnelDown("control channel lost")
+
+	event := receiver.next(t, 5*time.Second)
+	if event.Event != WebhookTunnelDown || event.Role != "server" || event.Transport != "tcp" {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	if n := receiver.requests.Load(); n != 1 {
+		t.Fatalf("%d requests, want 1", n)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	receiver, url := newWebhookReceiver(t, "", http.StatusInternalServerError)
+	w := startWebhooks(t, WebhookConfig{URLs: []string{url}, Retries: 1})
+
+	w.Send(WebhookTunnelUp, nil)
+	if event := receiver.next(t, 5*time.Second); event.Event != WebhookTunnelUp {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	if n := receiver.requests.Load(); n != 2 {
+		t.Fatalf("%d requests, want 2", n)
+	}
+}
+
+func TestWebhookInvalidTokenStorm(t *testing.T) {
+	receiver, url := newWebhookReceiver(t, "")
+	w := startWebhooks(t, WebhookConfig{URLs: []string{url}, Events: []string{WebhookInvalidTokenStorm}})
+
+	for i := 0; i < invalidTokenStorm+5; i++ {
+		w.InvalidToken("192.0.2.1:1234")
+	}
+
+	event := receiver.next(t, 5*time.Second)
+	data := event.Data.(map[string]any)
+	if data["failures"] != float64(invalidTokenStorm) {
+		t.Fatalf("unexpected event data %+v", data)
+	}
+	if sources := data["sources"].(map[string]any); sources["192.0.2.1"] != float64(invalidTokenStorm) {
+		t.Fatalf("unexpected sources %+v", sources)
+	}
+	select {
+	case event := <-receiver.events:
+		t.Fatalf("storm sent twice: %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookQuotaReached(t *testing.T) {
+	receiver, url := newWebhookReceiver(t, "")
+	w := startWebhooks(t, WebhookConfig{URLs: []string{url}, Events: []string{WebhookQuotaReached}})
+
+	w.QuotaReached(443, 3<<20, 2<<20)
+	event := receiver.next(t, 5*time.Second)
+	data := event.Data.(map[string]any)
+	if event.Event != WebhookQuotaReached || data["port"] != float64(443) || data["usage"] != float64(3<<20) || data["quota"] != float64(2<<20) {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WSMuxProtocol is the websocket subprotocol of mux sessions carried in binary
+// messages. Peers that don't negotiate it run the session on the connection
+// below the websocket, as older versions do.
+const WSMuxProtocol = "backhaul-mux"
+
+// WSMuxConn returns the connection a mux session runs on: the websocket when
+// WSMuxProtocol was negotiated, otherwise the connection below it.
+func WSMuxConn(conn *websocket.Conn) net.Conn {
+	if conn.Subprotocol() == WSMuxProtocol {
+		return NewWSConn(conn)
+	}
+	return conn.NetConn()
+}
+
+// WSConn adapts a websocket connection to net.Conn: every write is sent as one
+// binary message and received messages are read as one stream, without holding
+// a message in memory.
+type WSConn struct {
+	conn    *websocket.Conn
+	readMu  sync.Mutex
+	reader  io.Reader // the message being read, nil between messages
+	writeMu sync.Mutex
+}
+
+// NewWSConn returns conn as a net.Conn.
+func NewWSConn(conn *websocket.Conn) *WSConn {
+	return &WSConn{conn: conn}
+}
+
+func (c *WSConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for {
+		if c.reader == nil {
+			_, reader, err := c.conn.NextReader()
+			if err != nil {
+				return 0, wsConnError(err)
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(b)
+		if errors.Is(err, io.EOF) {
+			// end of the message, not of the connection
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, wsConnError(err)
+	}
+}
+
+func (c *WSConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	w, err := c.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, w.Close()
+}
+
+// WriteBuffers sends the buffers as one message, smux writes a frame's header
+// and payload with it.
+func (c *WSConn) WriteBuffers(v [][]byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	w, err := c.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, b := range v {
+		n, err := w.Write(b)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, w.Close()
+}
+
+func (c *WSConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *WSConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *WSConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *WSConn) SetDeadline(t time.Time) error {
+	if err := c.conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *WSConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *WSConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// wsConnError reports a normal websocket close as EOF.
+func wsConnError(err error) error {
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		return io.EOF
+	}
+	return err
+}
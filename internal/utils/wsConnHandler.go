@@ -4,93 +4,208 @@ import (
 	"errors"
 	"io"
 	"net"
+	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/musix/backhaul/internal/web"
 	"github.com/sirupsen/logrus"
 )
 
-// WebSocketToTCPConnectionHandler handles data transfer between a WebSocket and a TCP connection
-func WSConnectionHandler(wsConn *websocket.Conn, tcpConn net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+// WSHalfCloseProtocol is the websocket subprotocol of tunnel connections that
+// pass half-closed connections on. With peers that don't negotiate it, like
+// older versions, EOF closes the connection.
+const WSHalfCloseProtocol = "backhaul-fin"
+
+// wsHalfClose is the payload of the pong control frame that ends one direction
+// of a websocket tunnel connection, the way FIN does for TCP.
+const wsHalfClose = "FIN"
+
+// A half-closed connection is closed once the peer sent nothing for this long,
+// so a peer that never ends its direction does not hold it forever.
+const wsHalfCloseIdle = 5 * time.Minute
+
+var errWSHalfClosed = errors.New("websocket peer half-closed the connection")
+
+const (
+	// With write coalescing a message stays open for this long after a read
+	// filled the buffer, for the data that is likely following
+	wsCoalesceWindow = time.Millisecond
+	// and is sent after this much data at the latest
+	wsCoalesceLimit = 256 * 1024 // 256K
+)
+
+// WebSocketToTCPConnectionHandler handles data transfer between a WebSocket and a TCP connection.
+// Messages are streamed through pooled buffers in both directions. With
+// coalesce, consecutive reads of a busy TCP connection are sent as one message.
+// If both peers negotiated WSHalfCloseProtocol, EOF of the TCP connection is sent
+// as a half-close pong and a received one is passed on as CloseWrite, the other
+// direction keeps flowing until it ends or idles for wsHalfCloseIdle.
+func WSConnectionHandler(wsConn *websocket.Conn, tcpConn net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool, coalesce bool) {
 	done := make(chan struct{})
+	halfClose := canCloseWrite(tcpConn) && wsConn.Subprotocol() == WSHalfCloseProtocol
+	halfClosed := &atomic.Bool{} // the half-close pong was sent
+
+	wsConn.SetPongHandler(func(data string) error {
+		if data == wsHalfClose {
+			return errWSHalfClosed
+		}
+		return nil
+	})
 
 	go func() {
 		defer close(done)
-		transferWebSocketToTCP(wsConn, tcpConn, logger, usage, remotePort, sniffer)
+		transferWebSocketToTCP(wsConn, tcpConn, halfClose, halfClosed, logger, newPortCounter(usage, remotePort, sniffer))
 	}()
 
-	transferTCPToWebSocket(tcpConn, wsConn, logger, usage, remotePort, sniffer)
+	transferTCPToWebSocket(tcpConn, wsConn, halfClose, halfClosed, coalesce, logger, newPortCounter(usage, remotePort, sniffer))
 
 	<-done
+	wsConn.Close()
+	tcpConn.Close()
 }
 
 // transferWebSocketToTCP transfers data from a WebSocket connection to a TCP connection
-func transferWebSocketToTCP(wsConn *websocket.Conn, tcpConn net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+func transferWebSocketToTCP(wsConn *websocket.Conn, tcpConn net.Conn, halfClose bool, halfClosed *atomic.Bool, logger *logrus.Logger, counter *portCounter) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	defer counter.flush()
+
 	for {
-		// Read message from the WebSocket connection
-		messageType, message, err := wsConn.ReadMessage()
+		// Get the next text or binary message, control messages are handled by gorilla
+		_, message, err := wsConn.NextReader()
 		if err != nil {
-			if errors.Is(err, websocket.ErrCloseSent) || errors.Is(err, io.EOF) {
+			if errors.Is(err, websocket.ErrCloseSent) || errors.Is(err, io.EOF) || errors.Is(err, errWSHalfClosed) {
 				logger.Trace("WebSocket reader stream closed or EOF received")
 			} else {
 				logger.Trace("unable to read from the WebSocket connection: ", err)
 			}
+			// the peer is done sending, the TCP side may still answer
+			if halfClose && errors.Is(err, errWSHalfClosed) && closeWrite(tcpConn) == nil {
+				return
+			}
 			wsConn.Close()
 			tcpConn.Close()
 			return
 		}
+		if halfClosed.Load() {
+			wsConn.SetReadDeadline(time.Now().Add(wsHalfCloseIdle))
+		}
 
-		// Only handle text or binary messages (ignore control messages like pings)
-		if messageType == websocket.TextMessage || messageType == websocket.BinaryMessage {
-			// Write the message to the TCP connection
-			w, err := tcpConn.Write(message)
-			if err != nil {
-				logger.Trace("unable to write to the TCP connection: ", err)
-				wsConn.Close()
-				tcpConn.Close()
-				return
+		// Stream the message to the TCP connection, an error while reading it
+		// is returned by the next NextReader
+		for {
+			n, err := message.Read(*buf)
+			if n > 0 {
+				w, err := tcpConn.Write((*buf)[:n])
+				if err != nil {
+					logger.Trace("unable to write to the TCP connection: ", err)
+					wsConn.Close()
+					tcpConn.Close()
+					return
+				}
+				logger.Tracef("transferred data from WebSocket to TCP: %d bytes", w)
+				counter.add(w)
 			}
-			logger.Tracef("transferred data from WebSocket to TCP: %d bytes", w)
-			if sniffer {
-				usage.AddOrUpdatePort(remotePort, uint64(w))
+			if err != nil {
+				break
 			}
 		}
 	}
 }
 
 // transferTCPToWebSocket transfers data from a TCP connection to a WebSocket connection
-func transferTCPToWebSocket(tcpConn net.Conn, wsConn *websocket.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
-	buf := make([]byte, 16*1024) // 16K buffer size
+func transferTCPToWebSocket(tcpConn net.Conn, wsConn *websocket.Conn, halfClose bool, halfClosed *atomic.Bool, coalesce bool, logger *logrus.Logger, counter *portCounter) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	defer counter.flush()
+
+	var message io.WriteCloser // the binary message being written
+	size := 0                  // bytes in the message
+	deadline := false          // a coalescing read deadline is set
+
+	// send sends the message written so far
+	send := func() error {
+		if deadline {
+			tcpConn.SetReadDeadline(time.Time{})
+			deadline = false
+		}
+		err := message.Close()
+		message, size = nil, 0
+		return err
+	}
+
 	for {
 		// Read data from the TCP connection
-		n, err := tcpConn.Read(buf)
+		n, err := tcpConn.Read(*buf)
+		if deadline && n == 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+			// no more data within the window, send the coalesced message
+			if err := send(); err != nil {
+				logWSWriteError(logger, err)
+				tcpConn.Close()
+				wsConn.Close()
+				return
+			}
+			continue
+		}
+
+		if n > 0 {
+			// Write the data to the WebSocket connection as a binary message
+			werr := error(nil)
+			if message == nil {
+				message, werr = wsConn.NextWriter(websocket.BinaryMessage)
+			}
+			if werr == nil {
+				_, werr = message.Write((*buf)[:n])
+				size += n
+			}
+			if werr == nil {
+				if coalesce && err == nil && n == len(*buf) && size < wsCoalesceLimit {
+					// the read filled the buffer, keep the message open for more
+					tcpConn.SetReadDeadline(time.Now().Add(wsCoalesceWindow))
+					deadline = true
+				} else {
+					werr = send()
+				}
+			}
+			if werr != nil {
+				logWSWriteError(logger, werr)
+				tcpConn.Close()
+				wsConn.Close()
+				return
+			}
+
+			logger.Tracef("transferred data from TCP to WebSocket: %d bytes", n)
+			counter.add(n)
+		}
+
 		if err != nil {
 			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 				logger.Trace("TCP reader stream closed or EOF received")
 			} else {
 				logger.Trace("unable to read from the TCP connection: ", err)
 			}
-			tcpConn.Close()
-			wsConn.Close()
-			return
-		}
-
-		// Write the data to the WebSocket connection as a binary message
-		err = wsConn.WriteMessage(websocket.BinaryMessage, buf[:n])
-		if err != nil {
-			if errors.Is(err, websocket.ErrCloseSent) || errors.Is(err, io.EOF) {
-				logger.Trace("WebSocket writer stream closed or EOF received")
-			} else {
-				logger.Trace("unable to write to the WebSocket connection: ", err)
+			if message != nil && send() != nil {
+				halfClose = false
+			}
+			if halfClose && errors.Is(err, io.EOF) && wsConn.WriteControl(websocket.PongMessage, []byte(wsHalfClose), time.Now().Add(5*time.Second)) == nil {
+				// the peer's direction is left, until it idles
+				halfClosed.Store(true)
+				wsConn.SetReadDeadline(time.Now().Add(wsHalfCloseIdle))
+				return
 			}
 			tcpConn.Close()
 			wsConn.Close()
 			return
 		}
+	}
+}
 
-		logger.Tracef("transferred data from TCP to WebSocket: %d bytes", n)
-		if sniffer {
-			usage.AddOrUpdatePort(remotePort, uint64(n))
-		}
+func logWSWriteError(logger *logrus.Logger, err error) {
+	if errors.Is(err, websocket.ErrCloseSent) || errors.Is(err, io.EOF) {
+		logger.Trace("WebSocket writer stream closed or EOF received")
+	} else {
+		logger.Trace("unable to write to the WebSocket connection: ", err)
 	}
 }
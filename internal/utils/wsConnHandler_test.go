@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+// wsTunnel connects user to target through a websocket tunnel connection
+// handled by WSConnectionHandler on both ends, like a ws server and client.
+func wsTunnel(t *testing.T, serverProtocols, clientProtocols []string) (user, target *net.TCPConn) {
+	t.Helper()
+	user, userSide := tcpPair(t)
+	target, targetSide := tcpPair(t)
+
+	upgrader := websocket.Upgrader{Subprotocols: serverProtocols}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		go WSConnectionHandler(conn, userSide, testLogger(), nil, 0, false, false)
+	}))
+	t.Cleanup(server.Close)
+
+	dialer := websocket.Dialer{Subprotocols: clientProtocols}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go WSConnectionHandler(conn, targetSide, testLogger(), nil, 0, false, false)
+	return user, target
+}
+
+func TestWSConnectionHandlerHalfClose(t *testing.T) {
+	user, target := wsTunnel(t, []string{WSHalfCloseProtocol}, []string{WSHalfCloseProtocol})
+
+	user.Write([]byte("request"))
+	user.CloseWrite()
+	target.SetReadDeadline(time.Now().Add(5 * time.Second))
+	request, err := io.ReadAll(target)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("target read %q, %v, want the request and EOF", request, err)
+	}
+
+	// The target answers after the user finished sending
+	target.Write([]byte("response"))
+	target.Close()
+	user.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := io.ReadAll(user)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("user read %q, %v, want the response", response, err)
+	}
+}
+
+func TestWSConnectionHandlerWithoutHalfClose(t *testing.T) {
+	// A peer that doesn't negotiate half-close gets the connection closed
+	user, target := wsTunnel(t, []string{WSHalfCloseProtocol}, nil)
+
+	user.Write([]byte("request"))
+	user.CloseWrite()
+	target.SetReadDeadline(time.Now().Add(5 * time.Second))
+	request, err := io.ReadAll(target)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("target read %q, %v, want the request and EOF", request, err)
+	}
+
+	user.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(user); err != nil {
+		t.Fatalf("user read %v, want the connection closed", err)
+	}
+}
@@ -0,0 +1,199 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AccessLogEntry is one JSON line of the access log, written when a forwarded
+// connection ends.
+type AccessLogEntry struct {
+	Time        time.Time `json:"time"`
+	Transport   string    `json:"transport"`
+	Source      string    `json:"source"`
+	LocalPort   int       `json:"localPort"`
+	Target      string    `json:"target"`
+	BytesUp     uint64    `json:"bytesUp"`
+	BytesDown   uint64    `json:"bytesDown"`
+	DurationMs  int64     `json:"durationMs"`
+	CloseReason string    `json:"closeReason"`
+}
+
+// AccessLog appends entries to a file and rotates it by size: path.1 is the newest
+// rotated file and path.<maxBackups> the oldest.
+type AccessLog struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	mu         sync.Mutex
+	file       *os.File // nil once closed or if reopening after a rotation failed
+	size       int64
+	refs       int // tunnels sharing the log
+	logger     *logrus.Logger
+}
+
+// accessLogs holds the open access logs by path, tunnels logging to the same
+// file share one so a single writer rotates it.
+var (
+	accessLogsMu sync.Mutex
+	accessLogs   = map[string]*AccessLog{}
+)
+
+// SetAccessLog enables the access log of forwarded connections, nil disables it.
+func (t *Tunnel) SetAccessLog(l *AccessLog) {
+	t.accessLog = l
+}
+
+// NewAccessLog opens path for appending, or returns the log another tunnel has
+// open on it. maxSizeMB is the size in megabytes at which the file is rotated,
+// maxBackups the number of rotated files kept, the last opener's apply to a
+// shared log. Every NewAccessLog is released with Close.
+func NewAccessLog(path string, maxSizeMB, maxBackups int, logger *logrus.Logger) (*AccessLog, error) {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access log path: %v", err)
+	}
+
+	accessLogsMu.Lock()
+	defer accessLogsMu.Unlock()
+
+	if l, ok := accessLogs[key]; ok {
+		l.mu.Lock()
+		l.maxSize = int64(maxSizeMB) * 1024 * 1024
+		l.maxBackups = maxBackups
+		l.refs++
+		l.mu.Unlock()
+		return l, nil
+	}
+
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create access log directory: %v", err)
+		}
+	}
+	l := &AccessLog{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+		refs:       1,
+		logger:     logger,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	accessLogs[key] = l
+	return l, nil
+}
+
+func (l *AccessLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat access log: %v", err)
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// Write appends entry as one JSON line.
+func (l *AccessLog) Write(entry AccessLogEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.refs == 0 {
+		// connections ending after every tunnel of the log stopped
+		return nil
+	}
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			if l.file == nil {
+				return err
+			}
+			// the file keeps growing, rotating is tried again after another maxSize
+			l.logger.Errorf("%v", err)
+			l.size = 0
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+func (l *AccessLog) log(entry AccessLogEntry) {
+	if err := l.Write(entry); err != nil {
+		l.logger.Errorf("failed to write access log: %v", err)
+	}
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest, and starts a new file.
+// If path can't be moved it is opened again.
+func (l *AccessLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+
+	if l.maxBackups <= 0 {
+		os.Remove(l.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxBackups))
+		for i := l.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		}
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			if openErr := l.open(); openErr != nil {
+				return openErr
+			}
+			return fmt.Errorf("failed to rotate access log: %v", err)
+		}
+	}
+
+	return l.open()
+}
+
+// Close releases the log, the file is closed once no tunnel uses it.
+func (l *AccessLog) Close() error {
+	accessLogsMu.Lock()
+	defer accessLogsMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.refs == 0 {
+		return nil
+	}
+	l.refs--
+	if l.refs > 0 {
+		return nil
+	}
+	for key, open := range accessLogs {
+		if open == l {
+			delete(accessLogs, key)
+		}
+	}
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
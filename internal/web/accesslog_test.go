@@ -0,0 +1,122 @@
+package web
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+// entrySize returns the size of the lines the tests write.
+func entrySize(t *testing.T) int64 {
+	line, err := json.Marshal(AccessLogEntry{Target: "127.0.0.1:80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(len(line) + 1)
+}
+
+func TestAccessLogShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	first, err := NewAccessLog(path, 0, 0, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewAccessLog(path, 0, 0, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatal("tunnels logging to the same path don't share the log")
+	}
+
+	// The log stays open until the last tunnel releases it
+	first.Close()
+	if err := second.Write(AccessLogEntry{Target: "127.0.0.1:80"}); err != nil {
+		t.Fatalf("Write() after the first Close() = %v", err)
+	}
+	second.Close()
+	if second.file != nil || len(accessLogs) != 0 {
+		t.Fatal("log not closed after the last Close()")
+	}
+	if err := second.Write(AccessLogEntry{Target: "127.0.0.1:81"}); err != nil {
+		t.Fatalf("Write() after the last Close() = %v", err)
+	}
+	if lines := readLines(t, path); len(lines) != 1 {
+		t.Fatalf("%d lines logged, want 1", len(lines))
+	}
+
+	// A released path is opened again
+	third, err := NewAccessLog(path, 0, 0, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	if third == first {
+		t.Fatal("released log reused")
+	}
+}
+
+func TestAccessLogRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := NewAccessLog(path, 1, 1, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.maxSize = 2 * entrySize(t) // two entries
+
+	for i := 0; i < 3; i++ {
+		if err := l.Write(AccessLogEntry{Target: "127.0.0.1:80"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lines := readLines(t, path+".1"); len(lines) != 2 {
+		t.Fatalf("%d lines rotated, want 2", len(lines))
+	}
+	if lines := readLines(t, path); len(lines) != 1 {
+		t.Fatalf("%d lines after the rotation, want 1", len(lines))
+	}
+}
+
+func TestAccessLogRotateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	// path.1 is a directory path can't be moved onto
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewAccessLog(path, 1, 1, testLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.maxSize = 2 * entrySize(t)
+
+	for i := 0; i < 4; i++ {
+		if err := l.Write(AccessLogEntry{Target: "127.0.0.1:80"}); err != nil {
+			t.Fatalf("Write() %d = %v, want the file kept open", i, err)
+		}
+	}
+	if lines := readLines(t, path); len(lines) != 4 {
+		t.Fatalf("%d lines logged, want 4", len(lines))
+	}
+}
@@ -0,0 +1,108 @@
+package web
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Role is the access level of a web panel user.
+type Role int
+
+const (
+	RoleNone     Role = iota
+	RoleReadOnly      // panel and GET endpoints
+	RoleAdmin         // everything, including endpoints that change state
+)
+
+// PanelConfig holds the web panel settings shared by every transport.
+type PanelConfig struct {
+	BindAddr         string   // listen host, all interfaces when empty
+	Password         string   // admin login, user "admin"
+	ReadOnlyPassword string   // read-only login, user "viewer"
+	Tokens           []string // admin API tokens (Authorization: Bearer)
+	ReadOnlyTokens   []string // read-only API tokens
+	TLSCertFile      string   // the panel is served over HTTPS when set
+	TLSKeyFile       string
+}
+
+// listenAddr replaces the host of addr (":port") with the configured bind address.
+func (p *PanelConfig) listenAddr(addr string) string {
+	if p.BindAddr == "" {
+		return addr
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return net.JoinHostPort(p.BindAddr, port)
+}
+
+func (p *PanelConfig) authEnabled() bool {
+	return p.Password != "" || p.ReadOnlyPassword != "" || len(p.Tokens) > 0 || len(p.ReadOnlyTokens) > 0
+}
+
+// adminEnabled reports whether an admin credential is configured.
+func (p *PanelConfig) adminEnabled() bool {
+	return p.Password != "" || len(p.Tokens) > 0
+}
+
+// authenticate returns the role granted by the request credentials.
+func (p *PanelConfig) authenticate(r *http.Request) Role {
+	if user, password, ok := r.BasicAuth(); ok {
+		switch {
+		case user == "admin" && secretEqual(password, p.Password):
+			return RoleAdmin
+		case user == "viewer" && secretEqual(password, p.ReadOnlyPassword):
+			return RoleReadOnly
+		}
+		return RoleNone
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return RoleNone
+	}
+	for _, t := range p.Tokens {
+		if secretEqual(token, t) {
+			return RoleAdmin
+		}
+	}
+	for _, t := range p.ReadOnlyTokens {
+		if secretEqual(token, t) {
+			return RoleReadOnly
+		}
+	}
+	return RoleNone
+}
+
+// requireRole rejects requests below role. Without configured credentials the
+// panel stays open for reading, as before, but endpoints that change state
+// need an admin credential to be configured.
+func (m *Usage) requireRole(role Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if role == RoleAdmin && !m.panel.adminEnabled() {
+			http.Error(w, "forbidden, set web_password or web_tokens to allow changes", http.StatusForbidden)
+			return
+		}
+		if m.panel.authEnabled() {
+			granted := m.panel.authenticate(r)
+			if granted == RoleNone {
+				w.Header().Set("WWW-Authenticate", `Basic realm="Backhaul"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if granted < role {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+// secretEqual compares in constant time, an empty secret never matches.
+func secretEqual(given, secret string) bool {
+	return secret != "" && subtle.ConstantTimeCompare([]byte(given), []byte(secret)) == 1
+}
@@ -0,0 +1,45 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireRole(t *testing.T) {
+	tests := []struct {
+		name   string
+		panel  PanelConfig
+		role   Role
+		header string
+		status int
+	}{
+		{"open panel read", PanelConfig{}, RoleReadOnly, "", http.StatusOK},
+		{"open panel write", PanelConfig{}, RoleAdmin, "", http.StatusForbidden},
+		{"read-only credentials write", PanelConfig{ReadOnlyTokens: []string{"ro"}}, RoleAdmin, "Bearer ro", http.StatusForbidden},
+		{"no credentials", PanelConfig{Tokens: []string{"admin"}}, RoleReadOnly, "", http.StatusUnauthorized},
+		{"wrong token", PanelConfig{Tokens: []string{"admin"}}, RoleReadOnly, "Bearer other", http.StatusUnauthorized},
+		{"empty token", PanelConfig{Tokens: []string{"admin"}, ReadOnlyTokens: []string{""}}, RoleReadOnly, "Bearer ", http.StatusUnauthorized},
+		{"read-only token read", PanelConfig{Tokens: []string{"admin"}, ReadOnlyTokens: []string{"ro"}}, RoleReadOnly, "Bearer ro", http.StatusOK},
+		{"read-only token write", PanelConfig{Tokens: []string{"admin"}, ReadOnlyTokens: []string{"ro"}}, RoleAdmin, "Bearer ro", http.StatusForbidden},
+		{"admin token write", PanelConfig{Tokens: []string{"admin"}}, RoleAdmin, "Bearer admin", http.StatusOK},
+		{"admin password write", PanelConfig{Password: "secret"}, RoleAdmin, "Basic YWRtaW46c2VjcmV0", http.StatusOK},
+		{"viewer password write", PanelConfig{Password: "secret", ReadOnlyPassword: "view"}, RoleAdmin, "Basic dmlld2VyOnZpZXc=", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Usage{panel: tt.panel}
+			handler := m.requireRole(tt.role, func(w http.ResponseWriter, r *http.Request) {})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxTrackedHosts bounds the failure history, stale entries are pruned beyond it.
+const maxTrackedHosts = 4096
+
+// Ban is a host refused at accept, listed on /bans.
+type Ban struct {
+	IP       string    `json:"ip"`
+	Failures int       `json:"failures"` // failed authentications that caused the ban
+	BannedAt time.Time `json:"bannedAt"`
+	Expires  time.Time `json:"expires"`
+}
+
+// BanList bans hosts that fail authentication threshold times within window,
+// like fail2ban, for duration.
+type BanList struct {
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+	whitelist []*net.IPNet
+	logger    *logrus.Logger
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	bans     map[string]Ban
+}
+
+// SetBanList enables banning, nil disables it. Active bans of the previous list
+// are kept so a reload does not lift them.
+func (t *Tunnel) SetBanList(l *BanList) {
+	if l != nil && t.bans != nil {
+		t.bans.mu.Lock()
+		for ip, ban := range t.bans.bans {
+			l.bans[ip] = ban
+		}
+		t.bans.mu.Unlock()
+	}
+	t.bans = l
+}
+
+// NewBanList creates a ban list. whitelist holds IPs or CIDRs that are never banned.
+func NewBanList(threshold int, window, duration time.Duration, whitelist []string, logger *logrus.Logger) (*BanList, error) {
+	l := &BanList{
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		logger:    logger,
+		failures:  make(map[string][]time.Time),
+		bans:      make(map[string]Ban),
+	}
+	for _, entry := range whitelist {
+		cidr := entry
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ban whitelist entry %q: %v", entry, err)
+		}
+		l.whitelist = append(l.whitelist, network)
+	}
+	return l, nil
+}
+
+// hostOf strips the port of addr.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func (l *BanList) whitelisted(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range l.whitelist {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fail records a failed authentication from addr and bans its host once the
+// threshold is reached.
+func (l *BanList) Fail(addr string) {
+	host := hostOf(addr)
+	if l.whitelisted(host) {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if _, banned := l.bans[host]; banned {
+		return
+	}
+	if len(l.failures) >= maxTrackedHosts {
+		l.prune(now)
+	}
+
+	recent := l.failures[host][:0]
+	for _, t := range l.failures[host] {
+		if now.Sub(t) < l.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+
+	if len(recent) < l.threshold {
+		l.failures[host] = recent
+		return
+	}
+	delete(l.failures, host)
+	l.bans[host] = Ban{IP: host, Failures: len(recent), BannedAt: now, Expires: now.Add(l.duration)}
+	l.logger.Warnf("banned %s for %v after %d failed authentications", host, l.duration, len(recent))
+}
+
+// prune drops failure histories outside the window, l.mu must be held.
+func (l *BanList) prune(now time.Time) {
+	for host, times := range l.failures {
+		if len(times) == 0 || now.Sub(times[len(times)-1]) >= l.window {
+			delete(l.failures, host)
+		}
+	}
+}
+
+// Banned reports whether the host of addr is banned.
+func (l *BanList) Banned(addr string) bool {
+	host := hostOf(addr)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ban, ok := l.bans[host]
+	if !ok {
+		return false
+	}
+	if time.Now().After(ban.Expires) {
+		delete(l.bans, host)
+		l.logger.Infof("ban of %s expired", host)
+		return false
+	}
+	return true
+}
+
+// Unban lifts the ban of ip, it reports whether ip was banned.
+func (l *BanList) Unban(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.bans[ip]; !ok {
+		return false
+	}
+	delete(l.bans, ip)
+	delete(l.failures, ip)
+	return true
+}
+
+// List returns the active bans, oldest first.
+func (l *BanList) List() []Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	list := []Ban{}
+	for host, ban := range l.bans {
+		if now.After(ban.Expires) {
+			delete(l.bans, host)
+			continue
+		}
+		list = append(list, ban)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].BannedAt.Before(list[j].BannedAt)
+	})
+	return list
+}
+
+// Banned reports whether the host of addr is banned, always false without a ban list.
+func (m *Usage) Banned(addr string) bool {
+	return m != nil && m.tunnel.bans != nil && m.tunnel.bans.Banned(addr)
+}
+
+// handleBans lists the banned hosts as JSON.
+func (m *Usage) handleBans(w http.ResponseWriter, r *http.Request) {
+	list := []Ban{}
+	if bans := m.tunnel.bans; bans != nil {
+		list = bans.List()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		m.logger.Errorf("error encoding JSON response: %v", err)
+	}
+}
+
+// handleUnban lifts the ban of the host given in the path.
+func (m *Usage) handleUnban(w http.ResponseWriter, r *http.Request) {
+	ip := strings.TrimSpace(r.PathValue("ip"))
+	if bans := m.tunnel.bans; bans == nil || !bans.Unban(ip) {
+		http.Error(w, "ban not found", http.StatusNotFound)
+		return
+	}
+	m.logger.Infof("ban of %s lifted by panel request", ip)
+	w.WriteHeader(http.StatusNoContent)
+}
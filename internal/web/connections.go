@@ -0,0 +1,290 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnectionInfo is one row of the live connection table.
+type ConnectionInfo struct {
+	ID        uint64    `json:"id"`
+	Transport string    `json:"transport"`
+	Source    string    `json:"source"`
+	LocalPort int       `json:"localPort"`
+	Target    string    `json:"target"`
+	BytesUp   uint64    `json:"bytesUp"`   // source to target
+	BytesDown uint64    `json:"bytesDown"` // target to source
+	StartTime time.Time `json:"startTime"`
+}
+
+// TrackedConn is an active forwarded connection. A nil *TrackedConn is valid and
+// tracks nothing, so handlers don't have to check whether the panel is enabled.
+type TrackedConn struct {
+	info      ConnectionInfo
+	up        atomic.Uint64
+	down      atomic.Uint64
+	closeFn   func()
+	closeOnce sync.Once
+	closed    chan struct{}
+	usage     *Usage
+	reasonMu  sync.Mutex
+	reason    string // why the connection ended, for the access log
+	wrapped   string // side passed to SourceConn or TargetConn
+}
+
+var connectionID atomic.Uint64
+
+// TrackConnection registers a forwarded connection until Done is called. closeFn
+// must close both sides, it is used by DELETE /connections/{id}.
+func (m *Usage) TrackConnection(transport, source, target string, localPort int, closeFn func()) *TrackedConn {
+	c := &TrackedConn{
+		info: ConnectionInfo{
+			ID:        connectionID.Add(1),
+			Transport: transport,
+			Source:    source,
+			LocalPort: localPort,
+			Target:    target,
+			StartTime: time.Now(),
+		},
+		closeFn: closeFn,
+		closed:  make(chan struct{}),
+		usage:   m,
+	}
+	if m != nil {
+		m.connections.Store(c.info.ID, c)
+	}
+	return c
+}
+
+// AddUp counts bytes sent from the source to the target.
+func (c *TrackedConn) AddUp(n int) {
+	if c != nil && n > 0 {
+		c.up.Add(uint64(n))
+		if c.usage != nil {
+			c.usage.countPort(c.info.LocalPort, n, 0)
+		}
+	}
+}
+
+// AddDown counts bytes sent from the target back to the source.
+func (c *TrackedConn) AddDown(n int) {
+	if c != nil && n > 0 {
+		c.down.Add(uint64(n))
+		if c.usage != nil {
+			c.usage.countPort(c.info.LocalPort, 0, n)
+		}
+	}
+}
+
+// SetCloseReason records why the connection ends, only the first reason is kept.
+func (c *TrackedConn) SetCloseReason(reason string) {
+	if c == nil {
+		return
+	}
+	c.reasonMu.Lock()
+	if c.reason == "" {
+		c.reason = reason
+	}
+	c.reasonMu.Unlock()
+}
+
+// Close closes the connection on request of the panel.
+func (c *TrackedConn) Close() {
+	if c == nil {
+		return
+	}
+	c.SetCloseReason("closed from web panel")
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if c.closeFn != nil {
+			c.closeFn()
+		}
+	})
+}
+
+// Closed is closed once Close has been called, for handlers that can't be
+// interrupted by closing a socket.
+func (c *TrackedConn) Closed() <-chan struct{} {
+	if c == nil {
+		return nil
+	}
+	return c.closed
+}
+
+// Done removes the connection from the table once its handler returns and
+// writes it to the access log.
+func (c *TrackedConn) Done() {
+	if c == nil {
+		return
+	}
+	if c.usage != nil {
+		c.usage.connections.Delete(c.info.ID)
+	}
+
+	if c.usage == nil {
+		return
+	}
+	if l := c.usage.tunnel.accessLog; l != nil {
+		// Only one side is wrapped, if it did not end first the other side did
+		switch c.wrapped {
+		case "source":
+			c.SetCloseReason("target closed")
+		case "target":
+			c.SetCloseReason("source closed")
+		default:
+			c.SetCloseReason("closed")
+		}
+		c.reasonMu.Lock()
+		reason := c.reason
+		c.reasonMu.Unlock()
+
+		info := c.Info()
+		l.log(AccessLogEntry{
+			Time:        time.Now(),
+			Transport:   info.Transport,
+			Source:      info.Source,
+			LocalPort:   info.LocalPort,
+			Target:      info.Target,
+			BytesUp:     info.BytesUp,
+			BytesDown:   info.BytesDown,
+			DurationMs:  time.Since(info.StartTime).Milliseconds(),
+			CloseReason: reason,
+		})
+	}
+}
+
+// Info returns a snapshot of the connection.
+func (c *TrackedConn) Info() ConnectionInfo {
+	info := c.info
+	info.BytesUp = c.up.Load()
+	info.BytesDown = c.down.Load()
+	return info
+}
+
+// SourceConn counts the traffic of the connection on the source side.
+func (c *TrackedConn) SourceConn(conn net.Conn) net.Conn {
+	if c == nil {
+		return conn
+	}
+	c.wrapped = "source"
+	return &countingConn{Conn: conn, tracked: c, side: "source", read: c.AddUp, written: c.AddDown}
+}
+
+// TargetConn counts the traffic of the connection on the target side.
+func (c *TrackedConn) TargetConn(conn net.Conn) net.Conn {
+	if c == nil {
+		return conn
+	}
+	c.wrapped = "target"
+	return &countingConn{Conn: conn, tracked: c, side: "target", read: c.AddDown, written: c.AddUp}
+}
+
+// countingConn counts the traffic of one side and records why that side ended.
+type countingConn struct {
+	net.Conn
+	tracked *TrackedConn
+	side    string
+	read    func(int)
+	written func(int)
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read(n)
+	if err != nil {
+		c.closeReason(err)
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written(n)
+	if err != nil {
+		c.closeReason(err)
+	}
+	return n, err
+}
+
+// NetConn returns the wrapped connection, so it can be half-closed or spliced.
+func (c *countingConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CountRead counts data read from the wrapped connection past the wrapper, like
+// a splice to another socket.
+func (c *countingConn) CountRead(n int64, err error) {
+	c.read(int(n))
+	if err != nil {
+		c.closeReason(err)
+	}
+}
+
+// CountWritten counts data written to the wrapped connection past the wrapper.
+func (c *countingConn) CountWritten(n int64, err error) {
+	c.written(int(n))
+	if err != nil {
+		c.closeReason(err)
+	}
+}
+
+func (c *countingConn) closeReason(err error) {
+	switch {
+	case errors.Is(err, io.EOF):
+		c.tracked.SetCloseReason(c.side + " closed")
+	case errors.Is(err, net.ErrClosed):
+		// closed locally after the other side ended, that side sets the reason
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		// a read deadline of the relay, like write coalescing, not the end
+	default:
+		c.tracked.SetCloseReason(c.side + " error: " + err.Error())
+	}
+}
+
+// Connections returns the active connections, oldest first.
+func (m *Usage) Connections() []ConnectionInfo {
+	connections := []ConnectionInfo{}
+	m.connections.Range(func(_, value any) bool {
+		connections = append(connections, value.(*TrackedConn).Info())
+		return true
+	})
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].ID < connections[j].ID
+	})
+	return connections
+}
+
+func (m *Usage) handleConnections(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(m.Connections()); err != nil {
+		m.logger.Errorf("error encoding JSON response: %v", err)
+	}
+}
+
+func (m *Usage) handleCloseConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(strings.TrimSpace(r.PathValue("id")), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid connection id", http.StatusBadRequest)
+		return
+	}
+	value, ok := m.connections.Load(id)
+	if !ok {
+		http.Error(w, "connection not found", http.StatusNotFound)
+		return
+	}
+
+	conn := value.(*TrackedConn)
+	m.logger.Infof("closing connection %d from %s on port %d by panel request", id, conn.info.Source, conn.info.LocalPort)
+	conn.Close()
+	w.WriteHeader(http.StatusNoContent)
+}
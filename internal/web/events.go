@@ -0,0 +1,240 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event is a message of the /events stream. Type is the SSE event name:
+// "status", "throughput", "rtt", "restart" or "resume".
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data"`
+}
+
+// PortThroughput is the rate of one tunnel port over the last second.
+type PortThroughput struct {
+	Port     int    `json:"port"`
+	UpRate   uint64 `json:"upRate"`   // bytes/s from source to target
+	DownRate uint64 `json:"downRate"` // bytes/s from target to source
+}
+
+type portCounter struct {
+	up, down         atomic.Uint64
+	lastUp, lastDown uint64 // only used by the event loop
+}
+
+// eventHub fans events out to the /events subscribers. Slow subscribers miss
+// events instead of blocking the publisher.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+func (h *eventHub) subscribe() chan Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers == nil {
+		h.subscribers = make(map[chan Event]struct{})
+	}
+	ch := make(chan Event, 16)
+	h.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, ch)
+}
+
+func (h *eventHub) publish(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Publish sends an event to the /events subscribers.
+func (m *Usage) Publish(eventType string, data any) {
+	if m == nil {
+		return
+	}
+	m.events.publish(Event{Type: eventType, Time: time.Now(), Data: data})
+}
+
+// SetRTT reports the round trip time of the control channel in milliseconds.
+func (m *Usage) SetRTT(rtt int64) {
+	if m == nil {
+		return
+	}
+	m.rtt.Store(rtt)
+}
+
+// Restarting marks the control channel as lost and tells the /events subscribers
+// that the tunnel restarts. On the server the panel goes down with it until the
+// transport is up again.
+func (m *Usage) Restarting() {
+	if m == nil {
+		return
+	}
+	m.controlChannel.Store(false)
+	for _, o := range m.tunnel.observers {
+		o.TunnelDown("restarting")
+	}
+	m.Publish("restart", map[string]string{"status": m.status()})
+}
+
+// Resuming marks the control channel as lost while the tunnel waits for it to be
+// resumed, tunnel connections stay up.
+func (m *Usage) Resuming() {
+	if m == nil {
+		return
+	}
+	m.controlChannel.Store(false)
+	for _, o := range m.tunnel.observers {
+		o.TunnelDown("resuming")
+	}
+	m.Publish("resume", map[string]string{"status": m.status()})
+}
+
+func (m *Usage) status() string {
+	if m.tunnelStatus == nil {
+		return ""
+	}
+	return *m.tunnelStatus
+}
+
+// countPort adds forwarded bytes to the throughput of port.
+func (m *Usage) countPort(port int, up, down int) {
+	value, ok := m.portCounters.Load(port)
+	if !ok {
+		value, _ = m.portCounters.LoadOrStore(port, &portCounter{})
+	}
+	counter := value.(*portCounter)
+	if up > 0 {
+		counter.up.Add(uint64(up))
+	}
+	if down > 0 {
+		counter.down.Add(uint64(down))
+	}
+}
+
+// throughput returns the bytes forwarded per port since the last call.
+func (m *Usage) throughput() []PortThroughput {
+	rates := []PortThroughput{}
+	m.portCounters.Range(func(key, value any) bool {
+		counter := value.(*portCounter)
+		up, down := counter.up.Load(), counter.down.Load()
+		rates = append(rates, PortThroughput{
+			Port:     key.(int),
+			UpRate:   up - counter.lastUp,
+			DownRate: down - counter.lastDown,
+		})
+		counter.lastUp, counter.lastDown = up, down
+		return true
+	})
+	sort.Slice(rates, func(i, j int) bool {
+		return rates[i].Port < rates[j].Port
+	})
+	return rates
+}
+
+// eventLoop publishes status and RTT changes and the port throughput once per second.
+func (m *Usage) eventLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	lastStatus := m.status()
+	lastRTT := m.rtt.Load()
+
+	for {
+		select {
+		case <-m.shutdownCtx.Done():
+			return
+		case <-ticker.C:
+			if status := m.status(); status != lastStatus {
+				lastStatus = status
+				m.Publish("status", map[string]string{"status": status})
+			}
+			if rtt := m.rtt.Load(); rtt != lastRTT {
+				lastRTT = rtt
+				m.Publish("rtt", map[string]int64{"rttMs": rtt})
+			}
+			m.Publish("throughput", m.throughput())
+		}
+	}
+}
+
+// handleEvents streams events to the client as server-sent events.
+func (m *Usage) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events := m.events.subscribe()
+	defer m.events.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	// The current state first, later events only carry changes
+	initial := []Event{{Type: "status", Time: time.Now(), Data: map[string]string{"status": m.status()}}}
+	if rtt := m.rtt.Load(); rtt > 0 {
+		initial = append(initial, Event{Type: "rtt", Time: time.Now(), Data: map[string]int64{"rttMs": rtt}})
+	}
+	for _, event := range initial {
+		if err := writeEvent(w, event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-m.shutdownCtx.Done():
+			// Deliver what was published before the shutdown, like the restart event
+			for {
+				select {
+				case event := <-events:
+					if err := writeEvent(w, event); err != nil {
+						return
+					}
+				default:
+					flusher.Flush()
+					return
+				}
+			}
+		case event := <-events:
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+	return err
+}
@@ -0,0 +1,110 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Readiness holds the /readyz thresholds shared by every transport.
+type Readiness struct {
+	HeartbeatTimeout time.Duration // maximum age of the last heartbeat
+	MinPool          int           // idle tunnel connections (or mux sessions) required
+}
+
+var processStart = time.Now()
+
+// ReadyStatus is the /readyz response.
+type ReadyStatus struct {
+	Ready          bool       `json:"ready"`
+	ControlChannel bool       `json:"controlChannel"`
+	LastHeartbeat  *time.Time `json:"lastHeartbeat,omitempty"`
+	HeartbeatAge   float64    `json:"heartbeatAgeSeconds"`
+	Pool           int        `json:"pool"`
+	MinPool        int        `json:"minPool"`
+	Reasons        []string   `json:"reasons,omitempty"` // why the tunnel is not ready
+}
+
+// ControlChannelUp marks the control channel as established, status is the new
+// tunnel status.
+func (m *Usage) ControlChannelUp(status string) {
+	if m == nil {
+		return
+	}
+	m.controlChannel.Store(true)
+	m.lastHeartbeat.Store(time.Now().UnixNano())
+	for _, o := range m.tunnel.observers {
+		o.TunnelUp(status)
+	}
+}
+
+// Heartbeat records a successful heartbeat on the control channel.
+func (m *Usage) Heartbeat() {
+	if m == nil {
+		return
+	}
+	m.lastHeartbeat.Store(time.Now().UnixNano())
+	for _, o := range m.tunnel.observers {
+		o.Heartbeat()
+	}
+}
+
+// SetPoolSize sets how the number of ready tunnel connections is read.
+func (m *Usage) SetPoolSize(pool func() int) {
+	if m == nil {
+		return
+	}
+	m.poolSize.Store(&pool)
+}
+
+func (m *Usage) readyStatus() ReadyStatus {
+	status := ReadyStatus{
+		ControlChannel: m.controlChannel.Load(),
+		MinPool:        m.tunnel.readiness.MinPool,
+	}
+	if pool := m.poolSize.Load(); pool != nil {
+		status.Pool = (*pool)()
+	}
+
+	if !status.ControlChannel {
+		status.Reasons = append(status.Reasons, "control channel is not established")
+	}
+	if last := m.lastHeartbeat.Load(); last > 0 {
+		t := time.Unix(0, last)
+		status.LastHeartbeat = &t
+		status.HeartbeatAge = time.Since(t).Seconds()
+		if time.Since(t) > m.tunnel.readiness.HeartbeatTimeout {
+			status.Reasons = append(status.Reasons, "last heartbeat is too old")
+		}
+	} else if status.ControlChannel {
+		status.Reasons = append(status.Reasons, "no heartbeat received")
+	}
+	if status.Pool < status.MinPool {
+		status.Reasons = append(status.Reasons, "tunnel pool is below the minimum")
+	}
+
+	status.Ready = len(status.Reasons) == 0
+	return status
+}
+
+// handleHealthz reports that the process is alive and serving requests.
+func (m *Usage) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":        "ok",
+		"uptimeSeconds": int64(time.Since(processStart).Seconds()),
+	})
+}
+
+// handleReadyz reports whether the tunnel can forward connections, with 503 if not.
+func (m *Usage) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	status := m.readyStatus()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		m.logger.Errorf("error encoding JSON response: %v", err)
+	}
+}
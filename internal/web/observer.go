@@ -0,0 +1,50 @@
+package web
+
+import (
+	"context"
+	"time"
+)
+
+// TunnelObserver is told about tunnel lifecycle changes, for integrations outside
+// the panel like the service manager. Calls come from transport goroutines.
+type TunnelObserver interface {
+	TunnelUp(status string)                           // control channel established
+	TunnelDown(reason string)                         // control channel lost, the transport restarts or resumes
+	Heartbeat()                                       // heartbeat on the control channel
+	InvalidToken(source string)                       // a peer failed authentication
+	QuotaReached(port int, usage, quota uint64)       // the sniffer usage of a forwarded port reached port_quota, in bytes
+	CertExpiring(certFile string, notAfter time.Time) // also sent once the certificate expired
+}
+
+// SetTunnelObservers replaces the observers, it is called once per (re)start
+// before the transport runs.
+func (t *Tunnel) SetTunnelObservers(observers ...TunnelObserver) {
+	t.observers = observers
+}
+
+// InvalidToken reports a peer at source that presented a wrong token, repeated
+// failures get it banned.
+func (m *Usage) InvalidToken(source string) {
+	if bans := m.tunnel.bans; bans != nil {
+		bans.Fail(source)
+	}
+	for _, o := range m.tunnel.observers {
+		o.InvalidToken(source)
+	}
+}
+
+// NotifyTunnelDown reports to the tunnel of ctx that it stopped because of
+// reason, it is not restarted until the configuration is reloaded.
+func NotifyTunnelDown(ctx context.Context, reason string) {
+	for _, o := range TunnelFrom(ctx).observers {
+		o.TunnelDown(reason)
+	}
+}
+
+// NotifyCertExpiring reports to the tunnel of ctx that the certificate in
+// certFile expires soon.
+func NotifyCertExpiring(ctx context.Context, certFile string, notAfter time.Time) {
+	for _, o := range TunnelFrom(ctx).observers {
+		o.CertExpiring(certFile, notAfter)
+	}
+}
@@ -0,0 +1,59 @@
+package web
+
+import "sync"
+
+// PortQuota is the traffic a forwarded port may transfer, as counted by the
+// sniffer and kept in sniffer_log, before the observers are told. It only
+// notifies, the traffic is not blocked.
+type PortQuota struct {
+	limit   uint64
+	mu      sync.Mutex
+	reached map[int]bool // ports reported, until their usage drops below the limit
+}
+
+// NewPortQuota returns a quota of limit bytes per port, nil for 0.
+func NewPortQuota(limit uint64) *PortQuota {
+	if limit == 0 {
+		return nil
+	}
+	return &PortQuota{limit: limit, reached: make(map[int]bool)}
+}
+
+// SetPortQuota sets the quota of the forwarded ports, nil disables it.
+func (t *Tunnel) SetPortQuota(q *PortQuota) {
+	t.quota = q
+}
+
+// exceeded returns the ports of usage that reached the limit since the last
+// call. A port is reported again after its usage dropped below the limit, like
+// when sniffer_log is reset.
+func (q *PortQuota) exceeded(usage []PortUsage) []PortUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var exceeded []PortUsage
+	for _, port := range usage {
+		switch {
+		case port.Usage < q.limit:
+			delete(q.reached, port.Port)
+		case !q.reached[port.Port]:
+			q.reached[port.Port] = true
+			exceeded = append(exceeded, port)
+		}
+	}
+	return exceeded
+}
+
+// checkQuota tells the observers about the ports whose usage reached the quota.
+func (m *Usage) checkQuota(usage []PortUsage) {
+	q := m.tunnel.quota
+	if q == nil {
+		return
+	}
+	for _, port := range q.exceeded(usage) {
+		m.logger.Warnf("port %d reached its quota, %s of %s", port.Port, m.convertBytesToReadable(port.Usage), m.convertBytesToReadable(q.limit))
+		for _, o := range m.tunnel.observers {
+			o.QuotaReached(port.Port, port.Usage, q.limit)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package web
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// quotaObserver records the quota_reached notifications.
+type quotaObserver struct {
+	ports []int
+}
+
+func (o *quotaObserver) TunnelUp(status string)                           {}
+func (o *quotaObserver) TunnelDown(reason string)                         {}
+func (o *quotaObserver) Heartbeat()                                       {}
+func (o *quotaObserver) InvalidToken(source string)                       {}
+func (o *quotaObserver) CertExpiring(certFile string, notAfter time.Time) {}
+func (o *quotaObserver) QuotaReached(port int, usage, quota uint64) {
+	o.ports = append(o.ports, port)
+}
+
+func TestPortQuota(t *testing.T) {
+	if NewPortQuota(0) != nil {
+		t.Fatal("NewPortQuota(0) enabled a quota")
+	}
+
+	observer := &quotaObserver{}
+	tunnel := NewTunnel()
+	tunnel.SetPortQuota(NewPortQuota(100))
+	tunnel.SetTunnelObservers(observer)
+	usage := NewDataStore(":0", WithTunnel(context.Background(), tunnel), "", true, nil, testLogger())
+
+	steps := []struct {
+		usage []PortUsage
+		want  []int
+	}{
+		{[]PortUsage{{Port: 443, Usage: 99}, {Port: 80, Usage: 100}}, []int{80}},
+		{[]PortUsage{{Port: 443, Usage: 150}, {Port: 80, Usage: 200}}, []int{80, 443}},
+		// usage reset below the quota, the port is reported when it reaches it again
+		{[]PortUsage{{Port: 443, Usage: 0}, {Port: 80, Usage: 300}}, []int{80, 443}},
+		{[]PortUsage{{Port: 443, Usage: 100}}, []int{80, 443, 443}},
+	}
+	for i, step := range steps {
+		usage.checkQuota(step.usage)
+		if !reflect.DeepEqual(observer.ports, step.want) {
+			t.Fatalf("step %d: reported ports %v, want %v", i, observer.ports, step.want)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shirou/gopsutil/v4/cpu"
@@ -22,7 +23,7 @@ import (
 )
 
 type Usage struct {
-	dataStore    sync.Map
+	dataStore    sync.Map // sniffer usage per port since the last save, port -> *atomic.Uint64
 	listenAddr   string
 	shutdownCtx  context.Context
 	cancelFunc   context.CancelFunc
@@ -33,6 +34,18 @@ type Usage struct {
 	mu           sync.Mutex
 	totalTraffic uint64
 	tunnelStatus *string
+	tunnel       *Tunnel          // settings shared with the other monitors of the tunnel
+	certExpiry   func() time.Time // expiry of the TLS certificate, nil without TLS
+	panel        PanelConfig
+	connections  sync.Map // live forwarded connections, id -> *TrackedConn
+	portCounters sync.Map // forwarded bytes per port for /events, port -> *portCounter
+	events       eventHub
+	rtt          atomic.Int64 // control channel RTT in ms, 0 if not measured
+
+	// readiness reported by the transport for /readyz
+	controlChannel atomic.Bool
+	lastHeartbeat  atomic.Int64 // unix nanoseconds
+	poolSize       atomic.Pointer[func() int]
 }
 
 type PortUsage struct {
@@ -52,6 +65,8 @@ type SystemStats struct {
 	BackhaulTraffic string `json:"backhaulTraffic"`
 	Sniffer         string `json:"sniffer"`
 	AllConnections  string `json:"allConnections"`
+	CertExpiry      string `json:"certExpiry,omitempty"`
+	CertDaysLeft    *int   `json:"certDaysLeft,omitempty"`
 }
 
 type ConfigProvider interface {
@@ -59,12 +74,6 @@ type ConfigProvider interface {
 	GetClientConfig() *config.ClientConfig
 }
 
-var configProvider ConfigProvider
-
-func SetConfigProvider(provider ConfigProvider) {
-	configProvider = provider
-}
-
 func NewDataStore(listenAddr string, shutdownCtx context.Context, snifferLog string, sniffer bool, tunnelStatus *string, logger *logrus.Logger) *Usage {
 	ctx, cancel := context.WithCancel(shutdownCtx)
 	u := &Usage{
@@ -75,13 +84,15 @@ func NewDataStore(listenAddr string, shutdownCtx context.Context, snifferLog str
 		sniffer:      sniffer,
 		snifferLog:   snifferLog,
 		tunnelStatus: tunnelStatus,
+		tunnel:       TunnelFrom(shutdownCtx),
 		mu:           sync.Mutex{},
 		totalTraffic: 0,
 	}
 	return u
 }
 
-func handleConfig(w http.ResponseWriter, r *http.Request) {
+func (m *Usage) handleConfig(w http.ResponseWriter, r *http.Request) {
+	configProvider := m.tunnel.config
 	if configProvider == nil {
 		logrus.Error("[WEB] Config provider not set!")
 		http.Error(w, "Config provider not set", http.StatusInternalServerError)
@@ -202,15 +213,25 @@ func handleConfig(w http.ResponseWriter, r *http.Request) {
 }
 
 func (m *Usage) Monitor() {
+	m.panel = m.tunnel.panel
+
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", m.handleIndex) // handle index
-	mux.HandleFunc("/stats", m.statsHandler)
+	mux.HandleFunc("/", m.requireRole(RoleReadOnly, m.handleIndex)) // handle index
+	mux.HandleFunc("/stats", m.requireRole(RoleReadOnly, m.statsHandler))
 	if m.sniffer {
-		mux.HandleFunc("/data", m.handleData) // New route for JSON data
-	}
-	mux.HandleFunc("/config", handleConfig) // New endpoint for config
+		mux.HandleFunc("/data", m.requireRole(RoleReadOnly, m.handleData)) // New route for JSON data
+	}
+	mux.HandleFunc("/config", m.requireRole(RoleReadOnly, m.handleConfig)) // New endpoint for config
+	mux.HandleFunc("GET /connections", m.requireRole(RoleReadOnly, m.handleConnections))
+	mux.HandleFunc("DELETE /connections/{id}", m.requireRole(RoleAdmin, m.handleCloseConnection))
+	mux.HandleFunc("GET /events", m.requireRole(RoleReadOnly, m.handleEvents))
+	mux.HandleFunc("GET /bans", m.requireRole(RoleReadOnly, m.handleBans))
+	mux.HandleFunc("DELETE /bans/{ip}", m.requireRole(RoleAdmin, m.handleUnban))
+	// Probes stay unauthenticated for orchestrators and load balancers
+	mux.HandleFunc("GET /healthz", m.handleHealthz)
+	mux.HandleFunc("GET /readyz", m.handleReadyz)
 	m.server = &http.Server{
-		Addr:    m.listenAddr,
+		Addr:    m.panel.listenAddr(m.listenAddr),
 		Handler: mux,
 	}
 
@@ -226,6 +247,8 @@ func (m *Usage) Monitor() {
 		}
 	}()
 
+	go m.eventLoop()
+
 	// start save data
 	if m.sniffer {
 		go func() {
@@ -242,9 +265,19 @@ func (m *Usage) Monitor() {
 			}
 		}()
 	}
+	if !m.panel.authEnabled() {
+		m.logger.Warn("web panel has no authentication, set web_password or web_tokens to protect it")
+	}
+
 	// Start the server
-	m.logger.Info("sniffer service listening on port: ", m.listenAddr)
-	if err := m.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	m.logger.Info("sniffer service listening on port: ", m.server.Addr)
+	var err error
+	if m.panel.TLSCertFile != "" {
+		err = m.server.ListenAndServeTLS(m.panel.TLSCertFile, m.panel.TLSKeyFile)
+	} else {
+		err = m.server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		m.logger.Errorf("sniffer server error: %v", err)
 	}
 }
@@ -291,21 +324,22 @@ func (m *Usage) statsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (m *Usage) AddOrUpdatePort(port int, usage uint64) {
+// SetCertExpiry publishes the expiry of the listener certificate on /stats.
+func (m *Usage) SetCertExpiry(expiry func() time.Time) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	m.certExpiry = expiry
+}
 
-	// Retrieve current usage data for the port
+// AddOrUpdatePort adds usage bytes to the sniffer usage of port. It is called
+// by every connection handler, so it doesn't lock: a port's counter is created
+// once and then added to atomically.
+func (m *Usage) AddOrUpdatePort(port int, usage uint64) {
 	value, ok := m.dataStore.Load(port)
-	if ok {
-		// Port exists, update usage
-		portUsage := value.(PortUsage)
-		portUsage.Usage += usage
-		m.dataStore.Store(port, portUsage)
-	} else {
-		// Port does not exist, create new entry
-		m.dataStore.Store(port, PortUsage{Port: port, Usage: usage})
+	if !ok {
+		value, _ = m.dataStore.LoadOrStore(port, new(atomic.Uint64))
 	}
+	value.(*atomic.Uint64).Add(usage)
 }
 
 func (m *Usage) saveUsageData() {
@@ -374,6 +408,7 @@ func (m *Usage) saveUsageData() {
 		mergedUsageData = append(mergedUsageData, usage)
 		m.totalTraffic += usage.Usage
 	}
+	m.checkQuota(mergedUsageData)
 
 	// Step 5: Convert merged data to JSON
 	data, err := json.MarshalIndent(mergedUsageData, "", "  ")
@@ -470,16 +505,13 @@ func (m *Usage) usageDataWithReadableUsage(usageData []PortUsage) []struct {
 	return result
 }
 
-// collectUsageDataFromSyncMap gathers data from sync.Map
+// collectUsageDataFromSyncMap gathers data from sync.Map and resets the counters,
+// they stay in the map so concurrent additions aren't lost
 func (m *Usage) collectUsageDataFromSyncMap() []PortUsage {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
 	var usageData []PortUsage
 	m.dataStore.Range(func(key, value interface{}) bool {
-		if portUsage, ok := value.(PortUsage); ok {
-			usageData = append(usageData, portUsage)
-			m.dataStore.Delete(key)
+		if usage := value.(*atomic.Uint64).Swap(0); usage > 0 {
+			usageData = append(usageData, PortUsage{Port: key.(int), Usage: usage})
 		}
 		return true
 	})
@@ -580,6 +612,17 @@ func (m *Usage) getSystemStats() (*SystemStats, error) {
 		AllConnections:  fmt.Sprintf("%d", len(connections)),
 	}
 
+	m.mu.Lock()
+	certExpiry := m.certExpiry
+	m.mu.Unlock()
+	if certExpiry != nil {
+		if notAfter := certExpiry(); !notAfter.IsZero() {
+			daysLeft := int(time.Until(notAfter).Hours() / 24)
+			stats.CertExpiry = notAfter.Format(time.RFC3339)
+			stats.CertDaysLeft = &daysLeft
+		}
+	}
+
 	return stats, nil
 }
 
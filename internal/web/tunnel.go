@@ -0,0 +1,65 @@
+package web
+
+import (
+	"context"
+	"time"
+)
+
+// Tunnel holds what the usage monitors of one tunnel share: the config shown on
+// /config, panel settings, readiness thresholds, access log, bans, port quota and
+// observers.
+// A process running several tunnels has one per tunnel, it outlives the restarts
+// of its transport. The setters are called before the transport runs, so a
+// reloaded tunnel starts with a Successor instead of changing the running one.
+type Tunnel struct {
+	config    ConfigProvider
+	panel     PanelConfig
+	accessLog *AccessLog
+	bans      *BanList
+	readiness Readiness
+	quota     *PortQuota
+	observers []TunnelObserver
+}
+
+func NewTunnel() *Tunnel {
+	return &Tunnel{readiness: Readiness{HeartbeatTimeout: 2 * time.Minute}}
+}
+
+// Successor returns a new tunnel for the next instance of t, only the bans
+// carry over to it.
+func (t *Tunnel) Successor() *Tunnel {
+	next := NewTunnel()
+	next.bans = t.bans
+	return next
+}
+
+// defaultTunnel is used by contexts without a tunnel.
+var defaultTunnel = NewTunnel()
+
+type tunnelKey struct{}
+
+// WithTunnel returns a context carrying t, usage monitors created with it
+// belong to t.
+func WithTunnel(ctx context.Context, t *Tunnel) context.Context {
+	return context.WithValue(ctx, tunnelKey{}, t)
+}
+
+// TunnelFrom returns the tunnel carried by ctx, the default tunnel if none.
+func TunnelFrom(ctx context.Context) *Tunnel {
+	if t, ok := ctx.Value(tunnelKey{}).(*Tunnel); ok {
+		return t
+	}
+	return defaultTunnel
+}
+
+func (t *Tunnel) SetConfigProvider(provider ConfigProvider) {
+	t.config = provider
+}
+
+func (t *Tunnel) SetPanelConfig(cfg PanelConfig) {
+	t.panel = cfg
+}
+
+func (t *Tunnel) SetReadiness(r Readiness) {
+	t.readiness = r
+}
@@ -12,7 +12,6 @@ import (
 	"time"
 
 	"github.com/musix/backhaul/cmd"
-	"github.com/musix/backhaul/internal/tuning"
 	"github.com/musix/backhaul/internal/utils"
 )
 
@@ -24,8 +23,6 @@ var (
 	ctx          context.Context
 	cancel       context.CancelFunc
 	wg           sync.WaitGroup
-	mu           sync.RWMutex
-	tuner        *tuning.Tuner
 	appProcess   *os.Process
 )
 
@@ -33,6 +30,11 @@ var (
 const version = "v0.6.6"
 
 func main() {
+	// "backhaul check -c config.toml" validates the configuration and exits
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(check(os.Args[2:]))
+	}
+
 	configPath = flag.String("c", "", "path to the configuration file (TOML format)")
 	noAutoTune = flag.Bool("no-auto-tune", false, "disable automatic performance tuning")
 	tuneInterval = flag.Duration("tune-interval", 10*time.Minute, "interval for automatic tuning (recommended: 10m for tunnels, 15m for very stable networks)")
@@ -76,14 +78,13 @@ func main() {
 			}
 		}()
 
-		cfg := cmd.Run(*configPath, ctx)
-
-		// Start the dynamic tuner unless --no-auto-tune is set
-		if !*noAutoTune {
-			mu.Lock()
-			tuner = tuning.NewTuner(cfg, utils.NewLogger(cfg.Server.LogLevel))
-			tuner.Start(*tuneInterval)
-			mu.Unlock()
+		// Every tunnel gets its own dynamic tuner unless --no-auto-tune is set
+		interval := *tuneInterval
+		if *noAutoTune {
+			interval = 0
+		}
+		cmd.Run(*configPath, ctx, interval)
+		if interval > 0 {
 			logger.Info("Auto-tuning enabled")
 		} else {
 			logger.Info("Auto-tuning disabled by flag")
@@ -109,8 +110,9 @@ func handleShutdown(sigChan chan os.Signal) {
 	// Wait for first signal
 	sig := <-sigChan
 	logger.Infof("Received signal: %v, initiating graceful shutdown...", sig)
+	utils.SdNotify("STOPPING=1")
 
-	// Cancel context immediately
+	// Cancel context immediately, the tunnels stop with their tuners
 	cancel()
 
 	// Start a goroutine to handle force shutdown
@@ -126,16 +128,6 @@ func handleShutdown(sigChan chan os.Signal) {
 		}
 	}()
 
-	// Stop tuner if running
-	if noAutoTune != nil && !*noAutoTune {
-		mu.RLock()
-		if tuner != nil {
-			logger.Info("Stopping auto-tuner...")
-			tuner.Stop()
-		}
-		mu.RUnlock()
-	}
-
 	// Create a timeout for graceful shutdown
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer shutdownCancel()
@@ -159,15 +151,6 @@ func handleShutdown(sigChan chan os.Signal) {
 func forceShutdown() {
 	logger.Error("Force shutdown initiated!")
 
-	// Stop tuner immediately
-	if noAutoTune != nil && !*noAutoTune {
-		mu.RLock()
-		if tuner != nil {
-			tuner.Stop()
-		}
-		mu.RUnlock()
-	}
-
 	// Close all possible file descriptors and connections
 	// This is a nuclear option
 	if appProcess != nil {
@@ -181,8 +164,8 @@ func forceShutdown() {
 func hotReload() {
 	defer wg.Done()
 
-	// Get initial modification time of the config file
-	lastModTime, err := getLastModTime(*configPath)
+	// Get initial modification time of the config and token files
+	lastModTime, err := getConfigModTime(*configPath)
 	if err != nil {
 		logger.Fatalf("Error getting modification time: %v", err)
 	}
@@ -198,61 +181,73 @@ func hotReload() {
 			logger.Info("Hot reload monitoring stopped")
 			return
 		case <-ticker.C:
-			modTime, err := getLastModTime(*configPath)
+			modTime, err := getConfigModTime(*configPath)
 			if err != nil {
 				logger.Errorf("Error checking file modification time: %v", err)
 				continue
 			}
 
-			// If the modification time has changed, reload the app
+			// If the modification time has changed, reload the changed tunnels
 			if modTime.After(lastModTime) {
-				logger.Info("Config file changed, reloading application...")
-
-				// Stop tuner before reloading
-				if noAutoTune != nil && !*noAutoTune {
-					mu.Lock()
-					if tuner != nil {
-						tuner.Stop()
-						tuner = nil
-					}
-					mu.Unlock()
-				}
+				logger.Info("Config or token file changed, reloading application...")
 
-				// Cancel the previous context to stop the old running instance
-				cancel()
-
-				// Wait a bit for graceful shutdown
-				time.Sleep(3 * time.Second)
-
-				// Create a new context for the new instance
-				mu.Lock()
-				ctx, cancel = context.WithCancel(context.Background())
-				mu.Unlock()
-
-				// Start the new instance
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					cfg := cmd.Run(*configPath, ctx)
-
-					// Restart tuner if needed
-					if noAutoTune != nil && !*noAutoTune {
-						mu.Lock()
-						tuner = tuning.NewTuner(cfg, utils.NewLogger(cfg.Server.LogLevel))
-						tuner.Start(*tuneInterval)
-						mu.Unlock()
-						logger.Info("Auto-tuner restarted")
+				// An invalid configuration keeps the running tunnels, a
+				// tunnel that fails to start keeps its previous configuration
+				if errs := cmd.Reload(*configPath); len(errs) > 0 {
+					for _, err := range errs {
+						logger.Error(err)
 					}
-				}()
+					logger.Errorf("configuration not applied, %d error(s), keeping the running instance", len(errs))
+				} else {
+					logger.Info("Application reloaded successfully")
+				}
 
 				// Update the last modification time
 				lastModTime = modTime
-				logger.Info("Application reloaded successfully")
 			}
 		}
 	}
 }
 
+// check validates the configuration given with -c and returns the exit code.
+func check(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	path := flags.String("c", "", "path to the configuration file (TOML format)")
+	flags.Parse(args)
+
+	if *path == "" {
+		fmt.Fprintf(os.Stderr, "Usage: %s check -c /path/to/config.toml\n", filepath.Base(os.Args[0]))
+		return 2
+	}
+
+	errs := cmd.Validate(*path)
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d error(s)\n", *path, len(errs))
+		return 1
+	}
+	fmt.Printf("%s: configuration is valid\n", *path)
+	return 0
+}
+
+// getConfigModTime returns the latest modification time of the configuration
+// file and the token files it refers to.
+func getConfigModTime(file string) (time.Time, error) {
+	modTime, err := getLastModTime(file)
+	if err != nil {
+		return modTime, err
+	}
+	for _, tokenFile := range cmd.TokenFiles() {
+		// a missing token file is reported by the reload of the configuration
+		if t, err := getLastModTime(tokenFile); err == nil && t.After(modTime) {
+			modTime = t
+		}
+	}
+	return modTime, nil
+}
+
 func getLastModTime(file string) (time.Time, error) {
 	absPath, _ := filepath.Abs(file)
 	fileInfo, err := os.Stat(absPath)